@@ -18,6 +18,7 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"gitlab.com/tozd/go/errors"
 
+	"github.com/walteh/ec1/pkg/host"
 	"github.com/walteh/ec1/pkg/units"
 	"github.com/walteh/ec1/pkg/vmm"
 	"github.com/walteh/ec1/pkg/vmm/vf"
@@ -150,16 +151,22 @@ func createContainerizedVM[H vmm.VirtualMachine](ctx context.Context, hypervisor
 
 	// slog.InfoContext(ctx, "createVM: VM configuration", "memory", memory, "vcpus", vcpus, "spec", valuelog.NewPrettyValue(spec), "platform", platform)
 
+	modulesDir, err := host.KernelModulesDir()
+	if err != nil {
+		return nil, errors.Errorf("getting kernel modules directory: %w", err)
+	}
+
 	vm, err := vmm.NewContainerizedVirtualMachineFromRootfs(ctx, hypervisor, vmm.ContainerizedVMConfig{
-		ID:           createRequest.ID,
-		RootfsMounts: createRequest.Rootfs,
-		StderrWriter: stdio.stderr,
-		StdoutWriter: stdio.stdout,
-		StdinReader:  stdio.stdin,
-		Spec:         spec,
-		Platform:     platform,
-		Memory:       memory,
-		VCPUs:        vcpus,
+		ID:               createRequest.ID,
+		RootfsMounts:     createRequest.Rootfs,
+		StderrWriter:     stdio.stderr,
+		StdoutWriter:     stdio.stdout,
+		StdinReader:      stdio.stdin,
+		Spec:             spec,
+		Platform:         platform,
+		Memory:           memory,
+		VCPUs:            vcpus,
+		KernelModulesDir: modulesDir,
 	})
 
 	if err != nil {
@@ -0,0 +1,236 @@
+// harpoon-initramfs builds the harpoon guest initramfs from declared inputs, without docker. the same inputs
+// always produce the same archive. every static binary is checked against a pinned sha256, given as the digest
+// or as the sha256sum file committed next to the binary.
+//
+//	go run ./cmd/harpoon-initramfs -harpoond harpoond.xz -busybox busybox -busybox-sha256 busybox.sha256 \
+//		-lshw lshw -lshw-sha256 lshw.sha256 -mke2fs mke2fs -mke2fs-sha256 mke2fs.sha256 \
+//		-socat socat -socat-sha256 socat.sha256 -config harpoon/initramfs -out initramfs.cpio.gz
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/initramfs"
+	"github.com/walteh/ec1/pkg/logging"
+)
+
+// busyboxApplets are the applet links `busybox --install -s` creates for the applets harpoond and the udhcpc
+// script use
+var busyboxApplets = []string{
+	"bin/sh", "bin/ash", "bin/cat", "bin/chmod", "bin/cp", "bin/dmesg", "bin/echo", "bin/grep", "bin/hostname",
+	"bin/ln", "bin/ls", "bin/mkdir", "bin/mknod", "bin/mount", "bin/mv", "bin/ping", "bin/ping6", "bin/ps",
+	"bin/rm", "bin/sleep", "bin/umount", "bin/uname", "bin/vi",
+	"sbin/ifconfig", "sbin/ifup", "sbin/ifdown", "sbin/ip", "sbin/modprobe", "sbin/insmod", "sbin/route",
+	"sbin/udhcpc", "sbin/switch_root", "sbin/poweroff", "sbin/reboot",
+	"usr/bin/env", "usr/bin/free", "usr/bin/head", "usr/bin/tail", "usr/bin/wget", "usr/bin/which",
+}
+
+// binary is a static executable copied into the initramfs, checked against its declared sha256
+type binary struct {
+	name   string
+	target string
+	path   string
+	sha256 string
+}
+
+// staticBinaries are the executables of the initramfs besides harpoond, at the paths harpoond runs them from
+func staticBinaries() []*binary {
+	return []*binary{
+		{name: "busybox", target: "bin/busybox"},
+		{name: "lshw", target: strings.TrimPrefix(ec1init.LshwPath, "/")},
+		{name: "mke2fs", target: strings.TrimPrefix(ec1init.Mke2fsPath, "/")},
+		{name: "socat", target: strings.TrimPrefix(ec1init.SocatPath, "/")},
+	}
+}
+
+func main() {
+	binaries := staticBinaries()
+	for _, b := range binaries {
+		flag.StringVar(&b.path, b.name, "", "Path to a static "+b.name+" binary")
+		flag.StringVar(&b.sha256, b.name+"-sha256", "", "Expected sha256 of the "+b.name+" binary, or a sha256sum file holding it")
+	}
+
+	var (
+		harpoondPath = flag.String("harpoond", "", "Path to the cross-compiled harpoond, optionally xz compressed")
+		configDir    = flag.String("config", "harpoon/initramfs", "Directory holding udhcpc.default and resolv.conf")
+		outPath      = flag.String("out", "initramfs.cpio.gz", "Path of the gzip compressed initramfs to write")
+	)
+	flag.Parse()
+
+	ctx := logging.SetupSlogSimple(context.Background())
+
+	missing := *harpoondPath == ""
+	for _, b := range binaries {
+		missing = missing || b.path == "" || b.sha256 == ""
+	}
+	if missing {
+		slog.ErrorContext(ctx, "harpoond, busybox, lshw, mke2fs and socat are required, each binary with its sha256")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := run(ctx, *harpoondPath, binaries, *configDir, *outPath); err != nil {
+		slog.ErrorContext(ctx, "failed to build initramfs", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, harpoondPath string, binaries []*binary, configDir, outPath string) error {
+	harpoond, err := readInput(ctx, harpoondPath)
+	if err != nil {
+		return errors.Errorf("reading harpoond: %w", err)
+	}
+
+	executables := []initramfs.Entry{}
+	for _, b := range binaries {
+		want, err := b.expectedSHA256()
+		if err != nil {
+			return err
+		}
+		data, err := readInput(ctx, b.path)
+		if err != nil {
+			return errors.Errorf("reading %s: %w", b.name, err)
+		}
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return errors.Errorf("%s sha256 is %s, expected %s", b.name, got, want)
+		}
+		executables = append(executables, initramfs.File(b.target, 0o755, data))
+	}
+
+	udhcpc, err := os.ReadFile(filepath.Join(configDir, "udhcpc.default"))
+	if err != nil {
+		return errors.Errorf("reading udhcpc script: %w", err)
+	}
+
+	resolv, err := os.ReadFile(filepath.Join(configDir, "resolv.conf"))
+	if err != nil {
+		return errors.Errorf("reading resolv.conf: %w", err)
+	}
+
+	entries := []initramfs.Entry{
+		initramfs.Symlink("init", "bin/harpoond"),
+		initramfs.File("bin/harpoond", 0o755, harpoond),
+		initramfs.File("etc/udhcpc/default.script", 0o755, udhcpc),
+		initramfs.File("etc/resolv.conf", 0o644, resolv),
+		initramfs.File("etc/network/interfaces", 0o644, []byte("auto eth0\niface eth0 inet dhcp\n")),
+		initramfs.CharDevice("dev/console", 0o600, 5, 1),
+		initramfs.CharDevice("dev/null", 0o666, 1, 3),
+		initramfs.CharDevice("dev/zero", 0o666, 1, 5),
+		initramfs.CharDevice("dev/tty", 0o666, 5, 0),
+		initramfs.CharDevice("dev/urandom", 0o666, 1, 9),
+		initramfs.Dir("proc", 0o555),
+		initramfs.Dir("sys", 0o555),
+		initramfs.Dir("run", 0o755),
+		initramfs.Dir("mnt", 0o755),
+		initramfs.Dir("tmp", 0o777|os.ModeSticky),
+		initramfs.Dir("usr/local/bin", 0o755),
+	}
+	entries = append(entries, executables...)
+	for _, applet := range busyboxApplets {
+		entries = append(entries, initramfs.Symlink(applet, "/bin/busybox"))
+	}
+
+	var cpio bytes.Buffer
+	dgst, err := initramfs.Build(ctx, &cpio, entries)
+	if err != nil {
+		return errors.Errorf("building initramfs: %w", err)
+	}
+
+	var out bytes.Buffer
+	// the gzip header has no name or mtime, so the compressed archive is reproducible as well
+	gz, err := gzip.NewWriterLevel(&out, gzip.BestSpeed)
+	if err != nil {
+		return errors.Errorf("creating gzip writer: %w", err)
+	}
+	if _, err := gz.Write(cpio.Bytes()); err != nil {
+		return errors.Errorf("compressing initramfs: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Errorf("compressing initramfs: %w", err)
+	}
+
+	if err := os.WriteFile(outPath, out.Bytes(), 0o644); err != nil {
+		return errors.Errorf("writing initramfs: %w", err)
+	}
+
+	// the content hash is of the uncompressed archive, which does not depend on the gzip implementation, so
+	// it is named after the archive and never mistaken for the hash of the gzip file
+	cpioPath := strings.TrimSuffix(outPath, ".gz")
+	hash := fmt.Sprintf("%s  %s\n", dgst.Encoded(), filepath.Base(cpioPath))
+	if err := os.WriteFile(cpioPath+".sha256", []byte(hash), 0o644); err != nil {
+		return errors.Errorf("writing content hash: %w", err)
+	}
+
+	slog.InfoContext(ctx, "wrote initramfs", "path", outPath, "size", out.Len(), "content_digest", dgst)
+
+	return nil
+}
+
+// expectedSHA256 is the pinned digest of b, read from a sha256sum file unless it is a digest itself
+func (b *binary) expectedSHA256() (string, error) {
+	if b.sha256 == "" {
+		return "", errors.Errorf("%s has no pinned sha256", b.name)
+	}
+	if isSHA256(b.sha256) {
+		return b.sha256, nil
+	}
+
+	pin, err := os.ReadFile(b.sha256)
+	if err != nil {
+		return "", errors.Errorf("reading the pinned sha256 of %s: %w", b.name, err)
+	}
+	fields := strings.Fields(string(pin))
+	if len(fields) == 0 || !isSHA256(fields[0]) {
+		return "", errors.Errorf("%s does not start with a sha256", b.sha256)
+	}
+	return fields[0], nil
+}
+
+func isSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
+
+// readInput reads a file, decompressing it when it ends in .xz like the embedded binaries
+func readInput(ctx context.Context, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".xz") {
+		xzr, err := (archives.Xz{}).OpenReader(f)
+		if err != nil {
+			return nil, errors.Errorf("opening xz reader for %s: %w", path, err)
+		}
+		defer xzr.Close()
+		r = xzr
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", path, err)
+	}
+
+	slog.DebugContext(ctx, "read initramfs input", "path", path, "size", len(data))
+
+	return data, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/cpio"
+	"github.com/walteh/ec1/pkg/ec1init"
+)
+
+func writeInputs(t *testing.T, dir string) []*binary {
+	t.Helper()
+
+	binaries := staticBinaries()
+	for _, b := range binaries {
+		data := []byte("static " + b.name)
+		sum := sha256.Sum256(data)
+		b.path = filepath.Join(dir, b.name)
+		b.sha256 = hex.EncodeToString(sum[:])
+		require.NoError(t, os.WriteFile(b.path, data, 0o755))
+	}
+	return binaries
+}
+
+func TestRunIncludesTheBinariesHarpoondRuns(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "harpoond"), []byte("harpoond"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "udhcpc.default"), []byte("#!/bin/sh\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 1.1.1.1\n"), 0o644))
+
+	out := filepath.Join(dir, "initramfs.cpio.gz")
+	require.NoError(t, run(ctx, filepath.Join(dir, "harpoond"), writeInputs(t, dir), dir, out))
+
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	fsys := cpio.NewFS(bytes.NewReader(raw))
+
+	target, err := fsys.ReadLink("init")
+	require.NoError(t, err)
+	assert.Equal(t, "bin/harpoond", target)
+
+	// harpoond bind-mounts lshw into every container and formats scratch disks with mke2fs
+	for path, want := range map[string]string{
+		ec1init.LshwPath:   "static lshw",
+		ec1init.Mke2fsPath: "static mke2fs",
+		ec1init.SocatPath:  "static socat",
+		"/bin/busybox":     "static busybox",
+	} {
+		name := strings.TrimPrefix(path, "/")
+		data, err := fsys.ReadFile(name)
+		require.NoError(t, err, path)
+		assert.Equal(t, want, string(data), path)
+
+		fi, err := fsys.Stat(name)
+		require.NoError(t, err, path)
+		assert.Equal(t, os.FileMode(0o755), fi.Mode().Perm(), path)
+	}
+}
+
+func TestRunChecksTheDeclaredChecksums(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "harpoond"), []byte("harpoond"), 0o755))
+
+	binaries := writeInputs(t, dir)
+	binaries[2].sha256 = strings.Repeat("0", 64)
+
+	err := run(ctx, filepath.Join(dir, "harpoond"), binaries, dir, filepath.Join(dir, "initramfs.cpio.gz"))
+	require.ErrorContains(t, err, "mke2fs sha256 is")
+
+	binaries = writeInputs(t, dir)
+	binaries[1].sha256 = ""
+	err = run(ctx, filepath.Join(dir, "harpoond"), binaries, dir, filepath.Join(dir, "initramfs.cpio.gz"))
+	require.ErrorContains(t, err, "lshw has no pinned sha256")
+}
+
+func TestRunReadsPinFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "harpoond"), []byte("harpoond"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "udhcpc.default"), []byte("#!/bin/sh\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 1.1.1.1\n"), 0o644))
+
+	// pins in the sha256sum format the tasks commit
+	binaries := writeInputs(t, dir)
+	for _, b := range binaries {
+		pin := b.path + ".sha256"
+		require.NoError(t, os.WriteFile(pin, []byte(b.sha256+"  "+filepath.Base(b.path)+"\n"), 0o644))
+		b.sha256 = pin
+	}
+
+	out := filepath.Join(dir, "initramfs.cpio.gz")
+	require.NoError(t, run(ctx, filepath.Join(dir, "harpoond"), binaries, dir, out))
+
+	// the content hash of the archive has a name of its own, next to the gzip file
+	hash, err := os.ReadFile(filepath.Join(dir, "initramfs.cpio.sha256"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(hash), "  initramfs.cpio\n"))
+	assert.NoFileExists(t, out+".sha256")
+
+	require.NoError(t, os.WriteFile(binaries[0].sha256, []byte("not a digest\n"), 0o644))
+	err = run(ctx, filepath.Join(dir, "harpoond"), binaries, dir, out)
+	require.ErrorContains(t, err, "does not start with a sha256")
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -40,7 +41,7 @@ func init() {
 }
 
 var binariesToCopy = []string{
-	"/hbin/lshw",
+	ec1init.LshwPath,
 	// "/hbin/mount",
 	// "/hbin/umount",
 	// "/hbin/lsblk",
@@ -108,6 +109,11 @@ func safeMain(ctx context.Context) error {
 		return nil
 	}
 
+	// injected modules may provide virtiofs or the rootfs filesystem, so load them before mounting anything
+	if err := loadKernelModules(ctx); err != nil {
+		return errors.Errorf("problem loading kernel modules: %w", err)
+	}
+
 	if _, err := os.Stat(ec1init.Ec1AbsPath); os.IsNotExist(err) {
 		os.MkdirAll(ec1init.Ec1AbsPath, 0755)
 	}
@@ -130,6 +136,18 @@ func safeMain(ctx context.Context) error {
 			return errors.Errorf("no bind mounts found")
 		}
 
+		rootfsCfg, err := loadRootfsConfig(ctx)
+		if err != nil {
+			return errors.Errorf("problem loading rootfs config: %w", err)
+		}
+
+		// in virtiofs mode the rootfs share is the first entry of the bind mounts
+		if rootfsCfg.Mode == ec1init.RootfsModeBlock {
+			if err := mountRootfsOverlay(ctx, rootfsCfg, ec1init.NewRootAbsPath); err != nil {
+				return errors.Errorf("problem mounting block rootfs: %w", err)
+			}
+		}
+
 		if err := mountRootfsSecondary(ctx, ec1init.NewRootAbsPath, bindMounts); err != nil {
 			return errors.Errorf("problem mounting rootfs secondary: %w", err)
 		}
@@ -389,10 +407,21 @@ func mountRootfsSecondary(ctx context.Context, prefix string, customMounts []spe
 
 	// dirs = append(dirs, filepath.Join(prefix, ec1init.Ec1AbsPath))
 
+	stagedFileShares := map[string]bool{}
+
 	// trying to figure out how to proerly do this to not skip things
 	for _, mount := range customMounts {
 
 		dest := filepath.Join(prefix, mount.Destination)
+
+		if mount.Type == ec1init.BindFileMountType {
+			fileCmds, err := bindFileMountCommands(mount, dest, stagedFileShares)
+			if err != nil {
+				return errors.Errorf("preparing file bind mount %s: %w", mount.Destination, err)
+			}
+			cmds = append(cmds, fileCmds...)
+			continue
+		}
 		// if mount.Destination == "/etc/resolv.conf" || mount.Destination == "/etc/hosts" {
 		// 	continue
 		// }
@@ -447,6 +476,36 @@ func mountRootfsSecondary(ctx context.Context, prefix string, customMounts []spe
 	return nil
 }
 
+// bindFileMountCommands mounts the virtiofs share holding the file (once per share) under the staging
+// directory and bind-mounts the single file over dest, remounting it read-only when requested
+func bindFileMountCommands(mount specs.Mount, dest string, staged map[string]bool) ([][]string, error) {
+	tag, name, ok := strings.Cut(mount.Source, "/")
+	if !ok || tag == "" || name == "" || strings.Contains(name, "/") {
+		return nil, errors.Errorf("invalid file bind mount source %q", mount.Source)
+	}
+
+	stagingDir := filepath.Join(ec1init.BindFileStagingAbsPath, tag)
+
+	cmds := [][]string{}
+
+	if !staged[tag] {
+		staged[tag] = true
+		cmds = append(cmds, []string{"mkdir", "-p", stagingDir})
+		cmds = append(cmds, []string{"mount", "-t", "virtiofs", tag, stagingDir})
+	}
+
+	// the bind target has to exist as a file, not a directory
+	cmds = append(cmds, []string{"mkdir", "-p", filepath.Dir(dest)})
+	cmds = append(cmds, []string{"touch", dest})
+	cmds = append(cmds, []string{"mount", "--bind", filepath.Join(stagingDir, name), dest})
+
+	if slices.Contains(mount.Options, "ro") {
+		cmds = append(cmds, []string{"mount", "-o", "remount,bind,ro", dest})
+	}
+
+	return cmds, nil
+}
+
 func mountRootfs(ctx context.Context, spec *oci.Spec, customMounts []specs.Mount) error {
 	// dirs := []string{}
 	cmds := [][]string{}
@@ -23,17 +23,13 @@ func mountInitramfs(ctx context.Context) error {
 	slog.InfoContext(ctx, "initramfs init started, mounting rootfs")
 
 	mounts := [][]string{
-		{"mkdir", "-p", "/proc", "/sys", "/dev", ec1init.NewRootAbsPath, "/run", ec1init.Ec1AbsPath, "/mnt/lower", "/mnt/upper", "/mnt/overlay", "/mnt/wrk"},
+		{"mkdir", "-p", "/proc", "/sys", "/dev", ec1init.NewRootAbsPath, "/run", ec1init.Ec1AbsPath, "/mnt/overlay", "/mnt/wrk"},
 		{"mount", "-t", "devtmpfs", "devtmpfs", "/dev"},
 		{"mount", "-t", "proc", "proc", "/proc"},
 		{"mount", "-t", "sysfs", "sysfs", "/sys"},
 		{"mkdir", "-p", "/dev/pts"},
 		{"mount", "-t", "devpts", "devpts", "/dev/pts"},
 		{"mount", "-t", "virtiofs", ec1init.Ec1VirtioTag, ec1init.Ec1AbsPath},
-		{"mount", "-t", "virtiofs", "-o", "ro", ec1init.RootfsVirtioTag, "/mnt/lower"},
-		{"mount", "-t", "tmpfs", "tmpfs", "/mnt/upper"},
-		{"mkdir", "-p", "/mnt/upper/upper", "/mnt/upper/work"},
-		{"mount", "-t", "overlay", "overlay", "-o", "lowerdir=/mnt/lower,upperdir=/mnt/upper/upper,workdir=/mnt/upper/work", ec1init.NewRootAbsPath},
 	}
 
 	for _, mount := range mounts {
@@ -43,6 +39,15 @@ func mountInitramfs(ctx context.Context) error {
 		}
 	}
 
+	rootfsCfg, err := loadRootfsConfig(ctx)
+	if err != nil {
+		return errors.Errorf("loading rootfs config: %w", err)
+	}
+
+	if err := mountRootfsOverlay(ctx, rootfsCfg, ec1init.NewRootAbsPath); err != nil {
+		return errors.Errorf("mounting rootfs overlay: %w", err)
+	}
+
 	return nil
 }
 
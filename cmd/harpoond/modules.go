@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/harpoon"
+)
+
+// loadKernelModules loads the modules the host injected into the initramfs, in the order it resolved from
+// modules.dep. insmod loads a module file through finit_module, so no modprobe index is needed and the
+// modules do not have to match the uname of the running kernel by path.
+func loadKernelModules(ctx context.Context) error {
+	list, err := os.ReadFile(ec1init.KernelModulesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Errorf("reading kernel modules list: %w", err)
+	}
+
+	if err := ensureKernelFilesystems(ctx); err != nil {
+		return errors.Errorf("mounting kernel filesystems: %w", err)
+	}
+
+	for _, module := range strings.Fields(string(list)) {
+		name := strings.ReplaceAll(strings.TrimSuffix(path.Base(module), ".ko"), "-", "_")
+		if _, err := os.Stat(path.Join("/sys/module", name)); err == nil {
+			slog.DebugContext(ctx, "kernel module already loaded", "module", name)
+			continue
+		}
+
+		if err := harpoon.ExecCmdForwardingStdio(ctx, "insmod", module); err != nil {
+			return errors.Errorf("loading kernel module %s: %w", module, err)
+		}
+		slog.InfoContext(ctx, "loaded kernel module", "module", name)
+	}
+
+	return nil
+}
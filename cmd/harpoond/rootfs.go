@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/harpoon"
+)
+
+const (
+	rootfsLowerDir = "/mnt/lower"
+	rootfsUpperDir = "/mnt/upper"
+)
+
+func loadRootfsConfig(ctx context.Context) (*ec1init.RootfsConfig, error) {
+	cfgd, err := os.ReadFile(filepath.Join(ec1init.Ec1AbsPath, ec1init.ContainerRootfsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// older hosts don't write the file and always share the rootfs over virtiofs
+			return &ec1init.RootfsConfig{Mode: ec1init.RootfsModeVirtioFs}, nil
+		}
+		return nil, errors.Errorf("reading rootfs config: %w", err)
+	}
+
+	var cfg ec1init.RootfsConfig
+	if err := json.Unmarshal(cfgd, &cfg); err != nil {
+		return nil, errors.Errorf("unmarshalling rootfs config: %w", err)
+	}
+
+	slog.InfoContext(ctx, "loaded rootfs config", "mode", cfg.Mode, "scratch", cfg.Scratch, "filesystem", cfg.Filesystem)
+
+	return &cfg, nil
+}
+
+// ensureKernelFilesystems makes sure /sys and /dev are available so block devices can be found
+func ensureKernelFilesystems(ctx context.Context) error {
+	cmds := [][]string{}
+
+	if _, err := os.Stat("/sys/block"); err != nil {
+		cmds = append(cmds, []string{"mkdir", "-p", "/sys"})
+		cmds = append(cmds, []string{"mount", "-t", "sysfs", "sysfs", "/sys"})
+	}
+
+	if _, err := os.Stat("/dev/null"); err != nil {
+		cmds = append(cmds, []string{"mkdir", "-p", "/dev"})
+		cmds = append(cmds, []string{"mount", "-t", "devtmpfs", "devtmpfs", "/dev"})
+	}
+
+	for _, cmd := range cmds {
+		if err := harpoon.ExecCmdForwardingStdio(ctx, cmd...); err != nil {
+			return errors.Errorf("running command: %v: %w", cmd, err)
+		}
+	}
+
+	return nil
+}
+
+// findBlockDeviceBySerial looks up the /dev node of the virtio-blk device the host tagged with serial
+func findBlockDeviceBySerial(serial string) (string, error) {
+	serialFiles, err := filepath.Glob("/sys/block/*/serial")
+	if err != nil {
+		return "", errors.Errorf("listing block device serials: %w", err)
+	}
+
+	for _, serialFile := range serialFiles {
+		data, err := os.ReadFile(serialFile)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == serial {
+			return filepath.Join("/dev", filepath.Base(filepath.Dir(serialFile))), nil
+		}
+	}
+
+	return "", errors.Errorf("no block device with serial %q", serial)
+}
+
+// mountRootfsOverlay mounts the read-only image rootfs (virtiofs share or block device) at the lower dir,
+// a writable scratch layer (tmpfs or a freshly formatted scratch disk) at the upper dir, and an overlay of the
+// two at target
+func mountRootfsOverlay(ctx context.Context, cfg *ec1init.RootfsConfig, target string) error {
+	cmds := [][]string{
+		{"mkdir", "-p", rootfsLowerDir, rootfsUpperDir, target},
+	}
+
+	switch cfg.Mode {
+	case ec1init.RootfsModeBlock:
+		if err := ensureKernelFilesystems(ctx); err != nil {
+			return errors.Errorf("preparing kernel filesystems: %w", err)
+		}
+
+		imageDev, err := findBlockDeviceBySerial(ec1init.RootfsImageBlockSerial)
+		if err != nil {
+			return errors.Errorf("finding rootfs image device: %w", err)
+		}
+
+		// noload skips the ext4 journal, the other formats are read-only to begin with
+		fstype, opts := "ext4", "ro,noload"
+		if cfg.Filesystem != "" && cfg.Filesystem != "ext4" {
+			fstype, opts = cfg.Filesystem, "ro"
+		}
+
+		cmds = append(cmds, []string{"mount", "-t", fstype, "-o", opts, imageDev, rootfsLowerDir})
+	default:
+		cmds = append(cmds, []string{"mount", "-t", "virtiofs", "-o", "ro", ec1init.RootfsVirtioTag, rootfsLowerDir})
+	}
+
+	switch cfg.Scratch {
+	case ec1init.RootfsScratchDisk:
+		scratchDev, err := findBlockDeviceBySerial(ec1init.RootfsScratchBlockSerial)
+		if err != nil {
+			return errors.Errorf("finding rootfs scratch device: %w", err)
+		}
+
+		// the scratch disk is a fresh sparse file on every boot
+		cmds = append(cmds, []string{ec1init.Mke2fsPath, "-q", "-F", "-t", "ext4", scratchDev})
+		cmds = append(cmds, []string{"mount", "-t", "ext4", scratchDev, rootfsUpperDir})
+	default:
+		cmds = append(cmds, []string{"mount", "-t", "tmpfs", "tmpfs", rootfsUpperDir})
+	}
+
+	cmds = append(cmds, []string{"mkdir", "-p", rootfsUpperDir + "/upper", rootfsUpperDir + "/work"})
+	cmds = append(cmds, []string{"mount", "-t", "overlay", "overlay", "-o", "lowerdir=" + rootfsLowerDir + ",upperdir=" + rootfsUpperDir + "/upper,workdir=" + rootfsUpperDir + "/work", target})
+
+	for _, cmd := range cmds {
+		if err := harpoon.ExecCmdForwardingStdio(ctx, cmd...); err != nil {
+			return errors.Errorf("running command: %v: %w", cmd, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/logging"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+const usage = `usage: vm-snapshot [-root dir] <command> [args]
+
+commands:
+  list                                   list the snapshots, newest first
+  inspect <id>                           print a snapshot
+  delete <id>                            delete a snapshot
+  prune [-max-age d] [-max-count n]      delete old snapshots
+  export <id> <file>                     write a snapshot to a tarball
+  import <file>                          read a snapshot from a tarball
+`
+
+func main() {
+	root := flag.String("root", "", "Snapshot catalog directory (default: the ec1 cache directory)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx := logging.SetupSlogSimple(context.Background())
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	catalog, err := openCatalog(ctx, *root)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to open snapshot catalog", "error", err)
+		os.Exit(1)
+	}
+
+	if err := run(ctx, catalog, flag.Arg(0), flag.Args()[1:]); err != nil {
+		slog.ErrorContext(ctx, "failed to run command", "command", flag.Arg(0), "error", err)
+		os.Exit(1)
+	}
+}
+
+func openCatalog(ctx context.Context, root string) (*vmm.SnapshotCatalog, error) {
+	if root != "" {
+		return vmm.NewSnapshotCatalog(root), nil
+	}
+	return vmm.NewDefaultSnapshotCatalog(ctx)
+}
+
+func run(ctx context.Context, catalog *vmm.SnapshotCatalog, command string, args []string) error {
+	switch command {
+	case "list":
+		infos, err := catalog.List(ctx)
+		if err != nil {
+			return err
+		}
+		if infos == nil {
+			infos = []*vmm.SnapshotInfo{}
+		}
+		return printJSON(infos)
+
+	case "inspect":
+		if len(args) != 1 {
+			return errors.New("inspect takes a snapshot id")
+		}
+		info, err := catalog.Inspect(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(info)
+
+	case "delete":
+		if len(args) != 1 {
+			return errors.New("delete takes a snapshot id")
+		}
+		return catalog.Delete(ctx, args[0])
+
+	case "prune":
+		flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+		maxAge := flags.Duration("max-age", 0, "Delete snapshots older than this")
+		maxCount := flags.Int("max-count", 0, "Keep only the newest snapshots of each vm")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *maxAge == 0 && *maxCount == 0 {
+			return errors.New("prune needs -max-age or -max-count")
+		}
+		pruned, err := catalog.Prune(ctx, vmm.SnapshotPrunePolicy{MaxAge: *maxAge, MaxCount: *maxCount})
+		if err != nil {
+			return err
+		}
+		return printJSON(pruned)
+
+	case "export":
+		if len(args) != 2 {
+			return errors.New("export takes a snapshot id and a file")
+		}
+		return exportSnapshot(ctx, catalog, args[0], args[1])
+
+	case "import":
+		if len(args) != 1 {
+			return errors.New("import takes a file")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return errors.Errorf("opening %s: %w", args[0], err)
+		}
+		defer f.Close()
+		info, err := catalog.Import(ctx, f)
+		if err != nil {
+			return err
+		}
+		return printJSON(info)
+
+	default:
+		return errors.Errorf("unknown command %q", command)
+	}
+}
+
+// exportSnapshot writes the tarball next to file and renames it into place, so a failed export leaves nothing behind
+func exportSnapshot(ctx context.Context, catalog *vmm.SnapshotCatalog, id string, file string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", file, time.Now().UnixNano())
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Errorf("creating %s: %w", file, err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if err := catalog.Export(ctx, id, f); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Errorf("closing %s: %w", file, err)
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Errorf("moving export into place: %w", err)
+	}
+
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -8,6 +8,8 @@ var BinaryXZ []byte
 
 const BinaryXZChecksum = "d791f03d6cc835cd67a5d5cb96cada79b8595f537f38aa6354aa4a3e57501f49"
 
+const BinaryChecksum = "9f8ea462448f86027fb0e2c1cdd34bf2530da67dc24b9a79887eff522703909d"
+
 func init() {
-	binembed.RegisterXZ(BinaryXZChecksum, BinaryXZ)
+	binembed.RegisterXZWithDigest(BinaryXZChecksum, BinaryChecksum, BinaryXZ)
 }
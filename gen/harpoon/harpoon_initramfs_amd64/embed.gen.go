@@ -8,6 +8,8 @@ var BinaryXZ []byte
 
 const BinaryXZChecksum = "018d036ff51e29bb65c09036fb977538ff9956129bcd3c957c7fe1d142f8e31d"
 
+const BinaryChecksum = "5369140ba7d2b211b093b37f9713eaf7bafc8cb087d7ad8794f0b72f030f207f"
+
 func init() {
-	binembed.RegisterXZ(BinaryXZChecksum, BinaryXZ)
+	binembed.RegisterXZWithDigest(BinaryXZChecksum, BinaryChecksum, BinaryXZ)
 }
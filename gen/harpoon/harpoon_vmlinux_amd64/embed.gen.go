@@ -8,6 +8,8 @@ var BinaryXZ []byte
 
 const BinaryXZChecksum = "29d79a62b749c939e3eff2d20ab97dbed33a842739b7adfeefea412962cba9d6"
 
+const BinaryChecksum = "e1a49dcbc9ec97fce60c48fc95c4748488ff69f070d8ea08511c8a01e2b36cef"
+
 const Version = "6.15-rc7"
 
 //go:embed config-6.15-rc7
@@ -17,6 +19,6 @@ var Config []byte
 const ConfigChecksum = "d0e00f55ba4159d115d7b19cfc3f507569b05d0295896d2dbcb8c645f7887bc5"
 
 func init() {
-	binembed.RegisterXZ(BinaryXZChecksum, BinaryXZ)
+	binembed.RegisterXZWithDigest(BinaryXZChecksum, BinaryChecksum, BinaryXZ)
 	binembed.RegisterRaw(ConfigChecksum, Config)
 }
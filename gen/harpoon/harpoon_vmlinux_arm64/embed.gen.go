@@ -8,6 +8,8 @@ var BinaryXZ []byte
 
 const BinaryXZChecksum = "206222f3fdace598c7754da3b7b5367c7b370f5d651b65b2728761619215fa07"
 
+const BinaryChecksum = "ea6d016f9267372162d3ada4ec45a53fb65636ef8301249514fc5aa1f7f7f14e"
+
 const Version = "6.15-rc7"
 
 //go:embed config-6.15-rc7
@@ -17,6 +19,6 @@ var Config []byte
 const ConfigChecksum = "8a54923717942b26d602402590303d4629e147e09394803454cf3fa94ebb5e5c"
 
 func init() {
-	binembed.RegisterXZ(BinaryXZChecksum, BinaryXZ)
+	binembed.RegisterXZWithDigest(BinaryXZChecksum, BinaryChecksum, BinaryXZ)
 	binembed.RegisterRaw(ConfigChecksum, Config)
 }
@@ -0,0 +1,9 @@
+// Package initramfs holds the inputs of the harpoon guest initramfs. the static busybox, lshw, mke2fs and
+// socat binaries are pinned by the <binary>-<arch>.sha256 files committed here, and cmd/harpoon-initramfs
+// refuses inputs that do not match. `task harpoon:busybox:<arch>` and `task harpoon:tools:<arch>` build
+// the binaries and check them against the pins; `task harpoon:pin:<arch>` rewrites the pins when an input
+// is deliberately changed.
+package initramfs
+
+//go:generate go run ../../cmd/harpoon-initramfs -harpoond ../../gen/harpoon/harpoon_harpoond_arm64/harpoond.xz -busybox busybox-arm64 -busybox-sha256 busybox-arm64.sha256 -lshw lshw-arm64 -lshw-sha256 lshw-arm64.sha256 -mke2fs mke2fs-arm64 -mke2fs-sha256 mke2fs-arm64.sha256 -socat socat-arm64 -socat-sha256 socat-arm64.sha256 -config . -out initramfs-arm64.cpio.gz
+//go:generate go run ../../cmd/harpoon-initramfs -harpoond ../../gen/harpoon/harpoon_harpoond_amd64/harpoond.xz -busybox busybox-amd64 -busybox-sha256 busybox-amd64.sha256 -lshw lshw-amd64 -lshw-sha256 lshw-amd64.sha256 -mke2fs mke2fs-amd64 -mke2fs-sha256 mke2fs-amd64.sha256 -socat socat-amd64 -socat-sha256 socat-amd64.sha256 -config . -out initramfs-amd64.cpio.gz
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"log/slog"
+	"os"
 	"sync"
 	"time"
 
@@ -17,10 +18,22 @@ type binaryEntry struct {
 	decompressor archives.Compression
 	isCompressed bool // New field to track if data is compressed
 
+	// decompressedChecksum is the sha256 of the decompressed bytes, when the generator recorded it
+	decompressedChecksum string
+
 	// Lazy decompression with sync.Once for thread safety
 	decompressOnce sync.Once
 	decompressed   []byte
 	decompressErr  error
+
+	// the sha256 of the compressed bytes is checked against the checksum once per process
+	verifyOnce sync.Once
+	verifyErr  error
+
+	// path is the decompressed file in the disk cache
+	pathOnce sync.Once
+	path     string
+	pathErr  error
 }
 
 // Global registry with a single RWMutex for better performance
@@ -42,6 +55,20 @@ func RegisterXZ(checkSum string, binary []byte) {
 	}
 }
 
+// RegisterXZWithDigest registers a compressed binary like RegisterXZ, along with the sha256 of its
+// decompressed bytes so they are verified too.
+func RegisterXZWithDigest(checkSum string, decompressedChecksum string, binary []byte) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	registry[checkSum] = &binaryEntry{
+		compressed:           binary,
+		decompressor:         &archives.Xz{},
+		isCompressed:         true,
+		decompressedChecksum: decompressedChecksum,
+	}
+}
+
 // RegisterRaw registers an uncompressed binary.
 // This is useful for config files or other data that doesn't need decompression.
 func RegisterRaw(checkSum string, binary []byte) {
@@ -60,14 +87,12 @@ func RegisterRaw(checkSum string, binary []byte) {
 // GetDecompressed returns a reader for the decompressed binary data.
 // The decompression is performed lazily and cached for subsequent calls.
 // This function is safe for concurrent use and handles both compressed and raw data.
+// Binaries registered by sha256 are verified and read from the disk cache, which other
+// processes share, so only the first process decompresses them.
 func GetDecompressed(checkSum string) (io.Reader, error) {
-	// Fast path: read-only access to find the entry
-	registryMutex.RLock()
-	entry, exists := registry[checkSum]
-	registryMutex.RUnlock()
-	
-	if !exists {
-		return nil, errors.Errorf("binary not found: %s", checkSum)
+	entry, err := lookup(checkSum)
+	if err != nil {
+		return nil, err
 	}
 	
 	// For uncompressed data, return immediately
@@ -78,7 +103,23 @@ func GetDecompressed(checkSum string) (io.Reader, error) {
 	// Lazy decompression with sync.Once ensures thread safety
 	// and prevents duplicate decompression work
 	entry.decompressOnce.Do(func() {
+		if isSHA256(checkSum) && CacheDir() != "" {
+			path, err := GetDecompressedPath(checkSum)
+			if err == nil {
+				entry.decompressed, err = os.ReadFile(path)
+			}
+			if err == nil {
+				return
+			}
+			slog.Warn("reading binary from the disk cache failed, decompressing in memory", "checksum", checkSum, "error", err)
+		}
 		entry.decompressed, entry.decompressErr = decompressBinary(entry.compressed, entry.decompressor)
+		if entry.decompressErr == nil && entry.decompressedChecksum != "" {
+			if got := sha256Hex(entry.decompressed); got != entry.decompressedChecksum {
+				entry.decompressed = nil
+				entry.decompressErr = errors.Errorf("decompressed binary has sha256 %s, expected %s", got, entry.decompressedChecksum)
+			}
+		}
 	})
 	
 	if entry.decompressErr != nil {
@@ -0,0 +1,274 @@
+package binembed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	cacheDirPerm  = 0o755
+	cacheFilePerm = 0o644
+
+	// digestSuffix names the file holding the sha256 of the decompressed bytes next to them
+	digestSuffix = ".sha256"
+	lockSuffix   = ".lock"
+)
+
+var (
+	cacheDir      string
+	cacheDirSet   bool
+	cacheDirMutex sync.Mutex
+)
+
+// SetCacheDir sets the directory decompressed binaries are kept in across processes. an empty dir keeps
+// them in process memory only.
+func SetCacheDir(dir string) {
+	cacheDirMutex.Lock()
+	defer cacheDirMutex.Unlock()
+
+	cacheDir, cacheDirSet = dir, true
+}
+
+// CacheDir returns the directory decompressed binaries are kept in, ec1/binembed in the user cache
+// directory unless SetCacheDir changed it
+func CacheDir() string {
+	cacheDirMutex.Lock()
+	defer cacheDirMutex.Unlock()
+
+	if !cacheDirSet {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			base = os.TempDir()
+		}
+		cacheDir, cacheDirSet = filepath.Join(base, "ec1", "binembed"), true
+	}
+	return cacheDir
+}
+
+// isSHA256 reports whether a checksum is the hex sha256 the generated embed packages register binaries
+// under. other keys are opaque names that are neither verified nor cached on disk.
+func isSHA256(checkSum string) bool {
+	if len(checkSum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(checkSum)
+	return err == nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyCompressed checks the embedded bytes against the checksum they are registered under
+func (e *binaryEntry) verifyCompressed(checkSum string) error {
+	e.verifyOnce.Do(func() {
+		if !isSHA256(checkSum) {
+			return
+		}
+		if got := sha256Hex(e.compressed); got != checkSum {
+			e.verifyErr = errors.Errorf("embedded binary has sha256 %s, it is registered as %s", got, checkSum)
+		}
+	})
+	return e.verifyErr
+}
+
+// GetDecompressedPath returns the path of the decompressed binary in the disk cache, decompressing it
+// there on first use. the file is shared by every process and must not be modified, so it can be handed
+// straight to a hypervisor. the sha256 of the compressed and decompressed bytes are verified.
+func GetDecompressedPath(checkSum string) (string, error) {
+	entry, err := lookup(checkSum)
+	if err != nil {
+		return "", err
+	}
+
+	dir := CacheDir()
+	if dir == "" {
+		return "", errors.Errorf("binary %s: no cache directory to decompress it to", checkSum)
+	}
+	if !isSHA256(checkSum) {
+		return "", errors.Errorf("binary %s: only binaries registered by sha256 are cached on disk", checkSum)
+	}
+
+	entry.pathOnce.Do(func() {
+		entry.path, entry.pathErr = ensureCached(dir, checkSum, entry)
+	})
+	if entry.pathErr != nil {
+		return "", errors.Errorf("caching binary %s: %w", checkSum, entry.pathErr)
+	}
+	return entry.path, nil
+}
+
+// OpenDecompressed opens the decompressed binary in the disk cache, see GetDecompressedPath
+func OpenDecompressed(checkSum string) (*os.File, error) {
+	path, err := GetDecompressedPath(checkSum)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("opening cached binary %s: %w", checkSum, err)
+	}
+	return f, nil
+}
+
+func lookup(checkSum string) (*binaryEntry, error) {
+	registryMutex.RLock()
+	entry, exists := registry[checkSum]
+	registryMutex.RUnlock()
+
+	if !exists {
+		return nil, errors.Errorf("binary not found: %s", checkSum)
+	}
+	if err := entry.verifyCompressed(checkSum); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ensureCached returns the cached file of entry, verifying an existing one and decompressing it into
+// place otherwise. the file lock keeps concurrent processes from decompressing the same binary twice.
+func ensureCached(dir string, checkSum string, entry *binaryEntry) (string, error) {
+	path := filepath.Join(dir, checkSum)
+
+	if err := verifyCached(path, entry.decompressedChecksum); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(dir, cacheDirPerm); err != nil {
+		return "", errors.Errorf("creating cache directory: %w", err)
+	}
+
+	unlock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return "", errors.Errorf("locking %s: %w", path, err)
+	}
+	defer unlock()
+
+	// another process may have decompressed it while we waited for the lock
+	if err := verifyCached(path, entry.decompressedChecksum); err == nil {
+		return path, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("discarding corrupt cached binary", "path", path, "error", err)
+	}
+
+	start := time.Now()
+
+	if err := writeCached(path, entry); err != nil {
+		return "", err
+	}
+
+	slog.Info("cached decompressed binary", "checksum", checkSum, "path", path, "duration", time.Since(start))
+
+	return path, nil
+}
+
+// verifyCached checks the cached file against the recorded sha256 of the decompressed bytes, and against
+// the one the binary was registered with when there is one
+func verifyCached(path string, want string) error {
+	recorded, err := os.ReadFile(path + digestSuffix)
+	if err != nil {
+		return err
+	}
+	if want == "" {
+		want = strings.TrimSpace(string(recorded))
+	} else if strings.TrimSpace(string(recorded)) != want {
+		return errors.Errorf("cached digest %s does not match %s", recorded, want)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.Errorf("hashing %s: %w", path, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return errors.Errorf("%s has sha256 %s, expected %s", path, got, want)
+	}
+	return nil
+}
+
+// writeCached decompresses entry next to path and renames it into place, after its digest, so a file at
+// path is always complete
+func writeCached(path string, entry *binaryEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var src io.Reader = bytes.NewReader(entry.compressed)
+	if entry.isCompressed {
+		rc, err := entry.decompressor.OpenReader(src)
+		if err != nil {
+			return errors.Errorf("opening decompressor: %w", err)
+		}
+		defer rc.Close()
+		src = rc
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		return errors.Errorf("decompressing: %w", err)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if entry.decompressedChecksum != "" && digest != entry.decompressedChecksum {
+		return errors.Errorf("decompressed binary has sha256 %s, expected %s", digest, entry.decompressedChecksum)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return errors.Errorf("syncing temp file: %w", err)
+	}
+	if err := tmp.Chmod(cacheFilePerm); err != nil {
+		return errors.Errorf("setting cache file mode: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("closing temp file: %w", err)
+	}
+
+	if err := writeFileAtomic(path+digestSuffix, []byte(digest+"\n")); err != nil {
+		return errors.Errorf("writing digest: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Errorf("renaming cached binary into place: %w", err)
+	}
+
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(cacheFilePerm); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,159 @@
+package binembed
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestCache gives the test an empty registry and disk cache
+func useTestCache(t *testing.T) string {
+	dir := t.TempDir()
+	prev := CacheDir()
+	SetCacheDir(dir)
+
+	registryMutex.Lock()
+	registry = make(map[string]*binaryEntry)
+	registryMutex.Unlock()
+
+	t.Cleanup(func() { SetCacheDir(prev) })
+	return dir
+}
+
+// newProcess forgets what this process decompressed, like a second shim starting
+func newProcess(checkSum string, compressed []byte) {
+	registryMutex.Lock()
+	registry = make(map[string]*binaryEntry)
+	registryMutex.Unlock()
+	RegisterXZ(checkSum, compressed)
+}
+
+func TestGetDecompressedPathIsSharedAcrossProcesses(t *testing.T) {
+	dir := useTestCache(t)
+
+	testData := bytes.Repeat([]byte("vmlinux "), 4096)
+	compressed := createTestXZData(t, testData)
+	checksum := sha256Hex(compressed)
+	RegisterXZ(checksum, compressed)
+
+	path, err := GetDecompressedPath(checksum)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, checksum), path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, testData, data)
+
+	digest, err := os.ReadFile(path + digestSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex(testData)+"\n", string(digest))
+
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	newProcess(checksum, compressed)
+	f, err := OpenDecompressed(checksum)
+	require.NoError(t, err)
+	defer f.Close()
+
+	after, err := f.Stat()
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after), "the second process reuses the cached file")
+
+	buf := make([]byte, 7)
+	_, err = f.ReadAt(buf, 8)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("vmlinux"), buf)
+
+	reader, err := GetDecompressed(checksum)
+	require.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, testData, data)
+}
+
+func TestGetDecompressedPathReplacesCorruptFiles(t *testing.T) {
+	useTestCache(t)
+
+	testData := []byte("initramfs")
+	compressed := createTestXZData(t, testData)
+	checksum := sha256Hex(compressed)
+	RegisterXZ(checksum, compressed)
+
+	path, err := GetDecompressedPath(checksum)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("tampered!"), 0o644))
+
+	newProcess(checksum, compressed)
+	path, err = GetDecompressedPath(checksum)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, testData, data)
+}
+
+func TestChecksumsAreVerified(t *testing.T) {
+	useTestCache(t)
+
+	compressed := createTestXZData(t, []byte("kernel"))
+	wrong := sha256Hex([]byte("something else"))
+	RegisterXZ(wrong, compressed)
+
+	_, err := GetDecompressedPath(wrong)
+	require.ErrorContains(t, err, "it is registered as "+wrong)
+
+	_, err = GetDecompressed(wrong)
+	require.ErrorContains(t, err, "it is registered as "+wrong)
+
+	checksum := sha256Hex(compressed)
+	RegisterXZWithDigest(checksum, sha256Hex([]byte("not the kernel")), compressed)
+
+	_, err = GetDecompressedPath(checksum)
+	require.ErrorContains(t, err, "decompressed binary has sha256 "+sha256Hex([]byte("kernel")))
+
+	RegisterXZWithDigest(checksum, sha256Hex([]byte("kernel")), compressed)
+	_, err = GetDecompressedPath(checksum)
+	require.NoError(t, err)
+}
+
+func TestGetDecompressedPathConcurrentProcesses(t *testing.T) {
+	useTestCache(t)
+
+	testData := bytes.Repeat([]byte("harpoon"), 10000)
+	compressed := createTestXZData(t, testData)
+	checksum := sha256Hex(compressed)
+
+	// separate entries decompress independently, like separate processes sharing the cache directory
+	const processes = 8
+	var wg sync.WaitGroup
+	paths := make([]string, processes)
+	errs := make([]error, processes)
+	for i := range processes {
+		entry := &binaryEntry{compressed: compressed, decompressor: &archives.Xz{}, isCompressed: true}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths[i], errs[i] = ensureCached(CacheDir(), checksum, entry)
+		}()
+	}
+	wg.Wait()
+
+	for i := range processes {
+		require.NoError(t, errs[i])
+		data, err := os.ReadFile(paths[i])
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(CacheDir(), "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "temp files are renamed or removed")
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package binembed
+
+// lockFile is a no-op without flock; the atomic rename still keeps readers from seeing partial files
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
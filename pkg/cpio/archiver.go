@@ -0,0 +1,139 @@
+package cpio
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+)
+
+// hardlinkKey identifies the file behind the names of a hardlink group, either by the device and inode of
+// the host file or by those of the source archive
+type hardlinkKey struct {
+	dev, ino   uint64
+	fromHeader bool
+}
+
+type hardlinkGroup struct {
+	inode      int64
+	hasContent bool
+}
+
+// archiveWriter converts archives.FileInfo to headers. inodes are renumbered and hardlink groups share
+// one, with the contents written once, on the first name of the group that has any.
+type archiveWriter struct {
+	w      *Writer
+	groups map[hardlinkKey]*hardlinkGroup
+}
+
+func newArchiveWriter(w *Writer) *archiveWriter {
+	return &archiveWriter{w: w, groups: map[hardlinkKey]*hardlinkGroup{}}
+}
+
+func (aw *archiveWriter) writeFile(f archives.FileInfo) error {
+	name := f.NameInArchive
+	if name == "" {
+		name = f.Name()
+	}
+
+	var (
+		hdr Header
+		key *hardlinkKey
+	)
+	if h, ok := f.Sys().(*Header); ok {
+		hdr = *h
+		if hdr.isHardlink() {
+			key = &hardlinkKey{dev: makedev(h.DevMajor, h.DevMinor), ino: uint64(h.Inode), fromHeader: true}
+		}
+	} else {
+		hdr = Header{Mode: f.Mode(), ModTime: f.ModTime(), Size: f.Size()}
+		if dev, ino, ok := statHeader(f.FileInfo, &hdr); ok && hdr.isHardlink() {
+			key = &hardlinkKey{dev: dev, ino: ino}
+		}
+	}
+
+	hdr.Name = name
+	hdr.DevMajor, hdr.DevMinor = 0, 0
+	hdr.Checksum = 0
+	hdr.Inode = aw.w.nextInode
+	if hdr.Mode&fs.ModeSymlink != 0 {
+		if f.LinkTarget != "" {
+			hdr.Linkname = f.LinkTarget
+		}
+		if hdr.Linkname == "" {
+			return errors.Errorf("writing %s: symlink has no target", name)
+		}
+	}
+	if !hdr.Mode.IsRegular() && hdr.Mode&fs.ModeSymlink == 0 {
+		hdr.Size = 0
+	}
+
+	if key != nil {
+		group, ok := aw.groups[*key]
+		if !ok {
+			group = &hardlinkGroup{inode: aw.w.nextInode}
+			aw.groups[*key] = group
+		}
+		hdr.Inode = group.inode
+		if group.hasContent {
+			hdr.Size = 0
+		}
+		group.hasContent = group.hasContent || hdr.Size > 0
+	}
+
+	hasContent := hdr.Mode.IsRegular() && hdr.Size > 0
+
+	if hasContent && aw.w.format == FormatCRC {
+		sum, err := sumFile(f, hdr.Size)
+		if err != nil {
+			return errors.Errorf("summing contents of %s: %w", name, err)
+		}
+		hdr.Checksum = sum
+	}
+
+	if err := aw.w.WriteHeader(&hdr); err != nil {
+		return errors.Errorf("writing header for %s: %w", name, err)
+	}
+
+	if !hasContent {
+		return nil
+	}
+
+	file, err := f.Open()
+	if err != nil {
+		return errors.Errorf("opening file %s: %w", name, err)
+	}
+	defer file.Close()
+
+	if n, err := io.CopyN(aw.w, file, hdr.Size); err != nil {
+		return errors.Errorf("copying data for %s: %d of %d bytes: %w", name, n, hdr.Size, err)
+	}
+
+	return nil
+}
+
+// sumFile reads the contents of f once to compute the checksum of FormatCRC headers
+func sumFile(f archives.FileInfo, size int64) (uint32, error) {
+	file, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var (
+		sum uint32
+		buf = make([]byte, 32*1024)
+	)
+	r := io.LimitReader(file, size)
+	for {
+		n, err := r.Read(buf)
+		sum += byteSum(buf[:n])
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
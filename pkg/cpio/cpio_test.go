@@ -0,0 +1,480 @@
+package cpio_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/cpio"
+)
+
+type entry struct {
+	hdr  cpio.Header
+	data []byte
+}
+
+// randomEntries generates an archive of every entry type, with hardlink groups that share an inode and
+// store their contents on the first or the last link
+func randomEntries(rng *rand.Rand, format cpio.Format) []entry {
+	var entries []entry
+	inode := int64(100)
+	mtime := func() time.Time { return time.Unix(rng.Int63n(1<<32), 0) }
+	perm := func() fs.FileMode { return fs.FileMode(rng.Intn(0o1000)) }
+	rdev := func() (uint32, uint32) {
+		// the single rdev field of odc holds 18 bits
+		if format == cpio.FormatODC {
+			return uint32(rng.Intn(1024)), uint32(rng.Intn(256))
+		}
+		return uint32(rng.Intn(4096)), uint32(rng.Intn(1 << 20))
+	}
+
+	for i := range 5 + rng.Intn(40) {
+		inode++
+		name := fmt.Sprintf("dir%d/entry%d", rng.Intn(4), i)
+		hdr := cpio.Header{
+			Name:     name,
+			Uid:      rng.Intn(1 << 16),
+			Gid:      rng.Intn(1 << 16),
+			ModTime:  mtime(),
+			Inode:    inode,
+			DevMajor: uint32(rng.Intn(256)),
+			DevMinor: uint32(rng.Intn(256)),
+			Links:    1,
+		}
+
+		switch rng.Intn(7) {
+		case 0:
+			hdr.Mode = fs.ModeDir | perm()
+			hdr.Links = 2
+			entries = append(entries, entry{hdr: hdr})
+		case 1:
+			hdr.Mode = fs.ModeSymlink | 0o777
+			hdr.Linkname = strings.Repeat("t", 1+rng.Intn(200))
+			entries = append(entries, entry{hdr: hdr})
+		case 2:
+			hdr.Mode = fs.ModeDevice | fs.ModeCharDevice | perm()
+			hdr.RdevMajor, hdr.RdevMinor = rdev()
+			entries = append(entries, entry{hdr: hdr})
+		case 3:
+			hdr.Mode = fs.ModeDevice | perm()
+			hdr.RdevMajor, hdr.RdevMinor = rdev()
+			entries = append(entries, entry{hdr: hdr})
+		case 4:
+			hdr.Mode = fs.ModeNamedPipe | perm()
+			entries = append(entries, entry{hdr: hdr})
+		case 5:
+			links := 2 + rng.Intn(3)
+			data := randomData(rng)
+			last := rng.Intn(2) == 0
+			for l := range links {
+				link := hdr
+				link.Name = fmt.Sprintf("%s.link%d", name, l)
+				link.Mode = perm() | fs.ModeSetgid
+				link.Links = links
+				var contents []byte
+				if (last && l == links-1) || (!last && l == 0) {
+					contents = data
+				}
+				link.Size = int64(len(contents))
+				link.Checksum = sum(contents)
+				entries = append(entries, entry{hdr: link, data: contents})
+			}
+		default:
+			hdr.Mode = perm() | fs.ModeSetuid
+			data := randomData(rng)
+			hdr.Size = int64(len(data))
+			hdr.Checksum = sum(data)
+			entries = append(entries, entry{hdr: hdr, data: data})
+		}
+	}
+	return entries
+}
+
+func randomData(rng *rand.Rand) []byte {
+	data := make([]byte, rng.Intn(3000))
+	rng.Read(data)
+	return data
+}
+
+func sum(p []byte) uint32 {
+	var s uint32
+	for _, b := range p {
+		s += uint32(b)
+	}
+	return s
+}
+
+func writeEntries(t *testing.T, format cpio.Format, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := cpio.NewFormatWriter(&buf, format)
+	for _, e := range entries {
+		hdr := e.hdr
+		require.NoError(t, w.WriteHeader(&hdr))
+		_, err := w.Write(e.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func readEntries(t *testing.T, archive []byte) []entry {
+	t.Helper()
+	var entries []entry
+	r := cpio.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		entries = append(entries, entry{hdr: *hdr, data: data})
+	}
+}
+
+func TestRoundTripMatchesKernelSemantics(t *testing.T) {
+	for _, format := range []cpio.Format{cpio.FormatNewc, cpio.FormatCRC, cpio.FormatODC} {
+		t.Run(format.String(), func(t *testing.T) {
+			for seed := range int64(50) {
+				rng := rand.New(rand.NewSource(seed))
+				want := randomEntries(rng, format)
+
+				archive := writeEntries(t, format, want)
+				assert.Zero(t, len(archive)%512, "seed %d: archive is padded to 512 bytes", seed)
+
+				got := readEntries(t, archive)
+				require.Len(t, got, len(want), "seed %d", seed)
+
+				firstLinks := map[int64]string{}
+				for i, w := range want {
+					g := got[i]
+					if w.hdr.Mode.IsRegular() && w.hdr.Links > 1 {
+						// the kernel links every later name of a group to the first one it created
+						if first, ok := firstLinks[w.hdr.Inode]; ok {
+							w.hdr.Linkname = first
+						} else {
+							firstLinks[w.hdr.Inode] = w.hdr.Name
+						}
+					}
+					if w.hdr.Mode&fs.ModeSymlink != 0 {
+						w.hdr.Size = int64(len(w.hdr.Linkname))
+						w.data = nil
+					}
+					if format != cpio.FormatCRC {
+						w.hdr.Checksum = 0
+					}
+					if format == cpio.FormatCRC && w.hdr.Mode&fs.ModeSymlink != 0 {
+						w.hdr.Checksum = sum([]byte(w.hdr.Linkname))
+					}
+					if len(w.data) == 0 {
+						w.data = nil
+					}
+					if len(g.data) == 0 {
+						g.data = nil
+					}
+
+					assert.Equal(t, w.hdr.Name, g.hdr.Name, "seed %d", seed)
+					assert.Equal(t, w.hdr.Mode, g.hdr.Mode, "seed %d: %s", seed, w.hdr.Name)
+					assert.Equal(t, w.hdr.ModTime.Unix(), g.hdr.ModTime.Unix(), "seed %d: %s", seed, w.hdr.Name)
+					g.hdr.ModTime = w.hdr.ModTime
+					assert.Equal(t, w, g, "seed %d: %s", seed, w.hdr.Name)
+				}
+			}
+		})
+	}
+}
+
+// genInitCpioFixture is what gen_init_cpio writes for
+//
+//	dir /bin 0755 0 0
+//	file /bin/busybox busybox 0755 0 0 /bin/sh
+//	nod /dev/console 0600 0 0 c 5 1
+//	pipe /run/initctl 0600 0 0
+//
+// with inodes from 721, device 3:1 on every entry and the contents on the last link of a hardlink group
+func genInitCpioFixture() []byte {
+	var buf bytes.Buffer
+	header := func(ino, mode, nlink, size, rmajor, rminor int, name string) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+			ino, mode, 0, 0, nlink, 0, size, 3, 1, rmajor, rminor, len(name)+1, 0, name)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	header(721, 0o40755, 2, 0, 0, 0, "bin")
+	header(722, 0o100755, 2, 0, 0, 0, "bin/busybox")
+	header(722, 0o100755, 2, 7, 0, 0, "bin/sh")
+	buf.WriteString("busybox")
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+	header(723, 0o20600, 1, 0, 5, 1, "dev/console")
+	header(724, 0o10600, 1, 0, 0, 0, "run/initctl")
+
+	fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 11, 0, "TRAILER!!!")
+	for buf.Len()%512 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func TestReadGenInitCpio(t *testing.T) {
+	fixture := genInitCpioFixture()
+
+	got := readEntries(t, fixture)
+	require.Len(t, got, 5)
+
+	assert.Equal(t, "bin", got[0].hdr.Name)
+	assert.Equal(t, fs.ModeDir|0o755, got[0].hdr.Mode)
+
+	assert.Equal(t, "bin/busybox", got[1].hdr.Name)
+	assert.EqualValues(t, 0, got[1].hdr.Size)
+	assert.Empty(t, got[1].hdr.Linkname)
+
+	assert.Equal(t, "bin/sh", got[2].hdr.Name)
+	assert.Equal(t, "bin/busybox", got[2].hdr.Linkname)
+	assert.Equal(t, []byte("busybox"), got[2].data)
+	assert.Equal(t, got[1].hdr.Inode, got[2].hdr.Inode)
+
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o600, got[3].hdr.Mode)
+	assert.EqualValues(t, 5, got[3].hdr.RdevMajor)
+	assert.EqualValues(t, 1, got[3].hdr.RdevMinor)
+
+	assert.Equal(t, fs.ModeNamedPipe|0o600, got[4].hdr.Mode)
+
+	for _, e := range got {
+		assert.EqualValues(t, 3, e.hdr.DevMajor, e.hdr.Name)
+		assert.EqualValues(t, 1, e.hdr.DevMinor, e.hdr.Name)
+	}
+
+	// the writer reproduces the exact bytes from the same headers
+	for i := range got {
+		got[i].hdr.Linkname = ""
+	}
+	assert.Equal(t, fixture, writeEntries(t, cpio.FormatNewc, got))
+}
+
+func TestReaderRejectsBadChecksum(t *testing.T) {
+	archive := writeEntries(t, cpio.FormatCRC, []entry{{
+		hdr:  cpio.Header{Name: "file", Mode: 0o644, Size: 4, Checksum: sum([]byte("data"))},
+		data: []byte("data"),
+	}})
+	archive[bytes.Index(archive, []byte("data"))] = 'D'
+
+	r := cpio.NewReader(bytes.NewReader(archive))
+	_, err := r.Next()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.ErrorContains(t, err, "contents sum to")
+}
+
+func TestWriterRejectsWrongChecksum(t *testing.T) {
+	w := cpio.NewFormatWriter(io.Discard, cpio.FormatCRC)
+	require.NoError(t, w.WriteHeader(&cpio.Header{Name: "file", Mode: 0o644, Size: 4, Checksum: 1}))
+	_, err := w.Write([]byte("data"))
+	require.NoError(t, err)
+	require.Error(t, w.Close())
+}
+
+func extractAll(t *testing.T, ctx context.Context, archive []byte) map[string]entry {
+	t.Helper()
+	got := map[string]entry{}
+	err := cpio.New().Extract(ctx, bytes.NewReader(archive), func(ctx context.Context, f archives.FileInfo) error {
+		file, err := f.Open()
+		require.NoError(t, err)
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		hdr, ok := f.Header.(*cpio.Header)
+		require.True(t, ok)
+		got[f.NameInArchive] = entry{hdr: *hdr, data: data}
+		return nil
+	})
+	require.NoError(t, err)
+	return got
+}
+
+// memFile is an archives.FileInfo that is not backed by a host file
+type memFile struct {
+	name  string
+	mode  fs.FileMode
+	mtime time.Time
+	data  []byte
+}
+
+func (f memFile) Name() string       { return filepath.Base(f.name) }
+func (f memFile) Size() int64        { return int64(len(f.data)) }
+func (f memFile) Mode() fs.FileMode  { return f.mode }
+func (f memFile) ModTime() time.Time { return f.mtime }
+func (f memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f memFile) Sys() any           { return nil }
+
+func (f memFile) fileInfo(target string) archives.FileInfo {
+	return archives.FileInfo{
+		FileInfo:      f,
+		NameInArchive: f.name,
+		LinkTarget:    target,
+		Open: func() (fs.File, error) {
+			return fstest.MapFS{"f": {Data: f.data}}.Open("f")
+		},
+	}
+}
+
+func TestArchiveFileInfo(t *testing.T) {
+	ctx := context.Background()
+	mtime := time.Unix(1700000000, 0)
+
+	files := []archives.FileInfo{
+		memFile{name: "etc", mode: fs.ModeDir | 0o755, mtime: mtime}.fileInfo(""),
+		memFile{name: "etc/hostname", mode: 0o644, mtime: mtime, data: []byte("harpoon\n")}.fileInfo(""),
+		memFile{name: "etc/localtime", mode: fs.ModeSymlink | 0o777, mtime: mtime}.fileInfo("/usr/share/zoneinfo/UTC"),
+	}
+
+	for _, format := range []cpio.Format{cpio.FormatNewc, cpio.FormatCRC, cpio.FormatODC} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, (&cpio.CpioArchival{Format: format}).Archive(ctx, &buf, files))
+
+			got := extractAll(t, ctx, buf.Bytes())
+			require.Len(t, got, 3)
+			assert.Equal(t, []byte("harpoon\n"), got["etc/hostname"].data)
+			assert.Equal(t, mtime.Unix(), got["etc/hostname"].hdr.ModTime.Unix())
+			assert.True(t, got["etc"].hdr.Mode.IsDir())
+			assert.Equal(t, "/usr/share/zoneinfo/UTC", got["etc/localtime"].hdr.Linkname)
+		})
+	}
+}
+
+func TestArchiveKeepsHostHardlinks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "busybox"), []byte("busybox"), 0o755))
+	if err := os.Link(filepath.Join(dir, "busybox"), filepath.Join(dir, "sh")); err != nil {
+		t.Skipf("hardlinks are not supported: %v", err)
+	}
+
+	files, err := archives.FilesFromDisk(ctx, nil, map[string]string{
+		filepath.Join(dir, "busybox"): "bin/busybox",
+		filepath.Join(dir, "sh"):      "bin/sh",
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, cpio.New().Archive(ctx, &buf, files))
+
+	got := extractAll(t, ctx, buf.Bytes())
+	busybox, sh := got["bin/busybox"], got["bin/sh"]
+	require.Equal(t, busybox.hdr.Inode, sh.hdr.Inode)
+	assert.Equal(t, 2, busybox.hdr.Links)
+
+	// the contents are stored once, on the first link
+	first, second := busybox, sh
+	if sh.hdr.Linkname == "" {
+		first, second = sh, busybox
+	}
+	assert.Equal(t, []byte("busybox"), first.data)
+	assert.Empty(t, second.data)
+	assert.Equal(t, first.hdr.Name, second.hdr.Linkname)
+}
+
+func TestExtractRoundTripsHeaders(t *testing.T) {
+	ctx := context.Background()
+	fixture := genInitCpioFixture()
+
+	var files []archives.FileInfo
+	err := cpio.New().Extract(ctx, bytes.NewReader(fixture), func(ctx context.Context, f archives.FileInfo) error {
+		file, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		f.Open = func() (fs.File, error) { return fstest.MapFS{"f": {Data: data}}.Open("f") }
+		files = append(files, f)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, cpio.New().Archive(ctx, &buf, files))
+
+	got := extractAll(t, ctx, buf.Bytes())
+	require.Len(t, got, 5)
+	assert.Equal(t, got["bin/busybox"].hdr.Inode, got["bin/sh"].hdr.Inode)
+	assert.Equal(t, []byte("busybox"), got["bin/sh"].data)
+	assert.EqualValues(t, 5, got["dev/console"].hdr.RdevMajor)
+	assert.Equal(t, fs.ModeNamedPipe|0o600, got["run/initctl"].hdr.Mode)
+}
+
+func TestExtractSkips(t *testing.T) {
+	ctx := context.Background()
+
+	var names []string
+	err := cpio.New().Extract(ctx, bytes.NewReader(genInitCpioFixture()), func(ctx context.Context, f archives.FileInfo) error {
+		names = append(names, f.NameInArchive)
+		if f.NameInArchive == "bin" {
+			return fs.SkipDir
+		}
+		if f.NameInArchive == "dev/console" {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bin", "dev/console"}, names)
+}
+
+func TestInsertAppendsInPlace(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []cpio.Format{cpio.FormatNewc, cpio.FormatCRC, cpio.FormatODC} {
+		t.Run(format.String(), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			existing := randomEntries(rng, format)
+			archive := writeEntries(t, format, existing)
+
+			path := filepath.Join(t.TempDir(), "initramfs.cpio")
+			require.NoError(t, os.WriteFile(path, archive, 0o644))
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer f.Close()
+
+			script := memFile{name: "init", mode: 0o755, data: []byte("#!/bin/sh\n")}
+			err = cpio.New().Insert(ctx, f, []archives.FileInfo{script.fileInfo("")})
+			require.NoError(t, err)
+
+			updated, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Zero(t, len(updated)%512)
+
+			got := readEntries(t, updated)
+			require.Len(t, got, len(existing)+1)
+			for i, e := range existing {
+				assert.Equal(t, e.hdr.Name, got[i].hdr.Name)
+			}
+
+			last := got[len(got)-1]
+			assert.Equal(t, "init", last.hdr.Name)
+			assert.Equal(t, []byte("#!/bin/sh\n"), last.data)
+			for _, e := range existing {
+				assert.NotEqual(t, e.hdr.Inode, last.hdr.Inode, "inserted inodes do not collide")
+			}
+		})
+	}
+}
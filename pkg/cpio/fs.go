@@ -0,0 +1,381 @@
+package cpio
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// maxSymlinks is the number of symlinks followed when resolving a path, MAXSYMLINKS on linux
+const maxSymlinks = 40
+
+// FS is a read-only fs.FS view of a cpio archive read through an io.ReaderAt. the first call builds an
+// index of the header offsets, without reading any contents unless they carry a crc to verify, and files
+// are then read straight from the archive. like the kernel, archives concatenated after a trailer are
+// unpacked over the earlier ones, later links of a hardlink group share the contents of the group, and
+// missing parent directories are implied. Open, Stat and ReadFile follow symlinks; Lstat and ReadLink
+// do not, like fs.ReadLinkFS.
+type FS struct {
+	r io.ReaderAt
+
+	once    sync.Once
+	err     error
+	entries map[string]*fsEntry
+}
+
+type fsEntry struct {
+	hdr      Header
+	data     *fsData
+	children map[string]bool
+}
+
+// fsData is the location of the contents of a file, shared by the links of a hardlink group
+type fsData struct {
+	offset int64
+	size   int64
+}
+
+// groupKey scopes a hardlink group to one of the concatenated archives, whose trailers reset the links
+type groupKey struct {
+	archive int
+	link    linkKey
+}
+
+// NewFS returns a FS reading the archive from r
+func NewFS(r io.ReaderAt) *FS {
+	return &FS{r: r}
+}
+
+func (f *FS) index() error {
+	f.once.Do(func() {
+		f.err = f.buildIndex()
+	})
+	return f.err
+}
+
+func (f *FS) buildIndex() error {
+	f.entries = map[string]*fsEntry{
+		".": {hdr: Header{Name: ".", Mode: fs.ModeDir | 0o755}, children: map[string]bool{}},
+	}
+	groups := map[groupKey]*fsData{}
+
+	var offset int64
+	for archive := 0; ; archive++ {
+		start, ok, err := f.skipZeros(offset)
+		if err != nil {
+			return errors.Errorf("reading archive %d: %w", archive, err)
+		}
+		if !ok {
+			return nil
+		}
+
+		cr := NewReader(io.NewSectionReader(f.r, start, math.MaxInt64-start))
+		for {
+			hdr, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Errorf("indexing archive %d at %d: %w", archive, start, err)
+			}
+
+			data := &fsData{offset: start + cr.offset, size: hdr.Size}
+			if hdr.isHardlink() {
+				key := groupKey{archive, linkKey{hdr.DevMajor, hdr.DevMinor, hdr.Inode}}
+				if group, ok := groups[key]; ok {
+					if group.size == 0 {
+						*group = *data
+					}
+					data = group
+				} else {
+					groups[key] = data
+				}
+			}
+			f.add(hdr, data)
+		}
+		offset = start + cr.offset
+	}
+}
+
+// skipZeros finds the next header after offset, past the padding that ends an archive
+func (f *FS) skipZeros(offset int64) (int64, bool, error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := f.r.ReadAt(buf, offset)
+		for i, b := range buf[:n] {
+			if b != 0 {
+				return offset + int64(i), true, nil
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+}
+
+func (f *FS) add(hdr *Header, data *fsData) {
+	name := cleanPath(hdr.Name)
+	if name == "." {
+		f.entries["."].hdr = *hdr
+		f.entries["."].hdr.Name = "."
+		return
+	}
+
+	entry := &fsEntry{hdr: *hdr, data: data}
+	entry.hdr.Name = name
+	if hdr.Mode.IsDir() {
+		entry.children = map[string]bool{}
+		if old, ok := f.entries[name]; ok && old.children != nil {
+			entry.children = old.children
+		}
+	}
+	if hdr.isHardlink() {
+		// Linkname names the first link of the group, not a symlink target
+		entry.hdr.Linkname = ""
+	}
+	f.entries[name] = entry
+
+	for child, dir := name, path.Dir(name); ; child, dir = dir, path.Dir(dir) {
+		parent, ok := f.entries[dir]
+		if !ok {
+			parent = &fsEntry{hdr: Header{Name: dir, Mode: fs.ModeDir | 0o755}, children: map[string]bool{}}
+			f.entries[dir] = parent
+		}
+		if parent.children == nil {
+			parent.children = map[string]bool{}
+		}
+		parent.children[path.Base(child)] = true
+		if ok || dir == "." {
+			return
+		}
+	}
+}
+
+// cleanPath turns "/bin/sh", "./bin/sh" and "bin/sh" into the "bin/sh" form of fs.FS paths
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// lookup resolves name, following symlinks in its directories and, when follow is set, in its last element
+func (f *FS) lookup(op, name string, follow bool) (*fsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := f.index(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+
+	cur, hops := ".", 0
+	for i := 0; i < len(parts); i++ {
+		dir := f.entries[cur]
+		if !dir.hdr.Mode.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.Errorf("%s is not a directory: %w", cur, fs.ErrNotExist)}
+		}
+
+		next := path.Join(cur, parts[i])
+		entry, ok := f.entries[next]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		last := i == len(parts)-1
+		if entry.hdr.Mode&fs.ModeSymlink == 0 || (last && !follow) {
+			cur = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinks {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+
+		target := entry.hdr.Linkname
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(cur, target)
+		}
+		var rest []string
+		if resolved := cleanPath(target); resolved != "." {
+			rest = strings.Split(resolved, "/")
+		}
+		parts = append(rest, parts[i+1:]...)
+		cur, i = ".", -1
+	}
+
+	return f.entries[cur], nil
+}
+
+func (e *fsEntry) info() fs.FileInfo {
+	hdr := e.hdr
+	if e.data != nil && hdr.Mode.IsRegular() {
+		hdr.Size = e.data.size
+	}
+	return hdr.FileInfo()
+}
+
+// Open implements fs.FS. directories implement fs.ReadDirFile and regular files io.ReaderAt and io.Seeker.
+func (f *FS) Open(name string) (fs.File, error) {
+	entry, err := f.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.hdr.Mode.IsDir() {
+		entries, err := f.readDir(entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &fsDir{info: entry.info(), entries: entries}, nil
+	}
+
+	var data fsData
+	if entry.data != nil && entry.hdr.Mode.IsRegular() {
+		data = *entry.data
+	}
+	return &fsFile{
+		SectionReader: io.NewSectionReader(f.r, data.offset, data.size),
+		info:          entry.info(),
+	}, nil
+}
+
+// Stat implements fs.StatFS
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := f.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info(), nil
+}
+
+// Lstat returns the fs.FileInfo of name without following a symlink in its last element. its Sys is the
+// *Header of the entry.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	entry, err := f.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info(), nil
+}
+
+// ReadLink returns the target of the symlink name
+func (f *FS) ReadLink(name string) (string, error) {
+	entry, err := f.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.hdr.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return entry.hdr.Linkname, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := f.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.hdr.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.readDir(entry)
+}
+
+func (f *FS) readDir(dir *fsEntry) ([]fs.DirEntry, error) {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		child := f.entries[path.Join(dir.hdr.Name, name)]
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+	return entries, nil
+}
+
+// ReadFile implements fs.ReadFileFS
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, ok := file.(*fsDir); ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+type fsFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Close() error               { return nil }
+
+type fsDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
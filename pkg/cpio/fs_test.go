@@ -0,0 +1,110 @@
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/cpio"
+)
+
+// fsFixture is an initramfs of two concatenated archives, the second overriding a file of the first, with
+// a hardlink group storing its contents on the last link like gen_init_cpio and optionally a symlink loop
+func fsFixture(t *testing.T, loop bool) []byte {
+	t.Helper()
+	first := writeEntries(t, cpio.FormatNewc, []entry{
+		{hdr: cpio.Header{Name: "bin", Mode: fs.ModeDir | 0o755}},
+		{hdr: cpio.Header{Name: "bin/busybox", Mode: 0o755, Links: 2, Inode: 7}},
+		{hdr: cpio.Header{Name: "bin/sh", Mode: 0o755, Links: 2, Inode: 7, Size: 7}, data: []byte("busybox")},
+		{hdr: cpio.Header{Name: "sbin", Mode: fs.ModeSymlink | 0o777, Linkname: "bin"}},
+		{hdr: cpio.Header{Name: "init", Mode: fs.ModeSymlink | 0o777, Linkname: "/sbin/../bin/sh"}},
+		{hdr: cpio.Header{Name: "etc/hostname", Mode: 0o644, Size: 4}, data: []byte("old\n")},
+		{hdr: cpio.Header{Name: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, RdevMajor: 5, RdevMinor: 1}},
+	})
+	overrides := []entry{
+		{hdr: cpio.Header{Name: "./etc/hostname", Mode: 0o644, Size: 8, Checksum: sum([]byte("harpoon\n"))}, data: []byte("harpoon\n")},
+	}
+	if loop {
+		overrides = append(overrides, entry{hdr: cpio.Header{Name: "loop", Mode: fs.ModeSymlink | 0o777, Linkname: "loop"}})
+	}
+	return append(first, writeEntries(t, cpio.FormatCRC, overrides)...)
+}
+
+func TestFSReadsFilesInPlace(t *testing.T) {
+	fsys := cpio.NewFS(bytes.NewReader(fsFixture(t, true)))
+
+	data, err := fs.ReadFile(fsys, "bin/busybox")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("busybox"), data)
+
+	data, err = fs.ReadFile(fsys, "init")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("busybox"), data, "symlinks are followed through other symlinks")
+
+	data, err = fs.ReadFile(fsys, "etc/hostname")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("harpoon\n"), data, "later archives override earlier ones")
+
+	target, err := fsys.ReadLink("init")
+	require.NoError(t, err)
+	assert.Equal(t, "/sbin/../bin/sh", target)
+
+	info, err := fsys.Lstat("sbin")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+
+	info, err = fsys.Stat("sbin")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	info, err = fsys.Stat("dev/console")
+	require.NoError(t, err)
+	hdr, ok := info.Sys().(*cpio.Header)
+	require.True(t, ok)
+	assert.EqualValues(t, 5, hdr.RdevMajor)
+
+	info, err = fsys.Stat("dev")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir(), "missing parents are implied")
+
+	_, err = fsys.Stat("loop")
+	require.ErrorContains(t, err, "too many levels of symbolic links")
+
+	_, err = fsys.Open("bin/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	f, err := fsys.Open("bin/sh")
+	require.NoError(t, err)
+	defer f.Close()
+	ra, ok := f.(io.ReaderAt)
+	require.True(t, ok)
+	buf := make([]byte, 3)
+	_, err = ra.ReadAt(buf, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("box"), buf)
+
+	matches, err := fs.Glob(fsys, "bin/*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bin/busybox", "bin/sh"}, matches)
+}
+
+func TestFSConformance(t *testing.T) {
+	// fstest does not expect a symlink loop
+	archive := fsFixture(t, false)
+
+	require.NoError(t, fstest.TestFS(cpio.NewFS(bytes.NewReader(archive)),
+		"bin/busybox", "bin/sh", "sbin", "init", "etc/hostname", "dev/console"))
+}
+
+func TestFSReportsCorruptArchives(t *testing.T) {
+	archive := fsFixture(t, true)
+	fsys := cpio.NewFS(bytes.NewReader(archive[:200]))
+
+	_, err := fsys.Open("bin/sh")
+	require.ErrorContains(t, err, "indexing archive 0")
+}
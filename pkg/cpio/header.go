@@ -0,0 +1,172 @@
+package cpio
+
+import (
+	"io/fs"
+	"path"
+	"time"
+)
+
+// Format is the header encoding of a cpio archive
+type Format int
+
+const (
+	// FormatNewc is the SVR4 "070701" format the kernel unpacks an initramfs from
+	FormatNewc Format = iota
+	// FormatCRC is newc with a sum of the file contents in each header, magic "070702"
+	FormatCRC
+	// FormatODC is the POSIX.1 portable "070707" format with octal fields and no padding
+	FormatODC
+)
+
+const (
+	magicNewc = "070701"
+	magicCRC  = "070702"
+	magicODC  = "070707"
+
+	trailerName = "TRAILER!!!"
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatNewc:
+		return "newc"
+	case FormatCRC:
+		return "crc"
+	case FormatODC:
+		return "odc"
+	default:
+		return "unknown"
+	}
+}
+
+func (f Format) magic() string {
+	switch f {
+	case FormatCRC:
+		return magicCRC
+	case FormatODC:
+		return magicODC
+	default:
+		return magicNewc
+	}
+}
+
+// Header is an entry of a cpio archive. entries of a hardlink group share DevMajor, DevMinor and Inode and
+// have more than one link. the contents are stored once, on the first link by CpioArchival and on the last
+// by gen_init_cpio; the others have a zero Size. the reader reports the later links of a group with
+// Linkname set to the first name of the group.
+type Header struct {
+	Name    string
+	Mode    fs.FileMode
+	Uid     int
+	Gid     int
+	Links   int
+	ModTime time.Time
+	// Size is the length of the file contents; it is set from Linkname for symlinks
+	Size int64
+	// Inode is assigned sequentially when zero
+	Inode int64
+	// DevMajor and DevMinor are the device holding the file, which scopes Inode
+	DevMajor uint32
+	DevMinor uint32
+	// Linkname is the target of a symlink, or the first name of the hardlink group of a regular file
+	Linkname string
+	// RdevMajor and RdevMinor are the device numbers of a char or block device node
+	RdevMajor uint32
+	RdevMinor uint32
+	// Checksum is the sum of the content bytes in FormatCRC archives
+	Checksum uint32
+}
+
+// FileInfo returns a fs.FileInfo describing the entry; its Sys is the *Header
+func (h *Header) FileInfo() fs.FileInfo {
+	return headerFileInfo{h}
+}
+
+// isHardlink reports whether the header is a regular file that may share its contents with other names
+func (h *Header) isHardlink() bool {
+	return h.Mode.IsRegular() && h.Links > 1
+}
+
+type headerFileInfo struct {
+	h *Header
+}
+
+func (fi headerFileInfo) Name() string       { return path.Base(fi.h.Name) }
+func (fi headerFileInfo) Size() int64        { return fi.h.Size }
+func (fi headerFileInfo) Mode() fs.FileMode  { return fi.h.Mode }
+func (fi headerFileInfo) ModTime() time.Time { return fi.h.ModTime }
+func (fi headerFileInfo) IsDir() bool        { return fi.h.Mode.IsDir() }
+func (fi headerFileInfo) Sys() any           { return fi.h }
+
+// UnixMode converts the type, permission and special bits of a fs.FileMode to a unix st_mode
+func UnixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+
+	switch {
+	case mode.IsDir():
+		m |= S_IFDIR
+	case mode&fs.ModeSymlink != 0:
+		m |= S_IFLNK
+	case mode&fs.ModeCharDevice != 0:
+		m |= S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		m |= S_IFBLK
+	case mode&fs.ModeNamedPipe != 0:
+		m |= S_IFIFO
+	case mode&fs.ModeSocket != 0:
+		m |= S_IFSOCK
+	default:
+		m |= S_IFREG
+	}
+	return m
+}
+
+// FileMode converts a unix st_mode to a fs.FileMode
+func FileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+
+	switch mode & S_IFMT {
+	case S_IFDIR:
+		m |= fs.ModeDir
+	case S_IFLNK:
+		m |= fs.ModeSymlink
+	case S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case S_IFBLK:
+		m |= fs.ModeDevice
+	case S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case S_IFSOCK:
+		m |= fs.ModeSocket
+	}
+	return m
+}
+
+// makedev and splitdev encode device numbers the way glibc does, for the single dev fields of odc headers
+func makedev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
+func splitdev(dev uint64) (major, minor uint32) {
+	major = uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor = uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
@@ -0,0 +1,254 @@
+package cpio
+
+import (
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// maxLinknameSize bounds the symlink targets read into memory, PATH_MAX on linux
+const maxLinknameSize = 4096
+
+type linkKey struct {
+	devMajor, devMinor uint32
+	inode              int64
+}
+
+// Reader reads newc, crc and odc archives, one entry at a time. the contents of a regular file are read
+// with Read after Next.
+type Reader struct {
+	r         io.Reader
+	offset    int64
+	format    Format
+	remaining int64
+	sum       uint32
+	checksum  uint32
+	verify    bool
+	name      string
+	links     map[linkKey]string
+	maxInode  int64
+	trailer   int64
+	done      bool
+}
+
+// NewReader returns a Reader reading an archive from r. the format is detected from each header.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, links: map[linkKey]string{}}
+}
+
+// Next skips the rest of the current entry and returns the next header. it returns io.EOF after the trailer.
+func (r *Reader) Next() (*Header, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if err := r.skipEntry(); err != nil {
+		return nil, err
+	}
+
+	headerOffset := r.offset
+
+	var magic [6]byte
+	if err := r.readFull(magic[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.Errorf("reading header: archive ends without a trailer: %w", io.ErrUnexpectedEOF)
+		}
+		return nil, errors.Errorf("reading header: %w", err)
+	}
+
+	var (
+		hdr      *Header
+		namesize int64
+		err      error
+	)
+	switch string(magic[:]) {
+	case magicNewc, magicCRC:
+		r.format = FormatNewc
+		if string(magic[:]) == magicCRC {
+			r.format = FormatCRC
+		}
+		hdr, namesize, err = r.readNewcHeader()
+	case magicODC:
+		r.format = FormatODC
+		hdr, namesize, err = r.readODCHeader()
+	default:
+		return nil, errors.Errorf("reading header at %d: unknown cpio magic %q", headerOffset, magic[:])
+	}
+	if err != nil {
+		return nil, errors.Errorf("reading header at %d: %w", headerOffset, err)
+	}
+
+	if namesize == 0 || namesize > 1<<16 {
+		return nil, errors.Errorf("reading header at %d: invalid name size %d", headerOffset, namesize)
+	}
+	name := make([]byte, namesize)
+	if err := r.readFull(name); err != nil {
+		return nil, errors.Errorf("reading name: %w", err)
+	}
+	hdr.Name = strings.TrimRight(string(name), "\x00")
+	if err := r.skipPadding(); err != nil {
+		return nil, errors.Errorf("reading name padding of %s: %w", hdr.Name, err)
+	}
+
+	r.name = hdr.Name
+	r.remaining = hdr.Size
+	r.sum = 0
+	r.verify = r.format == FormatCRC
+
+	if hdr.Name == trailerName {
+		r.done = true
+		r.trailer = headerOffset
+		return nil, io.EOF
+	}
+
+	if hdr.Inode > r.maxInode {
+		r.maxInode = hdr.Inode
+	}
+
+	if hdr.isHardlink() {
+		key := linkKey{hdr.DevMajor, hdr.DevMinor, hdr.Inode}
+		if first, ok := r.links[key]; ok {
+			hdr.Linkname = first
+		} else {
+			r.links[key] = hdr.Name
+		}
+	}
+
+	if hdr.Mode&fs.ModeSymlink != 0 {
+		if hdr.Size > maxLinknameSize {
+			return nil, errors.Errorf("reading link target of %s: %d bytes is too long", hdr.Name, hdr.Size)
+		}
+		target := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(r, target); err != nil {
+			return nil, errors.Errorf("reading link target of %s: %w", hdr.Name, err)
+		}
+		hdr.Linkname = string(target)
+	}
+
+	return hdr, nil
+}
+
+// Read reads the contents of the current entry
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	if r.verify {
+		r.sum += byteSum(p[:n])
+	}
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && r.remaining == 0 && r.verify && r.sum != r.checksum {
+		err = errors.Errorf("%s: contents sum to %08x, the header has %08x", r.name, r.sum, r.checksum)
+	}
+	return n, err
+}
+
+func (r *Reader) skipEntry() error {
+	if r.remaining > 0 {
+		if s, ok := r.r.(io.Seeker); ok && !r.verify {
+			if _, err := s.Seek(r.remaining, io.SeekCurrent); err != nil {
+				return errors.Errorf("skipping contents of %s: %w", r.name, err)
+			}
+			r.offset += r.remaining
+			r.remaining = 0
+		} else if _, err := io.Copy(io.Discard, r); err != nil {
+			return errors.Errorf("skipping contents of %s: %w", r.name, err)
+		}
+	}
+	return r.skipPadding()
+}
+
+// skipPadding aligns newc and crc archives to 4 bytes
+func (r *Reader) skipPadding() error {
+	if r.format == FormatODC {
+		return nil
+	}
+	var pad [3]byte
+	return r.readFull(pad[:(4-r.offset%4)%4])
+}
+
+func (r *Reader) readFull(p []byte) error {
+	n, err := io.ReadFull(r.r, p)
+	r.offset += int64(n)
+	return err
+}
+
+func (r *Reader) readNewcHeader() (*Header, int64, error) {
+	var raw [104]byte
+	if err := r.readFull(raw[:]); err != nil {
+		return nil, 0, err
+	}
+
+	var fields [13]uint64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[i*8:i*8+8]), 16, 32)
+		if err != nil {
+			return nil, 0, errors.Errorf("field %d: %w", i, err)
+		}
+		fields[i] = v
+	}
+
+	r.checksum = uint32(fields[12])
+
+	return &Header{
+		Inode:     int64(fields[0]),
+		Mode:      FileMode(uint32(fields[1])),
+		Uid:       int(fields[2]),
+		Gid:       int(fields[3]),
+		Links:     int(fields[4]),
+		ModTime:   time.Unix(int64(fields[5]), 0),
+		Size:      int64(fields[6]),
+		DevMajor:  uint32(fields[7]),
+		DevMinor:  uint32(fields[8]),
+		RdevMajor: uint32(fields[9]),
+		RdevMinor: uint32(fields[10]),
+		Checksum:  uint32(fields[12]),
+	}, int64(fields[11]), nil
+}
+
+func (r *Reader) readODCHeader() (*Header, int64, error) {
+	var raw [70]byte
+	if err := r.readFull(raw[:]); err != nil {
+		return nil, 0, err
+	}
+
+	widths := []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+	fields := make([]uint64, len(widths))
+	pos := 0
+	for i, width := range widths {
+		v, err := strconv.ParseUint(string(raw[pos:pos+width]), 8, 64)
+		if err != nil {
+			return nil, 0, errors.Errorf("field %d: %w", i, err)
+		}
+		fields[i] = v
+		pos += width
+	}
+
+	devMajor, devMinor := splitdev(fields[0])
+	rdevMajor, rdevMinor := splitdev(fields[6])
+
+	return &Header{
+		DevMajor:  devMajor,
+		DevMinor:  devMinor,
+		Inode:     int64(fields[1]),
+		Mode:      FileMode(uint32(fields[2])),
+		Uid:       int(fields[3]),
+		Gid:       int(fields[4]),
+		Links:     int(fields[5]),
+		RdevMajor: rdevMajor,
+		RdevMinor: rdevMinor,
+		ModTime:   time.Unix(int64(fields[7]), 0),
+		Size:      int64(fields[9]),
+	}, int64(fields[8]), nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package cpio
+
+import "io/fs"
+
+func statHeader(fi fs.FileInfo, hdr *Header) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package cpio
+
+import (
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// statHeader fills the owner, link count and device numbers of hdr from a host file and returns its
+// device and inode
+func statHeader(fi fs.FileInfo, hdr *Header) (dev, ino uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	hdr.Uid = int(st.Uid)
+	hdr.Gid = int(st.Gid)
+	hdr.Links = int(st.Nlink)
+	if hdr.Mode&fs.ModeDevice != 0 {
+		hdr.RdevMajor = unix.Major(uint64(st.Rdev))
+		hdr.RdevMinor = unix.Minor(uint64(st.Rdev))
+	}
+
+	return uint64(st.Dev), uint64(st.Ino), true
+}
@@ -0,0 +1,201 @@
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// Writer writes a cpio archive. the contents of a regular file are written with Write after its header.
+// newc and crc headers use the upper case hex of gen_init_cpio, so the same entries produce the same bytes.
+type Writer struct {
+	w         io.Writer
+	format    Format
+	written   int64
+	remaining int64
+	sum       uint32
+	checksum  uint32
+	name      string
+	nextInode int64
+	closed    bool
+}
+
+// NewWriter returns a Writer writing a newc archive to w
+func NewWriter(w io.Writer) *Writer {
+	return NewFormatWriter(w, FormatNewc)
+}
+
+// NewFormatWriter returns a Writer writing an archive of the given format to w. FormatCRC headers must
+// carry the Checksum of their contents, which is verified as they are written.
+func NewFormatWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: w, format: format, nextInode: 1}
+}
+
+// WriteHeader finishes the previous entry and writes hdr
+func (w *Writer) WriteHeader(hdr *Header) error {
+	if w.closed {
+		return errors.Errorf("writing header for %s: archive is closed", hdr.Name)
+	}
+	if err := w.finishEntry(); err != nil {
+		return err
+	}
+
+	h := *hdr
+	if h.Mode&fs.ModeSymlink != 0 {
+		h.Size = int64(len(h.Linkname))
+	} else if !h.Mode.IsRegular() && h.Size != 0 {
+		return errors.Errorf("writing header for %s: only regular files and symlinks have contents", h.Name)
+	}
+
+	if h.Inode == 0 {
+		h.Inode = w.nextInode
+		w.nextInode++
+	} else if h.Inode >= w.nextInode {
+		w.nextInode = h.Inode + 1
+	}
+
+	if h.Links == 0 {
+		h.Links = 1
+		if h.Mode.IsDir() {
+			h.Links = 2
+		}
+	}
+
+	if w.format == FormatCRC && h.Mode&fs.ModeSymlink != 0 {
+		h.Checksum = byteSum([]byte(h.Linkname))
+	}
+
+	if err := w.writeHeader(&h); err != nil {
+		return errors.Errorf("writing header for %s: %w", h.Name, err)
+	}
+
+	w.name = h.Name
+	w.remaining = h.Size
+	w.sum = 0
+	w.checksum = h.Checksum
+
+	if h.Mode&fs.ModeSymlink != 0 {
+		if _, err := w.Write([]byte(h.Linkname)); err != nil {
+			return errors.Errorf("writing link target of %s: %w", h.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the contents of the current regular file
+func (w *Writer) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		return 0, errors.Errorf("writing %d bytes: only %d left in %s", len(p), w.remaining, w.name)
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	w.remaining -= int64(n)
+	if w.format == FormatCRC {
+		w.sum += byteSum(p[:n])
+	}
+	return n, err
+}
+
+// Close writes the trailer and pads the archive to 512 bytes, like gen_init_cpio. it does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.finishEntry(); err != nil {
+		return err
+	}
+	if err := w.writeHeader(&Header{Name: trailerName, Links: 1}); err != nil {
+		return errors.Errorf("writing trailer: %w", err)
+	}
+	w.closed = true
+	return w.pad(512)
+}
+
+func (w *Writer) finishEntry() error {
+	if w.remaining != 0 {
+		return errors.Errorf("%s is missing %d bytes of contents", w.name, w.remaining)
+	}
+	if w.format == FormatCRC && w.sum != w.checksum {
+		return errors.Errorf("%s: contents sum to %08x, the header has %08x", w.name, w.sum, w.checksum)
+	}
+	w.sum, w.checksum = 0, 0
+	return w.padEntry()
+}
+
+func (w *Writer) writeHeader(h *Header) error {
+	mtime := int64(0)
+	if !h.ModTime.IsZero() {
+		mtime = h.ModTime.Unix()
+	}
+
+	// the trailer has no type, like the one of gen_init_cpio
+	mode := UnixMode(h.Mode)
+	if h.Name == trailerName {
+		mode = 0
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if w.format == FormatODC {
+		fields := []uint64{
+			makedev(h.DevMajor, h.DevMinor), uint64(h.Inode), uint64(mode), uint64(h.Uid),
+			uint64(h.Gid), uint64(h.Links), makedev(h.RdevMajor, h.RdevMinor),
+		}
+		for i, v := range fields {
+			if v > 0o777777 {
+				return errors.Errorf("field %d: %d does not fit an odc header", i, v)
+			}
+		}
+		if uint64(mtime) > 0o77777777777 || uint64(h.Size) > 0o77777777777 || len(h.Name)+1 > 0o777777 {
+			return errors.Errorf("mtime, size or name does not fit an odc header")
+		}
+		n, err = fmt.Fprintf(w.w, "%s%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00",
+			magicODC, fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6],
+			mtime, len(h.Name)+1, h.Size, h.Name)
+	} else {
+		if h.Size > 0xffffffff || h.Inode > 0xffffffff || mtime < 0 || mtime > 0xffffffff {
+			return errors.Errorf("inode, mtime or size does not fit a %s header", w.format)
+		}
+		checksum := uint32(0)
+		if w.format == FormatCRC {
+			checksum = h.Checksum
+		}
+		n, err = fmt.Fprintf(w.w, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+			w.format.magic(), h.Inode, mode, h.Uid, h.Gid, h.Links, mtime, h.Size,
+			h.DevMajor, h.DevMinor, h.RdevMajor, h.RdevMinor, len(h.Name)+1, checksum, h.Name)
+	}
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.padEntry()
+}
+
+// padEntry aligns newc and crc headers and contents to 4 bytes; odc is not padded
+func (w *Writer) padEntry() error {
+	if w.format == FormatODC {
+		return nil
+	}
+	return w.pad(4)
+}
+
+func (w *Writer) pad(align int64) error {
+	padding := (align - w.written%align) % align
+	n, err := w.w.Write(make([]byte, padding))
+	w.written += int64(n)
+	return err
+}
+
+func byteSum(p []byte) uint32 {
+	var sum uint32
+	for _, b := range p {
+		sum += uint32(b)
+	}
+	return sum
+}
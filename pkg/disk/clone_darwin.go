@@ -0,0 +1,16 @@
+//go:build darwin
+
+package disk
+
+import (
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones src into dst with clonefile (apfs)
+func reflink(src string, dst string) error {
+	if err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW); err != nil {
+		return errors.Errorf("clonefile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package disk
+
+import (
+	"os"
+
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones src into dst with FICLONE (btrfs, xfs, bcachefs)
+func reflink(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Errorf("opening source: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, filePerm)
+	if err != nil {
+		return errors.Errorf("creating destination: %w", err)
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		return errors.Errorf("FICLONE: %w", err)
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package disk
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+func reflink(src string, dst string) error {
+	return errors.Errorf("reflink not supported on this platform")
+}
@@ -0,0 +1,359 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+const (
+	basesDir   = "bases"
+	clonesDir  = "clones"
+	ownerFile  = "owner.json"
+	lockName   = ".lock"
+	rawSuffix  = ".raw"
+	tempSuffix = ".tmp"
+
+	dirPerm  = 0755
+	filePerm = 0644
+)
+
+// Manager owns shared base images and the per-VM writable clones derived from them.
+//
+//	<root>/bases/<key>.raw          imported base images (qcow2 converted to raw)
+//	<root>/clones/<owner>/<name>.raw per-VM clones
+//	<root>/clones/<owner>/owner.json who the clones belong to, used by GarbageCollect
+//	<root>/clones/.lock              held shared while cloning, exclusive while removing clones
+type Manager struct {
+	root string
+	mu   sync.RWMutex
+}
+
+// CloneOwner records which VM (and which host process) a set of clones belongs to
+type CloneOwner struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Clone is a writable per-VM copy of a base image
+type Clone struct {
+	Path      string
+	Base      string
+	Reflinked bool
+}
+
+func NewManager(root string) *Manager {
+	return &Manager{
+		root: root,
+	}
+}
+
+// NewDefaultManager creates a manager rooted in the ec1 host cache directory
+func NewDefaultManager() (*Manager, error) {
+	prefix, err := host.CacheDirPrefix()
+	if err != nil {
+		return nil, errors.Errorf("getting cache dir prefix: %w", err)
+	}
+	return NewManager(filepath.Join(prefix, "disks")), nil
+}
+
+func (m *Manager) Root() string {
+	return m.root
+}
+
+func (m *Manager) ownerDir(owner string) string {
+	return filepath.Join(m.root, clonesDir, owner)
+}
+
+// lockClones keeps GarbageCollect and Release from removing clones while they are created, in this process
+// and in others sharing the root. creating clones holds it shared, removing them exclusive.
+func (m *Manager) lockClones(exclusive bool) (func(), error) {
+	lockMu, unlockMu := m.mu.RLock, m.mu.RUnlock
+	if exclusive {
+		lockMu, unlockMu = m.mu.Lock, m.mu.Unlock
+	}
+	lockMu()
+
+	dir := filepath.Join(m.root, clonesDir)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		unlockMu()
+		return nil, errors.Errorf("creating clones dir: %w", err)
+	}
+
+	unlock, err := lockFile(filepath.Join(dir, lockName), exclusive)
+	if err != nil {
+		unlockMu()
+		return nil, errors.Errorf("locking clones: %w", err)
+	}
+
+	return func() {
+		unlock()
+		unlockMu()
+	}, nil
+}
+
+// Clone creates a writable copy of base for owner. it uses a reflink when the filesystem supports it
+// (FICLONE on linux, clonefile on darwin) so the clone is instant and shares blocks with the base,
+// otherwise it falls back to a sparse copy that skips zeroed regions. an empty base creates an empty image,
+// which cloneAndResize grows to its size.
+func (m *Manager) Clone(ctx context.Context, base string, owner string, name string) (*Clone, error) {
+	if owner == "" || strings.ContainsAny(owner, `/\`) || name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, errors.Errorf("invalid clone owner %q or name %q", owner, name)
+	}
+
+	unlock, err := m.lockClones(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// the owner is recorded before any clone file exists, so garbage collection never sees clones without one
+	if err := m.registerOwner(owner); err != nil {
+		return nil, errors.Errorf("registering clone owner: %w", err)
+	}
+
+	dest := filepath.Join(m.ownerDir(owner), name+rawSuffix)
+	tmp := dest + tempSuffix
+
+	os.Remove(tmp)
+
+	start := time.Now()
+
+	if base == "" {
+		if err := os.WriteFile(tmp, nil, filePerm); err != nil {
+			return nil, errors.Errorf("creating empty image: %w", err)
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			os.Remove(tmp)
+			return nil, errors.Errorf("renaming empty image into place: %w", err)
+		}
+		return &Clone{Path: dest}, nil
+	}
+
+	reflinked := true
+	if err := reflink(base, tmp); err != nil {
+		slog.DebugContext(ctx, "reflink not available, falling back to sparse copy", "base", base, "error", err)
+		os.Remove(tmp)
+		reflinked = false
+		if err := sparseCopy(ctx, base, tmp); err != nil {
+			os.Remove(tmp)
+			return nil, errors.Errorf("copying base image: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return nil, errors.Errorf("renaming clone into place: %w", err)
+	}
+
+	slog.InfoContext(ctx, "cloned disk image",
+		"base", base,
+		"clone", dest,
+		"reflinked", reflinked,
+		"duration", time.Since(start))
+
+	return &Clone{
+		Path:      dest,
+		Base:      base,
+		Reflinked: reflinked,
+	}, nil
+}
+
+// Resize grows a raw image to size. raw images are sparse so growing is free; shrinking would destroy data
+// and is refused.
+func (m *Manager) Resize(ctx context.Context, path string, size strongunits.B) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.Errorf("statting image: %w", err)
+	}
+
+	if int64(size) < fi.Size() {
+		return errors.Errorf("refusing to shrink %s from %d to %d bytes", path, fi.Size(), size)
+	}
+
+	if int64(size) == fi.Size() {
+		return nil
+	}
+
+	if err := os.Truncate(path, int64(size)); err != nil {
+		return errors.Errorf("resizing image: %w", err)
+	}
+
+	slog.DebugContext(ctx, "resized disk image", "path", path, "from", fi.Size(), "to", int64(size))
+
+	return nil
+}
+
+// Release removes every clone that belongs to owner
+func (m *Manager) Release(ctx context.Context, owner string) error {
+	unlock, err := m.lockClones(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.RemoveAll(m.ownerDir(owner)); err != nil {
+		return errors.Errorf("removing clones for %s: %w", owner, err)
+	}
+
+	return nil
+}
+
+// GarbageCollect removes the clones of every owner for which alive returns false. when alive is nil the owner
+// is considered alive as long as the host process that created the clones is still running.
+func (m *Manager) GarbageCollect(ctx context.Context, alive func(CloneOwner) bool) ([]string, error) {
+	if alive == nil {
+		alive = ownerProcessAlive
+	}
+
+	// held across checking and removing, so no clone is created for an owner that is being collected
+	unlock, err := m.lockClones(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := os.ReadDir(filepath.Join(m.root, clonesDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading clones dir: %w", err)
+	}
+
+	removed := []string{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(m.root, clonesDir, entry.Name())
+
+		owner, err := readOwner(dir)
+		if err != nil {
+			slog.WarnContext(ctx, "clone dir without a readable owner, removing", "dir", dir, "error", err)
+		} else if alive(*owner) {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, errors.Errorf("removing orphaned clones %s: %w", dir, err)
+		}
+
+		removed = append(removed, entry.Name())
+	}
+
+	if len(removed) > 0 {
+		slog.InfoContext(ctx, "garbage collected orphaned disk clones", "owners", removed)
+	}
+
+	return removed, nil
+}
+
+// NewVirtioBlk clones base for owner, grows it to size (when non-zero) and returns a virtio-blk device for it.
+// an empty base gives a blank, sparse disk of size.
+func (m *Manager) NewVirtioBlk(ctx context.Context, base string, owner string, name string, size strongunits.B) (*virtio.VirtioBlk, error) {
+	clone, err := m.cloneAndResize(ctx, base, owner, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return virtio.VirtioBlkNew(clone.Path)
+}
+
+// NewNVMExpressController clones base for owner, grows it to size (when non-zero) and returns an nvme
+// controller for it
+func (m *Manager) NewNVMExpressController(ctx context.Context, base string, owner string, name string, size strongunits.B) (*virtio.NVMExpressController, error) {
+	clone, err := m.cloneAndResize(ctx, base, owner, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return virtio.NVMExpressControllerNew(clone.Path)
+}
+
+func (m *Manager) cloneAndResize(ctx context.Context, base string, owner string, name string, size strongunits.B) (*Clone, error) {
+	clone, err := m.Clone(ctx, base, owner, name)
+	if err != nil {
+		return nil, errors.Errorf("cloning %s: %w", base, err)
+	}
+
+	if size > 0 {
+		if err := m.Resize(ctx, clone.Path, size); err != nil {
+			return nil, errors.Errorf("resizing clone: %w", err)
+		}
+	}
+
+	return clone, nil
+}
+
+// registerOwner records this process as the owner of the clones in its dir. the caller holds the clones lock.
+// the record is rewritten every time, so clones left by a dead process under the same owner are not
+// collected while they are used again, and it is renamed into place so it is never seen half written.
+func (m *Manager) registerOwner(owner string) error {
+	dir := m.ownerDir(owner)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return errors.Errorf("creating clone dir: %w", err)
+	}
+
+	data, err := json.Marshal(CloneOwner{
+		ID:        owner,
+		PID:       os.Getpid(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return errors.Errorf("marshalling owner: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ownerFile+".*"+tempSuffix)
+	if err != nil {
+		return errors.Errorf("creating owner file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return errors.Errorf("writing owner file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("closing owner file: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ownerFile))
+}
+
+func readOwner(dir string) (*CloneOwner, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ownerFile))
+	if err != nil {
+		return nil, errors.Errorf("reading owner: %w", err)
+	}
+
+	var owner CloneOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return nil, errors.Errorf("unmarshalling owner: %w", err)
+	}
+
+	return &owner, nil
+}
+
+func ownerProcessAlive(owner CloneOwner) bool {
+	if owner.PID <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(owner.PID)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
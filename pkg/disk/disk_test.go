@@ -0,0 +1,172 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBaseImage(t *testing.T, dir string) (string, []byte) {
+	t.Helper()
+
+	data := make([]byte, 3*sparseChunkSize+512)
+	copy(data[10:], []byte("boot sector"))
+	copy(data[2*sparseChunkSize+100:], []byte("filesystem data"))
+
+	path := filepath.Join(dir, "base.raw")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	return path, data
+}
+
+func TestCloneResizeRelease(t *testing.T) {
+	ctx := context.Background()
+	base, data := writeBaseImage(t, t.TempDir())
+
+	mgr := NewManager(t.TempDir())
+
+	clone, err := mgr.Clone(ctx, base, "vm-1", "root")
+	require.NoError(t, err)
+	assert.Equal(t, base, clone.Base)
+
+	got, err := os.ReadFile(clone.Path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "clone content differs from base")
+
+	// writes to the clone must not leak into the base
+	require.NoError(t, os.WriteFile(clone.Path, []byte("changed"), 0644))
+	got, err = os.ReadFile(base)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "base was modified through the clone")
+
+	require.NoError(t, mgr.Resize(ctx, clone.Path, strongunits.MiB(8).ToBytes()))
+	fi, err := os.Stat(clone.Path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), fi.Size())
+
+	assert.Error(t, mgr.Resize(ctx, clone.Path, strongunits.MiB(1).ToBytes()))
+
+	_, err = mgr.Clone(ctx, base, "../escape", "root")
+	assert.Error(t, err)
+
+	require.NoError(t, mgr.Release(ctx, "vm-1"))
+	_, err = os.Stat(clone.Path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSparseCopy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	base, data := writeBaseImage(t, dir)
+
+	dst := filepath.Join(dir, "copy.raw")
+	require.NoError(t, sparseCopy(ctx, base, dst))
+
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "sparse copy content differs from source")
+}
+
+func TestGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	base, _ := writeBaseImage(t, t.TempDir())
+
+	mgr := NewManager(t.TempDir())
+
+	_, err := mgr.Clone(ctx, base, "alive", "root")
+	require.NoError(t, err)
+	_, err = mgr.Clone(ctx, base, "dead", "root")
+	require.NoError(t, err)
+
+	removed, err := mgr.GarbageCollect(ctx, func(owner CloneOwner) bool {
+		return owner.ID == "alive"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dead"}, removed)
+
+	// the owner was registered by this process, so the default liveness check keeps it
+	removed, err = mgr.GarbageCollect(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	_, err = os.Stat(filepath.Join(mgr.Root(), clonesDir, "alive"))
+	assert.NoError(t, err)
+}
+
+func TestNewVirtioBlk(t *testing.T) {
+	ctx := context.Background()
+	base, _ := writeBaseImage(t, t.TempDir())
+
+	mgr := NewManager(t.TempDir())
+
+	blk, err := mgr.NewVirtioBlk(ctx, base, "vm-1", "data", strongunits.MiB(16).ToBytes())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(mgr.Root(), clonesDir, "vm-1", "data.raw"), blk.ImagePath)
+
+	fi, err := os.Stat(blk.ImagePath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16<<20), fi.Size())
+}
+
+func TestGarbageCollectWaitsForClones(t *testing.T) {
+	ctx := context.Background()
+	base, _ := writeBaseImage(t, t.TempDir())
+
+	mgr := NewManager(t.TempDir())
+
+	// a clone being created holds the clones lock, so collection waits for it instead of removing its dir
+	unlock, err := mgr.lockClones(false)
+	require.NoError(t, err)
+	require.NoError(t, mgr.registerOwner("vm-1"))
+
+	collected := make(chan []string)
+	go func() {
+		removed, err := mgr.GarbageCollect(ctx, func(CloneOwner) bool { return false })
+		assert.NoError(t, err)
+		collected <- removed
+	}()
+
+	select {
+	case <-collected:
+		t.Fatal("garbage collection ran while a clone was created")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	owner, err := readOwner(mgr.ownerDir("vm-1"))
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), owner.PID)
+	unlock()
+	assert.Equal(t, []string{"vm-1"}, <-collected)
+
+	// clones left by a dead process under the same owner are claimed again
+	require.NoError(t, os.MkdirAll(mgr.ownerDir("vm-2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(mgr.ownerDir("vm-2"), ownerFile), []byte(`{"id":"vm-2","pid":-1}`), 0644))
+	_, err = mgr.Clone(ctx, base, "vm-2", "root")
+	require.NoError(t, err)
+
+	removed, err := mgr.GarbageCollect(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+func TestNewVirtioBlkWithoutBase(t *testing.T) {
+	ctx := context.Background()
+	mgr := NewManager(t.TempDir())
+
+	blk, err := mgr.NewVirtioBlk(ctx, "", "vm-1", "scratch", strongunits.MiB(8).ToBytes())
+	require.NoError(t, err)
+
+	fi, err := os.Stat(blk.ImagePath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), fi.Size())
+
+	require.NoError(t, mgr.Release(ctx, "vm-1"))
+	assert.NoFileExists(t, blk.ImagePath)
+}
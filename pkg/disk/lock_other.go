@@ -0,0 +1,8 @@
+//go:build !unix
+
+package disk
+
+// lockFile is a no-op without flock; the manager's mutex still orders clones and collection in this process
+func lockFile(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,112 @@
+package disk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lima-vm/go-qcow2reader"
+	"github.com/lima-vm/go-qcow2reader/convert"
+	"github.com/lima-vm/go-qcow2reader/image/qcow2"
+	"gitlab.com/tozd/go/errors"
+)
+
+// ImportQcow2 converts a qcow2 image into a sparse raw base image and returns its path. the result is keyed
+// by the source path, size and modification time, so importing the same file twice is a no-op.
+func (m *Manager) ImportQcow2(ctx context.Context, qcow2Path string) (string, error) {
+	abs, err := filepath.Abs(qcow2Path)
+	if err != nil {
+		return "", errors.Errorf("resolving qcow2 path: %w", err)
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", errors.Errorf("statting qcow2 image: %w", err)
+	}
+
+	dest := filepath.Join(m.root, basesDir, baseImageKey(abs, fi)+rawSuffix)
+
+	if _, err := os.Stat(dest); err == nil {
+		slog.DebugContext(ctx, "qcow2 image already imported", "qcow2", abs, "raw", dest)
+		return dest, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), dirPerm); err != nil {
+		return "", errors.Errorf("creating bases dir: %w", err)
+	}
+
+	src, err := os.Open(abs)
+	if err != nil {
+		return "", errors.Errorf("opening qcow2 image: %w", err)
+	}
+	defer src.Close()
+
+	img, err := qcow2reader.Open(src)
+	if err != nil {
+		return "", errors.Errorf("opening qcow2 image: %w", err)
+	}
+	defer img.Close()
+
+	// the reader opens any format it knows, raw included
+	if img.Type() != qcow2.Type {
+		return "", errors.Errorf("opening qcow2 image: %s is a %s image", abs, img.Type())
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*"+tempSuffix)
+	if err != nil {
+		return "", errors.Errorf("creating temp raw image: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+
+	// the converter only writes allocated clusters, so size the file first and leave the holes sparse
+	if err := tmp.Truncate(img.Size()); err != nil {
+		return "", errors.Errorf("sizing raw image: %w", err)
+	}
+
+	if err := convert.Convert(tmp, img, convert.Options{}); err != nil {
+		return "", errors.Errorf("converting qcow2 to raw: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return "", errors.Errorf("syncing raw image: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", errors.Errorf("closing raw image: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", errors.Errorf("renaming raw image into place: %w", err)
+	}
+
+	slog.InfoContext(ctx, "imported qcow2 image",
+		"qcow2", abs,
+		"raw", dest,
+		"virtual_size", img.Size(),
+		"duration", time.Since(start))
+
+	return dest, nil
+}
+
+// ImportImage returns a raw base image for path, converting it first when it is a qcow2 image
+func (m *Manager) ImportImage(ctx context.Context, path string) (string, error) {
+	if strings.HasSuffix(path, ".qcow2") {
+		return m.ImportQcow2(ctx, path)
+	}
+	return path, nil
+}
+
+func baseImageKey(abs string, fi os.FileInfo) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", abs, fi.Size(), fi.ModTime().UnixNano())))
+	name := strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+	return name + "-" + hex.EncodeToString(h[:8])
+}
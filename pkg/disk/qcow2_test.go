@@ -0,0 +1,96 @@
+package disk
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClusterBits = 16
+
+// writeQcow2 writes data as a version 2 qcow2 image with one L2 table, allocating only the clusters that
+// are not all zero
+func writeQcow2(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	const cluster = 1 << testClusterBits
+	const (
+		l1Offset = 1 * cluster
+		l2Offset = 2 * cluster
+		dataAt   = 3 * cluster
+		copied   = uint64(1) << 63
+	)
+
+	clusters := (len(data) + cluster - 1) / cluster
+	require.LessOrEqual(t, clusters, cluster/8, "one L2 table")
+
+	header := make([]byte, 72)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[20:], testClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(len(data)))
+	binary.BigEndian.PutUint32(header[36:], 1)
+	binary.BigEndian.PutUint64(header[40:], l1Offset)
+
+	out := make([]byte, dataAt)
+	copy(out, header)
+	binary.BigEndian.PutUint64(out[l1Offset:], l2Offset|copied)
+
+	for i := 0; i < clusters; i++ {
+		chunk := data[i*cluster : min((i+1)*cluster, len(data))]
+		if isZero(chunk) {
+			continue
+		}
+		binary.BigEndian.PutUint64(out[l2Offset+8*i:], uint64(len(out))|copied)
+		padded := make([]byte, cluster)
+		copy(padded, chunk)
+		out = append(out, padded...)
+	}
+
+	require.NoError(t, os.WriteFile(path, out, 0644))
+}
+
+func TestImportQcow2(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager(t.TempDir())
+
+	data := make([]byte, 3<<testClusterBits+4096)
+	copy(data[10:], "boot sector")
+	copy(data[2<<testClusterBits+100:], "filesystem data")
+
+	qcow2 := filepath.Join(t.TempDir(), "image.qcow2")
+	writeQcow2(t, qcow2, data)
+
+	base, err := m.ImportImage(ctx, qcow2)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(m.Root(), basesDir), filepath.Dir(base))
+
+	raw, err := os.ReadFile(base)
+	require.NoError(t, err)
+	assert.Equal(t, data, raw)
+
+	again, err := m.ImportQcow2(ctx, qcow2)
+	require.NoError(t, err)
+	assert.Equal(t, base, again, "the import is reused")
+
+	clone, err := m.Clone(ctx, base, "vm-1", "rootfs")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(clone.Path, []byte("written by the vm"), 0644))
+
+	raw, err = os.ReadFile(base)
+	require.NoError(t, err)
+	assert.Equal(t, data, raw, "the base is not changed by its clones")
+
+	_, err = m.ImportQcow2(ctx, filepath.Join(t.TempDir(), "missing.qcow2"))
+	require.Error(t, err)
+
+	notQcow2 := filepath.Join(t.TempDir(), "raw.qcow2")
+	require.NoError(t, os.WriteFile(notQcow2, data, 0644))
+	_, err = m.ImportQcow2(ctx, notQcow2)
+	require.ErrorContains(t, err, "opening qcow2 image")
+}
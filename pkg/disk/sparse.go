@@ -0,0 +1,71 @@
+package disk
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const sparseChunkSize = 1 << 20
+
+// sparseCopy copies src to dst chunk by chunk, leaving all-zero chunks as holes in dst
+func sparseCopy(ctx context.Context, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Errorf("opening source: %w", err)
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return errors.Errorf("statting source: %w", err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, filePerm)
+	if err != nil {
+		return errors.Errorf("creating destination: %w", err)
+	}
+	defer out.Close()
+
+	buf := make([]byte, sparseChunkSize)
+	var off int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(in, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, werr := out.WriteAt(buf[:n], off); werr != nil {
+				return errors.Errorf("writing destination: %w", werr)
+			}
+		}
+		off += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("reading source: %w", err)
+		}
+	}
+
+	// trailing holes are never written, so set the final size explicitly
+	if err := out.Truncate(fi.Size()); err != nil {
+		return errors.Errorf("sizing destination: %w", err)
+	}
+
+	return out.Close()
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -18,4 +18,19 @@ const (
 	ContainerTimesyncFile = "/timesync"
 	ContainerReadyFile    = "/ready"
 	TempVirtioTag         = "temp"
+
+	// BindFileMountType marks a single-file bind mount of a file in a directory shared over virtiofs;
+	// the mount source is "<tag>/<file name>" and harpoond bind-mounts the file into place
+	BindFileMountType      = "harpoon-bind-file"
+	BindFileStagingAbsPath = "/mnt/bind-files"
+
+	// KernelModulesFile lists the absolute paths of the kernel modules injected into the initramfs, one
+	// per line in load order, for harpoond to load at boot
+	KernelModulesFile = "/etc/harpoon/modules"
+
+	// static tools the initramfs carries besides busybox: harpoond bind-mounts lshw into the container
+	// and formats scratch disks with mke2fs, and socat serves vsock in the guest
+	LshwPath   = "/hbin/lshw"
+	Mke2fsPath = "/bin/mke2fs"
+	SocatPath  = "/bin/socat"
 )
@@ -0,0 +1,39 @@
+package ec1init
+
+// RootfsMode selects how the container rootfs is handed to the guest
+type RootfsMode string
+
+const (
+	// RootfsModeVirtioFs shares the rootfs directory over virtiofs (the default)
+	RootfsModeVirtioFs RootfsMode = "virtiofs"
+	// RootfsModeBlock attaches an image of the rootfs as a read-only virtio-blk device
+	RootfsModeBlock RootfsMode = "block"
+)
+
+// RootfsScratch selects where the writable overlay layer on top of a block rootfs lives
+type RootfsScratch string
+
+const (
+	RootfsScratchTmpfs RootfsScratch = "tmpfs"
+	RootfsScratchDisk  RootfsScratch = "disk"
+)
+
+const (
+	RootfsModeAnnotation        = "ec1.harpoon.rootfs.mode"
+	RootfsScratchAnnotation     = "ec1.harpoon.rootfs.scratch"
+	RootfsScratchSizeAnnotation = "ec1.harpoon.rootfs.scratch-size"
+
+	// virtio-blk serials are limited to 20 bytes
+	RootfsImageBlockSerial   = "harpoon-rootfs"
+	RootfsScratchBlockSerial = "harpoon-scratch"
+
+	ContainerRootfsFile = "/container-rootfs.json"
+)
+
+// RootfsConfig is written by the host next to the container spec so harpoond knows how to mount the rootfs
+type RootfsConfig struct {
+	Mode    RootfsMode    `json:"mode"`
+	Scratch RootfsScratch `json:"scratch,omitempty"`
+	// Filesystem is the filesystem of the block rootfs image, ext4 when empty
+	Filesystem string `json:"filesystem,omitempty"`
+}
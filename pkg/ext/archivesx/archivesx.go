@@ -17,11 +17,18 @@ type Manipulator interface {
 func IdentifyAndDecompress(ctx context.Context, path string, reader io.Reader) (io.ReadCloser, bool, error) {
 	format, rdr, err := archives.Identify(ctx, path, reader)
 	if err != nil {
+		if errors.Is(err, archives.NoMatch) {
+			return iox.PreservedNopCloser(rdr), false, nil
+		}
 		return nil, false, errors.Errorf("identifying file %s: %w", path, err)
 	}
 
-	if err == archives.NoMatch {
-		return iox.PreservedNopCloser(rdr), false, nil
+	// a compressed tarball is identified as the combination, only the outer compression is removed
+	if ca, ok := format.(archives.CompressedArchive); ok {
+		if ca.Compression == nil {
+			return iox.PreservedNopCloser(rdr), false, nil
+		}
+		format = ca.Compression
 	}
 
 	if format, ok := format.(archives.Compression); ok {
@@ -32,6 +39,11 @@ func IdentifyAndDecompress(ctx context.Context, path string, reader io.Reader) (
 		return rdrz, true, nil
 	}
 
+	// an uncompressed archive (for example a plain tar) is passed through untouched
+	if _, ok := format.(archives.Archival); ok {
+		return iox.PreservedNopCloser(rdr), false, nil
+	}
+
 	return nil, false, errors.Errorf("unable to decompress format %T", format)
 }
 
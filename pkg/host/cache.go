@@ -25,17 +25,11 @@ func init() {
 }
 
 func CacheDirForURL(urld string) (string, error) {
-	hrlHasher := sha256.New()
-	hrlHasher.Write([]byte(urld))
-	hrlHash := hex.EncodeToString(hrlHasher.Sum(nil))
-
-	// parse the url and get the filename
-	parsedURL, err := url.Parse(urld)
+	dirname, err := urlDirName(urld)
 	if err != nil {
 		return "", err
 	}
 
-	dirname := fmt.Sprintf("%s_%s", parsedURL.Host, hrlHash[:16])
 	userCacheDir, err := CacheDirPrefix()
 	if err != nil {
 		return "", err
@@ -44,6 +38,21 @@ func CacheDirForURL(urld string) (string, error) {
 	return filepath.Join(userCacheDir, "downloads", dirname), nil
 }
 
+// urlDirName names the cache directory of a url after its host and hash
+func urlDirName(urld string) (string, error) {
+	hrlHasher := sha256.New()
+	hrlHasher.Write([]byte(urld))
+	hrlHash := hex.EncodeToString(hrlHasher.Sum(nil))
+
+	// parse the url and get the filename
+	parsedURL, err := url.Parse(urld)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s_%s", parsedURL.Host, hrlHash[:16]), nil
+}
+
 func CacheDirPrefix() (string, error) {
 	userCacheDir, err := os.UserCacheDir()
 	if err != nil {
@@ -60,6 +69,15 @@ func EmphiricalVMCacheDir(ctx context.Context, id string) (string, error) {
 	return filepath.Join(cacheDir, "vm", id), nil
 }
 
+// KernelModulesDir holds the kernel modules trees containers can inject into their vm
+func KernelModulesDir() (string, error) {
+	cacheDir, err := CacheDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "kernel-modules"), nil
+}
+
 func TempDir(ctx context.Context) string {
 	tmp, err := os.MkdirTemp(filepath.Join(os.TempDir(), "ec1"), "hostfs-*")
 	if err != nil {
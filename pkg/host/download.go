@@ -7,136 +7,49 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 
-	"github.com/cavaliergopher/grab/v3"
 	"github.com/lima-vm/go-qcow2reader"
 	"github.com/lima-vm/go-qcow2reader/convert"
 	"github.com/mholt/archives"
 	"gitlab.com/tozd/go/errors"
 )
 
+// DownloadAndExtractVMI downloads the files of a VM image by name, without digests to verify them
+// against, and opens them
 func DownloadAndExtractVMI(ctx context.Context, downloads map[string]string) (map[string]io.Reader, error) {
-
-	files := make(map[string]io.Reader)
-
-	group := sync.WaitGroup{}
-	errs := make(chan error)
-	mutex := sync.Mutex{}
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
+	dls := make([]VMIDownload, 0, len(downloads))
 	for name, url := range downloads {
-		group.Add(1)
-		go func() {
-			defer group.Done()
-			rdr, err := downloadAndExtractFileFromURL(ctx, name, url)
-			if err != nil {
-				errs <- errors.Errorf("downloading and extracting file %s: %w", name, err)
-				return
-			}
-			mutex.Lock()
-			files[name] = rdr
-			mutex.Unlock()
-		}()
-	}
-
-	go func() {
-		group.Wait()
-		close(errs)
-	}()
-
-	errout := []error{}
-	for err := range errs {
-		errout = append(errout, err)
-	}
-
-	if len(errout) > 0 {
-		return nil, errors.Errorf("errors: %w", errors.Join(errout...))
+		dls = append(dls, VMIDownload{Name: name, URL: url})
 	}
+	slices.SortFunc(dls, func(a, b VMIDownload) int { return strings.Compare(a.Name, b.Name) })
 
-	return files, nil
+	return (&Downloader{}).Open(ctx, dls)
 }
 
-func downloadAndExtractFileFromURL(ctx context.Context, name string, url string) (io.Reader, error) {
-
-	cacheDir, err := CacheDirForURL(url)
-	if err != nil {
-		return nil, errors.Errorf("getting cache dir for url: %w", err)
-	}
-
-	err = os.MkdirAll(cacheDir, 0755)
+// Open downloads every file like Download and opens them
+func (d *Downloader) Open(ctx context.Context, downloads []VMIDownload) (map[string]io.Reader, error) {
+	paths, err := d.Download(ctx, downloads)
 	if err != nil {
-		return nil, errors.Errorf("creating cache dir: %w", err)
+		return nil, err
 	}
 
-	extractedCachedZip := filepath.Join(cacheDir, name+".cached")
-
-	if _, err := os.Stat(extractedCachedZip); err != nil {
-
-		err = downloadURLToFile(ctx, url, extractedCachedZip)
+	files := make(map[string]io.Reader, len(paths))
+	for name, path := range paths {
+		f, err := os.Open(path)
 		if err != nil {
-			// os.Remove(tmpfile.Name())
-			return nil, errors.Errorf("downloading url to file: %w", err)
+			for _, opened := range files {
+				opened.(*os.File).Close()
+			}
+			return nil, errors.Errorf("opening file: %w", err)
 		}
-
-		// slog.InfoContext(ctx, "downloaded file", "url", url, "file", extractedCachedZip)
-
+		files[name] = f
 	}
 
-	rdrf, err := os.Open(extractedCachedZip)
-	if err != nil {
-		return nil, errors.Errorf("opening file: %w", err)
-	}
-
-	// z, err := (archives.Gz{}).OpenReader(rdrf)
-	// if err != nil {
-	// 	return nil, errors.Errorf("extracting archive: %w", err)
-	// }
-
-	return rdrf, nil
-
-	// if strings.HasSuffix(url, ".qcow2") {
-	// 	slog.InfoContext(ctx, "converting qcow2 to raw", "cacheFile", cacheFile)
-	// 	updatedCacheFile := strings.TrimSuffix(cacheFile, ".qcow2") + ".raw"
-	// 	outFile, err := os.Create(updatedCacheFile)
-	// 	if err != nil {
-	// 		return errors.Errorf("creating file: %w", err)
-	// 	}
-	// 	defer outFile.Close()
-	// 	qcow2File, err := os.Open(cacheFile)
-	// 	if err != nil {
-	// 		return errors.Errorf("opening file: %w", err)
-	// 	}
-	// 	defer qcow2File.Close()
-	// 	err = convertQcow2ToRaw(ctx, qcow2File, outFile)
-	// 	if err != nil {
-	// 		return errors.Errorf("converting qcow2 to raw: %w", err)
-	// 	}
-	// 	cacheFile = updatedCacheFile
-	// }
-
-	// if _, err := os.Stat(extractedCachedZip); err != nil {
-
-	// }
-
-	// if _, err := os.Stat(filepath.Join(outDir, ".extracted")); err != nil {
-	// 	err = extractIntoDir(ctx, extractedCachedZip, outDir)
-	// 	if err != nil {
-	// 		return errors.Errorf("extracting into dir: %w", err)
-	// 	}
-	// }
-
-	// err = prov.Initialize(ctx, outDir)
-	// if err != nil {
-	// 	return errors.Errorf("initializing os provider: %w", err)
-	// }
-
-	// slog.InfoContext(ctx, "OS provider initialized", "url", url, "cacheFile", cacheFile, "outDir", outDir)
-
-	// return nil
+	// qcow2 images are converted to raw bases (and cloned per VM) by disk.Manager.ImportQcow2
+
+	return files, nil
 }
 
 // func SaveDownloadedFilesToCache(ctx context.Context, tmpCacheDir string) error {
@@ -193,29 +106,6 @@ func downloadAndExtractFileFromURL(ctx context.Context, name string, url string)
 // 	return nil
 // }
 
-func downloadURLToFile(ctx context.Context, url string, file string) error {
-	slog.DebugContext(ctx, "downloading url to file", "url", url, "file", file)
-
-	// move the file to the cache
-	err := os.MkdirAll(filepath.Dir(file), 0755)
-	if err != nil {
-		return err
-	}
-
-	grab.DefaultClient.UserAgent = "ec1"
-	resp, err := grab.Get(filepath.Dir(file), url)
-	if err != nil {
-		return errors.Errorf("downloading url: %w", err)
-	}
-
-	err = os.Rename(resp.Filename, file)
-	if err != nil {
-		return errors.Errorf("renaming file: %w", err)
-	}
-
-	return nil
-}
-
 func getDirSize(dir string) (int64, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
@@ -0,0 +1,542 @@
+package host
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// cachedSuffix names a complete, verified download; recordSuffix the DownloadRecord next to it,
+	// partialSuffix the file a download is resumed into and lockSuffix the file locked while downloading
+	cachedSuffix  = ".cached"
+	recordSuffix  = ".json"
+	partialSuffix = ".partial"
+	lockSuffix    = ".lock"
+
+	DefaultDownloadConcurrency = 4
+	DefaultDownloadRetries     = 3
+	DefaultDownloadBackoff     = time.Second
+
+	downloadProgressInterval = 500 * time.Millisecond
+)
+
+var ErrDigestMismatch = errors.New("download digest mismatch")
+
+// transientError marks download failures another attempt may fix
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+func transient(err error) error { return &transientError{err: err} }
+
+func isTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// VMIDownload is a file of a VM image to download
+type VMIDownload struct {
+	// Name is the file name in the cache and the key of the result
+	Name string
+	URL  string
+	// Digest is the expected digest of the file. empty accepts any complete download and records its sha256
+	Digest digest.Digest
+}
+
+// DownloadRecord is stored next to every complete download. a cached file without one, or that does not
+// match it, is downloaded again.
+type DownloadRecord struct {
+	URL    string        `json:"url"`
+	Digest digest.Digest `json:"digest"`
+	ETag   string        `json:"etag,omitempty"`
+	// LastModified is the Last-Modified header of the response, used like ETag to resume downloads
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	Downloaded   time.Time `json:"downloaded"`
+}
+
+// DownloadEvent reports the progress of one file. the event with Done set ends it and carries its
+// Duration.
+type DownloadEvent struct {
+	Name string
+	URL  string
+	// BytesDone and BytesTotal count the bytes of the file, including those resumed from an earlier
+	// attempt; BytesTotal is -1 when the size is unknown
+	BytesDone  int64
+	BytesTotal int64
+	Attempt    int
+	// Cached reports a file served from the cache without downloading it
+	Cached   bool
+	Duration time.Duration
+	Done     bool
+}
+
+// DownloadProgressFunc receives download events. it is called from the download goroutines, so it must be
+// safe for concurrent use and should not block.
+type DownloadProgressFunc func(ctx context.Context, event DownloadEvent)
+
+// LogDownloadProgress is the DownloadProgressFunc used when none is set
+func LogDownloadProgress(ctx context.Context, event DownloadEvent) {
+	switch {
+	case event.Done:
+		slog.InfoContext(ctx, "download finished",
+			"name", event.Name,
+			"url", event.URL,
+			"bytes", event.BytesDone,
+			"cached", event.Cached,
+			"attempts", event.Attempt,
+			"duration", event.Duration)
+	default:
+		slog.DebugContext(ctx, "download progress",
+			"name", event.Name,
+			"bytes_done", event.BytesDone,
+			"bytes_total", event.BytesTotal,
+			"attempt", event.Attempt)
+	}
+}
+
+// Downloader fetches files into the download cache. downloads are resumed with range requests after
+// failures, verified against their digest and only then renamed into place.
+type Downloader struct {
+	// Dir is the cache root, with one directory per URL. empty uses the directories of CacheDirForURL
+	Dir string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Concurrency bounds the files downloaded at once, DefaultDownloadConcurrency when zero
+	Concurrency int
+	// Retries is how often a failed download is retried, DefaultDownloadRetries when zero; negative
+	// disables retries
+	Retries int
+	// Backoff is the wait before the first retry, doubled for every following one. DefaultDownloadBackoff
+	// when zero
+	Backoff time.Duration
+	// VerifyCached hashes cached files again before using them instead of trusting their record
+	VerifyCached bool
+	// Progress receives the events of every file. nil logs them through slog
+	Progress DownloadProgressFunc
+}
+
+// Download fetches every file, or takes it from the cache, and returns their paths by name
+func (d *Downloader) Download(ctx context.Context, downloads []VMIDownload) (map[string]string, error) {
+	paths := make(map[string]string, len(downloads))
+	results := make([]string, len(downloads))
+
+	for _, dl := range downloads {
+		if dl.Name == "" || strings.ContainsAny(dl.Name, `/\`) {
+			return nil, errors.Errorf("invalid download name %q", dl.Name)
+		}
+		if _, dup := paths[dl.Name]; dup {
+			return nil, errors.Errorf("duplicate download name %q", dl.Name)
+		}
+		paths[dl.Name] = ""
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(d.concurrency())
+
+	for i, dl := range downloads {
+		group.Go(func() error {
+			path, err := d.fetch(ctx, dl)
+			if err != nil {
+				return errors.Errorf("downloading %s from %s: %w", dl.Name, dl.URL, err)
+			}
+			results[i] = path
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	for i, dl := range downloads {
+		paths[dl.Name] = results[i]
+	}
+	return paths, nil
+}
+
+func (d *Downloader) concurrency() int {
+	if d.Concurrency > 0 {
+		return d.Concurrency
+	}
+	return DefaultDownloadConcurrency
+}
+
+func (d *Downloader) dirFor(url string) (string, error) {
+	if d.Dir == "" {
+		return CacheDirForURL(url)
+	}
+	name, err := urlDirName(url)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.Dir, name), nil
+}
+
+func (d *Downloader) progress(ctx context.Context, event DownloadEvent) {
+	if d.Progress != nil {
+		d.Progress(ctx, event)
+		return
+	}
+	LogDownloadProgress(ctx, event)
+}
+
+// fetch returns the cached file of dl, downloading it first when the cache has no valid copy. the file lock
+// keeps processes sharing the cache from writing the same partial file at once.
+func (d *Downloader) fetch(ctx context.Context, dl VMIDownload) (string, error) {
+	start := time.Now()
+
+	dir, err := d.dirFor(dl.URL)
+	if err != nil {
+		return "", errors.Errorf("getting cache dir for url: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Errorf("creating cache dir: %w", err)
+	}
+
+	path := filepath.Join(dir, dl.Name+cachedSuffix)
+
+	if record, err := d.cached(path, dl); err == nil {
+		d.progress(ctx, DownloadEvent{Name: dl.Name, URL: dl.URL, BytesDone: record.Size, BytesTotal: record.Size, Cached: true, Duration: time.Since(start), Done: true})
+		return path, nil
+	}
+
+	unlock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return "", errors.Errorf("locking %s: %w", path, err)
+	}
+	defer unlock()
+
+	// another process may have downloaded it while we waited for the lock
+	if record, err := d.cached(path, dl); err == nil {
+		d.progress(ctx, DownloadEvent{Name: dl.Name, URL: dl.URL, BytesDone: record.Size, BytesTotal: record.Size, Cached: true, Duration: time.Since(start), Done: true})
+		return path, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.WarnContext(ctx, "discarding cached download", "path", path, "error", err)
+	}
+	if err := os.Remove(path + recordSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", errors.Errorf("removing stale download record: %w", err)
+	}
+
+	retries := d.Retries
+	if retries == 0 {
+		retries = DefaultDownloadRetries
+	}
+	backoff := d.Backoff
+	if backoff == 0 {
+		backoff = DefaultDownloadBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		record, err := d.attempt(ctx, dl, path, attempt, start)
+		if err == nil {
+			d.progress(ctx, DownloadEvent{Name: dl.Name, URL: dl.URL, BytesDone: record.Size, BytesTotal: record.Size, Attempt: attempt, Duration: time.Since(start), Done: true})
+			return path, nil
+		}
+		if !isTransient(err) || attempt > retries {
+			return "", err
+		}
+
+		slog.WarnContext(ctx, "download failed, retrying", "name", dl.Name, "url", dl.URL, "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// cached returns the record of a complete download at path that matches dl
+func (d *Downloader) cached(path string, dl VMIDownload) (*DownloadRecord, error) {
+	record, err := readRecord(path + recordSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if record.URL != dl.URL {
+		return nil, errors.Errorf("cached from %s", record.URL)
+	}
+	if dl.Digest != "" && record.Digest != dl.Digest {
+		return nil, errors.Errorf("cached with digest %s, expected %s", record.Digest, dl.Digest)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != record.Size {
+		return nil, errors.Errorf("cached file has %d bytes, expected %d", fi.Size(), record.Size)
+	}
+
+	if d.VerifyCached {
+		if err := verifyFile(path, record.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// attempt downloads dl into its partial file, resuming what an earlier attempt left there, and renames it
+// into place once it is verified. fetch holds the file lock, so no other process writes the partial file.
+func (d *Downloader) attempt(ctx context.Context, dl VMIDownload, path string, attempt int, start time.Time) (*DownloadRecord, error) {
+	partial := path + partialSuffix
+
+	// the validators of the partial file, to only resume it from the same version of the file
+	resume, err := readRecord(partial + recordSuffix)
+	if err != nil || resume.URL != dl.URL {
+		resume = nil
+	}
+
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil && resume != nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.URL, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("User-Agent", "ec1")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if resume.ETag != "" {
+			req.Header.Set("If-Range", resume.ETag)
+		} else if resume.LastModified != "" {
+			req.Header.Set("If-Range", resume.LastModified)
+		}
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, transient(errors.Errorf("requesting: %w", err))
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		first, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || first != offset {
+			os.Remove(partial)
+			return nil, transient(errors.Errorf("unexpected content range %q", resp.Header.Get("Content-Range")))
+		}
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		// a fresh download, or the file changed since the partial one was started
+		offset = 0
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partial)
+		return nil, transient(errors.Errorf("%s resuming at %d bytes", resp.Status, offset))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, transient(errors.Errorf("unexpected response: %s", resp.Status))
+	default:
+		return nil, errors.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	record := &DownloadRecord{
+		URL:          dl.URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err := writeRecord(partial+recordSuffix, record); err != nil {
+		return nil, errors.Errorf("recording partial download: %w", err)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return nil, errors.Errorf("opening partial download: %w", err)
+	}
+	defer f.Close()
+
+	progress := &progressWriter{
+		ctx:   ctx,
+		d:     d,
+		event: DownloadEvent{Name: dl.Name, URL: dl.URL, BytesDone: offset, BytesTotal: total, Attempt: attempt},
+		start: start,
+	}
+	n, err := io.Copy(io.MultiWriter(f, progress), resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, transient(errors.Errorf("reading response after %d bytes: %w", offset+n, err))
+	}
+	if total >= 0 && offset+n != total {
+		return nil, transient(errors.Errorf("response ended after %d of %d bytes", offset+n, total))
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.Errorf("closing partial download: %w", err)
+	}
+
+	record.Size = offset + n
+	record.Digest, err = fileDigest(partial, dl.Digest.Algorithm())
+	if err != nil {
+		return nil, err
+	}
+	if dl.Digest != "" && record.Digest != dl.Digest {
+		// start over, the partial file may predate a change of the remote file
+		os.Remove(partial)
+		os.Remove(partial + recordSuffix)
+		err := errors.Errorf("%w: got %s, expected %s", ErrDigestMismatch, record.Digest, dl.Digest)
+		if offset > 0 {
+			return nil, transient(err)
+		}
+		return nil, err
+	}
+
+	// without a record the file is downloaded again, so it is written last
+	record.Downloaded = time.Now()
+	if err := os.Rename(partial, path); err != nil {
+		return nil, errors.Errorf("renaming download into place: %w", err)
+	}
+	if err := writeRecord(path+recordSuffix, record); err != nil {
+		return nil, errors.Errorf("recording download: %w", err)
+	}
+	os.Remove(partial + recordSuffix)
+
+	return record, nil
+}
+
+// progressWriter reports the bytes written through it at most every downloadProgressInterval
+type progressWriter struct {
+	ctx   context.Context
+	d     *Downloader
+	event DownloadEvent
+	start time.Time
+	last  time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.event.BytesDone += int64(len(p))
+	if now := time.Now(); now.Sub(w.last) >= downloadProgressInterval {
+		w.last = now
+		w.event.Duration = now.Sub(w.start)
+		w.d.progress(w.ctx, w.event)
+	}
+	return len(p), nil
+}
+
+// parseContentRange returns the first byte and the complete size of a "bytes start-end/size" header,
+// with a size of -1 when it is "*"
+func parseContentRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+func fileDigest(path string, algorithm digest.Algorithm) (digest.Digest, error) {
+	if algorithm == "" {
+		algorithm = digest.Canonical
+	}
+	if !algorithm.Available() {
+		return "", errors.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Errorf("opening download: %w", err)
+	}
+	defer f.Close()
+
+	dgst, err := algorithm.FromReader(f)
+	if err != nil {
+		return "", errors.Errorf("hashing download: %w", err)
+	}
+	return dgst, nil
+}
+
+func verifyFile(path string, want digest.Digest) error {
+	got, err := fileDigest(path, want.Algorithm())
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return errors.Errorf("%w: %s has %s, expected %s", ErrDigestMismatch, path, got, want)
+	}
+	return nil
+}
+
+func readRecord(path string) (*DownloadRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record DownloadRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Errorf("parsing %s: %w", path, err)
+	}
+	return &record, nil
+}
+
+func writeRecord(path string, record *DownloadRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,323 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// imageServer serves random files with ETags and range support, optionally failing requests first
+type imageServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	requests map[string][]*http.Request
+	// fail is called before serving, and handles the request itself when it returns true
+	fail func(w http.ResponseWriter, r *http.Request, n int) bool
+
+	inflight    atomic.Int32
+	maxInflight atomic.Int32
+	delay       time.Duration
+}
+
+func newImageServer(t *testing.T, names ...string) *imageServer {
+	rng := rand.New(rand.NewPCG(uint64(len(names)), 48))
+
+	s := &imageServer{files: map[string][]byte{}, requests: map[string][]*http.Request{}}
+	for _, name := range names {
+		data := make([]byte, 256<<10)
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		s.files["/"+name] = data
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+		for {
+			peak := s.maxInflight.Load()
+			if n <= peak || s.maxInflight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(s.delay)
+
+		s.mu.Lock()
+		s.requests[r.URL.Path] = append(s.requests[r.URL.Path], r.Clone(context.Background()))
+		count := len(s.requests[r.URL.Path])
+		data, ok := s.files[r.URL.Path]
+		s.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if s.fail != nil && s.fail(w, r, count) {
+			return
+		}
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, digest.FromBytes(data).Encoded()[:16]))
+		http.ServeContent(w, r, r.URL.Path, time.Unix(0, 0), bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *imageServer) download(name string) VMIDownload {
+	return VMIDownload{Name: name, URL: s.URL + "/" + name, Digest: digest.FromBytes(s.files["/"+name])}
+}
+
+func (s *imageServer) requestCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests["/"+name])
+}
+
+func testDownloader(t *testing.T) *Downloader {
+	return &Downloader{Dir: t.TempDir(), Backoff: time.Millisecond}
+}
+
+func TestDownloaderVerifiesAndCaches(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "disk.qcow2", "vmlinuz")
+	d := testDownloader(t)
+
+	var events []DownloadEvent
+	var mu sync.Mutex
+	d.Progress = func(ctx context.Context, event DownloadEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	downloads := []VMIDownload{srv.download("disk.qcow2"), srv.download("vmlinuz")}
+	paths, err := d.Download(ctx, downloads)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	for _, dl := range downloads {
+		data, err := os.ReadFile(paths[dl.Name])
+		require.NoError(t, err)
+		assert.Equal(t, srv.files["/"+dl.Name], data)
+
+		record, err := readRecord(paths[dl.Name] + recordSuffix)
+		require.NoError(t, err)
+		assert.Equal(t, dl.URL, record.URL)
+		assert.Equal(t, dl.Digest, record.Digest)
+		assert.Equal(t, int64(len(data)), record.Size)
+		assert.NotEmpty(t, record.ETag)
+	}
+
+	done := 0
+	for _, event := range events {
+		if event.Done {
+			done++
+			assert.False(t, event.Cached)
+			assert.Equal(t, event.BytesTotal, event.BytesDone)
+		}
+	}
+	assert.Equal(t, 2, done)
+
+	events = nil
+	again, err := d.Download(ctx, downloads)
+	require.NoError(t, err)
+	assert.Equal(t, paths, again)
+	assert.Equal(t, 1, srv.requestCount("vmlinuz"), "the second download is served from the cache")
+	require.Len(t, events, 2)
+	assert.True(t, events[0].Cached)
+}
+
+func TestDownloaderResumesInterruptedDownloads(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "disk.raw")
+	srv.fail = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		if n > 1 {
+			return false
+		}
+		// send half of the file, then drop the connection
+		data := srv.files[r.URL.Path]
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, digest.FromBytes(data).Encoded()[:16]))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	d := testDownloader(t)
+	paths, err := d.Download(ctx, []VMIDownload{srv.download("disk.raw")})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(paths["disk.raw"])
+	require.NoError(t, err)
+	assert.Equal(t, srv.files["/disk.raw"], data)
+
+	require.Equal(t, 2, srv.requestCount("disk.raw"))
+	resumed := srv.requests["/disk.raw"][1]
+	assert.Equal(t, fmt.Sprintf("bytes=%d-", len(data)/2), resumed.Header.Get("Range"))
+	assert.NotEmpty(t, resumed.Header.Get("If-Range"))
+
+	_, err = os.Stat(paths["disk.raw"] + partialSuffix)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDownloaderRejectsDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "disk.raw")
+	d := testDownloader(t)
+
+	dl := srv.download("disk.raw")
+	dl.Digest = digest.FromString("something else")
+
+	_, err := d.Download(ctx, []VMIDownload{dl})
+	require.ErrorIs(t, err, ErrDigestMismatch)
+	assert.Equal(t, 1, srv.requestCount("disk.raw"), "a complete download with the wrong digest is not retried")
+
+	// the lock file stays, removing it would let another process lock a file nobody else opens
+	entries, err := filepath.Glob(filepath.Join(d.Dir, "*", "*"))
+	require.NoError(t, err)
+	entries = slices.DeleteFunc(entries, func(e string) bool { return strings.HasSuffix(e, lockSuffix) })
+	assert.Empty(t, entries, "nothing is left in the cache")
+}
+
+func TestDownloaderReplacesCorruptCache(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "disk.raw", "legacy.raw")
+	d := testDownloader(t)
+
+	paths, err := d.Download(ctx, []VMIDownload{srv.download("disk.raw")})
+	require.NoError(t, err)
+
+	// truncated after the download, and a file cached before records existed
+	require.NoError(t, os.Truncate(paths["disk.raw"], 1000))
+	dir, err := d.dirFor(srv.URL + "/legacy.raw")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.raw"+cachedSuffix), []byte("truncated"), 0644))
+
+	paths, err = d.Download(ctx, []VMIDownload{srv.download("disk.raw"), srv.download("legacy.raw")})
+	require.NoError(t, err)
+
+	for name, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, srv.files["/"+name], data, name)
+	}
+	assert.Equal(t, 2, srv.requestCount("disk.raw"))
+
+	// with VerifyCached a file corrupted in place is caught too
+	f, err := os.OpenFile(paths["disk.raw"], os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("corrupt"), 10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	d.VerifyCached = true
+	_, err = d.Download(ctx, []VMIDownload{srv.download("disk.raw")})
+	require.NoError(t, err)
+	assert.Equal(t, 3, srv.requestCount("disk.raw"))
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "flaky.raw", "missing.raw")
+	srv.fail = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		if r.URL.Path == "/missing.raw" {
+			http.Error(w, "gone", http.StatusForbidden)
+			return true
+		}
+		if n <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	}
+	d := testDownloader(t)
+
+	_, err := d.Download(ctx, []VMIDownload{srv.download("flaky.raw")})
+	require.NoError(t, err)
+	assert.Equal(t, 3, srv.requestCount("flaky.raw"))
+
+	_, err = d.Download(ctx, []VMIDownload{srv.download("missing.raw")})
+	require.ErrorContains(t, err, "403 Forbidden")
+	assert.Equal(t, 1, srv.requestCount("missing.raw"), "client errors are not retried")
+
+	d.Retries = -1
+	srv.files["/flaky2.raw"] = []byte("data")
+	srv.fail = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return true
+	}
+	_, err = d.Download(ctx, []VMIDownload{{Name: "flaky2.raw", URL: srv.URL + "/flaky2.raw"}})
+	require.ErrorContains(t, err, "503 Service Unavailable")
+	assert.Equal(t, 1, srv.requestCount("flaky2.raw"))
+}
+
+func TestDownloaderBoundsConcurrency(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	srv := newImageServer(t, names...)
+	srv.delay = 20 * time.Millisecond
+
+	d := testDownloader(t)
+	d.Concurrency = 2
+
+	downloads := []VMIDownload{}
+	for _, name := range names {
+		downloads = append(downloads, srv.download(name))
+	}
+
+	paths, err := d.Download(ctx, downloads)
+	require.NoError(t, err)
+	assert.Len(t, paths, len(names))
+	assert.LessOrEqual(t, srv.maxInflight.Load(), int32(2))
+	assert.Equal(t, int32(2), srv.maxInflight.Load(), "downloads run in parallel up to the limit")
+}
+
+func TestDownloaderSharesACacheAcrossDownloaders(t *testing.T) {
+	ctx := context.Background()
+	srv := newImageServer(t, "disk.raw")
+	srv.delay = 20 * time.Millisecond
+	dir := t.TempDir()
+
+	// downloaders of their own stand in for processes sharing the cache, each opens the lock file itself
+	var wg sync.WaitGroup
+	paths := make([]string, 4)
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := &Downloader{Dir: dir, Backoff: time.Millisecond}
+			got, err := d.Download(ctx, []VMIDownload{srv.download("disk.raw")})
+			if assert.NoError(t, err) {
+				paths[i] = got["disk.raw"]
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, srv.requestCount("disk.raw"), "the others wait for the first download and take it from the cache")
+	for _, path := range paths {
+		assert.Equal(t, paths[0], path)
+	}
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	assert.Equal(t, srv.files["/disk.raw"], data)
+}
@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/mholt/archives"
+
+	"github.com/walteh/ec1/pkg/magic"
 )
 
 var (
@@ -67,14 +69,6 @@ var magicHeaders = []magicHeader{
 	},
 }
 
-// PE32+ file header magic for EFI applications
-var peHeaderMagic = []byte{0x4d, 0x5a} // MZ
-
-// ARM64 boot image header magic: "LINUX ARM64 KERNEL" (with nulls between)
-var arm64Magic = []byte{
-	0x41, 0x52, 0x4d, 0x64, // ARMd
-}
-
 // isELF checks if a reader contains a valid ELF file
 func isELF(r io.ReaderAt) bool {
 	_, err := elf.NewFile(r)
@@ -107,7 +101,7 @@ func isArm64BootImage(r io.ReaderAt) bool {
 	}
 
 	// Check for ARM64 identifier at offset 0x38
-	return bytes.Equal(buf[0x38:0x38+4], arm64Magic)
+	return magic.ARM64Magic.Matches(buf, magic.ARM64MagicOffset)
 }
 
 // isValidKernel checks if the file is a valid kernel (ELF, PE32+ EFI, or ARM64 boot image)
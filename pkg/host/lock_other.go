@@ -0,0 +1,9 @@
+//go:build !unix
+
+package host
+
+// lockFile is a no-op without flock; downloads of the same file by several processes then overwrite each
+// other's partial file, and fail their digest check instead of being cached corrupt
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
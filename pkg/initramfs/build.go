@@ -0,0 +1,124 @@
+package initramfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/cpio"
+)
+
+// Entry is a file, directory, symlink or device node of an initramfs built by Build
+type Entry struct {
+	Path string
+	// Mode holds the type and permissions. devices are fs.ModeDevice, with fs.ModeCharDevice for char devices
+	Mode fs.FileMode
+	// Data is the contents of a regular file
+	Data []byte
+	// Linkname is the target of a symlink
+	Linkname string
+	// Major and Minor are the device numbers of a device node
+	Major uint32
+	Minor uint32
+}
+
+// specialPerm are the permission bits an entry keeps, including setuid, setgid and sticky
+const specialPerm = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// File declares a regular file
+func File(name string, perm fs.FileMode, data []byte) Entry {
+	return Entry{Path: name, Mode: perm & specialPerm, Data: data}
+}
+
+// Dir declares a directory
+func Dir(name string, perm fs.FileMode) Entry {
+	return Entry{Path: name, Mode: fs.ModeDir | perm&specialPerm}
+}
+
+// Symlink declares a symlink to target
+func Symlink(name string, target string) Entry {
+	return Entry{Path: name, Mode: fs.ModeSymlink | 0o777, Linkname: target}
+}
+
+// CharDevice declares a char device node, like /dev/console (5, 1)
+func CharDevice(name string, perm fs.FileMode, major, minor uint32) Entry {
+	return Entry{Path: name, Mode: fs.ModeDevice | fs.ModeCharDevice | perm.Perm(), Major: major, Minor: minor}
+}
+
+// Build writes a reproducible newc initramfs of entries to w and returns the digest of the archive. entries
+// are sorted by path, missing parent directories are created with mode 0755, and every entry is owned by
+// root with a zero mtime, so the same entries always produce the same bytes.
+func Build(ctx context.Context, w io.Writer, entries []Entry) (digest.Digest, error) {
+	byPath := map[string]Entry{}
+	for _, entry := range entries {
+		name := cleanName(entry.Path)
+		if name == "" {
+			return "", errors.Errorf("entry %q: empty path", entry.Path)
+		}
+		if _, ok := byPath[name]; ok {
+			return "", errors.Errorf("entry %s: declared twice", name)
+		}
+		entry.Path = name
+		byPath[name] = entry
+	}
+
+	for name := range byPath {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			parent, ok := byPath[dir]
+			if !ok {
+				byPath[dir] = Dir(dir, 0o755)
+				continue
+			}
+			if !parent.Mode.IsDir() {
+				return "", errors.Errorf("entry %s: parent %s is not a directory", name, dir)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(byPath))
+	for name := range byPath {
+		names = append(names, name)
+	}
+	// parents sort before their children since they are a prefix of them
+	slices.Sort(names)
+
+	digester := digest.Canonical.Digester()
+	cw := cpio.NewWriter(io.MultiWriter(w, digester.Hash()))
+
+	for _, name := range names {
+		entry := byPath[name]
+		if !entry.Mode.IsRegular() && len(entry.Data) > 0 {
+			return "", errors.Errorf("entry %s: only regular files have data", name)
+		}
+
+		hdr := &cpio.Header{
+			Name:      name,
+			Mode:      entry.Mode,
+			Size:      int64(len(entry.Data)),
+			Linkname:  entry.Linkname,
+			RdevMajor: entry.Major,
+			RdevMinor: entry.Minor,
+		}
+		if err := cw.WriteHeader(hdr); err != nil {
+			return "", errors.Errorf("writing %s: %w", name, err)
+		}
+		if _, err := cw.Write(entry.Data); err != nil {
+			return "", errors.Errorf("writing %s: %w", name, err)
+		}
+	}
+
+	if err := cw.Close(); err != nil {
+		return "", errors.Errorf("closing initramfs: %w", err)
+	}
+
+	dgst := digester.Digest()
+	slog.InfoContext(ctx, "built initramfs", "entries", len(names), "digest", dgst)
+
+	return dgst, nil
+}
@@ -0,0 +1,126 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/initramfs"
+)
+
+func TestBuildIsReproducible(t *testing.T) {
+	ctx := context.Background()
+
+	entries := []initramfs.Entry{
+		initramfs.Symlink("init", "bin/harpoond"),
+		initramfs.File("/bin/harpoond", 0755, []byte("harpoond")),
+		initramfs.File("etc/resolv.conf", 0644, []byte("nameserver 1.1.1.1\n")),
+		initramfs.CharDevice("dev/console", 0600, 5, 1),
+		initramfs.Dir("tmp", 0777|fs.ModeSticky),
+	}
+
+	var first bytes.Buffer
+	firstDigest, err := initramfs.Build(ctx, &first, entries)
+	require.NoError(t, err)
+
+	reversed := make([]initramfs.Entry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		reversed = append(reversed, entries[i])
+	}
+
+	var second bytes.Buffer
+	secondDigest, err := initramfs.Build(ctx, &second, reversed)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.Bytes(), second.Bytes(), "declaration order must not change the archive")
+	assert.Equal(t, firstDigest, secondDigest)
+	assert.Zero(t, first.Len()%512)
+
+	headers := readNewcHeaders(t, first.Bytes())
+	var names []string
+	for _, hdr := range headers {
+		names = append(names, hdr.name)
+		assert.Zero(t, hdr.mtime, hdr.name)
+		assert.Zero(t, hdr.uid, hdr.name)
+		assert.Zero(t, hdr.gid, hdr.name)
+	}
+	assert.Equal(t, []string{"bin", "bin/harpoond", "dev", "dev/console", "etc", "etc/resolv.conf", "init", "tmp"}, names)
+
+	byName := map[string]newcTestHeader{}
+	for _, hdr := range headers {
+		byName[hdr.name] = hdr
+	}
+	assert.Equal(t, uint64(0o020600), byName["dev/console"].mode)
+	assert.Equal(t, [2]uint64{5, 1}, byName["dev/console"].rdev)
+	assert.Equal(t, uint64(0o041777), byName["tmp"].mode)
+	assert.Equal(t, uint64(0o040755), byName["dev"].mode, "missing parents are created")
+	assert.Equal(t, uint64(0o120777), byName["init"].mode)
+	assert.Equal(t, "bin/harpoond", byName["init"].data)
+	assert.Equal(t, "harpoond", byName["bin/harpoond"].data)
+}
+
+func TestBuildRejectsInvalidEntries(t *testing.T) {
+	ctx := context.Background()
+
+	for name, entries := range map[string][]initramfs.Entry{
+		"duplicate":         {initramfs.Dir("etc", 0755), initramfs.Dir("/etc/", 0755)},
+		"file parent":       {initramfs.File("etc", 0644, nil), initramfs.File("etc/hosts", 0644, nil)},
+		"data on directory": {{Path: "etc", Mode: fs.ModeDir | 0755, Data: []byte("x")}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := initramfs.Build(ctx, &bytes.Buffer{}, entries)
+			assert.Error(t, err)
+		})
+	}
+}
+
+type newcTestHeader struct {
+	name     string
+	mode     uint64
+	uid, gid uint64
+	mtime    uint64
+	rdev     [2]uint64
+	data     string
+}
+
+// readNewcHeaders parses a newc archive up to its trailer
+func readNewcHeaders(t *testing.T, archive []byte) []newcTestHeader {
+	t.Helper()
+
+	var headers []newcTestHeader
+	field := func(raw []byte, i int) uint64 {
+		v, err := strconv.ParseUint(string(raw[6+i*8:14+i*8]), 16, 32)
+		require.NoError(t, err)
+		return v
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	for pos := 0; ; {
+		raw := archive[pos : pos+110]
+		require.Equal(t, "070701", string(raw[:6]))
+		namesize := int(field(raw, 11))
+		name := string(archive[pos+110 : pos+110+namesize-1])
+		pos = align(pos + 110 + namesize)
+		size := int(field(raw, 6))
+		data := string(archive[pos : pos+size])
+		pos = align(pos + size)
+
+		if name == "TRAILER!!!" {
+			return headers
+		}
+		headers = append(headers, newcTestHeader{
+			name:  name,
+			mode:  field(raw, 1),
+			uid:   field(raw, 2),
+			gid:   field(raw, 3),
+			mtime: field(raw, 5),
+			rdev:  [2]uint64{field(raw, 9), field(raw, 10)},
+			data:  data,
+		})
+	}
+}
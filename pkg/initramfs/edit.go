@@ -0,0 +1,544 @@
+package initramfs
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/cpio"
+)
+
+type opKind int
+
+const (
+	opAdd opKind = iota
+	opReplace
+	opDelete
+	opChmod
+	opRename
+)
+
+// Operation is one edit applied by StreamEdit
+type Operation struct {
+	kind   opKind
+	path   string
+	target string
+	mode   fs.FileMode
+	data   []byte
+}
+
+// AddFile adds a regular file, overwriting an entry with the same path in place
+func AddFile(name string, perm fs.FileMode, data []byte) Operation {
+	return Operation{kind: opAdd, path: cleanName(name), mode: perm & specialPerm, data: data}
+}
+
+// AddDir adds a directory, updating the mode of an existing one in place
+func AddDir(name string, perm fs.FileMode) Operation {
+	return Operation{kind: opAdd, path: cleanName(name), mode: fs.ModeDir | perm&specialPerm}
+}
+
+// AddSymlink adds a symlink to target, overwriting an entry with the same path in place
+func AddSymlink(name string, target string) Operation {
+	return Operation{kind: opAdd, path: cleanName(name), mode: fs.ModeSymlink | 0o777, data: []byte(target)}
+}
+
+// Replace swaps the contents of an existing entry and keeps its metadata
+func Replace(name string, data []byte) Operation {
+	return Operation{kind: opReplace, path: cleanName(name), data: data}
+}
+
+// Delete removes an entry and, for a directory, everything below it. deleting a missing entry is a no-op.
+func Delete(name string) Operation {
+	return Operation{kind: opDelete, path: cleanName(name)}
+}
+
+// Chmod sets the permission bits of an existing entry
+func Chmod(name string, perm fs.FileMode) Operation {
+	return Operation{kind: opChmod, path: cleanName(name), mode: perm & specialPerm}
+}
+
+// Rename moves an existing entry to a new path. the other operations match the renamed path, so
+// Rename("init", "iniz") followed by AddFile("init", ...) wraps the original init.
+func Rename(name string, to string) Operation {
+	return Operation{kind: opRename, path: cleanName(name), target: cleanName(to)}
+}
+
+func (o Operation) String() string {
+	switch o.kind {
+	case opAdd:
+		return "add " + o.path
+	case opReplace:
+		return "replace " + o.path
+	case opDelete:
+		return "delete " + o.path
+	case opChmod:
+		return "chmod " + o.path
+	default:
+		return "rename " + o.path + " to " + o.target
+	}
+}
+
+// StreamEdit applies ops to a cpio initramfs in a single pass and writes it back as newc. a compressed
+// archive is decompressed and the result recompressed with the same compression. entries are renumbered so
+// hardlinks keep sharing an inode, and a link that is replaced or chmodded becomes a file of its own. missing
+// parent directories of added entries are created, and archives concatenated after the first trailer are
+// passed through untouched.
+func StreamEdit(ctx context.Context, src io.Reader, ops ...Operation) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(streamEdit(ctx, src, pw, ops))
+	}()
+
+	return pr
+}
+
+func streamEdit(ctx context.Context, src io.Reader, dst io.Writer, ops []Operation) error {
+	e, err := newEditor(ops)
+	if err != nil {
+		return err
+	}
+
+	format, stream, err := archives.Identify(ctx, "", src)
+	if err != nil && !errors.Is(err, archives.NoMatch) {
+		return errors.Errorf("identifying initramfs compression: %w", err)
+	}
+
+	// a compressed cpio is identified as a compressed archive when pkg/cpio registered its format
+	if ca, ok := format.(archives.CompressedArchive); ok {
+		format = ca.Compression
+	}
+
+	decompressor, isDecompressor := format.(archives.Decompressor)
+	compressor, isCompressor := format.(archives.Compressor)
+	if !isDecompressor || !isCompressor {
+		return e.edit(ctx, stream, dst)
+	}
+
+	rc, err := decompressor.OpenReader(stream)
+	if err != nil {
+		return errors.Errorf("opening %s reader: %w", format.Extension(), err)
+	}
+	defer rc.Close()
+
+	wc, err := compressor.OpenWriter(dst)
+	if err != nil {
+		return errors.Errorf("opening %s writer: %w", format.Extension(), err)
+	}
+
+	if err := e.edit(ctx, rc, wc); err != nil {
+		wc.Close()
+		return err
+	}
+
+	if err := wc.Close(); err != nil {
+		return errors.Errorf("closing %s writer: %w", format.Extension(), err)
+	}
+
+	return nil
+}
+
+// editor holds the operations by path and the state of one pass
+type editor struct {
+	adds    []*Operation
+	byPath  map[string]*Operation
+	renames map[string]*Operation
+	deletes map[string]bool
+	done    map[*Operation]bool
+	dirs    map[string]bool
+	links   map[linkKey]*linkGroup
+	groups  []*linkGroup
+	nextIno int64
+	copyBuf []byte
+}
+
+// linkKey identifies a hardlink group in the source archive
+type linkKey struct {
+	devMajor, devMinor uint32
+	inode              int64
+}
+
+// linkGroup is a hardlink group of the source archive. the contents are carried by one of its entries, the
+// last one in archives written by gen_init_cpio, so entries that come before it wait in pending. the
+// contents are kept to give them to the links split off the group, or to a surviving link when the one
+// that carried them is deleted.
+type linkGroup struct {
+	inode   int64
+	data    []byte
+	hasData bool
+	written bool
+	pending []*pendingLink
+}
+
+// pendingLink is a link of a group waiting for the contents; split links become files of their own
+type pendingLink struct {
+	hdr   *cpio.Header
+	split bool
+}
+
+func newEditor(ops []Operation) (*editor, error) {
+	e := &editor{
+		byPath:  map[string]*Operation{},
+		renames: map[string]*Operation{},
+		deletes: map[string]bool{},
+		done:    map[*Operation]bool{},
+		dirs:    map[string]bool{"": true},
+		links:   map[linkKey]*linkGroup{},
+		nextIno: 1,
+		copyBuf: make([]byte, 64<<10),
+	}
+
+	for i := range ops {
+		op := &ops[i]
+		if op.path == "" {
+			return nil, errors.Errorf("%s: empty path", op)
+		}
+		switch op.kind {
+		case opRename:
+			if _, ok := e.renames[op.path]; ok {
+				return nil, errors.Errorf("%s: %s is already renamed", op, op.path)
+			}
+			e.renames[op.path] = op
+		case opDelete:
+			e.deletes[op.path] = true
+		default:
+			if prev, ok := e.byPath[op.path]; ok {
+				return nil, errors.Errorf("%s: conflicts with %s", op, prev)
+			}
+			e.byPath[op.path] = op
+			if op.kind == opAdd {
+				e.adds = append(e.adds, op)
+			}
+		}
+	}
+
+	for name := range e.byPath {
+		if e.deleted(name) {
+			return nil, errors.Errorf("%s: conflicts with delete", e.byPath[name])
+		}
+	}
+
+	return e, nil
+}
+
+// deleted reports whether name or one of its parents is deleted
+func (e *editor) deleted(name string) bool {
+	for ; name != "."; name = path.Dir(name) {
+		if e.deletes[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *editor) edit(ctx context.Context, src io.Reader, dst io.Writer) error {
+	r := bufio.NewReaderSize(src, 64<<10)
+	w := bufio.NewWriterSize(dst, 64<<10)
+
+	cr := cpio.NewReader(r)
+	cw := cpio.NewWriter(w)
+
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("reading initramfs: %w", err)
+		}
+
+		if err := e.editEntry(ctx, cr, cw, hdr); err != nil {
+			return errors.Errorf("editing %s: %w", hdr.Name, err)
+		}
+	}
+
+	if err := e.finish(ctx, cw); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return errors.Errorf("writing trailer: %w", err)
+	}
+	if err := e.passThroughRest(r, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (e *editor) editEntry(ctx context.Context, cr *cpio.Reader, cw *cpio.Writer, hdr *cpio.Header) error {
+	name := cleanName(hdr.Name)
+	if op, ok := e.renames[name]; ok {
+		e.done[op] = true
+		name = op.target
+		hdr.Name = op.target
+	}
+
+	var group *linkGroup
+	if hdr.Mode.IsRegular() && hdr.Links >= 2 {
+		var err error
+		if group, err = e.linkGroup(cw, cr, hdr); err != nil {
+			return err
+		}
+	}
+
+	// whatever is not copied is skipped by the next call to Next
+	if e.deleted(name) {
+		slog.DebugContext(ctx, "deleting initramfs entry", "name", name)
+		return nil
+	}
+
+	var replacement []byte
+	hasReplacement := false
+	split := false
+
+	if op, ok := e.byPath[name]; ok {
+		e.done[op] = true
+		switch op.kind {
+		case opAdd:
+			if hdr.Mode.IsDir() && op.mode.IsDir() {
+				hdr.Mode = op.mode
+			} else {
+				hdr = newEntryHeader(name, op.mode)
+				replacement, hasReplacement = op.data, true
+			}
+		case opReplace:
+			replacement, hasReplacement = op.data, true
+		case opChmod:
+			hdr.Mode = hdr.Mode&^specialPerm | op.mode
+			split = true
+		}
+	}
+
+	if hdr.Mode.IsDir() {
+		e.dirs[name] = true
+	}
+
+	if hasReplacement {
+		if group != nil {
+			hdr.Links = 1
+		}
+		e.renumber(hdr)
+		return e.writeEntry(cw, hdr, replacement)
+	}
+
+	if group != nil {
+		link := &pendingLink{hdr: hdr, split: split}
+		if !group.hasData {
+			group.pending = append(group.pending, link)
+			return nil
+		}
+		return e.writeLink(cw, group, link)
+	}
+
+	e.renumber(hdr)
+
+	if err := cw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !hdr.Mode.IsRegular() {
+		return nil
+	}
+	if _, err := io.CopyBuffer(cw, cr, e.copyBuf); err != nil {
+		return errors.Errorf("copying data: %w", err)
+	}
+	return nil
+}
+
+// linkGroup returns the hardlink group of hdr. the first entry with contents gives them to the group, and
+// the links waiting for them are written.
+func (e *editor) linkGroup(cw *cpio.Writer, cr *cpio.Reader, hdr *cpio.Header) (*linkGroup, error) {
+	key := linkKey{hdr.DevMajor, hdr.DevMinor, hdr.Inode}
+	group, ok := e.links[key]
+	if !ok {
+		group = &linkGroup{}
+		e.links[key] = group
+		e.groups = append(e.groups, group)
+	}
+
+	if group.hasData || hdr.Size == 0 {
+		return group, nil
+	}
+
+	data, err := io.ReadAll(cr)
+	if err != nil {
+		return nil, errors.Errorf("reading data: %w", err)
+	}
+	group.data, group.hasData = data, true
+
+	if err := e.flushLinks(cw, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (e *editor) flushLinks(cw *cpio.Writer, group *linkGroup) error {
+	pending := group.pending
+	group.pending = nil
+	for _, link := range pending {
+		if err := e.writeLink(cw, group, link); err != nil {
+			return errors.Errorf("writing %s: %w", link.hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// writeLink writes a link of group. the first one written carries the contents and the others link to it,
+// the way the kernel unpacks them; a split link is a file of its own with a copy of the contents.
+func (e *editor) writeLink(cw *cpio.Writer, group *linkGroup, link *pendingLink) error {
+	hdr := link.hdr
+
+	if link.split {
+		hdr.Links = 1
+		e.renumber(hdr)
+		return e.writeEntry(cw, hdr, group.data)
+	}
+
+	if group.written {
+		hdr.Inode = group.inode
+		return e.writeEntry(cw, hdr, nil)
+	}
+
+	e.renumber(hdr)
+	group.inode, group.written = hdr.Inode, true
+	return e.writeEntry(cw, hdr, group.data)
+}
+
+// renumber gives an entry a fresh inode
+func (e *editor) renumber(hdr *cpio.Header) {
+	hdr.Inode = e.nextIno
+	e.nextIno++
+}
+
+// finish writes the added entries that did not overwrite an existing one
+func (e *editor) finish(ctx context.Context, cw *cpio.Writer) error {
+	// links of groups without contents are empty files
+	for _, group := range e.groups {
+		if err := e.flushLinks(cw, group); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range e.renames {
+		if !e.done[op] {
+			return errors.Errorf("%s: no such entry", op)
+		}
+	}
+	for _, op := range e.byPath {
+		if op.kind != opAdd && !e.done[op] {
+			return errors.Errorf("%s: no such entry", op)
+		}
+	}
+
+	for _, op := range e.adds {
+		if e.done[op] {
+			continue
+		}
+
+		if err := e.writeParents(ctx, cw, path.Dir(op.path)); err != nil {
+			return err
+		}
+
+		slog.DebugContext(ctx, "adding initramfs entry", "name", op.path, "mode", op.mode)
+
+		hdr := newEntryHeader(op.path, op.mode)
+		e.renumber(hdr)
+		if err := e.writeEntry(cw, hdr, op.data); err != nil {
+			return errors.Errorf("%s: %w", op, err)
+		}
+		if op.mode.IsDir() {
+			e.dirs[op.path] = true
+		}
+	}
+
+	return nil
+}
+
+// writeParents creates the directories up to dir that are neither in the archive nor added
+func (e *editor) writeParents(ctx context.Context, cw *cpio.Writer, dir string) error {
+	if dir == "." || e.dirs[dir] {
+		return nil
+	}
+	if err := e.writeParents(ctx, cw, path.Dir(dir)); err != nil {
+		return err
+	}
+	if op, ok := e.byPath[dir]; ok && op.kind == opAdd && !e.done[op] {
+		// added later in the operations, write it now so its children can be created
+		e.done[op] = true
+		if !op.mode.IsDir() {
+			return errors.Errorf("%s: parent of another added entry", op)
+		}
+		return e.writeDir(cw, dir, op.mode)
+	}
+
+	slog.DebugContext(ctx, "adding missing initramfs parent directory", "name", dir)
+	return e.writeDir(cw, dir, fs.ModeDir|0o755)
+}
+
+func (e *editor) writeDir(cw *cpio.Writer, dir string, mode fs.FileMode) error {
+	hdr := newEntryHeader(dir, mode)
+	e.renumber(hdr)
+	e.dirs[dir] = true
+	return e.writeEntry(cw, hdr, nil)
+}
+
+// writeEntry writes hdr with data as the contents of a regular file or the target of a symlink
+func (e *editor) writeEntry(cw *cpio.Writer, hdr *cpio.Header, data []byte) error {
+	hdr.Size, hdr.Linkname = 0, ""
+	if hdr.Mode&fs.ModeSymlink != 0 {
+		hdr.Linkname = string(data)
+		data = nil
+	} else if hdr.Mode.IsRegular() {
+		hdr.Size = int64(len(data))
+	} else if len(data) > 0 {
+		return errors.Errorf("only regular files and symlinks have contents")
+	}
+
+	if err := cw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return errors.Errorf("writing data: %w", err)
+	}
+	return nil
+}
+
+// passThroughRest skips the zero padding after the trailer and copies any archive concatenated after it.
+// the writer already padded the edited archive to 512 bytes, which keeps the 4 byte alignment the kernel
+// expects of the next one.
+func (e *editor) passThroughRest(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Errorf("reading after trailer: %w", err)
+		}
+		if b == 0 {
+			continue
+		}
+		if err := r.UnreadByte(); err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(w, r, e.copyBuf); err != nil {
+			return errors.Errorf("copying concatenated archive: %w", err)
+		}
+		return nil
+	}
+}
+
+// newEntryHeader is the header of an added entry, owned by root with a zero mtime
+func newEntryHeader(name string, mode fs.FileMode) *cpio.Header {
+	return &cpio.Header{Name: name, Mode: mode}
+}
+
+// cleanName turns "/bin/sh", "./bin/sh" and "bin/sh" into the "bin/sh" form of initramfs entries
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
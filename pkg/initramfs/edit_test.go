@@ -0,0 +1,539 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	oinitramfs "go.pdmccormick.com/initramfs"
+
+	"github.com/walteh/ec1/pkg/cpio"
+	"github.com/walteh/ec1/pkg/initramfs"
+	"github.com/walteh/ec1/pkg/initramfs/testdata"
+	"github.com/walteh/ec1/pkg/testing/testdataembed"
+	"github.com/walteh/ec1/pkg/testing/tlog"
+)
+
+// logicalWrapInitTest replaces init with mockInitBinary and keeps the original as its name with a z
+func logicalWrapInitTest(t *testing.T, initName string, mockInitBinary string, cpioPath io.ReadSeeker) {
+	ctx := tlog.SetupSlogForTestWithContext(t, t.Context())
+
+	iniz := replaceLastLetterWithZ(initName)
+
+	fileHeadersBefore, fileDataBefore, err := initramfs.ExtractFilesFromCpio(ctx, cpioPath)
+	require.NoError(t, err)
+
+	require.NotNil(t, fileHeadersBefore[initName], "the input cpio headers should have an init file")
+	require.NotEqual(t, mockInitBinary, string(fileDataBefore[initName]), "the input cpio init file should not be the mock init binary")
+
+	_, err = cpioPath.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	rawData, err := io.ReadAll(initramfs.StreamEdit(ctx, cpioPath,
+		initramfs.Rename(initName, iniz),
+		initramfs.AddFile(initName, 0755, []byte(mockInitBinary)),
+	))
+	require.NoError(t, err)
+	assert.Zero(t, len(rawData)%512, "the output should be padded like gen_init_cpio")
+
+	headers, data, err := initramfs.ExtractFilesFromCpio(ctx, bytes.NewReader(rawData))
+	require.NoError(t, err)
+
+	require.NotNil(t, headers[initName], "the output should have an init file")
+	assert.Equal(t, mockInitBinary, string(data[initName]), "the output should have the mock init binary")
+
+	require.NotNil(t, headers[iniz], "the output should have an iniz file")
+	assert.Equal(t, fileDataBefore[initName], data[iniz], "the iniz file should be the original init")
+	assert.Equal(t, fileHeadersBefore[initName].Mode, headers[iniz].Mode, "the iniz file should keep the original mode")
+
+	assert.Len(t, headers, len(fileHeadersBefore)+1, "only init should be added")
+}
+
+func TestStreamEditWrapInitDifferentPadding(t *testing.T) {
+
+	thirtyTwoCharacterString := "#!/bin/sh\n\necho 'mock_init' %s\n"
+	fourCharacterName := "init"
+
+	for i := 0; i < 4; i++ {
+		t.Run(fmt.Sprintf("binary_padding_%d", i), func(t *testing.T) {
+			mockInitBinary := fmt.Sprintf(thirtyTwoCharacterString, strings.Repeat("a", i))
+			mockInitName := fourCharacterName
+			cpioPath := generateTestCpio(t, map[string][]byte{mockInitName: []byte("#!/bin/sh\necho 'original_init'\n")})
+			defer cpioPath.Close()
+			logicalWrapInitTest(t, mockInitName, mockInitBinary, cpioPath)
+		})
+		t.Run(fmt.Sprintf("name_padding_%d", i), func(t *testing.T) {
+			mockInitBinary := thirtyTwoCharacterString
+			mockInitName := fmt.Sprintf("%s_%s", fourCharacterName, strings.Repeat("a", i))
+			cpioPath := generateTestCpio(t, map[string][]byte{mockInitName: []byte("#!/bin/sh\necho 'original_init'\n")})
+			defer cpioPath.Close()
+			logicalWrapInitTest(t, mockInitName, mockInitBinary, cpioPath)
+		})
+		t.Run(fmt.Sprintf("both_padding_%d", i), func(t *testing.T) {
+			mockInitBinary := fmt.Sprintf(thirtyTwoCharacterString, strings.Repeat("a", i))
+			mockInitName := fmt.Sprintf("%s_%s", fourCharacterName, strings.Repeat("a", i))
+			cpioPath := generateTestCpio(t, map[string][]byte{mockInitName: []byte("#!/bin/sh\necho 'original_init'\n")})
+			defer cpioPath.Close()
+			logicalWrapInitTest(t, mockInitName, mockInitBinary, cpioPath)
+		})
+	}
+}
+
+func TestStreamEditWrapInitSmallFile(t *testing.T) {
+	cpioPath := testdataembed.MustCreateTmpFileFor(t, testdata.Testdata(), "start.cpio")
+	defer cpioPath.Close()
+
+	mockInitBinary := "#!/bin/sh\necho 'mock_init' with padding for some extra struff\n"
+
+	logicalWrapInitTest(t, "init", mockInitBinary, cpioPath)
+}
+
+func TestStreamEditWrapInitLargeFile(t *testing.T) {
+	cpioPath := openLargeCpio(t)
+	defer cpioPath.Close()
+
+	mockInitBinary := "#!/bin/sh\necho 'mock_init' with padding for some extra struff\n"
+
+	logicalWrapInitTest(t, "init", mockInitBinary, cpioPath)
+}
+
+func TestStreamEditOperations(t *testing.T) {
+	ctx := tlog.SetupSlogForTestWithContext(t, t.Context())
+
+	buf := bytes.NewBuffer(nil)
+	w := oinitramfs.NewWriter(buf)
+	for _, entry := range []struct {
+		header oinitramfs.Header
+		data   string
+	}{
+		{header: oinitramfs.Header{Filename: "bin", Mode: oinitramfs.Mode_Dir | 0755, Inode: 10, NumLinks: 2}},
+		{header: oinitramfs.Header{Filename: "bin/busybox", Mode: oinitramfs.Mode_File | 0755, Inode: 11, NumLinks: 2}},
+		{header: oinitramfs.Header{Filename: "bin/sh", Mode: oinitramfs.Mode_File | 0755, Inode: 11, NumLinks: 2}, data: "busybox"},
+		{header: oinitramfs.Header{Filename: "etc", Mode: oinitramfs.Mode_Dir | 0755, Inode: 12, NumLinks: 2}},
+		{header: oinitramfs.Header{Filename: "etc/motd", Mode: oinitramfs.Mode_File | 0644, Inode: 13, NumLinks: 1}, data: "hello"},
+		{header: oinitramfs.Header{Filename: "etc/hostname", Mode: oinitramfs.Mode_File | 0644, Inode: 14, NumLinks: 1}, data: "old"},
+		{header: oinitramfs.Header{Filename: "var", Mode: oinitramfs.Mode_Dir | 0755, Inode: 15, NumLinks: 2}},
+		{header: oinitramfs.Header{Filename: "var/cache", Mode: oinitramfs.Mode_File | 0644, Inode: 16, NumLinks: 1}, data: "stale"},
+	} {
+		header := entry.header
+		header.FilenameSize = uint32(len(header.Filename) + 1)
+		header.DataSize = uint32(len(entry.data))
+		header.Magic = oinitramfs.Magic_070701
+		require.NoError(t, w.WriteHeader(&header))
+		_, err := w.Write([]byte(entry.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.WriteTrailer())
+	require.NoError(t, w.Close())
+
+	gz := bytes.NewBuffer(nil)
+	gzw, err := (archives.Gz{}).OpenWriter(gz)
+	require.NoError(t, err)
+	_, err = gzw.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+
+	ops := []initramfs.Operation{
+		initramfs.Delete("var"),
+		initramfs.Replace("etc/hostname", []byte("vm-1")),
+		initramfs.Chmod("etc/motd", 0600),
+		initramfs.AddFile("lib/modules/6.1.0/vsock.ko", 0644, []byte("module")),
+		initramfs.AddSymlink("/sbin/init", "/bin/busybox"),
+		initramfs.AddDir("lib/modules", 0700),
+	}
+
+	for name, archive := range map[string][]byte{"plain": buf.Bytes(), "gzip": gz.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			var out io.Reader = initramfs.StreamEdit(ctx, bytes.NewReader(archive), ops...)
+			if name == "gzip" {
+				rc, err := (archives.Gz{}).OpenReader(out)
+				require.NoError(t, err)
+				defer rc.Close()
+				out = rc
+			}
+
+			headers, data, err := initramfs.ExtractFilesFromCpio(ctx, out)
+			require.NoError(t, err)
+
+			assert.NotContains(t, headers, "var")
+			assert.NotContains(t, headers, "var/cache")
+			assert.Equal(t, "vm-1", string(data["etc/hostname"]))
+			assert.EqualValues(t, oinitramfs.Mode_File|0644, headers["etc/hostname"].Mode)
+			assert.EqualValues(t, oinitramfs.Mode_File|0600, headers["etc/motd"].Mode)
+			assert.Equal(t, "module", string(data["lib/modules/6.1.0/vsock.ko"]))
+			assert.Equal(t, "/bin/busybox", string(data["sbin/init"]))
+
+			for _, dir := range []string{"lib", "lib/modules/6.1.0", "sbin"} {
+				require.Contains(t, headers, dir, "missing parent directories are created")
+				assert.EqualValues(t, oinitramfs.Mode_Dir|0755, headers[dir].Mode)
+			}
+			assert.EqualValues(t, oinitramfs.Mode_Dir|0700, headers["lib/modules"].Mode)
+
+			inodes := map[uint32]string{}
+			for _, header := range initramfs.OrderedByInode(headers) {
+				if other, ok := inodes[header.Inode]; ok {
+					assert.ElementsMatch(t, []string{"bin/busybox", "bin/sh"}, []string{other, header.Filename}, "only hardlinks share an inode")
+				}
+				inodes[header.Inode] = header.Filename
+			}
+			assert.Equal(t, headers["bin/busybox"].Inode, headers["bin/sh"].Inode)
+		})
+	}
+}
+
+// unpackedFile is what the kernel leaves of an entry: the links of a group share the contents of whichever
+// entry of the group carried them
+type unpackedFile struct {
+	mode  fs.FileMode
+	inode int64
+	links int
+	data  string
+}
+
+func writeLinkArchive(t *testing.T, entries []cpio.Header, data map[string]string) []byte {
+	t.Helper()
+
+	buf := bytes.NewBuffer(nil)
+	w := cpio.NewWriter(buf)
+	for _, hdr := range entries {
+		hdr.Size = int64(len(data[hdr.Name]))
+		require.NoError(t, w.WriteHeader(&hdr))
+		_, err := w.Write([]byte(data[hdr.Name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func unpackLinks(t *testing.T, archive io.Reader) map[string]*unpackedFile {
+	t.Helper()
+
+	files := map[string]*unpackedFile{}
+	groups := map[int64][]*unpackedFile{}
+	contents := map[int64]string{}
+
+	r := cpio.NewReader(archive)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+
+		file := &unpackedFile{mode: hdr.Mode, inode: hdr.Inode, links: hdr.Links, data: string(data)}
+		files[hdr.Name] = file
+		if hdr.Mode.IsRegular() && hdr.Links >= 2 {
+			groups[hdr.Inode] = append(groups[hdr.Inode], file)
+			if len(data) > 0 {
+				contents[hdr.Inode] = string(data)
+			}
+		}
+	}
+
+	for inode, group := range groups {
+		for _, file := range group {
+			file.data = contents[inode]
+		}
+	}
+	return files
+}
+
+func TestStreamEditSplitsHardlinks(t *testing.T) {
+	ctx := tlog.SetupSlogForTestWithContext(t, t.Context())
+
+	// gen_init_cpio puts the contents on the last link of a group
+	archive := writeLinkArchive(t, []cpio.Header{
+		{Name: "bin", Mode: fs.ModeDir | 0o755, Inode: 10},
+		{Name: "bin/busybox", Mode: 0o755, Inode: 11, Links: 4},
+		{Name: "bin/sh", Mode: 0o755, Inode: 11, Links: 4},
+		{Name: "bin/ls", Mode: 0o755, Inode: 11, Links: 4},
+		{Name: "bin/cat", Mode: 0o755, Inode: 11, Links: 4},
+	}, map[string]string{"bin/cat": "busybox"})
+
+	files := unpackLinks(t, initramfs.StreamEdit(ctx, bytes.NewReader(archive),
+		initramfs.Replace("bin/sh", []byte("dash")),
+		initramfs.Chmod("bin/busybox", 0o700),
+	))
+
+	require.Contains(t, files, "bin/sh")
+	assert.Equal(t, "dash", files["bin/sh"].data, "replacing a link changes only that file")
+	assert.Equal(t, 1, files["bin/sh"].links)
+
+	require.Contains(t, files, "bin/busybox")
+	assert.Equal(t, "busybox", files["bin/busybox"].data, "a link split by chmod keeps the contents")
+	assert.Equal(t, fs.FileMode(0o700), files["bin/busybox"].mode)
+	assert.Equal(t, 1, files["bin/busybox"].links)
+
+	for _, name := range []string{"bin/ls", "bin/cat"} {
+		require.Contains(t, files, name)
+		assert.Equal(t, "busybox", files[name].data)
+		assert.Equal(t, fs.FileMode(0o755), files[name].mode, "chmod of a split link leaves the group alone")
+	}
+	assert.Equal(t, files["bin/ls"].inode, files["bin/cat"].inode)
+
+	inodes := map[int64]bool{}
+	for _, name := range []string{"bin", "bin/sh", "bin/busybox", "bin/ls"} {
+		assert.False(t, inodes[files[name].inode], "%s shares an inode", name)
+		inodes[files[name].inode] = true
+	}
+}
+
+func TestStreamEditDeletesTheLinkWithTheContents(t *testing.T) {
+	ctx := tlog.SetupSlogForTestWithContext(t, t.Context())
+
+	for name, carrier := range map[string]string{"last": "bin/ls", "first": "bin/busybox"} {
+		t.Run(name, func(t *testing.T) {
+			archive := writeLinkArchive(t, []cpio.Header{
+				{Name: "bin", Mode: fs.ModeDir | 0o755, Inode: 10},
+				{Name: "bin/busybox", Mode: 0o755, Inode: 11, Links: 3},
+				{Name: "bin/sh", Mode: 0o755, Inode: 11, Links: 3},
+				{Name: "bin/ls", Mode: 0o755, Inode: 11, Links: 3},
+				{Name: "empty", Mode: 0o644, Inode: 12, Links: 2},
+				{Name: "empty-link", Mode: 0o644, Inode: 12, Links: 2},
+			}, map[string]string{carrier: "busybox"})
+
+			files := unpackLinks(t, initramfs.StreamEdit(ctx, bytes.NewReader(archive), initramfs.Delete(carrier)))
+
+			assert.NotContains(t, files, carrier)
+			survivors := []string{}
+			for _, name := range []string{"bin/busybox", "bin/sh", "bin/ls"} {
+				if name == carrier {
+					continue
+				}
+				require.Contains(t, files, name)
+				assert.Equal(t, "busybox", files[name].data, "the contents move to a surviving link")
+				survivors = append(survivors, name)
+			}
+			assert.Equal(t, files[survivors[0]].inode, files[survivors[1]].inode)
+
+			require.Contains(t, files, "empty-link", "links of a group without contents are kept")
+			assert.Equal(t, files["empty"].inode, files["empty-link"].inode)
+		})
+	}
+}
+
+func TestStreamEditErrors(t *testing.T) {
+	ctx := context.Background()
+
+	cpioPath := generateTestCpio(t, map[string][]byte{"init": []byte("#!/bin/sh\n")})
+	defer cpioPath.Close()
+
+	for name, ops := range map[string][]initramfs.Operation{
+		"replace missing": {initramfs.Replace("missing", nil)},
+		"chmod missing":   {initramfs.Chmod("missing", 0644)},
+		"rename missing":  {initramfs.Rename("missing", "found")},
+		"conflict":        {initramfs.AddFile("init", 0755, nil), initramfs.Replace("init", nil)},
+		"deleted parent":  {initramfs.Delete("etc"), initramfs.AddFile("etc/hosts", 0644, nil)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := cpioPath.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+
+			_, err = io.ReadAll(initramfs.StreamEdit(ctx, cpioPath, ops...))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := io.ReadAll(initramfs.StreamEdit(ctx, strings.NewReader("not a cpio archive at all, not even close to one")))
+	assert.Error(t, err)
+}
+
+// TestStreamEditFormats edits crc and odc archives, which are written back as newc, and keeps an archive
+// concatenated after the first
+func TestStreamEditFormats(t *testing.T) {
+	ctx := context.Background()
+
+	second := bytes.NewBuffer(nil)
+	cw := cpio.NewWriter(second)
+	require.NoError(t, cw.WriteHeader(&cpio.Header{Name: "extra", Mode: 0o644, Size: int64(len("second"))}))
+	_, err := cw.Write([]byte("second"))
+	require.NoError(t, err)
+	require.NoError(t, cw.Close())
+
+	for _, format := range []cpio.Format{cpio.FormatCRC, cpio.FormatODC} {
+		t.Run(format.String(), func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			w := cpio.NewFormatWriter(buf, format)
+			require.NoError(t, w.WriteHeader(&cpio.Header{Name: "init", Mode: 0o755, Size: 3, Checksum: 'a' + 'b' + 'c'}))
+			_, err := w.Write([]byte("abc"))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			buf.Write(second.Bytes())
+
+			raw, err := io.ReadAll(initramfs.StreamEdit(ctx, buf, initramfs.AddFile("etc/hostname", 0o644, []byte("vm-1"))))
+			require.NoError(t, err)
+			assert.Equal(t, "070701", string(raw[:6]))
+
+			fsys := cpio.NewFS(bytes.NewReader(raw))
+			for name, want := range map[string]string{"init": "abc", "etc/hostname": "vm-1", "extra": "second"} {
+				data, err := fsys.ReadFile(name)
+				require.NoError(t, err, name)
+				assert.Equal(t, want, string(data), name)
+			}
+		})
+	}
+}
+
+// TestStreamEditMultipleFiles injects the files a VM needs in a single pass
+func TestStreamEditMultipleFiles(t *testing.T) {
+	ctx := context.Background()
+
+	// Create a simple initial CPIO archive
+	buf := bytes.NewBuffer(nil)
+	w := oinitramfs.NewWriter(buf)
+
+	// Add a simple existing file
+	existingHeader := oinitramfs.Header{
+		Filename:     "existing.txt",
+		FilenameSize: uint32(len("existing.txt") + 1),
+		Mode:         oinitramfs.Mode_File,
+		NumLinks:     1,
+		Magic:        oinitramfs.Magic_070701,
+		DataSize:     uint32(len("existing content")),
+	}
+	require.NoError(t, w.WriteHeader(&existingHeader))
+	_, err := w.Write([]byte("existing content"))
+	require.NoError(t, err)
+
+	// Write trailer
+	require.NoError(t, w.WriteTrailer())
+	require.NoError(t, w.Close())
+
+	blacklistContent := []byte("blacklist floppy\nblacklist pcspkr\n")
+	earlyContent := []byte("options scsi_mod scan=manual\n")
+	vsockContent := []byte("#!/bin/sh\nmodprobe vsock\n")
+
+	result := initramfs.StreamEdit(ctx, bytes.NewReader(buf.Bytes()),
+		initramfs.AddFile("etc/modprobe.d/blacklist.conf", 0644, blacklistContent),
+		initramfs.AddFile("etc/modprobe.d/early.conf", 0644, earlyContent),
+		initramfs.AddFile("usr/bin/vsock-early", 0755, vsockContent),
+	)
+
+	_, foundFiles, err := initramfs.ExtractFilesFromCpio(ctx, result)
+	require.NoError(t, err)
+
+	// Verify all files are present and correct
+	assert.Equal(t, []byte("existing content"), foundFiles["existing.txt"])
+	assert.Equal(t, blacklistContent, foundFiles["etc/modprobe.d/blacklist.conf"])
+	assert.Equal(t, earlyContent, foundFiles["etc/modprobe.d/early.conf"])
+	assert.Equal(t, vsockContent, foundFiles["usr/bin/vsock-early"])
+}
+
+// BenchmarkStreamEdit benchmarks single and multi-file edits of a large initramfs
+func BenchmarkStreamEdit(b *testing.B) {
+	ctx := context.Background()
+
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	// Create a large mock init binary for benchmarking
+	mockInitBinary := make([]byte, 1024*1024) // 1MB
+	for i := range mockInitBinary {
+		mockInitBinary[i] = byte(i % 256)
+	}
+
+	f := openLargeCpio(b)
+	defer f.Close()
+
+	benchmarks := map[string][]initramfs.Operation{
+		"wrap_init": {
+			initramfs.Rename("init", "iniz"),
+			initramfs.AddFile("init", 0755, mockInitBinary),
+		},
+		"agent_config_modules": {
+			initramfs.Rename("init", "iniz"),
+			initramfs.AddFile("init", 0755, mockInitBinary),
+			initramfs.AddFile("etc/ec1/config.json", 0644, []byte(`{"vsock_port":2019}`)),
+			initramfs.AddFile("lib/modules/vsock.ko", 0644, mockInitBinary[:64<<10]),
+			initramfs.AddFile("lib/modules/virtio_vsock.ko", 0644, mockInitBinary[:64<<10]),
+		},
+	}
+
+	for name, ops := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				f.Seek(0, io.SeekStart)
+				_, err := io.Copy(io.Discard, initramfs.StreamEdit(ctx, f, ops...))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// generateTestCpio creates a simple CPIO file for testing
+func generateTestCpio(t testing.TB, files map[string][]byte) io.ReadSeekCloser {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "test.cpio")
+
+	f, err := os.Create(outputPath)
+	require.NoError(t, err)
+
+	img := oinitramfs.NewWriter(f)
+	offset := uint32(0)
+
+	for k, v := range files {
+		offset++
+		err := img.WriteHeader(&oinitramfs.Header{
+			Filename:     k,
+			Mode:         oinitramfs.Mode_File | oinitramfs.GroupExecute | oinitramfs.UserExecute | oinitramfs.OtherExecute,
+			DataSize:     uint32(len(v)),
+			Inode:        offset,
+			FilenameSize: uint32(len(k)),
+			Magic:        oinitramfs.Magic_070701,
+		})
+		require.NoError(t, err)
+
+		_, err = img.Write(v)
+		require.NoError(t, err)
+	}
+
+	err = img.WriteTrailer()
+	require.NoError(t, err)
+
+	err = img.Close()
+	require.NoError(t, err)
+
+	f, err = os.Open(outputPath)
+	require.NoError(t, err)
+
+	return f
+}
+
+func openLargeCpio(t testing.TB) io.ReadSeekCloser {
+	cpioPath := testdataembed.MustCreateTmpFileFor(t, testdata.Testdata(), "large.cpio.xz")
+	defer cpioPath.Close()
+
+	reader, err := (archives.Xz{}).OpenReader(cpioPath)
+	require.NoError(t, err)
+
+	// save to a temp file
+	tmpFile, err := os.CreateTemp("", "large.cpio")
+	require.NoError(t, err)
+
+	_, err = io.Copy(tmpFile, reader)
+	require.NoError(t, err)
+
+	tmpFile.Seek(0, io.SeekStart)
+
+	return tmpFile
+}
+
+func replaceLastLetterWithZ(data string) string {
+	if len(data) == 0 {
+		return data
+	}
+	return data[:len(data)-1] + "z"
+}
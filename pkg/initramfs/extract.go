@@ -0,0 +1,63 @@
+package initramfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+
+	"gitlab.com/tozd/go/errors"
+	"go.pdmccormick.com/initramfs"
+)
+
+func OrderedByInode(headers map[string]*initramfs.Header) []*initramfs.Header {
+	names := make([]*initramfs.Header, 0, len(headers))
+	for _, header := range headers {
+		names = append(names, header)
+	}
+	slices.SortFunc(names, func(a, b *initramfs.Header) int {
+		return int(a.Inode) - int(b.Inode)
+	})
+	return names
+}
+
+func ExtractFilesFromCpio(ctx context.Context, pipe io.Reader) (headers map[string]*initramfs.Header, data map[string][]byte, err error) {
+	data = make(map[string][]byte)
+	headers = make(map[string]*initramfs.Header)
+
+	ir := initramfs.NewReader(pipe)
+	for {
+		rec, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Errorf("reading CPIO record: %w", err)
+		}
+		if rec.Trailer() {
+			break
+		}
+
+		// read next n bytes and return them
+		buf := bytes.NewBuffer(nil)
+		_, err = io.CopyN(buf, ir, int64(rec.DataSize))
+		if err != nil {
+			return nil, nil, errors.Errorf("copying data for %s: %w", rec.Filename, err)
+		}
+		if old, ok := headers[rec.Filename]; ok {
+			slog.WarnContext(ctx, "duplicate filename - ignoring",
+				"filename", old.Filename,
+				"inode", old.Inode,
+				"size", old.DataSize,
+				"mode", old.Mode,
+				"mtime", old.Mtime,
+				"uid", old.Uid,
+				"gid", old.Gid)
+		}
+		data[rec.Filename] = buf.Bytes()
+		headers[rec.Filename] = rec
+	}
+
+	return headers, data, nil
+}
@@ -0,0 +1,71 @@
+package initramfs
+
+import (
+	"context"
+	"io"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/cpio"
+	"github.com/walteh/ec1/pkg/ext/iox"
+)
+
+// FS is a read-only fs.FS view of an initramfs. it must be closed to release the cache and decompressor.
+type FS struct {
+	*cpio.FS
+	lazy    *iox.LazyReader
+	closers []io.Closer
+}
+
+// OpenFS returns a view of the initramfs read from src without unpacking it. a compressed initramfs is
+// decompressed on demand and the decompressed bytes kept in cache, such as a temporary file, so the
+// contents of a file are only read when it is opened. fs.WalkDir, fs.Glob and fs.Sub work on the result.
+func OpenFS(ctx context.Context, src io.Reader, cache io.ReadWriteSeeker) (*FS, error) {
+	format, stream, err := archives.Identify(ctx, "", src)
+	if err != nil && !errors.Is(err, archives.NoMatch) {
+		return nil, errors.Errorf("identifying initramfs compression: %w", err)
+	}
+
+	// a compressed cpio is identified as a compressed archive when pkg/cpio registered its format
+	if ca, ok := format.(archives.CompressedArchive); ok {
+		format = ca.Compression
+	}
+
+	var closers []io.Closer
+	if decompressor, ok := format.(archives.Decompressor); ok {
+		rc, err := decompressor.OpenReader(stream)
+		if err != nil {
+			return nil, errors.Errorf("opening %s reader: %w", format.Extension(), err)
+		}
+		stream = rc
+		closers = append(closers, rc)
+	}
+
+	lazy, err := iox.NewLazyReader(stream, cache)
+	if err != nil {
+		for _, c := range closers {
+			c.Close()
+		}
+		return nil, errors.Errorf("creating lazy reader: %w", err)
+	}
+
+	return &FS{FS: cpio.NewFS(lazy), lazy: lazy, closers: closers}, nil
+}
+
+// Close releases the cache and the decompressor
+func (f *FS) Close() error {
+	var errs []error
+	if err := f.lazy.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, c := range f.closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("closing initramfs: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/initramfs"
+)
+
+func TestOpenFSDecompressesOnDemand(t *testing.T) {
+	ctx := context.Background()
+
+	var archive bytes.Buffer
+	_, err := initramfs.Build(ctx, &archive, []initramfs.Entry{
+		initramfs.Symlink("init", "bin/harpoond"),
+		initramfs.File("bin/harpoond", 0o755, []byte("harpoond")),
+		initramfs.File("etc/resolv.conf", 0o644, []byte("nameserver 1.1.1.1\n")),
+		initramfs.CharDevice("dev/console", 0o600, 5, 1),
+	})
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(archive.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	cache, err := os.CreateTemp(t.TempDir(), "initramfs-cache-*")
+	require.NoError(t, err)
+
+	fsys, err := initramfs.OpenFS(ctx, &compressed, cache)
+	require.NoError(t, err)
+	defer fsys.Close()
+
+	data, err := fs.ReadFile(fsys, "init")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("harpoond"), data)
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		walked = append(walked, path)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "bin", "bin/harpoond", "dev", "dev/console", "etc", "etc/resolv.conf", "init"}, walked)
+}
@@ -0,0 +1,309 @@
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/ec1init"
+)
+
+// moduleCompressions are the suffixes of compressed modules, which are injected decompressed so the
+// guest kernel does not need module decompression support
+var moduleCompressions = map[string]archives.Decompressor{
+	".xz":  archives.Xz{},
+	".gz":  archives.Gz{},
+	".zst": archives.Zstd{},
+}
+
+// KernelModules is a kernel modules tree, the lib/modules/<version> directory of a kernel build
+type KernelModules struct {
+	fsys    fs.FS
+	version string
+	// deps maps the path of a module to the full list of modules it depends on, as modules.dep does
+	deps    map[string][]string
+	byName  map[string]string
+	builtin map[string]bool
+}
+
+// OpenKernelModules opens a modules tree from a directory or a tarball, such as the layer of an OCI
+// artifact, holding lib/modules/<version> or <version>
+func OpenKernelModules(ctx context.Context, name string) (*KernelModules, error) {
+	fsys, err := archives.FileSystem(ctx, name, nil)
+	if err != nil {
+		return nil, errors.Errorf("opening kernel modules %s: %w", name, err)
+	}
+	return LoadKernelModules(ctx, fsys)
+}
+
+// OpenKernelModulesIn opens the modules tree at name inside dir, a directory or a tarball as
+// OpenKernelModules does. name is relative to dir and cannot reach outside it, through .. or symlinks.
+func OpenKernelModulesIn(ctx context.Context, dir string, name string) (*KernelModules, error) {
+	if !filepath.IsLocal(name) {
+		return nil, errors.Errorf("kernel modules %s are not inside %s", name, dir)
+	}
+
+	// a directory tree reads its modules from the root later, so it is only closed for tarballs
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, errors.Errorf("opening kernel modules directory: %w", err)
+	}
+
+	info, err := root.Stat(name)
+	if err != nil {
+		root.Close()
+		return nil, errors.Errorf("opening kernel modules %s: %w", name, err)
+	}
+
+	if info.IsDir() {
+		fsys, err := fs.Sub(root.FS(), filepath.ToSlash(name))
+		if err != nil {
+			root.Close()
+			return nil, errors.Errorf("opening kernel modules %s: %w", name, err)
+		}
+		return LoadKernelModules(ctx, fsys)
+	}
+
+	f, err := root.Open(name)
+	root.Close()
+	if err != nil {
+		return nil, errors.Errorf("opening kernel modules %s: %w", name, err)
+	}
+	fsys, err := archives.FileSystem(ctx, name, f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Errorf("opening kernel modules %s: %w", name, err)
+	}
+	return LoadKernelModules(ctx, fsys)
+}
+
+// LoadKernelModules reads modules.dep and modules.builtin from a modules tree
+func LoadKernelModules(ctx context.Context, fsys fs.FS) (*KernelModules, error) {
+	root, version, err := findModulesRoot(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := fs.Sub(fsys, root)
+	if err != nil {
+		return nil, errors.Errorf("opening %s: %w", root, err)
+	}
+
+	m := &KernelModules{
+		fsys:    sub,
+		version: version,
+		deps:    map[string][]string{},
+		byName:  map[string]string{},
+		builtin: map[string]bool{},
+	}
+
+	dep, err := fs.ReadFile(sub, "modules.dep")
+	if err != nil {
+		return nil, errors.Errorf("reading modules.dep: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(dep))
+	for scanner.Scan() {
+		module, deps, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		m.deps[module] = strings.Fields(deps)
+		m.byName[moduleName(module)] = module
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf("reading modules.dep: %w", err)
+	}
+
+	if builtin, err := fs.ReadFile(sub, "modules.builtin"); err == nil {
+		for _, module := range strings.Fields(string(builtin)) {
+			m.builtin[moduleName(module)] = true
+		}
+	}
+
+	slog.InfoContext(ctx, "loaded kernel modules", "version", version, "modules", len(m.deps), "builtin", len(m.builtin))
+
+	return m, nil
+}
+
+// findModulesRoot finds the directory holding modules.dep, whose name is the kernel version
+func findModulesRoot(fsys fs.FS) (root string, version string, err error) {
+	for _, pattern := range []string{"lib/modules/*/modules.dep", "*/modules.dep"} {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return "", "", errors.Errorf("looking for %s: %w", pattern, err)
+		}
+		if len(matches) > 1 {
+			return "", "", errors.Errorf("found modules for more than one kernel: %v", matches)
+		}
+		if len(matches) == 1 {
+			root = path.Dir(matches[0])
+			return root, path.Base(root), nil
+		}
+	}
+
+	return "", "", errors.Errorf("no lib/modules/<version>/modules.dep in the kernel modules tree")
+}
+
+// moduleName turns kernel/fs/overlayfs/overlay.ko.xz into overlay. the kernel treats - and _ alike.
+func moduleName(module string) string {
+	name := path.Base(module)
+	for suffix := range moduleCompressions {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	name = strings.TrimSuffix(name, ".ko")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// Version is the kernel version the modules were built for
+func (m *KernelModules) Version() string {
+	return m.version
+}
+
+// Resolve returns the paths of the named modules and everything they depend on, relative to the modules
+// tree and in load order. names are module names like "overlay" or paths from modules.dep; modules built
+// into the kernel are skipped.
+func (m *KernelModules) Resolve(ctx context.Context, names ...string) ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var order []string
+
+	var visit func(module string, chain []string) error
+	visit = func(module string, chain []string) error {
+		switch state[module] {
+		case visiting:
+			return errors.Errorf("dependency cycle: %s", strings.Join(append(chain, module), " -> "))
+		case visited:
+			return nil
+		}
+		deps, ok := m.deps[module]
+		if !ok {
+			return errors.Errorf("%s is not in modules.dep", module)
+		}
+
+		state[module] = visiting
+		chain = append(slices.Clip(chain), module)
+		// modules.dep lists every transitive dependency, in the reverse of the order modprobe loads them
+		for i := len(deps) - 1; i >= 0; i-- {
+			if err := visit(deps[i], chain); err != nil {
+				return err
+			}
+		}
+		state[module] = visited
+		order = append(order, module)
+		return nil
+	}
+
+	for _, name := range names {
+		module := name
+		if _, ok := m.deps[name]; !ok {
+			if m.builtin[moduleName(name)] {
+				slog.DebugContext(ctx, "kernel module is built in", "module", name)
+				continue
+			}
+			if module, ok = m.byName[moduleName(name)]; !ok {
+				return nil, errors.Errorf("kernel module %s not found for %s", name, m.version)
+			}
+		}
+		if err := visit(module, nil); err != nil {
+			return nil, errors.Errorf("resolving kernel module %s: %w", name, err)
+		}
+	}
+
+	return order, nil
+}
+
+// Operations returns the cpio editor operations adding the named modules and their dependencies under
+// /lib/modules/<version>, decompressed, with a modules.dep covering them for modprobe, and listing them in
+// load order in ec1init.KernelModulesFile for harpoond to load at boot
+func (m *KernelModules) Operations(ctx context.Context, names ...string) ([]Operation, error) {
+	modules, err := m.Resolve(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Join("lib/modules", m.version)
+
+	renamed := map[string]string{}
+	ops := make([]Operation, 0, len(modules)+2)
+	for _, module := range modules {
+		data, target, err := m.readModule(module)
+		if err != nil {
+			return nil, err
+		}
+		renamed[module] = target
+		ops = append(ops, AddFile(path.Join(dir, target), 0o644, data))
+	}
+
+	var dep, load strings.Builder
+	for _, module := range modules {
+		dep.WriteString(renamed[module] + ":")
+		for _, d := range m.deps[module] {
+			dep.WriteString(" " + renamed[d])
+		}
+		dep.WriteString("\n")
+		load.WriteString("/" + path.Join(dir, renamed[module]) + "\n")
+	}
+
+	ops = append(ops,
+		AddFile(path.Join(dir, "modules.dep"), 0o644, []byte(dep.String())),
+		AddFile(ec1init.KernelModulesFile, 0o644, []byte(load.String())),
+	)
+
+	slog.InfoContext(ctx, "resolved kernel modules", "version", m.version, "requested", names, "modules", modules)
+
+	return ops, nil
+}
+
+// readModule reads a module, decompressing it when needed, and returns the path it is injected at
+func (m *KernelModules) readModule(module string) ([]byte, string, error) {
+	f, err := m.fsys.Open(module)
+	if err != nil {
+		return nil, "", errors.Errorf("opening kernel module %s: %w", module, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	target := module
+	for suffix, decompressor := range moduleCompressions {
+		if !strings.HasSuffix(module, ".ko"+suffix) {
+			continue
+		}
+		rc, err := decompressor.OpenReader(f)
+		if err != nil {
+			return nil, "", errors.Errorf("decompressing kernel module %s: %w", module, err)
+		}
+		defer rc.Close()
+		r, target = rc, strings.TrimSuffix(module, suffix)
+		break
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", errors.Errorf("reading kernel module %s: %w", module, err)
+	}
+	return data, target, nil
+}
+
+// InjectKernelModules adds the named modules and their dependencies to the initramfs read from src, in
+// a single streaming pass of StreamEdit
+func InjectKernelModules(ctx context.Context, src io.Reader, modules *KernelModules, names ...string) (io.ReadCloser, error) {
+	ops, err := modules.Operations(ctx, names...)
+	if err != nil {
+		return nil, errors.Errorf("resolving kernel modules: %w", err)
+	}
+	return StreamEdit(ctx, src, ops...), nil
+}
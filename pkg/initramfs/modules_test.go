@@ -0,0 +1,126 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/cpio"
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/initramfs"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func modulesTree(t *testing.T) fstest.MapFS {
+	const dir = "lib/modules/6.12.1-harpoon/"
+	return fstest.MapFS{
+		dir + "modules.dep": {Data: []byte(
+			"kernel/net/netfilter/nf_conntrack.ko: kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko kernel/lib/libcrc32c.ko\n" +
+				"kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko:\n" +
+				"kernel/lib/libcrc32c.ko:\n" +
+				"kernel/net/netfilter/xt_conntrack.ko: kernel/net/netfilter/nf_conntrack.ko kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko kernel/lib/libcrc32c.ko\n" +
+				"kernel/fs/fuse/virtio-fs.ko.gz:\n",
+		)},
+		dir + "modules.builtin":                             {Data: []byte("kernel/fs/overlayfs/overlay.ko\n")},
+		dir + "kernel/net/netfilter/nf_conntrack.ko":        {Data: []byte("nf_conntrack")},
+		dir + "kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko": {Data: []byte("nf_defrag_ipv6")},
+		dir + "kernel/lib/libcrc32c.ko":                     {Data: []byte("libcrc32c")},
+		dir + "kernel/net/netfilter/xt_conntrack.ko":        {Data: []byte("xt_conntrack")},
+		dir + "kernel/fs/fuse/virtio-fs.ko.gz":              {Data: gzipped(t, []byte("virtiofs"))},
+	}
+}
+
+func TestKernelModulesResolveDependencyClosure(t *testing.T) {
+	ctx := context.Background()
+
+	modules, err := initramfs.LoadKernelModules(ctx, modulesTree(t))
+	require.NoError(t, err)
+	assert.Equal(t, "6.12.1-harpoon", modules.Version())
+
+	order, err := modules.Resolve(ctx, "xt_conntrack", "overlay", "virtio_fs", "libcrc32c")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"kernel/lib/libcrc32c.ko",
+		"kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko",
+		"kernel/net/netfilter/nf_conntrack.ko",
+		"kernel/net/netfilter/xt_conntrack.ko",
+		"kernel/fs/fuse/virtio-fs.ko.gz",
+	}, order, "dependencies load first, built in modules are skipped and modules are only listed once")
+
+	_, err = modules.Resolve(ctx, "missing")
+	require.ErrorContains(t, err, "kernel module missing not found for 6.12.1-harpoon")
+}
+
+func TestKernelModulesRejectCycles(t *testing.T) {
+	ctx := context.Background()
+
+	modules, err := initramfs.LoadKernelModules(ctx, fstest.MapFS{
+		"6.12.1/modules.dep": {Data: []byte("a.ko: b.ko\nb.ko: a.ko\n")},
+	})
+	require.NoError(t, err)
+
+	_, err = modules.Resolve(ctx, "a")
+	require.ErrorContains(t, err, "dependency cycle: a.ko -> b.ko -> a.ko")
+}
+
+func TestInjectKernelModules(t *testing.T) {
+	ctx := context.Background()
+
+	var archive bytes.Buffer
+	_, err := initramfs.Build(ctx, &archive, []initramfs.Entry{
+		initramfs.File("init", 0o755, []byte("harpoond")),
+	})
+	require.NoError(t, err)
+
+	modules, err := initramfs.LoadKernelModules(ctx, modulesTree(t))
+	require.NoError(t, err)
+
+	rc, err := initramfs.InjectKernelModules(ctx, &archive, modules, "nf_conntrack", "virtio-fs")
+	require.NoError(t, err)
+	defer rc.Close()
+	edited, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	fsys := cpio.NewFS(bytes.NewReader(edited))
+
+	data, err := fs.ReadFile(fsys, "lib/modules/6.12.1-harpoon/kernel/fs/fuse/virtio-fs.ko")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("virtiofs"), data, "compressed modules are injected decompressed")
+
+	data, err = fs.ReadFile(fsys, "lib/modules/6.12.1-harpoon/modules.dep")
+	require.NoError(t, err)
+	assert.Equal(t, "kernel/lib/libcrc32c.ko:\n"+
+		"kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko:\n"+
+		"kernel/net/netfilter/nf_conntrack.ko: kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko kernel/lib/libcrc32c.ko\n"+
+		"kernel/fs/fuse/virtio-fs.ko:\n", string(data))
+
+	data, err = fs.ReadFile(fsys, ec1init.KernelModulesFile[1:])
+	require.NoError(t, err)
+	assert.Equal(t, "/lib/modules/6.12.1-harpoon/kernel/lib/libcrc32c.ko\n"+
+		"/lib/modules/6.12.1-harpoon/kernel/net/ipv6/netfilter/nf_defrag_ipv6.ko\n"+
+		"/lib/modules/6.12.1-harpoon/kernel/net/netfilter/nf_conntrack.ko\n"+
+		"/lib/modules/6.12.1-harpoon/kernel/fs/fuse/virtio-fs.ko\n", string(data))
+
+	_, err = fs.Stat(fsys, "lib/modules/6.12.1-harpoon/kernel/net/netfilter/xt_conntrack.ko")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	data, err = fs.ReadFile(fsys, "init")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("harpoond"), data)
+}
@@ -0,0 +1,231 @@
+package kernel
+
+import (
+	"slices"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/units"
+)
+
+// Param is a kernel parameter. an empty value is rendered as a bare flag, like quiet, unless HasValue is set.
+type Param struct {
+	Key   string
+	Value string
+	// HasValue renders an empty value as key=, like ip=, which the kernel reads differently from the flag ip
+	HasValue bool
+}
+
+func (p Param) String() string {
+	if p.Value == "" && !p.HasValue {
+		return p.Key
+	}
+	return p.Key + "=" + quote(p.Value)
+}
+
+// CmdLine is a kernel command line: ordered parameters, then the arguments passed to init after --
+type CmdLine struct {
+	Params []Param
+	Init   []string
+}
+
+// ConsoleDevice is how the guest console is attached
+type ConsoleDevice string
+
+const (
+	// ConsoleVirtio is a virtio console, what the Virtualization Framework and libkrun attach
+	ConsoleVirtio ConsoleDevice = "virtio"
+	// ConsoleSerial is the uart of the platform
+	ConsoleSerial ConsoleDevice = "serial"
+)
+
+// Console returns the name of the console device on arch, like hvc0, ttyS0 or ttyAMA0
+func Console(arch string, device ConsoleDevice) string {
+	switch {
+	case device == ConsoleVirtio:
+		return "hvc0"
+	case arch == units.ArchARM64:
+		return "ttyAMA0"
+	}
+	return "ttyS0"
+}
+
+// ParseCmdLine splits a command line like the kernel does: on whitespace outside double quotes, with
+// the quotes removed. the arguments after the first -- are init arguments.
+func ParseCmdLine(s string) (*CmdLine, error) {
+	c := &CmdLine{}
+	afterInit := false
+	for {
+		arg, quoted, rest, err := nextArg(s)
+		if err != nil {
+			return nil, err
+		}
+		if arg == "" && !quoted {
+			return c, nil
+		}
+		s = rest
+
+		switch {
+		case afterInit:
+			c.Init = append(c.Init, arg)
+		case arg == "--" && !quoted:
+			afterInit = true
+		default:
+			key, value, found := strings.Cut(arg, "=")
+			// only an empty value needs HasValue to render as it was written
+			c.Params = append(c.Params, Param{Key: key, Value: value, HasValue: found && value == ""})
+		}
+	}
+}
+
+// nextArg returns the next argument of s without its quotes, whether it had any, and what follows it
+func nextArg(s string) (arg string, quoted bool, rest string, err error) {
+	s = strings.TrimLeft(s, " \t\n\v\f\r")
+
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '"':
+			inQuote = !inQuote
+			quoted = true
+		case !inQuote && isSpace(ch):
+			return b.String(), quoted, s[i:], nil
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	if inQuote {
+		return "", false, "", errors.Errorf("unterminated quote in kernel command line: %s", s)
+	}
+	return b.String(), quoted, "", nil
+}
+
+func isSpace(ch byte) bool {
+	return strings.IndexByte(" \t\n\v\f\r", ch) >= 0
+}
+
+// quote wraps values with whitespace in double quotes, the kernel has no other escaping
+func quote(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r < 0x80 && isSpace(byte(r)) }) < 0 {
+		return s
+	}
+	return `"` + s + `"`
+}
+
+func (c *CmdLine) String() string {
+	args := make([]string, 0, len(c.Params)+len(c.Init)+1)
+	for _, p := range c.Params {
+		args = append(args, p.String())
+	}
+	if len(c.Init) > 0 {
+		args = append(args, "--")
+		for _, arg := range c.Init {
+			args = append(args, quote(arg))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// Validate checks that the command line renders to what ParseCmdLine reads back
+func (c *CmdLine) Validate() error {
+	for _, p := range c.Params {
+		if p.Key == "" || p.Key == "--" || strings.ContainsAny(p.Key, "=\" \t\n\v\f\r") {
+			return errors.Errorf("invalid kernel parameter name %q", p.Key)
+		}
+		if strings.Contains(p.Value, `"`) {
+			return errors.Errorf("kernel parameter %s cannot contain a double quote", p.Key)
+		}
+	}
+	for _, arg := range c.Init {
+		if strings.Contains(arg, `"`) {
+			return errors.Errorf("init argument %q cannot contain a double quote", arg)
+		}
+	}
+	return nil
+}
+
+func (c *CmdLine) MarshalText() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return []byte(c.String()), nil
+}
+
+func (c *CmdLine) UnmarshalText(text []byte) error {
+	parsed, err := ParseCmdLine(string(text))
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
+
+// Get returns the value of the last occurrence of key, the one the kernel uses
+func (c *CmdLine) Get(key string) (string, bool) {
+	for _, p := range slices.Backward(c.Params) {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces every occurrence of key with one parameter where the first one was, or appends it
+func (c *CmdLine) Set(key, value string) {
+	c.replace(key, Param{Key: key, Value: value})
+}
+
+// Add appends a parameter, keeping earlier ones with the same key, like a second console
+func (c *CmdLine) Add(key, value string) {
+	c.Params = append(c.Params, Param{Key: key, Value: value})
+}
+
+// Delete removes every occurrence of key
+func (c *CmdLine) Delete(key string) {
+	c.replace(key)
+}
+
+// SetConsole selects the console the kernel and init write to
+func (c *CmdLine) SetConsole(arch string, device ConsoleDevice) {
+	c.Set("console", Console(arch, device))
+}
+
+// Merge overrides the parameters of c with those of other, key by key, and appends the init arguments
+// of other. keys other repeats, like console, replace all of those in c.
+func (c *CmdLine) Merge(other *CmdLine) {
+	if other == nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, p := range other.Params {
+		if seen[p.Key] {
+			continue
+		}
+		seen[p.Key] = true
+
+		var params []Param
+		for _, o := range other.Params {
+			if o.Key == p.Key {
+				params = append(params, o)
+			}
+		}
+		c.replace(p.Key, params...)
+	}
+	c.Init = append(c.Init, other.Init...)
+}
+
+// replace puts params where the first occurrence of key was, or at the end, and removes the others
+func (c *CmdLine) replace(key string, params ...Param) {
+	at := slices.IndexFunc(c.Params, func(p Param) bool { return p.Key == key })
+	c.Params = slices.DeleteFunc(c.Params, func(p Param) bool { return p.Key == key })
+	if at < 0 {
+		at = len(c.Params)
+	}
+	c.Params = slices.Insert(c.Params, at, params...)
+}
+
+func (c *CmdLine) Clone() *CmdLine {
+	return &CmdLine{Params: slices.Clone(c.Params), Init: slices.Clone(c.Init)}
+}
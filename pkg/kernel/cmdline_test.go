@@ -0,0 +1,111 @@
+package kernel_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/kernel"
+)
+
+func TestParseCmdLine(t *testing.T) {
+	cmdline, err := kernel.ParseCmdLine(` console=hvc0  quiet "dyndbg=file x.c +p" root=LABEL="my root"	--  --debug "two words" `)
+	require.NoError(t, err)
+
+	assert.Equal(t, []kernel.Param{
+		{Key: "console", Value: "hvc0"},
+		{Key: "quiet"},
+		{Key: "dyndbg", Value: "file x.c +p"},
+		{Key: "root", Value: "LABEL=my root"},
+	}, cmdline.Params)
+	assert.Equal(t, []string{"--debug", "two words"}, cmdline.Init)
+
+	assert.Equal(t, `console=hvc0 quiet dyndbg="file x.c +p" root="LABEL=my root" -- --debug "two words"`, cmdline.String())
+
+	again, err := kernel.ParseCmdLine(cmdline.String())
+	require.NoError(t, err)
+	assert.Equal(t, cmdline, again)
+
+	_, err = kernel.ParseCmdLine(`root="unterminated`)
+	require.ErrorContains(t, err, "unterminated quote")
+
+	empty, err := kernel.ParseCmdLine("")
+	require.NoError(t, err)
+	assert.Empty(t, empty.String())
+}
+
+func TestParseCmdLineEmptyValues(t *testing.T) {
+	cmdline, err := kernel.ParseCmdLine(`ip= quiet root="" rd.break`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []kernel.Param{
+		{Key: "ip", HasValue: true},
+		{Key: "quiet"},
+		{Key: "root", HasValue: true},
+		{Key: "rd.break"},
+	}, cmdline.Params)
+	assert.Equal(t, "ip= quiet root= rd.break", cmdline.String())
+
+	again, err := kernel.ParseCmdLine(cmdline.String())
+	require.NoError(t, err)
+	assert.Equal(t, cmdline, again)
+
+	value, ok := cmdline.Get("ip")
+	assert.True(t, ok)
+	assert.Empty(t, value)
+}
+
+func TestCmdLineSetAndMerge(t *testing.T) {
+	cmdline, err := kernel.ParseCmdLine("console=ttyS0 loglevel=4 console=tty0 ro -- --foo")
+	require.NoError(t, err)
+
+	cmdline.SetConsole("arm64", kernel.ConsoleVirtio)
+	cmdline.Set("init", "/sbin/harpoond")
+	cmdline.Add("earlycon", "")
+	assert.Equal(t, "console=hvc0 loglevel=4 ro init=/sbin/harpoond earlycon -- --foo", cmdline.String())
+
+	value, ok := cmdline.Get("loglevel")
+	assert.True(t, ok)
+	assert.Equal(t, "4", value)
+
+	user, err := kernel.ParseCmdLine("quiet loglevel=7 console=ttyAMA0 console=hvc0 -- --bar")
+	require.NoError(t, err)
+
+	merged := cmdline.Clone()
+	merged.Merge(user)
+	merged.Delete("ro")
+	assert.Equal(t, "console=ttyAMA0 console=hvc0 loglevel=7 init=/sbin/harpoond earlycon quiet -- --foo --bar", merged.String())
+	assert.Equal(t, "console=hvc0 loglevel=4 ro init=/sbin/harpoond earlycon -- --foo", cmdline.String(), "clones are independent")
+
+	merged.Merge(nil)
+	assert.Equal(t, "console=ttyAMA0 console=hvc0 loglevel=7 init=/sbin/harpoond earlycon quiet -- --foo --bar", merged.String())
+}
+
+func TestCmdLineValidate(t *testing.T) {
+	require.NoError(t, (&kernel.CmdLine{Params: []kernel.Param{{Key: "root", Value: "LABEL=a b"}}}).Validate())
+
+	require.ErrorContains(t, (&kernel.CmdLine{Params: []kernel.Param{{Key: "bad key", Value: "x"}}}).Validate(), `invalid kernel parameter name "bad key"`)
+	require.ErrorContains(t, (&kernel.CmdLine{Params: []kernel.Param{{Key: "x", Value: `a"b`}}}).Validate(), "cannot contain a double quote")
+	require.ErrorContains(t, (&kernel.CmdLine{Init: []string{`"`}}).Validate(), "cannot contain a double quote")
+
+	data, err := json.Marshal(struct {
+		CmdLine *kernel.CmdLine `json:"cmdline"`
+	}{&kernel.CmdLine{Params: []kernel.Param{{Key: "console", Value: "hvc0"}}, Init: []string{"-v"}}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"cmdline": "console=hvc0 -- -v"}`, string(data))
+
+	var decoded struct {
+		CmdLine *kernel.CmdLine `json:"cmdline"`
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, []string{"-v"}, decoded.CmdLine.Init)
+}
+
+func TestConsole(t *testing.T) {
+	assert.Equal(t, "hvc0", kernel.Console("arm64", kernel.ConsoleVirtio))
+	assert.Equal(t, "hvc0", kernel.Console("amd64", kernel.ConsoleVirtio))
+	assert.Equal(t, "ttyAMA0", kernel.Console("arm64", kernel.ConsoleSerial))
+	assert.Equal(t, "ttyS0", kernel.Console("amd64", kernel.ConsoleSerial))
+}
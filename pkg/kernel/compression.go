@@ -0,0 +1,100 @@
+package kernel
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+)
+
+var ErrUnsupportedCompression = errors.New("unsupported kernel compression")
+
+// Compression is a compression format the kernel build supports for its payloads
+type Compression string
+
+const (
+	CompressionNone  Compression = ""
+	CompressionGzip  Compression = "gzip"
+	CompressionXz    Compression = "xz"
+	CompressionZstd  Compression = "zstd"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionLz4   Compression = "lz4"
+	CompressionLzma  Compression = "lzma"
+	CompressionLzo   Compression = "lzo"
+)
+
+// maxDecompressedSize bounds decompressed payloads, well above any real kernel
+const maxDecompressedSize = 1 << 30
+
+var compressionMagics = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionBzip2, []byte("BZh")},
+	// the legacy lz4 frame the kernel build writes
+	{CompressionLz4, []byte{0x02, 0x21, 0x4c, 0x18}},
+	{CompressionLzma, []byte{0x5d, 0x00, 0x00}},
+	{CompressionLzo, []byte{0x89, 'L', 'Z', 'O'}},
+}
+
+func compressionOf(head []byte) Compression {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// zbootCompression maps the compression name in a zboot header to its Compression
+func zbootCompression(name string) Compression {
+	if name == "xzkern" {
+		return CompressionXz
+	}
+	return Compression(name)
+}
+
+func (c Compression) decompressor() (archives.Decompressor, error) {
+	switch c {
+	case CompressionGzip:
+		return archives.Gz{}, nil
+	case CompressionXz:
+		return archives.Xz{}, nil
+	case CompressionZstd:
+		return archives.Zstd{}, nil
+	case CompressionBzip2:
+		return archives.Bz2{}, nil
+	case CompressionLz4:
+		return archives.Lz4{}, nil
+	}
+	return nil, errors.Errorf("%w: %q", ErrUnsupportedCompression, c)
+}
+
+// decompress reads the stream a payload holds. the kernel build appends the decompressed size to its
+// payloads, so an error after the stream ended is not fatal.
+func decompress(c Compression, payload io.Reader) ([]byte, error) {
+	d, err := c.decompressor()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := d.OpenReader(payload)
+	if err != nil {
+		return nil, errors.Errorf("opening %s stream: %w", c, err)
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(rc, maxDecompressedSize+1))
+	if n > maxDecompressedSize {
+		return nil, errors.Errorf("%s stream decompresses to more than %d bytes", c, maxDecompressedSize)
+	}
+	if err != nil && n == 0 {
+		return nil, errors.Errorf("reading %s stream: %w", c, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,213 @@
+package kernel
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/magic"
+	"github.com/walteh/ec1/pkg/units"
+)
+
+const (
+	// headerSize covers the arm64, x86 and zboot headers
+	headerSize = 4096
+
+	// maxDepth bounds how many compressed payloads are unpacked
+	maxDepth = 3
+)
+
+func inspect(r io.ReaderAt, size int64, depth int) (*Image, error) {
+	img, payload, err := identify(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload == nil {
+		if err := scan(r, size, img); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	if depth >= maxDepth {
+		return nil, errors.Errorf("%s nests more than %d compressed payloads", img, maxDepth)
+	}
+
+	data, err := decompress(img.Compression, payload)
+	if errors.Is(err, ErrUnsupportedCompression) && img.Format != FormatCompressed {
+		return img, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("decompressing %s: %w", img, err)
+	}
+
+	inner, err := inspect(bytes.NewReader(data), int64(len(data)), depth+1)
+	if err != nil {
+		return nil, errors.Errorf("inspecting the payload of %s: %w", img, err)
+	}
+
+	inner.data = data
+	img.Inner = inner
+	if img.Arch == "" {
+		img.Arch = inner.Arch
+	}
+	img.Banner, img.Config = inner.Banner, inner.Config
+	if inner.Version != "" {
+		img.Version = inner.Version
+	}
+	return img, nil
+}
+
+// identify reads the format, architecture and payload compression from the header of the image in r,
+// returning the compressed payload it carries without unpacking it
+func identify(r io.ReaderAt, size int64) (*Image, io.Reader, error) {
+	head := make([]byte, headerSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, nil, errors.Errorf("reading kernel header: %w", err)
+	}
+	head = head[:n]
+
+	img := &Image{}
+	if magic.PEMagic.Matches(head, 0) {
+		img.Arch = peArch(r)
+		img.EFIStub = img.Arch != ""
+	}
+
+	// the compressed payload the image carries
+	var payload io.Reader
+
+	switch {
+	case magic.PEMagic.Matches(head, 0) && magic.EFIZbootMagic.Matches(head, magic.EFIZbootMagicOffset):
+		img.Format = FormatEFIZboot
+		if len(head) < 56 {
+			return nil, nil, errors.Errorf("truncated EFI zboot header")
+		}
+		offset := int64(binary.LittleEndian.Uint32(head[8:]))
+		length := int64(binary.LittleEndian.Uint32(head[12:]))
+		name, _, _ := bytes.Cut(head[24:56], []byte{0})
+		img.Compression = zbootCompression(string(name))
+		payload = io.NewSectionReader(r, offset, length)
+
+	case magic.X86Header.Matches(head, magic.X86HeaderOffset) && magic.X86BootFlag.Matches(head, magic.X86BootFlagOffset):
+		img.Format = FormatBzImage
+		if err := parseSetupHeader(r, head, img, &payload); err != nil {
+			return nil, nil, err
+		}
+
+	case magic.ARM64Magic.Matches(head, magic.ARM64MagicOffset):
+		img.Format = FormatArm64Image
+		img.Arch = units.ArchARM64
+
+	case magic.ELFMagic.Matches(head, 0):
+		f, err := elf.NewFile(r)
+		if err != nil {
+			return nil, nil, errors.Errorf("reading vmlinux: %w", err)
+		}
+		img.Format = FormatELF
+		img.Arch = elfArch(f.Machine)
+
+	default:
+		img.Compression = compressionOf(head)
+		if img.Compression == CompressionNone {
+			return nil, nil, ErrUnknownFormat
+		}
+		img.Format = FormatCompressed
+		payload = io.NewSectionReader(r, 0, size)
+	}
+
+	return img, payload, nil
+}
+
+// parseSetupHeader reads the x86 setup header of a bzImage, see Documentation/arch/x86/boot.rst
+func parseSetupHeader(r io.ReaderAt, head []byte, img *Image, payload *io.Reader) error {
+	if len(head) < 0x250 {
+		return errors.Errorf("truncated bzImage setup header")
+	}
+
+	version := binary.LittleEndian.Uint16(head[0x206:])
+	setupSects := int64(head[0x1f1])
+	if setupSects == 0 {
+		setupSects = 4
+	}
+
+	img.Arch = "386"
+	// XLF_KERNEL_64 in xloadflags, protocol 2.12
+	if version >= 0x020c && head[0x236]&1 != 0 {
+		img.Arch = units.ArchAMD64
+	}
+
+	// kernel_version points at a string after the boot sector, protocol 2.00
+	if ptr := int64(binary.LittleEndian.Uint16(head[0x20e:])); ptr != 0 {
+		buf := make([]byte, 256)
+		n, _ := r.ReadAt(buf, ptr+0x200)
+		s, _, _ := strings.Cut(string(buf[:n]), "\x00")
+		if release, _, _ := strings.Cut(s, " "); release != "" {
+			img.Version = release
+		}
+	}
+
+	// payload_offset and payload_length, protocol 2.08
+	if version < 0x0208 {
+		return nil
+	}
+	offset := int64(binary.LittleEndian.Uint32(head[0x248:]))
+	length := int64(binary.LittleEndian.Uint32(head[0x24c:]))
+	if length == 0 {
+		return nil
+	}
+
+	protectedMode := (setupSects + 1) * 512
+	peek := make([]byte, 8)
+	n, err := r.ReadAt(peek, protectedMode+offset)
+	if err != nil && err != io.EOF {
+		return errors.Errorf("reading bzImage payload: %w", err)
+	}
+	img.Compression = compressionOf(peek[:n])
+	if img.Compression == CompressionNone {
+		return errors.Errorf("bzImage payload is not compressed with a known format")
+	}
+	*payload = io.NewSectionReader(r, protectedMode+offset, length)
+	return nil
+}
+
+// peArch returns the GOARCH of the PE header of an EFI stub, or "" without one
+func peArch(r io.ReaderAt) string {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	switch f.Machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return units.ArchAMD64
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return units.ArchARM64
+	case pe.IMAGE_FILE_MACHINE_RISCV64:
+		return "riscv64"
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "386"
+	}
+	return ""
+}
+
+func elfArch(machine elf.Machine) string {
+	switch machine {
+	case elf.EM_X86_64:
+		return units.ArchAMD64
+	case elf.EM_AARCH64:
+		return units.ArchARM64
+	case elf.EM_RISCV:
+		return "riscv64"
+	case elf.EM_386:
+		return "386"
+	}
+	return strings.ToLower(strings.TrimPrefix(machine.String(), "EM_"))
+}
@@ -0,0 +1,201 @@
+// Package kernel identifies linux kernel images, so user supplied kernels can be validated before they
+// are handed to a hypervisor, and builds the command lines they boot with.
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"math"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/units"
+)
+
+var ErrUnknownFormat = errors.New("not a linux kernel image")
+
+// Format is the container a kernel image comes in
+type Format string
+
+const (
+	// FormatELF is an uncompressed vmlinux
+	FormatELF Format = "vmlinux"
+	// FormatBzImage is a self decompressing x86 kernel
+	FormatBzImage Format = "bzImage"
+	// FormatArm64Image is an uncompressed arm64 Image
+	FormatArm64Image Format = "arm64 Image"
+	// FormatEFIZboot is an EFI application decompressing the kernel it carries, like arm64 vmlinuz.efi
+	FormatEFIZboot Format = "EFI zboot"
+	// FormatCompressed is a kernel image in a plain compressed stream, like Image.gz
+	FormatCompressed Format = "compressed"
+)
+
+// Backend is a hypervisor backend that boots linux kernels directly
+type Backend string
+
+const (
+	BackendVirtualizationFramework Backend = "vf"
+	BackendLibkrun                 Backend = "libkrun"
+)
+
+// Backends lists every backend, in the order Image.Backends reports them
+var Backends = []Backend{BackendVirtualizationFramework, BackendLibkrun}
+
+// Image describes a kernel image
+type Image struct {
+	Format Format
+	// Compression of the kernel a bzImage, zboot image or compressed stream carries
+	Compression Compression
+	// Arch is the GOARCH of the kernel
+	Arch string
+	// EFIStub reports a PE header, so EFI firmware can start the image
+	EFIStub bool
+
+	// Banner is the "Linux version" line the kernel prints at boot
+	Banner string
+	// Version is the release from the banner, like 6.15.0-rc7
+	Version string
+	// Config is the .config embedded by CONFIG_IKCONFIG
+	Config []byte
+
+	// Inner is the image a bzImage, zboot image or compressed stream decompresses to, when the
+	// compression is supported
+	Inner *Image
+
+	// data holds the decompressed bytes of an inner image
+	data []byte
+}
+
+// Inspect identifies the kernel image in r, unpacking compressed payloads to find its banner and
+// embedded config. the size of r is taken from a Size or Stat method when it has one.
+func Inspect(r io.ReaderAt) (*Image, error) {
+	return inspect(r, sizeOf(r), 0)
+}
+
+// Identify reads the format and architecture of the kernel image in r from its header alone, without
+// unpacking or scanning it, which is all checking whether a backend boots it needs. it finds no banner or
+// config, and a plain compressed stream has no architecture until it is inspected.
+func Identify(r io.ReaderAt) (*Image, error) {
+	img, _, err := identify(r, sizeOf(r))
+	return img, err
+}
+
+// Unpack returns the outermost image in r that backend boots directly, with a reader over its bytes.
+// compressed wrappers like Image.gz or EFI zboot are unpacked in memory.
+func Unpack(r io.ReaderAt, backend Backend) (*Image, io.ReaderAt, error) {
+	img, err := Inspect(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for cur := img; cur != nil; cur = cur.Inner {
+		if cur.Bootable(backend) == nil {
+			return cur, r, nil
+		}
+		if cur.Inner != nil {
+			r = bytes.NewReader(cur.Inner.data)
+		}
+	}
+	return nil, nil, img.Bootable(backend)
+}
+
+func (img *Image) String() string {
+	switch img.Format {
+	case FormatCompressed:
+		if img.Inner != nil {
+			return string(img.Compression) + " compressed " + img.Inner.String()
+		}
+		return string(img.Compression) + " compressed data"
+	case FormatEFIZboot:
+		return string(img.Format) + " (" + string(img.Compression) + ")"
+	case FormatELF:
+		if img.Arch != "" {
+			return img.Arch + " " + string(img.Format)
+		}
+	}
+	return string(img.Format)
+}
+
+// Bootable returns why backend cannot boot the image directly, or nil if it can
+func (img *Image) Bootable(backend Backend) error {
+	switch backend {
+	case BackendVirtualizationFramework:
+		// VZLinuxBootLoader only decompresses kernels on intel
+		switch {
+		case img.Format == FormatArm64Image:
+		case img.Arch == units.ArchAMD64 && (img.Format == FormatBzImage || img.Format == FormatELF):
+		default:
+			return errors.Errorf("%s boots an uncompressed arm64 Image or an amd64 bzImage or vmlinux, not a %s", backend, img)
+		}
+	case BackendLibkrun:
+		// the formats krun_set_kernel accepts
+		switch {
+		case img.Format == FormatArm64Image:
+		case img.Format == FormatELF && img.Arch == units.ArchAMD64:
+		case img.Format == FormatEFIZboot && img.Compression == CompressionGzip:
+		case img.Format == FormatCompressed && img.Inner != nil && img.Inner.Format == FormatArm64Image &&
+			(img.Compression == CompressionGzip || img.Compression == CompressionBzip2 || img.Compression == CompressionZstd):
+		default:
+			return errors.Errorf("%s boots an arm64 Image, its gzip, bzip2 or zstd compressed stream, a gzip EFI zboot image or an amd64 vmlinux, not a %s", backend, img)
+		}
+	default:
+		return errors.Errorf("unknown hypervisor backend %q", backend)
+	}
+	return nil
+}
+
+// Backends returns the backends that can boot the image directly
+func (img *Image) Backends() []Backend {
+	var backends []Backend
+	for _, backend := range Backends {
+		if img.Bootable(backend) == nil {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// Validate checks that backend can boot the image directly on arch
+func (img *Image) Validate(arch string, backend Backend) error {
+	if img.Arch == "" {
+		if err := img.Bootable(backend); err != nil {
+			return err
+		}
+		return errors.Errorf("the architecture of the %s kernel is unknown until it is inspected", img)
+	}
+	if img.Arch != arch {
+		return errors.Errorf("%s kernel cannot boot on %s", img.Arch, arch)
+	}
+	return img.Bootable(backend)
+}
+
+// ConfigValue returns the value of an option in the embedded config, with or without its CONFIG_
+// prefix. options that are not set are not found.
+func (img *Image) ConfigValue(name string) (string, bool) {
+	prefix := "CONFIG_" + strings.TrimPrefix(name, "CONFIG_") + "="
+
+	scanner := bufio.NewScanner(bytes.NewReader(img.Config))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), prefix); ok {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
+
+// sizeOf returns the size of r, or the largest possible size when r does not know it so reads run
+// until io.EOF
+func sizeOf(r io.ReaderAt) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return math.MaxInt64
+}
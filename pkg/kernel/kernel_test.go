@@ -0,0 +1,243 @@
+package kernel_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/kernel"
+)
+
+const (
+	banner = "Linux version 6.15.0-rc7-harpoon (builder@ec1) (gcc 14.2) #1 SMP PREEMPT"
+	config = "CONFIG_LOCALVERSION=\"-harpoon\"\n# CONFIG_MODULES is not set\nCONFIG_VIRTIO_FS=y\n"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// body holds what the inspector looks for past the header, with the banner straddling a read chunk
+func body(t *testing.T, header []byte) []byte {
+	t.Helper()
+	data := append([]byte{}, header...)
+	data = append(data, "<5>%s version %s\x00Linux version %s\x00"...)
+	data = append(data, "IKCFG_ST is a marker\x00"...)
+	data = append(data, make([]byte, 1<<20-len(data)-5)...)
+	data = append(data, banner+"\n\x00"...)
+	data = append(data, "IKCFG_ST"...)
+	data = append(data, gzipped(t, []byte(config))...)
+	data = append(data, "IKCFG_ED"...)
+	return data
+}
+
+func arm64Image(t *testing.T) []byte {
+	header := make([]byte, 64)
+	binary.LittleEndian.PutUint64(header[8:], 0x80000)
+	copy(header[0x38:], "ARM\x64")
+	return body(t, header)
+}
+
+func amd64Vmlinux(t *testing.T) []byte {
+	header := make([]byte, 64)
+	copy(header, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(header[16:], 2)  // ET_EXEC
+	binary.LittleEndian.PutUint16(header[18:], 62) // EM_X86_64
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[52:], 64)
+	return body(t, header)
+}
+
+// withSize appends the decompressed size like the kernel build does to its payloads
+func withSize(compressed []byte, size int) []byte {
+	return binary.LittleEndian.AppendUint32(compressed, uint32(size))
+}
+
+func bzImage(t *testing.T) []byte {
+	vmlinux := amd64Vmlinux(t)
+	payload := withSize(gzipped(t, vmlinux), len(vmlinux))
+
+	data := make([]byte, 2*512)
+	data[0x1f1] = 1 // setup_sects
+	copy(data[0x1fe:], "\x55\xaa")
+	copy(data[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(data[0x206:], 0x020f)
+	binary.LittleEndian.PutUint16(data[0x20e:], 0x100)
+	data[0x236] = 1 // XLF_KERNEL_64
+	binary.LittleEndian.PutUint32(data[0x248:], 0)
+	binary.LittleEndian.PutUint32(data[0x24c:], uint32(len(payload)))
+	copy(data[0x300:], "6.15.0-rc7-harpoon (builder@ec1) #1 SMP PREEMPT\x00")
+	return append(data, payload...)
+}
+
+func zboot(t *testing.T, compression string) []byte {
+	image := arm64Image(t)
+	payload := withSize(gzipped(t, image), len(image))
+
+	data := make([]byte, 512)
+	copy(data, "MZ\x00\x00zimg")
+	binary.LittleEndian.PutUint32(data[8:], 512)
+	binary.LittleEndian.PutUint32(data[12:], uint32(len(payload)))
+	copy(data[24:], compression)
+	return append(data, payload...)
+}
+
+func TestInspect(t *testing.T) {
+	image := arm64Image(t)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		format      kernel.Format
+		compression kernel.Compression
+		arch        string
+		backends    []kernel.Backend
+	}{
+		{"arm64 Image", image, kernel.FormatArm64Image, kernel.CompressionNone, "arm64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework, kernel.BackendLibkrun}},
+		{"Image.gz", withSize(gzipped(t, image), len(image)), kernel.FormatCompressed, kernel.CompressionGzip, "arm64",
+			[]kernel.Backend{kernel.BackendLibkrun}},
+		{"EFI zboot", zboot(t, "gzip"), kernel.FormatEFIZboot, kernel.CompressionGzip, "arm64",
+			[]kernel.Backend{kernel.BackendLibkrun}},
+		{"vmlinux", amd64Vmlinux(t), kernel.FormatELF, kernel.CompressionNone, "amd64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework, kernel.BackendLibkrun}},
+		{"bzImage", bzImage(t), kernel.FormatBzImage, kernel.CompressionGzip, "amd64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := kernel.Inspect(bytes.NewReader(tt.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.format, img.Format)
+			assert.Equal(t, tt.compression, img.Compression)
+			assert.Equal(t, tt.arch, img.Arch)
+			assert.Equal(t, tt.backends, img.Backends())
+
+			assert.Equal(t, banner, img.Banner)
+			assert.Equal(t, "6.15.0-rc7-harpoon", img.Version)
+			assert.Equal(t, config, string(img.Config))
+		})
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	image := arm64Image(t)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		format   kernel.Format
+		arch     string
+		backends []kernel.Backend
+	}{
+		{"arm64 Image", image, kernel.FormatArm64Image, "arm64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework, kernel.BackendLibkrun}},
+		{"EFI zboot", zboot(t, "gzip"), kernel.FormatEFIZboot, "", []kernel.Backend{kernel.BackendLibkrun}},
+		{"vmlinux", amd64Vmlinux(t), kernel.FormatELF, "amd64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework, kernel.BackendLibkrun}},
+		{"bzImage", bzImage(t), kernel.FormatBzImage, "amd64",
+			[]kernel.Backend{kernel.BackendVirtualizationFramework}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := kernel.Identify(bytes.NewReader(tt.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.format, img.Format)
+			assert.Equal(t, tt.arch, img.Arch)
+			assert.Equal(t, tt.backends, img.Backends())
+			assert.Nil(t, img.Inner, "the payload is not unpacked")
+			assert.Empty(t, img.Banner, "the image is not scanned")
+			assert.Empty(t, img.Config)
+		})
+	}
+
+	img, err := kernel.Identify(bytes.NewReader(bzImage(t)))
+	require.NoError(t, err)
+	assert.Equal(t, "6.15.0-rc7-harpoon", img.Version, "the setup header names the release")
+	require.NoError(t, img.Validate("amd64", kernel.BackendVirtualizationFramework))
+
+	img, err = kernel.Identify(bytes.NewReader(withSize(gzipped(t, image), len(image))))
+	require.NoError(t, err)
+	assert.Equal(t, kernel.FormatCompressed, img.Format)
+	require.ErrorContains(t, img.Validate("arm64", kernel.BackendVirtualizationFramework), "vf boots an uncompressed arm64 Image")
+
+	img, err = kernel.Identify(bytes.NewReader(zboot(t, "gzip")))
+	require.NoError(t, err)
+	require.ErrorContains(t, img.Validate("arm64", kernel.BackendLibkrun), "unknown until it is inspected")
+}
+
+func TestInspectUnsupportedPayloadCompression(t *testing.T) {
+	img, err := kernel.Inspect(bytes.NewReader(zboot(t, "lzo")))
+	require.NoError(t, err)
+
+	assert.Equal(t, kernel.FormatEFIZboot, img.Format)
+	assert.Equal(t, kernel.CompressionLzo, img.Compression)
+	assert.Nil(t, img.Inner, "the payload is identified but not unpacked")
+	assert.Empty(t, img.Banner)
+	require.ErrorContains(t, img.Bootable(kernel.BackendLibkrun), "libkrun boots an arm64 Image")
+}
+
+func TestInspectRejectsOtherFiles(t *testing.T) {
+	_, err := kernel.Inspect(bytes.NewReader([]byte("#!/bin/sh\necho not a kernel\n")))
+	require.ErrorIs(t, err, kernel.ErrUnknownFormat)
+
+	_, err = kernel.Inspect(bytes.NewReader(gzipped(t, []byte("not a kernel either"))))
+	require.ErrorIs(t, err, kernel.ErrUnknownFormat)
+}
+
+func TestImageValidate(t *testing.T) {
+	img, err := kernel.Inspect(bytes.NewReader(withSize(gzipped(t, arm64Image(t)), 0)))
+	require.NoError(t, err)
+
+	require.NoError(t, img.Validate("arm64", kernel.BackendLibkrun))
+	require.ErrorContains(t, img.Validate("arm64", kernel.BackendVirtualizationFramework),
+		"vf boots an uncompressed arm64 Image or an amd64 bzImage or vmlinux, not a gzip compressed arm64 Image")
+	require.ErrorContains(t, img.Validate("amd64", kernel.BackendLibkrun), "arm64 kernel cannot boot on amd64")
+
+	value, ok := img.ConfigValue("LOCALVERSION")
+	assert.True(t, ok)
+	assert.Equal(t, "-harpoon", value)
+
+	value, ok = img.ConfigValue("CONFIG_VIRTIO_FS")
+	assert.True(t, ok)
+	assert.Equal(t, "y", value)
+
+	_, ok = img.ConfigValue("MODULES")
+	assert.False(t, ok)
+}
+
+func TestUnpack(t *testing.T) {
+	image := arm64Image(t)
+
+	for _, data := range [][]byte{image, withSize(gzipped(t, image), len(image)), zboot(t, "gzip")} {
+		img, r, err := kernel.Unpack(bytes.NewReader(data), kernel.BackendVirtualizationFramework)
+		require.NoError(t, err)
+		assert.Equal(t, kernel.FormatArm64Image, img.Format)
+
+		unpacked := make([]byte, len(image))
+		_, err = r.ReadAt(unpacked, 0)
+		require.NoError(t, err)
+		assert.Equal(t, image, unpacked)
+	}
+
+	img, _, err := kernel.Unpack(bytes.NewReader(zboot(t, "gzip")), kernel.BackendLibkrun)
+	require.NoError(t, err)
+	assert.Equal(t, kernel.FormatEFIZboot, img.Format, "libkrun boots gzip zboot images as they are")
+
+	_, _, err = kernel.Unpack(bytes.NewReader(zboot(t, "lzo")), kernel.BackendVirtualizationFramework)
+	require.ErrorContains(t, err, "not a EFI zboot (lzo)")
+}
@@ -0,0 +1,115 @@
+package kernel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	scanChunkSize = 1 << 20
+
+	// maxBannerSize and maxConfigSize bound what is read past their markers
+	maxBannerSize = 512
+	maxConfigSize = 16 << 20
+)
+
+var (
+	bannerMarker = []byte("Linux version ")
+
+	// kernel/configs.c wraps the gzip compressed .config in these
+	configStartMarker = []byte("IKCFG_ST")
+)
+
+// scan looks through an uncompressed kernel for its banner and embedded config
+func scan(r io.ReaderAt, size int64, img *Image) error {
+	banner, err := findBanner(r, size)
+	if err != nil {
+		return errors.Errorf("finding the linux banner: %w", err)
+	}
+	img.Banner = banner
+	if fields := strings.Fields(banner); len(fields) > 2 {
+		img.Version = fields[2]
+	}
+
+	config, err := findConfig(r, size)
+	if err != nil {
+		return errors.Errorf("finding the embedded config: %w", err)
+	}
+	img.Config = config
+	return nil
+}
+
+// findBanner returns the linux_banner string, which starts with the release unlike the printf
+// formats that mention "Linux version"
+func findBanner(r io.ReaderAt, size int64) (string, error) {
+	for off := int64(0); ; {
+		at, err := index(r, size, off, bannerMarker)
+		if err != nil || at < 0 {
+			return "", err
+		}
+		off = at + 1
+
+		buf := make([]byte, maxBannerSize)
+		n, err := r.ReadAt(buf, at)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		banner := buf[:n]
+		if i := bytes.IndexAny(banner, "\n\x00"); i >= 0 {
+			banner = banner[:i]
+		}
+		if release := banner[len(bannerMarker):]; len(release) > 0 && release[0] >= '0' && release[0] <= '9' {
+			return string(banner), nil
+		}
+	}
+}
+
+// findConfig returns the .config embedded by CONFIG_IKCONFIG, or nil when there is none
+func findConfig(r io.ReaderAt, size int64) ([]byte, error) {
+	for off := int64(0); ; {
+		at, err := index(r, size, off, configStartMarker)
+		if err != nil || at < 0 {
+			return nil, err
+		}
+		off = at + 1
+
+		start := at + int64(len(configStartMarker))
+		zr, err := gzip.NewReader(io.NewSectionReader(r, start, size-start))
+		if err != nil {
+			// the marker also shows up in code referencing it
+			continue
+		}
+		zr.Multistream(false)
+		config, err := io.ReadAll(io.LimitReader(zr, maxConfigSize))
+		if err != nil {
+			continue
+		}
+		return config, nil
+	}
+}
+
+// index returns the offset of the first pattern at or after off, or -1 when there is none
+func index(r io.ReaderAt, size int64, off int64, pattern []byte) (int64, error) {
+	buf := make([]byte, scanChunkSize+len(pattern)-1)
+	for off < size {
+		if remaining := size - off; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		n, err := r.ReadAt(buf, off)
+		if i := bytes.Index(buf[:n], pattern); i >= 0 {
+			return off + int64(i), nil
+		}
+		if err == io.EOF || n < len(pattern) {
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		off += int64(n - len(pattern) + 1)
+	}
+	return -1, nil
+}
@@ -5,6 +5,26 @@ type MagicString string
 const (
 	ARM64MagicOffset             = 56
 	ARM64Magic       MagicString = "ARM\x64"
+
+	// the x86 boot protocol setup header, see Documentation/arch/x86/boot.rst
+	X86BootFlagOffset             = 0x1fe
+	X86BootFlag       MagicString = "\x55\xaa"
+	X86HeaderOffset               = 0x202
+	X86Header         MagicString = "HdrS"
+
+	// the header of an EFI zboot image, see drivers/firmware/efi/libstub/zboot-header.S
+	EFIZbootMagicOffset             = 4
+	EFIZbootMagic       MagicString = "zimg"
+
+	PEMagic  MagicString = "MZ"
+	ELFMagic MagicString = "\x7fELF"
+
+	Qcow2Magic MagicString = "QFI\xfb"
 )
 
 func (m MagicString) Bytes() []byte { return []byte(m) }
+
+// Matches reports whether buf holds the magic at offset
+func (m MagicString) Matches(buf []byte, offset int) bool {
+	return offset >= 0 && offset+len(m) <= len(buf) && string(buf[offset:offset+len(m)]) == string(m)
+}
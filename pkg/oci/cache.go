@@ -5,13 +5,28 @@ type imageCache struct {
 	cacheDir     string
 	ImageFetcher // Optional - only used for standalone mode
 	FilesystemConverter
+	manager *CacheManager
 }
 
 // NewImageCacheWithFS creates a new cache instance with custom filesystem provider
 func NewImageCache(cacheDir string, fetcher ImageFetcher, converter FilesystemConverter) *imageCache {
+	manager := NewCacheManager(cacheDir)
+
+	cachedFetcher := NewCachedFetcher(cacheDir, fetcher)
+	cachedFetcher.manager = manager
+
+	cachedConverter := NewCachedConverter(converter)
+	cachedConverter.manager = manager
+
 	return &imageCache{
 		cacheDir:            cacheDir,
-		ImageFetcher:        NewCachedFetcher(cacheDir, fetcher),
-		FilesystemConverter: NewCachedConverter(converter),
+		ImageFetcher:        cachedFetcher,
+		FilesystemConverter: cachedConverter,
+		manager:             manager,
 	}
 }
+
+// Manager returns the manager that tracks usage of the cache and prunes it
+func (c *imageCache) Manager() *CacheManager {
+	return c.manager
+}
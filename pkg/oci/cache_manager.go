@@ -0,0 +1,424 @@
+package oci
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/xid"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// lastUsedFile is touched in an entry every time the cache serves it
+	lastUsedFile = ".ec1-last-used"
+	// leasesDir holds one file per running user of a converted image, named <pid>-<id>
+	leasesDir = ".ec1-leases"
+	// lockFile is flocked by Prune and while leasing an entry, across processes sharing the cache
+	lockFile = ".ec1-lock"
+)
+
+// ErrCacheEntryRemoved is returned when an image is pruned before it could be leased
+var ErrCacheEntryRemoved = errors.New("oci cache entry was removed")
+
+// CacheManager tracks usage of the entries in an OCI cache directory and evicts them. an entry is a
+// top-level directory of the cache root: an OCI layout together with everything converted from it.
+//
+//	<root>/.ec1-lock                                      held while pruning or leasing
+//	<root>/<entry>/.ec1-last-used                         access time used for LRU
+//	<root>/<entry>/converted/<os_arch_format>/.ec1-leases/<pid>-<id>  held while a VM uses the image
+type CacheManager struct {
+	root string
+	mu   sync.Mutex
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func NewCacheManager(root string) *CacheManager {
+	return &CacheManager{root: root}
+}
+
+func (m *CacheManager) Root() string {
+	return m.root
+}
+
+// CachePrunePolicy bounds the cache. entries with a live lease are never removed.
+type CachePrunePolicy struct {
+	// MaxAge removes entries unused for longer; zero disables the age limit
+	MaxAge time.Duration
+	// MaxSize removes the least recently used entries until the cache fits, in bytes; zero disables the size limit
+	MaxSize int64
+}
+
+func DefaultCachePrunePolicy() CachePrunePolicy {
+	return CachePrunePolicy{MaxAge: DefaultCacheExpiration}
+}
+
+type CacheEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	InUse    bool      `json:"in_use"`
+}
+
+type CachePruneResult struct {
+	Removed    []CacheEntry `json:"removed"`
+	FreedBytes int64        `json:"freed_bytes"`
+}
+
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	InUse   int    `json:"in_use"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// HitRate is the fraction of lookups served from the cache since the manager was created
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+func (m *CacheManager) recordHit(path string) {
+	if m == nil {
+		return
+	}
+	m.hits.Add(1)
+	m.touch(path)
+}
+
+func (m *CacheManager) recordMiss(path string) {
+	if m == nil {
+		return
+	}
+	m.misses.Add(1)
+	m.touch(path)
+}
+
+// entryFor returns the entry directory path belongs to, or "" when path is not inside the cache
+func (m *CacheManager) entryFor(path string) string {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.Join(m.root, strings.Split(rel, string(filepath.Separator))[0])
+}
+
+func (m *CacheManager) touch(path string) {
+	entry := m.entryFor(path)
+	if entry == "" {
+		return
+	}
+
+	marker := filepath.Join(entry, lastUsedFile)
+	now := time.Now()
+	if err := os.Chtimes(marker, now, now); err == nil {
+		return
+	}
+	if err := os.WriteFile(marker, nil, CacheFilePerm); err != nil {
+		slog.Debug("recording oci cache access", "entry", entry, "error", err)
+	}
+}
+
+// Entries lists the cache entries, least recently used first
+func (m *CacheManager) Entries(ctx context.Context) ([]CacheEntry, error) {
+	dirents, err := os.ReadDir(m.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading cache root: %w", err)
+	}
+
+	entries := []CacheEntry{}
+	for _, d := range dirents {
+		if !d.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(m.root, d.Name())
+		entry, err := inspectCacheEntry(path)
+		if err != nil {
+			slog.WarnContext(ctx, "skipping unreadable oci cache entry", "entry", path, "error", err)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	return entries, nil
+}
+
+// Prune removes entries older than policy.MaxAge, then the least recently used ones until the cache is no
+// bigger than policy.MaxSize
+func (m *CacheManager) Prune(ctx context.Context, policy CachePrunePolicy) (*CachePruneResult, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := m.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	result := &CachePruneResult{Removed: []CacheEntry{}}
+	now := time.Now()
+
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		expired := policy.MaxAge > 0 && now.Sub(e.LastUsed) > policy.MaxAge
+		oversize := policy.MaxSize > 0 && total > policy.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+
+		if e.InUse {
+			slog.DebugContext(ctx, "keeping oci cache entry in use", "entry", e.Path)
+			continue
+		}
+
+		if err := os.RemoveAll(e.Path); err != nil {
+			return result, errors.Errorf("removing cache entry %s: %w", e.Path, err)
+		}
+
+		total -= e.Size
+		result.FreedBytes += e.Size
+		result.Removed = append(result.Removed, e)
+	}
+
+	if len(result.Removed) > 0 {
+		slog.InfoContext(ctx, "pruned oci cache", "root", m.root, "removed", len(result.Removed), "freed_bytes", result.FreedBytes, "remaining_bytes", total)
+	}
+
+	return result, nil
+}
+
+func (m *CacheManager) Stats(ctx context.Context) (*CacheStats, error) {
+	entries, err := m.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CacheStats{
+		Entries: len(entries),
+		Hits:    m.hits.Load(),
+		Misses:  m.misses.Load(),
+	}
+	for _, e := range entries {
+		stats.Bytes += e.Size
+		if e.InUse {
+			stats.InUse++
+		}
+	}
+
+	return stats, nil
+}
+
+// lock keeps Prune and leasing apart, in this process and in others using the same root
+func (m *CacheManager) lock() (func(), error) {
+	m.mu.Lock()
+
+	if err := os.MkdirAll(m.root, CacheDirPerm); err != nil {
+		m.mu.Unlock()
+		return nil, errors.Errorf("creating cache root: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(m.root, lockFile), os.O_CREATE|os.O_RDWR, CacheFilePerm)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, errors.Errorf("opening cache lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		m.mu.Unlock()
+		return nil, errors.Errorf("locking cache: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		m.mu.Unlock()
+	}, nil
+}
+
+// lease leases the converted image at path, failing with ErrCacheEntryRemoved when it was pruned. a nil
+// manager, or a path outside the cache, has nothing to lease.
+func (m *CacheManager) lease(path string) (*ImageLease, error) {
+	if m == nil || m.entryFor(path) == "" {
+		return nil, nil
+	}
+
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("leasing %s: %w", path, ErrCacheEntryRemoved)
+		}
+		return nil, errors.Errorf("leasing %s: %w", path, err)
+	}
+
+	return writeLease(filepath.Join(filepath.Dir(path), leasesDir))
+}
+
+func inspectCacheEntry(path string) (*CacheEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &CacheEntry{Path: path, LastUsed: fi.ModTime()}
+	if mfi, err := os.Stat(filepath.Join(path, lastUsedFile)); err == nil {
+		entry.LastUsed = mfi.ModTime()
+	}
+
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == leasesDir {
+			if liveLeases(p) {
+				entry.InUse = true
+			}
+			return fs.SkipDir
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry.Size += diskUsage(fi)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Errorf("walking cache entry: %w", err)
+	}
+
+	return entry, nil
+}
+
+// diskUsage is the space fi occupies, which for sparse ext4 images is far less than their size
+func diskUsage(fi fs.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// liveLeases reports whether dir holds a lease of a running process, removing the leases of dead ones
+func liveLeases(dir string) bool {
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	live := false
+	for _, d := range dirents {
+		pidStr, _, _ := strings.Cut(d.Name(), "-")
+		pid, err := strconv.Atoi(pidStr)
+		if err == nil && processAlive(pid) {
+			live = true
+			continue
+		}
+		os.Remove(filepath.Join(dir, d.Name()))
+	}
+
+	return live
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if pid == os.Getpid() {
+		return true
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// ImageLease keeps a converted image from being pruned until it is released or the process exits
+type ImageLease struct {
+	path string
+	once sync.Once
+}
+
+// AcquireImage leases img for as long as a VM uses its rootfs or block image. images converted through an
+// image cache are leased by the conversion, before a concurrent Prune can remove them, and AcquireImage hands
+// that lease over; it can only be acquired once.
+func AcquireImage(img *Image) (*ImageLease, error) {
+	if img.lease != nil {
+		lease := img.lease
+		img.lease = nil
+		return lease, nil
+	}
+
+	return writeLease(filepath.Join(filepath.Dir(img.leasePath()), leasesDir))
+}
+
+// leasePath is the file a lease on img protects; the rootfs directory and block image are both written to
+// the converted platform directory
+func (img *Image) leasePath() string {
+	if path, _ := img.BlockImage(); path != "" {
+		return path
+	}
+	return img.RootfsPath
+}
+
+func writeLease(dir string) (*ImageLease, error) {
+	if err := os.MkdirAll(dir, CacheDirPerm); err != nil {
+		return nil, errors.Errorf("creating lease directory: %w", err)
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+"-"+xid.New().String())
+	if err := os.WriteFile(path, nil, CacheFilePerm); err != nil {
+		return nil, errors.Errorf("writing lease: %w", err)
+	}
+
+	return &ImageLease{path: path}, nil
+}
+
+// Release drops the lease; it is safe to call more than once and on a nil lease
+func (l *ImageLease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+}
@@ -0,0 +1,250 @@
+package oci_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/oci"
+	"github.com/walteh/ec1/pkg/units"
+)
+
+// writeCacheEntry creates an entry with a converted rootfs of size bytes, last used at lastUsed
+func writeCacheEntry(t *testing.T, root, name string, size int, lastUsed time.Time) *oci.Image {
+	t.Helper()
+
+	rootfs := filepath.Join(root, name, "converted", "linux_arm64_ext4", oci.CacheRootfsDir)
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "data"), make([]byte, size), 0644))
+
+	marker := filepath.Join(root, name, ".ec1-last-used")
+	require.NoError(t, os.WriteFile(marker, nil, 0644))
+	require.NoError(t, os.Chtimes(marker, lastUsed, lastUsed))
+
+	return &oci.Image{RootfsPath: rootfs, Platform: units.PlatformLinuxARM64}
+}
+
+func entryNames(entries []oci.CacheEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, filepath.Base(e.Path))
+	}
+	return names
+}
+
+func TestCacheManagerPruneBySize(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	now := time.Now()
+
+	writeCacheEntry(t, root, "oldest", 1<<20, now.Add(-3*time.Hour))
+	writeCacheEntry(t, root, "middle", 1<<20, now.Add(-2*time.Hour))
+	writeCacheEntry(t, root, "newest", 1<<20, now.Add(-1*time.Hour))
+
+	manager := oci.NewCacheManager(root)
+
+	entries, err := manager.Entries(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oldest", "middle", "newest"}, entryNames(entries))
+
+	result, err := manager.Prune(ctx, oci.CachePrunePolicy{MaxSize: 3 << 19})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oldest", "middle"}, entryNames(result.Removed))
+	assert.Positive(t, result.FreedBytes)
+
+	assert.NoDirExists(t, filepath.Join(root, "oldest"))
+	assert.NoDirExists(t, filepath.Join(root, "middle"))
+	assert.DirExists(t, filepath.Join(root, "newest"))
+}
+
+func TestCacheManagerPruneByAgeKeepsLeasedImages(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	now := time.Now()
+
+	inUse := writeCacheEntry(t, root, "in-use", 4096, now.Add(-48*time.Hour))
+	writeCacheEntry(t, root, "expired", 4096, now.Add(-48*time.Hour))
+	writeCacheEntry(t, root, "fresh", 4096, now)
+
+	lease, err := oci.AcquireImage(inUse)
+	require.NoError(t, err)
+
+	manager := oci.NewCacheManager(root)
+
+	result, err := manager.Prune(ctx, oci.DefaultCachePrunePolicy())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, entryNames(result.Removed))
+	assert.DirExists(t, filepath.Join(root, "in-use"))
+
+	stats, err := manager.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 1, stats.InUse)
+
+	lease.Release()
+	lease.Release()
+
+	result, err = manager.Prune(ctx, oci.DefaultCachePrunePolicy())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"in-use"}, entryNames(result.Removed))
+}
+
+func TestCacheManagerStaleLease(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	img := writeCacheEntry(t, root, "crashed", 4096, time.Now().Add(-48*time.Hour))
+
+	// a lease left behind by a process that no longer exists
+	leases := filepath.Join(filepath.Dir(img.RootfsPath), ".ec1-leases")
+	require.NoError(t, os.MkdirAll(leases, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(leases, "999999999-stale"), nil, 0644))
+
+	result, err := oci.NewCacheManager(root).Prune(ctx, oci.DefaultCachePrunePolicy())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crashed"}, entryNames(result.Removed))
+}
+
+func TestImageCacheStats(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	mockFetcher := &mockRemoteFetcher{
+		RemoteImageFetcher: oci.RemoteImageFetcher{CacheDir: tempDir},
+		mockOCILayoutPath:  filepath.Join(tempDir, "mock-oci-layout"),
+	}
+	cache := oci.NewImageCache(tempDir, mockFetcher, oci.NewOCIFilesystemConverter())
+
+	for range 3 {
+		_, err := cache.FetchImageToOCILayout(ctx, "test:image")
+		require.NoError(t, err)
+	}
+
+	stats, err := cache.Manager().Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.InDelta(t, 2.0/3.0, stats.HitRate(), 0.001)
+
+	// pruning the entry out from under the fetcher makes the next lookup a miss, not a dangling path
+	_, err = cache.Manager().Prune(ctx, oci.CachePrunePolicy{MaxSize: 1})
+	require.NoError(t, err)
+
+	_, err = cache.FetchImageToOCILayout(ctx, "test:image")
+	require.NoError(t, err)
+	assert.Equal(t, 2, mockFetcher.callCount)
+}
+
+// pruningConverter writes a block image into the converted directory, running prune once right after
+type pruningConverter struct {
+	prune func()
+}
+
+func (c *pruningConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Context, ociLayoutPath string, platform units.Platform) (*oci.Image, error) {
+	dir := filepath.Join(ociLayoutPath, "converted", platform.OS()+"_"+platform.Arch()+"_ext4")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	disk := filepath.Join(dir, "rootfs.ext4")
+	if err := os.WriteFile(disk, make([]byte, 4096), 0644); err != nil {
+		return nil, err
+	}
+
+	if c.prune != nil {
+		prune := c.prune
+		c.prune = nil
+		prune()
+	}
+
+	return &oci.Image{Ext4Path: disk, Platform: platform}, nil
+}
+
+func TestFetchAndConvertImageLeasesBeforePrune(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	mockFetcher := &mockRemoteFetcher{
+		RemoteImageFetcher: oci.RemoteImageFetcher{CacheDir: tempDir},
+		mockOCILayoutPath:  filepath.Join(tempDir, "mock-oci-layout"),
+	}
+	converter := &pruningConverter{}
+	cache := oci.NewImageCache(tempDir, mockFetcher, converter)
+
+	// a size based prune racing the first conversion removes the entry before it is leased, so it is fetched
+	// and converted again
+	converter.prune = func() {
+		result, err := cache.Manager().Prune(ctx, oci.CachePrunePolicy{MaxSize: 1})
+		require.NoError(t, err)
+		require.Len(t, result.Removed, 1)
+	}
+
+	img, err := oci.FetchAndConvertImage(ctx, cache, "test:image", units.PlatformLinuxARM64)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mockFetcher.callCount)
+	assert.FileExists(t, img.Ext4Path)
+
+	// the image is leased from the conversion on, AcquireImage hands that lease over
+	result, err := cache.Manager().Prune(ctx, oci.CachePrunePolicy{MaxSize: 1})
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+
+	lease, err := oci.AcquireImage(img)
+	require.NoError(t, err)
+
+	again, err := oci.AcquireImage(img)
+	require.NoError(t, err)
+	again.Release()
+
+	result, err = cache.Manager().Prune(ctx, oci.CachePrunePolicy{MaxSize: 1})
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+
+	lease.Release()
+
+	result, err = cache.Manager().Prune(ctx, oci.CachePrunePolicy{MaxSize: 1})
+	require.NoError(t, err)
+	assert.Len(t, result.Removed, 1)
+	assert.NoFileExists(t, img.Ext4Path)
+}
+
+func TestImageCacheConvertsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	cache := oci.NewImageCache(tempDir, nil, &pruningConverter{})
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// layouts of their own, so the conversions all miss and fill the result cache at once
+			layout := filepath.Join(tempDir, fmt.Sprintf("layout-%d", i))
+			for range 2 {
+				img, err := cache.ConvertOCILayoutToRootfsAndExt4(ctx, layout, units.PlatformLinuxARM64)
+				if !assert.NoError(t, err) {
+					return
+				}
+				lease, err := oci.AcquireImage(img)
+				if assert.NoError(t, err) {
+					lease.Release()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every lease was released, so nothing keeps the entries
+	stats, err := cache.Manager().Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 8, stats.Entries)
+	assert.Zero(t, stats.InUse)
+}
@@ -3,6 +3,7 @@ package oci_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -93,6 +94,94 @@ func TestOCIFilesystemConverter(t *testing.T) {
 	assert.WithinDuration(t, time.Now(), image.CachedAt, 5*time.Second)
 }
 
+func TestOCIFilesystemConverterWithoutRootfsDirectory(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	memFetcher := oci.NewMemoryMapFetcher(tempDir, toci.Registry())
+
+	ociLayoutPath, err := memFetcher.FetchImageToOCILayout(ctx, string(oci_image_cache.ALPINE_LATEST))
+	require.NoError(t, err)
+
+	converter := &oci.OCIFilesystemConverter{SkipRootfsDirectory: true}
+
+	image, err := converter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, units.PlatformLinuxAMD64)
+	require.NoError(t, err)
+	assert.Empty(t, image.RootfsPath)
+	assert.FileExists(t, image.Ext4Path)
+	assert.NoDirExists(t, filepath.Join(filepath.Dir(image.Ext4Path), oci.CacheRootfsDir))
+}
+
+func TestOCIFilesystemConverterFormats(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []oci.ImageFormat{oci.ImageFormatEROFS, oci.ImageFormatSquashfs} {
+		// from the merged layers, and packed from the rootfs directory
+		for _, skip := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/skip_rootfs=%t", format, skip), func(t *testing.T) {
+				memFetcher := oci.NewMemoryMapFetcher(t.TempDir(), toci.Registry())
+
+				ociLayoutPath, err := memFetcher.FetchImageToOCILayout(ctx, string(oci_image_cache.ALPINE_LATEST))
+				require.NoError(t, err)
+
+				converter := &oci.OCIFilesystemConverter{SkipRootfsDirectory: skip, Format: format}
+
+				image, err := converter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, units.PlatformLinuxAMD64)
+				require.NoError(t, err)
+				assert.Equal(t, format, image.Format)
+				assert.Empty(t, image.Ext4Path)
+				assert.FileExists(t, image.DiskPath)
+				assert.Equal(t, skip, image.RootfsPath == "")
+
+				path, got := image.BlockImage()
+				assert.Equal(t, image.DiskPath, path)
+				assert.Equal(t, format, got)
+			})
+		}
+	}
+
+	converter := &oci.OCIFilesystemConverter{Format: "btrfs"}
+	_, err := converter.ConvertOCILayoutToRootfsAndExt4(ctx, t.TempDir(), units.PlatformLinuxAMD64)
+	assert.ErrorContains(t, err, "unsupported image format")
+}
+
+func TestOCIFilesystemConverterProgress(t *testing.T) {
+	ctx := context.Background()
+
+	memFetcher := oci.NewMemoryMapFetcher(t.TempDir(), toci.Registry())
+	ociLayoutPath, err := memFetcher.FetchImageToOCILayout(ctx, string(oci_image_cache.ALPINE_LATEST))
+	require.NoError(t, err)
+
+	var events []oci.ProgressEvent
+	converter := &oci.OCIFilesystemConverter{
+		Progress: func(ctx context.Context, event oci.ProgressEvent) {
+			events = append(events, event)
+		},
+	}
+
+	_, err = converter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, units.PlatformLinuxAMD64)
+	require.NoError(t, err)
+
+	var stages []oci.PullStage
+	layerBytes := map[string]int64{}
+	for _, event := range events {
+		assert.Equal(t, ociLayoutPath, event.Image)
+		if event.Done {
+			stages = append(stages, event.Stage)
+			continue
+		}
+		assert.Equal(t, oci.PullStageExtracting, event.Stage)
+		layerBytes[event.Layer.String()] = event.BytesDone
+		assert.LessOrEqual(t, event.BytesDone, event.BytesTotal)
+	}
+
+	assert.Equal(t, []oci.PullStage{oci.PullStageExtracting, oci.PullStageConverting}, stages)
+	require.NotEmpty(t, layerBytes)
+	for layer, done := range layerBytes {
+		assert.Positive(t, done, "layer %s", layer)
+	}
+}
+
 func TestCachedConverter(t *testing.T) {
 	ctx := context.Background()
 	tempDir := t.TempDir()
@@ -121,6 +210,36 @@ func TestCachedConverter(t *testing.T) {
 	assert.Equal(t, image1, image2)
 }
 
+func TestCachedConverterKeepsFormatsApart(t *testing.T) {
+	ctx := context.Background()
+
+	memFetcher := oci.NewMemoryMapFetcher(t.TempDir(), toci.Registry())
+	ociLayoutPath, err := memFetcher.FetchImageToOCILayout(ctx, string(oci_image_cache.ALPINE_LATEST))
+	require.NoError(t, err)
+
+	platform := units.PlatformLinuxAMD64
+	realConverter := &oci.OCIFilesystemConverter{SkipRootfsDirectory: true}
+	cachedConverter := oci.NewCachedConverter(realConverter)
+
+	ext4, err := cachedConverter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, platform)
+	require.NoError(t, err)
+
+	realConverter.Format = oci.ImageFormatEROFS
+	erofs, err := cachedConverter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, platform)
+	require.NoError(t, err)
+	assert.Equal(t, oci.ImageFormatEROFS, erofs.Format, "the ext4 image is not served for erofs")
+	assert.NotEqual(t, filepath.Dir(ext4.DiskPath), filepath.Dir(erofs.DiskPath))
+	assert.FileExists(t, ext4.DiskPath, "converting to erofs keeps the ext4 image")
+
+	// a new cache finds both on disk
+	realConverter.Format = ""
+	image, err := oci.NewCachedConverter(realConverter).ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, platform)
+	require.NoError(t, err)
+	path, format := image.BlockImage()
+	assert.Equal(t, ext4.DiskPath, path)
+	assert.Equal(t, oci.ImageFormatExt4, format)
+}
+
 func TestImageCache(t *testing.T) {
 	ctx := context.Background()
 	tempDir := t.TempDir()
@@ -1,8 +1,6 @@
 package oci
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -12,22 +10,33 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
 	"github.com/containers/image/v5/image"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/types"
-	"github.com/mholt/archives"
 	"gitlab.com/tozd/go/errors"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
+	"github.com/walteh/ec1/pkg/rofs"
 	"github.com/walteh/ec1/pkg/units"
 )
 
-// OCIFilesystemConverter implements FilesystemConverter for OCI layout processing
+// OCIFilesystemConverter implements FilesystemConverter for OCI layout processing. every layer is decompressed
+// once: into the rootfs directory, which the block image is then packed from, or with SkipRootfsDirectory
+// straight into the block image from the merged layer stream.
 type OCIFilesystemConverter struct {
+	// SkipRootfsDirectory leaves Image.RootfsPath empty, which halves the disk space and IO of a conversion
+	// for callers that only boot from the block image
+	SkipRootfsDirectory bool
+	// Format is the filesystem of the block image, ext4 when empty
+	Format ImageFormat
+	// Progress receives the extracting and converting events of every conversion, with the OCI layout path
+	// as the image. nil logs them through slog
+	Progress ProgressFunc
 }
 
 // NewOCIFilesystemConverter creates a new OCI filesystem converter
@@ -35,16 +44,30 @@ func NewOCIFilesystemConverter() *OCIFilesystemConverter {
 	return &OCIFilesystemConverter{}
 }
 
+func (c *OCIFilesystemConverter) imageFormat() ImageFormat {
+	if c.Format == "" {
+		return ImageFormatExt4
+	}
+	return c.Format
+}
+
 func (c *OCIFilesystemConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Context, ociLayoutPath string, platform units.Platform) (*Image, error) {
-	destDir := convertedDirPath(ociLayoutPath, platform)
+	format := c.imageFormat()
+	destDir := convertedDirPath(ociLayoutPath, platform, format)
+
+	diskFile, err := format.fileName()
+	if err != nil {
+		return nil, err
+	}
 
 	slog.InfoContext(ctx, "converting image from OCI layout to filesystem",
 		"source", ociLayoutPath,
 		"platform", string(platform),
+		"format", format,
 		"dest", destDir)
 
 	// First, check if we need to handle duplicate manifests in the index
-	err := c.ensureCleanIndex(ctx, ociLayoutPath)
+	err = c.ensureCleanIndex(ctx, ociLayoutPath)
 	if err != nil {
 		return nil, errors.Errorf("cleaning index: %w", err)
 	}
@@ -103,19 +126,39 @@ func (c *OCIFilesystemConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Con
 		return nil, errors.Errorf("getting OCI config: %w", err)
 	}
 
+	layers := layerBlobsFromOCILayout(ociLayoutPath, img)
+
 	// Extract the filesystem layers to a rootfs directory
-	rootfsPath := filepath.Join(destDir, CacheRootfsDir)
-	err = c.extractLayersFromOCILayout(ctx, ociLayoutPath, rootfsPath, img)
-	if err != nil {
-		return nil, errors.Errorf("extracting layers: %w", err)
+	rootfsPath := ""
+	if !c.SkipRootfsDirectory {
+		rootfsPath = filepath.Join(destDir, CacheRootfsDir)
+		extracting := startStage(c.Progress, ociLayoutPath, PullStageExtracting)
+		err = c.extractLayersFromOCILayout(ctx, rootfsPath, layers, extracting)
+		if err != nil {
+			return nil, errors.Errorf("extracting layers: %w", err)
+		}
+		extracting.done(ctx)
+	} else if err := os.MkdirAll(destDir, CacheDirPerm); err != nil {
+		return nil, errors.Errorf("creating destination directory: %w", err)
+	}
+
+	// Create the disk image from the rootfs directory, or from the layers when there is none
+	diskPath := filepath.Join(destDir, diskFile)
+	converting := startStage(c.Progress, ociLayoutPath, PullStageConverting)
+	switch {
+	case rootfsPath != "":
+		err = createImageFromDirectory(ctx, rootfsPath, diskPath, format)
+	case format == ImageFormatEROFS:
+		err = createReadOnlyImageFromLayers(ctx, layers, diskPath, format, rofs.ConvertTarToEROFS)
+	case format == ImageFormatSquashfs:
+		err = createReadOnlyImageFromLayers(ctx, layers, diskPath, format, rofs.ConvertTarToSquashfs)
+	default:
+		err = createExt4FromLayers(ctx, layers, diskPath)
 	}
-
-	// Create ext4 disk image from rootfs
-	ext4Path := filepath.Join(destDir, CacheExt4File)
-	err = c.createExt4FromRootfs(ctx, rootfsPath, ext4Path)
 	if err != nil {
-		return nil, errors.Errorf("creating ext4 image: %w", err)
+		return nil, errors.Errorf("creating %s image: %w", format, err)
 	}
+	converting.done(ctx)
 
 	metadataPath := filepath.Join(destDir, CacheMetadataFile)
 	metadataBytes, err := json.Marshal(ociConfig)
@@ -130,18 +173,29 @@ func (c *OCIFilesystemConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Con
 	slog.InfoContext(ctx, "successfully converted container image to filesystem",
 		"dest", destDir,
 		"rootfs", rootfsPath,
-		"ext4", ext4Path,
+		"disk", diskPath,
+		"format", format,
 		"metadata", metadataPath,
 		"entrypoint", ociConfig.Config.Entrypoint,
 		"cmd", ociConfig.Config.Cmd,
 		"platform", ociConfig.Platform)
 
+	verification, err := loadImageVerification(ociLayoutPath)
+	if err != nil {
+		return nil, errors.Errorf("loading image verification: %w", err)
+	}
+
 	image := &Image{
-		RootfsPath: rootfsPath,
-		Ext4Path:   ext4Path,
-		Metadata:   ociConfig,
-		Platform:   platform,
-		CachedAt:   time.Now(),
+		RootfsPath:   rootfsPath,
+		Metadata:     ociConfig,
+		Platform:     platform,
+		CachedAt:     time.Now(),
+		Verification: verification,
+		Format:       format,
+		DiskPath:     diskPath,
+	}
+	if format == ImageFormatExt4 {
+		image.Ext4Path = diskPath
 	}
 
 	if err := SaveImageToCache(ctx, metadataPath, image); err != nil {
@@ -217,10 +271,8 @@ func MkdirAll(fs fs.FS, path string, perm os.FileMode) error {
 	}
 }
 
-// extractLayersFromOCILayout extracts the filesystem layers from an OCI layout to create a rootfs
-func (c *OCIFilesystemConverter) extractLayersFromOCILayout(ctx context.Context, ociLayoutDir string, rootfsPath string, img types.Image) error {
-	slog.InfoContext(ctx, "extracting layers from OCI layout", "oci_layout", ociLayoutDir)
-
+// extractLayersFromOCILayout extracts layers (bottom first) on top of each other to create a rootfs
+func (c *OCIFilesystemConverter) extractLayersFromOCILayout(ctx context.Context, rootfsPath string, layers []layerBlob, progress *progressStage) error {
 	destDir := rootfsPath
 
 	// Create the destination filesystem directory
@@ -228,131 +280,164 @@ func (c *OCIFilesystemConverter) extractLayersFromOCILayout(ctx context.Context,
 		return errors.Errorf("creating filesystem directory: %w", err)
 	}
 
-	// Get layer information from the image
-	layerInfos := img.LayerInfos()
-	slog.InfoContext(ctx, "found layers", "count", len(layerInfos))
+	slog.InfoContext(ctx, "found layers", "count", len(layers))
 
-	// Extract each layer in order
-	for i, layerInfo := range layerInfos {
-		// Remove the "sha256:" prefix from digest to get the filename
-		layerFile := strings.TrimPrefix(layerInfo.Digest.String(), "sha256:")
-		// OCI layout stores blobs in blobs/sha256/ directory
-		layerPath := filepath.Join(ociLayoutDir, "blobs", "sha256", layerFile)
+	attrs := rootfsAttrs{}
 
-		slog.InfoContext(ctx, "extracting layer", "layer", i+1, "total", len(layerInfos), "digest", layerInfo.Digest.String(), "path", layerPath)
+	// Extract each layer in order
+	for i, layer := range layers {
+		slog.InfoContext(ctx, "extracting layer", "layer", i+1, "total", len(layers), "digest", layer.info.Digest.String(), "path", layer.path)
+		progress.layer(ctx, layer.info.Digest, 0, layer.info.Size)
 
-		if err := c.extractLayer(ctx, layerPath, destDir); err != nil {
+		if err := c.extractLayer(ctx, layer.path, layer.info, destDir, attrs); err != nil {
 			return errors.Errorf("extracting layer %d: %w", i+1, err)
 		}
+
+		progress.layer(ctx, layer.info.Digest, layer.info.Size, layer.info.Size)
+	}
+
+	if err := attrs.save(rootfsAttrsPath(destDir)); err != nil {
+		return errors.Errorf("saving rootfs attrs: %w", err)
 	}
 
 	slog.InfoContext(ctx, "successfully extracted layers to rootfs", "dest", destDir)
 	return nil
 }
 
-// extractLayer extracts a single compressed layer tar file to the destination
-func (c *OCIFilesystemConverter) extractLayer(ctx context.Context, layerPath, destDir string) error {
-	file, err := os.Open(layerPath)
+// extractLayer extracts a single layer blob to the destination, decompressing it according to its media type.
+// metadata that cannot be applied on disk is recorded in attrs.
+func (c *OCIFilesystemConverter) extractLayer(ctx context.Context, layerPath string, layer types.BlobInfo, destDir string, attrs rootfsAttrs) error {
+	rdr, err := openLayer(ctx, layerPath, layer)
 	if err != nil {
-		return errors.Errorf("opening layer file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer rdr.Close()
 
-	// Decompress the gzipped layer
-	gzReader, err := gzip.NewReader(file)
-	if err != nil {
-		return errors.Errorf("creating gzip reader: %w", err)
+	if err := applyLayer(ctx, rdr, destDir, attrs, layerMetadataEntries(layer)...); err != nil {
+		return errors.Errorf("applying layer: %w", err)
 	}
-	defer gzReader.Close()
 
-	// Extract the tar archive
-	tarReader := tar.NewReader(gzReader)
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return errors.Errorf("reading tar header: %w", err)
-		}
+	return nil
+}
 
-		// Skip whiteout files (used for deletions in overlay filesystems)
-		if strings.HasPrefix(filepath.Base(header.Name), ".wh.") {
-			continue
-		}
+// createExt4FromLayers merges layers (bottom first) into an ext4 disk image without extracting them. the
+// image size limit is estimated from the layer contents.
+func createExt4FromLayers(ctx context.Context, layers []layerBlob, ext4Path string) error {
+	slog.InfoContext(ctx, "creating ext4 disk image from layers", "layers", len(layers), "ext4", ext4Path)
 
-		targetPath := filepath.Join(destDir, header.Name)
+	maxSize, err := estimateExt4Size(ctx, layers)
+	if err != nil {
+		return errors.Errorf("estimating ext4 size: %w", err)
+	}
 
-		// Ensure the target directory exists
-		if err := os.MkdirAll(filepath.Dir(targetPath), CacheDirPerm); err != nil {
-			return errors.Errorf("creating directory: %w", err)
-		}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(mergeLayers(ctx, layers, pw))
+	}()
+	defer pr.Close()
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-				return errors.Errorf("creating directory %s: %w", targetPath, err)
-			}
-		case tar.TypeReg:
-			if err := c.extractFile(tarReader, targetPath, header); err != nil {
-				return errors.Errorf("extracting file %s: %w", targetPath, err)
-			}
-		case tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, targetPath); err != nil && !os.IsExist(err) {
-				return errors.Errorf("creating symlink %s: %w", targetPath, err)
-			}
-		case tar.TypeLink:
-			linkTarget := filepath.Join(destDir, header.Linkname)
-			if err := os.Link(linkTarget, targetPath); err != nil && !os.IsExist(err) {
-				return errors.Errorf("creating hard link %s: %w", targetPath, err)
-			}
-		default:
-			slog.WarnContext(ctx, "skipping unsupported file type", "type", header.Typeflag, "file", header.Name)
-		}
+	if err := writeExt4(pr, ext4Path, maxSize); err != nil {
+		return err
 	}
 
+	slog.InfoContext(ctx, "ext4 disk image created", "path", ext4Path, "max_size", maxSize)
 	return nil
 }
 
-// extractFile extracts a single file from the tar reader
-func (c *OCIFilesystemConverter) extractFile(tarReader *tar.Reader, targetPath string, header *tar.Header) error {
-	file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+// createReadOnlyImageFromLayers merges layers (bottom first) into a read-only image written by convert.
+// unlike ext4 these formats have no size limit to estimate.
+func createReadOnlyImageFromLayers(ctx context.Context, layers []layerBlob, diskPath string, format ImageFormat, convert func(io.Reader, io.WriteSeeker) error) error {
+	slog.InfoContext(ctx, "creating disk image from layers", "layers", len(layers), "format", format, "path", diskPath)
+
+	return createReadOnlyImage(ctx, diskPath, format, convert, func(w io.Writer) error {
+		return mergeLayers(ctx, layers, w)
+	})
+}
+
+// createImageFromDirectory packs an extracted rootfs directory into a block image of format
+func createImageFromDirectory(ctx context.Context, rootfsPath, diskPath string, format ImageFormat) error {
+	convert := rofs.ConvertTarToEROFS
+	switch format {
+	case ImageFormatExt4:
+		return CreateExt4FromDirectory(ctx, rootfsPath, diskPath)
+	case ImageFormatSquashfs:
+		convert = rofs.ConvertTarToSquashfs
+	}
+
+	slog.InfoContext(ctx, "creating disk image", "rootfs", rootfsPath, "format", format, "path", diskPath)
+
+	attrs, err := loadRootfsAttrs(rootfsPath)
+	if err != nil {
+		return errors.Errorf("loading rootfs attrs: %w", err)
+	}
+
+	return createReadOnlyImage(ctx, diskPath, format, convert, func(w io.Writer) error {
+		return writeRootfsTar(ctx, rootfsPath, attrs, w)
+	})
+}
+
+// createReadOnlyImage converts the tar stream written by write into a read-only image at diskPath
+func createReadOnlyImage(ctx context.Context, diskPath string, format ImageFormat, convert func(io.Reader, io.WriteSeeker) error, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	defer pr.Close()
+
+	os.Remove(diskPath)
+
+	out, err := os.Create(diskPath)
 	if err != nil {
-		return errors.Errorf("creating file: %w", err)
+		return errors.Errorf("creating %s file: %w", format, err)
+	}
+	defer out.Close()
+
+	if err := convert(pr, out); err != nil {
+		return errors.Errorf("converting tar to %s: %w", format, err)
 	}
-	defer file.Close()
 
-	if _, err := io.Copy(file, tarReader); err != nil {
-		return errors.Errorf("copying file content: %w", err)
+	if err := out.Close(); err != nil {
+		return errors.Errorf("closing %s file: %w", format, err)
 	}
 
+	slog.InfoContext(ctx, "disk image created", "path", diskPath, "format", format)
 	return nil
 }
 
-// createExt4FromRootfs creates an ext4 disk image from a rootfs directory
-func (c *OCIFilesystemConverter) createExt4FromRootfs(ctx context.Context, rootfsPath, ext4Path string) error {
+// CreateExt4FromDirectory packs an already extracted rootfs directory into an ext4 disk image. ownership,
+// modes, xattrs and device nodes recorded during unprivileged extraction are applied to the image.
+func CreateExt4FromDirectory(ctx context.Context, rootfsPath, ext4Path string) error {
 	slog.InfoContext(ctx, "creating ext4 disk image", "rootfs", rootfsPath, "ext4", ext4Path)
 
-	// Use tar2ext4 to create a proper ext4 image
-	files, err := archives.FilesFromDisk(ctx, &archives.FromDiskOptions{}, map[string]string{
-		rootfsPath: ext4Path,
-	})
+	attrs, err := loadRootfsAttrs(rootfsPath)
 	if err != nil {
-		return errors.Errorf("getting files from disk: %w", err)
+		return errors.Errorf("loading rootfs attrs: %w", err)
 	}
 
-	// Remove existing ext4 file if it exists
-	os.Remove(ext4Path)
+	maxSize, err := estimateDirectoryExt4Size(rootfsPath)
+	if err != nil {
+		return errors.Errorf("estimating ext4 size: %w", err)
+	}
 
 	// Pack the folder into a tar stream
 	pr, pw := io.Pipe()
 	go func() {
-		defer pw.Close()
-		err := (&archives.Tar{}).Archive(ctx, pw, files)
-		if err != nil {
-			slog.ErrorContext(ctx, "failed to archive files", "error", err)
-		}
+		pw.CloseWithError(writeRootfsTar(ctx, rootfsPath, attrs, pw))
 	}()
+	defer pr.Close()
+
+	if err := writeExt4(pr, ext4Path, maxSize); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "ext4 disk image created", "path", ext4Path, "recorded_attrs", len(attrs), "max_size", maxSize)
+	return nil
+}
+
+// writeExt4 converts the tar stream r to an ext4 image at ext4Path that may grow up to maxSize
+func writeExt4(r io.Reader, ext4Path string, maxSize int64) error {
+	// Remove existing ext4 file if it exists
+	os.Remove(ext4Path)
 
 	// Create the ext4 file
 	out, err := os.Create(ext4Path)
@@ -362,19 +447,21 @@ func (c *OCIFilesystemConverter) createExt4FromRootfs(ctx context.Context, rootf
 	defer out.Close()
 
 	// Convert tar stream to ext4
-	err = tar2ext4.ConvertTarToExt4(pr, out, tar2ext4.MaximumDiskSize(DefaultExt4MaxSize), tar2ext4.InlineData)
+	err = tar2ext4.ConvertTarToExt4(r, out, tar2ext4.MaximumDiskSize(maxSize), tar2ext4.InlineData)
 	if err != nil {
 		return errors.Errorf("converting tar to ext4: %w", err)
 	}
 
-	slog.InfoContext(ctx, "ext4 disk image created", "path", ext4Path)
-	return nil
+	return out.Close()
 }
 
 type CachedConverter struct {
 	cacheDir      string
 	resultCache   map[string]*Image
 	realConverter FilesystemConverter
+	manager       *CacheManager
+	// mutex guards resultCache, conversions themselves run concurrently
+	mutex sync.Mutex
 }
 
 func NewCachedConverter(realConverter FilesystemConverter) *CachedConverter {
@@ -384,27 +471,64 @@ func NewCachedConverter(realConverter FilesystemConverter) *CachedConverter {
 	}
 }
 
-func (c *CachedConverter) reqHash(ociLayoutPath string, platform units.Platform) string {
-	return fmt.Sprintf("%s-%s-%s", ociLayoutPath, platform.OS(), platform.Arch())
+// formatConverter is a FilesystemConverter that knows the format of the block images it writes
+type formatConverter interface {
+	imageFormat() ImageFormat
 }
 
-func convertedDirPath(ociLayoutPath string, platform units.Platform) string {
-	return filepath.Join(ociLayoutPath, "converted", platform.OS()+"_"+platform.Arch())
+// format is the block image format of the real converter, ext4 when it does not say
+func (c *CachedConverter) format() ImageFormat {
+	if fc, ok := c.realConverter.(formatConverter); ok {
+		return fc.imageFormat()
+	}
+	return ImageFormatExt4
 }
 
-func (c *CachedConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Context, ociLayoutPath string, platform units.Platform) (*Image, error) {
-	hash := c.reqHash(ociLayoutPath, platform)
+func (c *CachedConverter) reqHash(ociLayoutPath string, platform units.Platform, format ImageFormat) string {
+	return fmt.Sprintf("%s-%s-%s-%s", ociLayoutPath, platform.OS(), platform.Arch(), format)
+}
 
-	if _, ok := c.resultCache[hash]; ok {
-		return c.resultCache[hash], nil
+// convertedDirPath is where an image is converted to, apart for every platform and format
+func convertedDirPath(ociLayoutPath string, platform units.Platform, format ImageFormat) string {
+	return filepath.Join(ociLayoutPath, "converted", platform.OS()+"_"+platform.Arch()+"_"+string(format))
+}
+
+// ConvertOCILayoutToRootfsAndExt4 converts the layout, or serves the image converted before. when the cache
+// has a manager, every call writes a lease into the converted directory, which stays until the lease is taken
+// with AcquireImage and released, or the process exits; callers that do not run the image should release it
+// right away.
+func (c *CachedConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Context, ociLayoutPath string, platform units.Platform) (*Image, error) {
+	format := c.format()
+	hash := c.reqHash(ociLayoutPath, platform, format)
+
+	c.mutex.Lock()
+	image, ok := c.resultCache[hash]
+	c.mutex.Unlock()
+
+	if ok {
+		// the entry may have been pruned since
+		diskPath, _ := image.BlockImage()
+		if _, err := os.Stat(diskPath); err == nil {
+			c.manager.recordHit(ociLayoutPath)
+			return c.leased(image)
+		}
+		c.mutex.Lock()
+		if c.resultCache[hash] == image {
+			delete(c.resultCache, hash)
+		}
+		c.mutex.Unlock()
 	}
 
-	destDir := convertedDirPath(ociLayoutPath, platform)
+	destDir := convertedDirPath(ociLayoutPath, platform, format)
 
 	metadataPath := filepath.Join(destDir, CacheImagePath)
 	image, err := LoadImageFromCache(ctx, metadataPath)
 	if err == nil {
-		return image, nil
+		if _, cached := image.BlockImage(); cached == format {
+			c.manager.recordHit(ociLayoutPath)
+			return c.leased(image)
+		}
+		slog.WarnContext(ctx, "converting cached image again in another format", "image", ociLayoutPath, "cached", image.Format, "format", format)
 	}
 
 	converted, err := c.realConverter.ConvertOCILayoutToRootfsAndExt4(ctx, ociLayoutPath, platform)
@@ -412,7 +536,23 @@ func (c *CachedConverter) ConvertOCILayoutToRootfsAndExt4(ctx context.Context, o
 		return nil, errors.Errorf("converting image from OCI layout to filesystem: %w", err)
 	}
 
+	c.mutex.Lock()
 	c.resultCache[hash] = converted
+	c.mutex.Unlock()
+	c.manager.recordMiss(ociLayoutPath)
+
+	return c.leased(converted)
+}
+
+// leased returns a copy of image holding a lease, taken under the cache lock so a concurrent Prune either
+// finishes first or sees the image in use. the copy keeps the lease out of resultCache.
+func (c *CachedConverter) leased(image *Image) (*Image, error) {
+	lease, err := c.manager.lease(image.leasePath())
+	if err != nil {
+		return nil, err
+	}
 
-	return converted, nil
+	leased := *image
+	leased.lease = lease
+	return &leased, nil
 }
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/containers/image/v5/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -95,8 +96,6 @@ func TestEnsureCleanIndex(t *testing.T) {
 
 // TestExtractLayer tests the extractLayer function
 func TestExtractLayer(t *testing.T) {
-	t.Skip("Creating a valid tar.gz file in-memory is complex")
-	
 	// Create a test directory
 	tempDir := t.TempDir()
 	
@@ -104,7 +103,7 @@ func TestExtractLayer(t *testing.T) {
 	converter := NewOCIFilesystemConverter()
 	
 	// Test with non-existent layer
-	err := converter.extractLayer(context.Background(), "/non/existent/layer", tempDir)
+	err := converter.extractLayer(context.Background(), "/non/existent/layer", types.BlobInfo{}, tempDir, nil)
 	assert.Error(t, err)
 }
 
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
@@ -35,36 +36,72 @@ var (
 type RemoteImageFetcher struct {
 	CacheDir      string // Optional: custom temp directory for fetches
 	SkipTLSVerify bool   // Skip TLS verification for remote registries
+
+	// DockerConfigPath is a docker config.json or containers auth.json whose auths and credHelpers are used.
+	// empty means the default locations (~/.docker/config.json, $XDG_RUNTIME_DIR/containers/auth.json)
+	DockerConfigPath string
+	// Credentials, when set, is asked for the registry of every image and for each of its mirrors, and takes
+	// precedence over DockerConfigPath
+	Credentials RegistryCredentialsFunc
+	// Mirrors maps a registry host to mirrors tried in order before falling back to the registry itself
+	Mirrors map[string][]RegistryMirror
+	// InsecureRegistries are registry hosts reached over plain HTTP or unverified TLS, like local registries
+	InsecureRegistries []string
+	// CertDir holds CA certificates (*.crt) and client certificates (*.cert, *.key) for registries, in the
+	// layout of /etc/containers/certs.d/<host>. empty uses the system roots and certs.d
+	CertDir string
+	// RegistriesConfPath is a containers-registries.conf(5) applied to every pull. it cannot be combined with
+	// Mirrors or InsecureRegistries, which are turned into a generated registries.conf
+	RegistriesConfPath string
+	// Policy decides which images are accepted. nil accepts any image and records it as unverified
+	Policy *ImagePolicy
+	// Progress receives the resolving and downloading events of every fetch. nil logs them through slog
+	Progress ProgressFunc
 }
 
 // FetchImage fetches an image using skopeo and returns the OCI layout path
 func (f *RemoteImageFetcher) FetchImageToOCILayout(ctx context.Context, imageRef string) (string, error) {
 	slog.InfoContext(ctx, "fetching image from remote registry", "image", imageRef)
 
-	// Create policy context (allow all for now - in production this should be more restrictive)
-	policyContext, err := signature.NewPolicyContext(&signature.Policy{
-		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
-	})
+	// the docker transport wants "//registry/repo:tag"; accept plain and docker:// references as well
+	imageRef = strings.TrimPrefix(strings.TrimPrefix(imageRef, "docker:"), "//")
+
+	srcRef, err := docker.ParseReference("//" + imageRef)
 	if err != nil {
-		return "", errors.Errorf("creating policy context: %w", err)
+		return "", errors.Errorf("parsing source reference: %w", err)
 	}
-	defer policyContext.Destroy()
 
-	srcRef, err := docker.ParseReference(imageRef)
+	workDir, err := os.MkdirTemp("", "ec1-registry-config-*")
 	if err != nil {
-		return "", errors.Errorf("parsing source reference: %w", err)
+		return "", errors.Errorf("creating registry config directory: %w", err)
 	}
+	defer os.RemoveAll(workDir)
+
+	sysCtx, err := f.systemContext(ctx, srcRef, workDir)
+	if err != nil {
+		return "", errors.Errorf("configuring registry access: %w", err)
+	}
+
+	sysCtx.RegistriesDirPath, err = f.Policy.registriesDir(workDir)
+	if err != nil {
+		return "", errors.Errorf("configuring signature lookaside: %w", err)
+	}
+
+	resolving := startStage(f.Progress, imageRef, PullStageResolving)
 
-	sysCtx := &types.SystemContext{}
+	// resolve the tag once, everything after reads the manifest by the digest it resolved to
+	topDigest, err := resolveManifestDigest(ctx, srcRef, sysCtx)
+	if err != nil {
+		return "", errors.Errorf("resolving %s: %w", imageRef, err)
+	}
 
-	if f.SkipTLSVerify {
-		sysCtx.OCIInsecureSkipTLSVerify = true
-		sysCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
-		sysCtx.DockerDaemonInsecureSkipTLSVerify = true
+	pinnedRef, err := pinnedReference(srcRef, topDigest)
+	if err != nil {
+		return "", err
 	}
 
 	// get image index manifest
-	srcImg, err := srcRef.NewImage(ctx, sysCtx)
+	srcImg, err := pinnedRef.NewImage(ctx, sysCtx)
 	if err != nil {
 		return "", errors.Errorf("creating source image: %w", err)
 	}
@@ -76,7 +113,34 @@ func (f *RemoteImageFetcher) FetchImageToOCILayout(ctx context.Context, imageRef
 	}
 
 	dig := digest.FromBytes(bdig)
-	destDir := filepath.Join(f.CacheDir, dig.String())
+	// oci layout paths cannot contain a colon
+	destDir := filepath.Join(f.CacheDir, dig.Algorithm().String()+"-"+dig.Encoded())
+
+	resolving.done(ctx)
+
+	policy, methods, err := f.Policy.signaturePolicy(srcRef, pinnedRef)
+	if err != nil {
+		return "", errors.Errorf("building image policy: %w", err)
+	}
+
+	// read before the policy is enforced, so a file changed during the pull is not recorded as the one used
+	policyDigest, keyDigest, err := f.Policy.digests()
+	if err != nil {
+		return "", err
+	}
+
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return "", errors.Errorf("creating policy context: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	if f.Policy != nil && len(f.Policy.AllowedDigests) > 0 {
+		if err := f.Policy.checkDigestPin(topDigest, dig); err != nil {
+			return "", errors.Errorf("verifying %s: %w", imageRef, err)
+		}
+		methods = append(methods, VerificationMethodDigestPin)
+	}
 
 	// Create OCI layout destination
 	if err := os.MkdirAll(destDir, 0755); err != nil {
@@ -88,22 +152,55 @@ func (f *RemoteImageFetcher) FetchImageToOCILayout(ctx context.Context, imageRef
 		return "", errors.Errorf("creating oci layout reference: %w", err)
 	}
 
-	// Copy image from source to OCI layout
-	_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
+	downloading := startStage(f.Progress, imageRef, PullStageDownloading)
+	progress := make(chan types.ProgressProperties)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		downloading.forwardCopyProgress(ctx, progress)
+	}()
+
+	// Copy image from source to OCI layout, by digest so it is the image that was checked
+	_, err = copy.Image(ctx, policyContext, destRef, pinnedRef, &copy.Options{
 		SourceCtx: sysCtx,
 		// we are the destination, so we don't need to verify the TLS certificate
-		DestinationCtx: &types.SystemContext{},
-		ReportWriter:   os.Stdout,
+		DestinationCtx:   &types.SystemContext{},
+		Progress:         progress,
+		ProgressInterval: 500 * time.Millisecond,
 	})
+	close(progress)
+	<-forwarded
 	if err != nil {
 		return "", errors.Errorf("copying image: %w", err)
 	}
 
+	downloading.done(ctx)
+
+	// copy.Image has enforced the signature policy by now
+	verification := &ImageVerification{
+		Verified:          len(methods) > 0,
+		Methods:           methods,
+		ManifestDigest:    dig,
+		IndexDigest:       topDigest,
+		PolicyDigest:      policyDigest,
+		SigstoreKeyDigest: keyDigest,
+		VerifiedAt:        time.Now(),
+	}
+	logImageVerification(ctx, imageRef, verification)
+
+	if err := saveImageVerification(destDir, verification); err != nil {
+		return "", err
+	}
+
 	slog.InfoContext(ctx, "successfully fetched image", "image", imageRef, "oci_layout", destDir)
 
 	return destDir, nil
 }
 
+func (f *RemoteImageFetcher) imagePolicy() *ImagePolicy {
+	return f.Policy
+}
+
 // NewRemoteImageFetcher creates a new skopeo-based image fetcher
 func NewRemoteImageFetcher() *RemoteImageFetcher {
 	return &RemoteImageFetcher{}
@@ -207,6 +304,9 @@ type CachedFetcher struct {
 	cacheDir    string
 	resultCache map[string]string
 	realFetcher ImageFetcher
+	manager     *CacheManager
+	// mutex guards resultCache, fetches themselves run concurrently
+	mutex sync.Mutex
 }
 
 func NewCachedFetcher(cacheDir string, realFetcher ImageFetcher) *CachedFetcher {
@@ -220,14 +320,33 @@ func NewCachedFetcher(cacheDir string, realFetcher ImageFetcher) *CachedFetcher
 	return fch
 }
 
+// verifyingFetcher is an ImageFetcher enforcing an ImagePolicy, which cached layouts are checked against too
+type verifyingFetcher interface {
+	imagePolicy() *ImagePolicy
+}
+
 func (fch *CachedFetcher) FetchImageToOCILayout(ctx context.Context, imageRef string) (string, error) {
-	if _, ok := fch.resultCache[imageRef]; ok {
-		return fch.resultCache[imageRef], nil
+	fch.mutex.Lock()
+	path, ok := fch.resultCache[imageRef]
+	fch.mutex.Unlock()
+
+	if ok {
+		// the entry may have been pruned since
+		if _, err := os.Stat(path); err == nil && fch.admits(ctx, imageRef, path) {
+			fch.manager.recordHit(path)
+			return path, nil
+		}
+		fch.mutex.Lock()
+		if fch.resultCache[imageRef] == path {
+			delete(fch.resultCache, imageRef)
+		}
+		fch.mutex.Unlock()
 	}
 
 	// check if the image is already cached
 	cachePath := filepath.Join(fch.cacheDir, ociLayoutDirFromImageRef(imageRef))
-	if _, err := os.Stat(cachePath); err == nil {
+	if _, err := os.Stat(cachePath); err == nil && fch.admits(ctx, imageRef, cachePath) {
+		fch.manager.recordHit(cachePath)
 		return cachePath, nil
 	}
 
@@ -236,11 +355,33 @@ func (fch *CachedFetcher) FetchImageToOCILayout(ctx context.Context, imageRef st
 		return "", errors.Errorf("fetching image to OCI layout: %w", err)
 	}
 
+	fch.mutex.Lock()
 	fch.resultCache[imageRef] = tempDir
+	fch.mutex.Unlock()
+	fch.manager.recordMiss(tempDir)
 
 	return tempDir, nil
 }
 
+// admits reports whether the layout at path satisfies the policy of the real fetcher. a layout it does not
+// admit, like one cached earlier by a fetcher without a policy, is fetched again under the policy.
+func (fch *CachedFetcher) admits(ctx context.Context, imageRef, path string) bool {
+	vf, ok := fch.realFetcher.(verifyingFetcher)
+	if !ok {
+		return true
+	}
+
+	v, err := loadImageVerification(path)
+	if err == nil {
+		err = vf.imagePolicy().admits(v)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "fetching cached image again for the image policy", "image", imageRef, "oci_layout", path, "reason", err)
+		return false
+	}
+	return true
+}
+
 func ExtractCompressedOCI(ctx context.Context, data []byte, destDir string) error {
 	// Create a reader from the embedded data
 	reader := bytes.NewReader(data)
@@ -22,6 +22,8 @@ const (
 	CacheMetadataFile = "metadata.json"
 	CacheRootfsDir    = "rootfs"
 	CacheExt4File     = "rootfs.ext4"
+	CacheErofsFile    = "rootfs.erofs"
+	CacheSquashfsFile = "rootfs.squashfs"
 	CacheImagePath    = "image.json"
 
 	// Default cache expiration
@@ -31,7 +33,7 @@ const (
 	CacheDirPerm  = 0755
 	CacheFilePerm = 0644
 
-	// Ext4 disk size limit
+	// Ext4 disk size limit. conversions estimate the limit from the image content instead.
 	DefaultExt4MaxSize = 1 << 30 // 1 GiB
 )
 
@@ -49,7 +51,19 @@ type ImageFetchConverter interface {
 	FilesystemConverter
 }
 
+// FetchAndConvertImage fetches and converts imageRef. images from an image cache come back leased, see
+// AcquireImage; one pruned between the fetch and the lease is fetched again. that lease is a file in the cache
+// which stays until AcquireImage(img).Release() is called or the process exits, so every caller takes and
+// releases it, even when it does not run the image.
 func FetchAndConvertImage(ctx context.Context, fetcher ImageFetchConverter, imageRef string, platform units.Platform) (*Image, error) {
+	converted, err := fetchAndConvertImage(ctx, fetcher, imageRef, platform)
+	if errors.Is(err, ErrCacheEntryRemoved) {
+		converted, err = fetchAndConvertImage(ctx, fetcher, imageRef, platform)
+	}
+	return converted, err
+}
+
+func fetchAndConvertImage(ctx context.Context, fetcher ImageFetchConverter, imageRef string, platform units.Platform) (*Image, error) {
 	ociLayoutPath, err := fetcher.FetchImageToOCILayout(ctx, imageRef)
 	if err != nil {
 		return nil, errors.Errorf("fetching image to OCI layout: %w", err)
@@ -81,13 +95,55 @@ type ImageCache interface {
 	FilesystemConverter
 }
 
+// ImageFormat is the filesystem of the block image a converter writes
+type ImageFormat string
+
+const (
+	ImageFormatExt4 ImageFormat = "ext4"
+	// ImageFormatEROFS is an lz4 compressed EROFS image with block aligned, deduplicated file contents
+	ImageFormatEROFS ImageFormat = "erofs"
+	// ImageFormatSquashfs is a zlib compressed squashfs image with deduplicated file contents
+	ImageFormatSquashfs ImageFormat = "squashfs"
+)
+
+func (f ImageFormat) fileName() (string, error) {
+	switch f {
+	case ImageFormatExt4:
+		return CacheExt4File, nil
+	case ImageFormatEROFS:
+		return CacheErofsFile, nil
+	case ImageFormatSquashfs:
+		return CacheSquashfsFile, nil
+	default:
+		return "", errors.Errorf("unsupported image format %q", f)
+	}
+}
+
 // CachedImage represents a cached container image ready for VM use
 type Image struct {
 	Platform   units.Platform `json:"platform"`
 	RootfsPath string         `json:"rootfs_path"`
-	Ext4Path   string         `json:"ext4_path"`
-	Metadata   *v1.Image      `json:"metadata"`
-	CachedAt   time.Time      `json:"cached_at"`
+	// Ext4Path is set when the block image is ext4, DiskPath holds it in every format
+	Ext4Path string    `json:"ext4_path"`
+	Metadata *v1.Image `json:"metadata"`
+	CachedAt time.Time `json:"cached_at"`
+	// Verification is how the image was verified when fetched, nil when the fetcher does not verify images
+	Verification *ImageVerification `json:"verification,omitempty"`
+	// Format is the filesystem of the block image at DiskPath
+	Format   ImageFormat `json:"format,omitempty"`
+	DiskPath string      `json:"disk_path,omitempty"`
+
+	// lease is taken by the cache while converting, see AcquireImage
+	lease *ImageLease
+}
+
+// BlockImage returns the path and filesystem of the block image of the rootfs. images cached before the
+// format was recorded are ext4.
+func (i *Image) BlockImage() (string, ImageFormat) {
+	if i.DiskPath == "" {
+		return i.Ext4Path, ImageFormatExt4
+	}
+	return i.DiskPath, i.Format
 }
 
 func SaveImageToCache(ctx context.Context, file string, i *Image) error {
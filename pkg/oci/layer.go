@@ -0,0 +1,456 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks a path removed by this layer
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower layer contents are hidden by this layer
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// maxSymlinkHops bounds symlink resolution inside the rootfs, like the kernel's MAXSYMLINKS
+	maxSymlinkHops = 255
+)
+
+// layerApplier applies one uncompressed layer tar on top of the rootfs in destDir, following the OCI
+// image layer changeset rules
+type layerApplier struct {
+	destDir string
+	// written holds every path (relative, slash separated) this layer created, so opaque markers
+	// only hide lower layer content
+	written map[string]struct{}
+	// attrs records the metadata the ext4 writer cannot read back from disk
+	attrs rootfsAttrs
+	// privileged is set when ownership can be applied and device nodes created
+	privileged bool
+	// dirTimes are applied after the whole layer is written, since creating children updates them
+	dirTimes []dirTime
+}
+
+type dirTime struct {
+	path  string
+	atime time.Time
+	mtime time.Time
+}
+
+// applyLayer applies the uncompressed layer tar r to destDir. entries named in skip describe the layer itself
+// (like the estargz table of contents) and are not extracted.
+func applyLayer(ctx context.Context, r io.Reader, destDir string, attrs rootfsAttrs, skip ...string) error {
+	a := &layerApplier{
+		destDir:    destDir,
+		written:    map[string]struct{}{},
+		attrs:      attrs,
+		privileged: os.Geteuid() == 0,
+	}
+
+	opaqueDirs := []string{}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("reading tar header: %w", err)
+		}
+
+		name := cleanLayerPath(header.Name)
+		if name == "" || slices.Contains(skip, name) {
+			continue
+		}
+
+		dir, base := filepath.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == whiteoutOpaque:
+			// applied once the whole layer is read, so entries of this layer that come before the marker survive
+			opaqueDirs = append(opaqueDirs, dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := a.remove(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return errors.Errorf("applying whiteout %s: %w", header.Name, err)
+			}
+			continue
+		}
+
+		if err := a.applyEntry(ctx, tarReader, name, header); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range opaqueDirs {
+		if err := a.applyOpaque(dir); err != nil {
+			return errors.Errorf("applying opaque whiteout for %s: %w", dir, err)
+		}
+	}
+
+	// children first, so setting a parent's times is not undone by a nested directory
+	for _, dt := range slices.Backward(a.dirTimes) {
+		if err := setTimes(dt.path, dt.atime, dt.mtime); err != nil {
+			return errors.Errorf("setting directory times %s: %w", dt.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *layerApplier) applyEntry(ctx context.Context, tarReader *tar.Reader, name string, header *tar.Header) error {
+	targetPath, err := a.resolve(name)
+	if err != nil {
+		return errors.Errorf("resolving %s: %w", header.Name, err)
+	}
+
+	// Ensure the target directory exists
+	if err := os.MkdirAll(filepath.Dir(targetPath), CacheDirPerm); err != nil {
+		return errors.Errorf("creating directory: %w", err)
+	}
+
+	if err := a.replaceExisting(name, targetPath, header.Typeflag == tar.TypeDir); err != nil {
+		return errors.Errorf("replacing %s: %w", targetPath, err)
+	}
+
+	attrs := fileAttrsFromHeader(header)
+	record := !a.privileged
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(targetPath, CacheDirPerm); err != nil {
+			return errors.Errorf("creating directory %s: %w", targetPath, err)
+		}
+	case tar.TypeReg, tar.TypeRegA: // TypeRegA is deprecated but still produced by old tar writers
+		if err := extractFile(tarReader, targetPath); err != nil {
+			return errors.Errorf("extracting file %s: %w", targetPath, err)
+		}
+	case tar.TypeSymlink:
+		// the link target is interpreted inside the guest, so it is stored verbatim
+		if err := os.Symlink(header.Linkname, targetPath); err != nil {
+			return errors.Errorf("creating symlink %s: %w", targetPath, err)
+		}
+	case tar.TypeLink:
+		linkName := cleanLayerPath(header.Linkname)
+		linkTarget, err := a.resolve(linkName)
+		if err != nil {
+			return errors.Errorf("resolving hard link target %s: %w", header.Linkname, err)
+		}
+		if err := os.Link(linkTarget, targetPath); err != nil {
+			return errors.Errorf("creating hard link %s: %w", targetPath, err)
+		}
+		// a hard link shares the inode (and so the metadata) of its target
+		if recorded, ok := a.attrs[linkName]; ok {
+			a.attrs.set(name, recorded)
+		}
+		a.written[name] = struct{}{}
+		return nil
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(targetPath, uint32(header.Mode&0o7777)); err != nil {
+			return errors.Errorf("creating fifo %s: %w", targetPath, err)
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if a.privileged {
+			mode := uint32(header.Mode & 0o7777)
+			if header.Typeflag == tar.TypeChar {
+				mode |= unix.S_IFCHR
+			} else {
+				mode |= unix.S_IFBLK
+			}
+			dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+			if err := unix.Mknod(targetPath, mode, int(dev)); err != nil {
+				return errors.Errorf("creating device %s: %w", targetPath, err)
+			}
+		} else {
+			// mknod needs privileges; keep a placeholder and let ext4 generation create the real node
+			if err := os.WriteFile(targetPath, nil, 0600); err != nil {
+				return errors.Errorf("creating device placeholder %s: %w", targetPath, err)
+			}
+			record = true
+		}
+	default:
+		slog.WarnContext(ctx, "skipping unsupported file type", "type", header.Typeflag, "file", header.Name)
+		return nil
+	}
+
+	if err := a.applyMetadata(ctx, targetPath, header); err != nil {
+		return errors.Errorf("applying metadata to %s: %w", targetPath, err)
+	}
+
+	// xattrs are always recorded since the ext4 writer only sees what is in the attrs file
+	if record || len(attrs.Xattrs) > 0 {
+		a.attrs.set(name, attrs)
+	} else {
+		delete(a.attrs, name)
+	}
+
+	a.written[name] = struct{}{}
+
+	return nil
+}
+
+// applyMetadata applies ownership, mode, xattrs and times in the order that keeps them intact: chown clears
+// setuid bits and file capabilities, so it comes first
+func (a *layerApplier) applyMetadata(ctx context.Context, path string, header *tar.Header) error {
+	if a.privileged {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return errors.Errorf("chown: %w", err)
+		}
+	}
+
+	if header.Typeflag != tar.TypeSymlink {
+		mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if !a.privileged {
+			// the true mode is recorded; on disk the owner must still be able to add children in later
+			// layers and read files back for ext4 generation
+			switch header.Typeflag {
+			case tar.TypeDir:
+				mode |= 0o700
+			case tar.TypeReg, tar.TypeRegA:
+				mode |= 0o600
+			}
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return errors.Errorf("chmod: %w", err)
+		}
+	}
+
+	for name, value := range headerXattrs(header) {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			// security.* and trusted.* need privileges the host may not have, the attrs file keeps them
+			slog.DebugContext(ctx, "unable to set xattr on disk", "path", path, "xattr", name, "error", err)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		a.dirTimes = append(a.dirTimes, dirTime{path: path, atime: header.AccessTime, mtime: header.ModTime})
+	default:
+		if err := setTimes(path, header.AccessTime, header.ModTime); err != nil {
+			return errors.Errorf("setting times: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// remove deletes name from the rootfs without following a final symlink
+func (a *layerApplier) remove(name string) error {
+	target, err := a.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	a.attrs.remove(name)
+
+	return nil
+}
+
+// applyOpaque removes everything below dir that was not written by the current layer
+func (a *layerApplier) applyOpaque(dir string) error {
+	root, err := a.resolve(dir)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child := entry.Name()
+		if dir != "" {
+			child = dir + "/" + child
+		}
+
+		_, written := a.written[child]
+
+		switch {
+		case written && entry.IsDir():
+			// a directory re-created by this layer still hides the lower layer children it did not write
+			if err := a.applyOpaque(child); err != nil {
+				return err
+			}
+		case written:
+		case a.wroteBelow(child):
+			if err := a.applyOpaque(child); err != nil {
+				return err
+			}
+		default:
+			if err := a.remove(child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *layerApplier) wroteBelow(dir string) bool {
+	prefix := dir + "/"
+	for name := range a.written {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve maps a rootfs relative path to a host path, resolving symlinks in the parent components as if the
+// rootfs were the root directory. absolute links and ".." can therefore never lead outside destDir. the final
+// component is not followed.
+func (a *layerApplier) resolve(name string) (string, error) {
+	return resolveInRoot(a.destDir, name)
+}
+
+// replaceExisting clears whatever a lower layer left at path so the new entry can take its place. directories
+// are merged with a new directory entry, anything else is removed (so a file is never written through a
+// symlink from a lower layer).
+func (a *layerApplier) replaceExisting(name string, path string, isDir bool) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.IsDir() && isDir {
+		return nil
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	a.attrs.remove(name)
+
+	return nil
+}
+
+// resolveInRoot resolves name (slash separated, relative to root) to a host path inside root. every
+// component but the last is checked with lstat and symlinks are expanded relative to root, the way openat2
+// with RESOLVE_IN_ROOT would.
+func resolveInRoot(root string, name string) (string, error) {
+	pending := strings.Split(name, "/")
+	resolved := []string{}
+	hops := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		candidate := append(slices.Clone(resolved), part)
+
+		if len(pending) == 0 {
+			resolved = candidate
+			break
+		}
+
+		fi, err := os.Lstat(filepath.Join(root, filepath.Join(candidate...)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = candidate
+				continue
+			}
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", errors.Errorf("too many levels of symbolic links resolving %s", name)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, filepath.Join(candidate...)))
+		if err != nil {
+			return "", err
+		}
+
+		target = filepath.ToSlash(target)
+		if strings.HasPrefix(target, "/") {
+			resolved = resolved[:0]
+		}
+
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// cleanLayerPath normalises a tar entry name to a slash separated path relative to the rootfs. ".." cannot
+// climb above the root.
+func cleanLayerPath(name string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+name)), "/")
+}
+
+// extractFile extracts a single file from the tar reader. the path was cleared beforehand, so O_EXCL makes
+// sure nothing (like a racing symlink) is written through.
+func extractFile(tarReader *tar.Reader, targetPath string) error {
+	file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Errorf("creating file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, tarReader); err != nil {
+		return errors.Errorf("copying file content: %w", err)
+	}
+
+	return file.Close()
+}
+
+func setTimes(path string, atime, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
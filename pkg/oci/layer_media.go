@@ -0,0 +1,122 @@
+package oci
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/mholt/archives"
+	"gitlab.com/tozd/go/errors"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/walteh/ec1/pkg/ext/archivesx"
+)
+
+const (
+	mediaTypeDockerLayer            = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	mediaTypeDockerLayerZstd        = "application/vnd.docker.image.rootfs.diff.tar.zstd"
+
+	// estargz layers keep the gzip media type and are marked with an annotation; their table of contents is a
+	// regular tar entry that must not end up in the rootfs
+	estargzTOCDigestAnnotation     = "containerd.io/snapshot/stargz/toc.digest"
+	estargzTOCEntry                = "stargz.index.json"
+	estargzPrefetchLandmarkEntry   = ".prefetch.landmark"
+	estargzNoPrefetchLandmarkEntry = ".no.prefetch.landmark"
+)
+
+type layerCompression string
+
+const (
+	layerCompressionUnknown layerCompression = ""
+	layerCompressionNone    layerCompression = "none"
+	layerCompressionGzip    layerCompression = "gzip"
+	layerCompressionZstd    layerCompression = "zstd"
+)
+
+// layerCompressionFromMediaType maps a layer descriptor media type to its compression. unknown media types
+// (including empty ones from older manifests) are sniffed instead.
+func layerCompressionFromMediaType(mediaType string) layerCompression {
+	// the nondistributable media types are deprecated but still found in the wild
+	switch mediaType {
+	case v1.MediaTypeImageLayer, v1.MediaTypeImageLayerNonDistributable, mediaTypeDockerLayer:
+		return layerCompressionNone
+	case v1.MediaTypeImageLayerGzip, v1.MediaTypeImageLayerNonDistributableGzip, mediaTypeDockerLayerGzip, mediaTypeDockerForeignLayerGzip:
+		return layerCompressionGzip
+	case v1.MediaTypeImageLayerZstd, v1.MediaTypeImageLayerNonDistributableZstd, mediaTypeDockerLayerZstd:
+		return layerCompressionZstd
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".gzip"):
+		return layerCompressionGzip
+	case strings.HasSuffix(mediaType, "+zstd"), strings.HasSuffix(mediaType, ".zstd"):
+		return layerCompressionZstd
+	}
+
+	return layerCompressionUnknown
+}
+
+// isEstargzLayer reports whether the layer carries an estargz table of contents inside the tar stream
+func isEstargzLayer(layer types.BlobInfo) bool {
+	_, ok := layer.Annotations[estargzTOCDigestAnnotation]
+	return ok
+}
+
+// layerMetadataEntries lists tar entries that describe the layer itself rather than the rootfs
+func layerMetadataEntries(layer types.BlobInfo) []string {
+	if isEstargzLayer(layer) {
+		return []string{estargzTOCEntry, estargzPrefetchLandmarkEntry, estargzNoPrefetchLandmarkEntry}
+	}
+	return nil
+}
+
+// openLayer returns the uncompressed tar stream of the layer blob at layerPath. estargz is a series of gzip
+// members and zstd:chunked keeps its metadata in skippable frames, so both read as regular archives.
+func openLayer(ctx context.Context, layerPath string, layer types.BlobInfo) (io.ReadCloser, error) {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return nil, errors.Errorf("opening layer file: %w", err)
+	}
+
+	var rdr io.ReadCloser
+
+	switch compression := layerCompressionFromMediaType(layer.MediaType); compression {
+	case layerCompressionNone:
+		rdr = file
+	case layerCompressionGzip:
+		rdr, err = archives.Gz{}.OpenReader(file)
+	case layerCompressionZstd:
+		rdr, err = archives.Zstd{}.OpenReader(file)
+	default:
+		rdr, _, err = archivesx.IdentifyAndDecompress(ctx, layerPath, file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Errorf("opening %s layer: %w", layer.MediaType, err)
+	}
+
+	if rdr == file {
+		return file, nil
+	}
+
+	return &layerReadCloser{ReadCloser: rdr, file: file}, nil
+}
+
+// layerReadCloser closes the decompressor and the underlying blob file
+type layerReadCloser struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (l *layerReadCloser) Close() error {
+	err := l.ReadCloser.Close()
+	if ferr := l.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,460 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// ext4BlockSize is the block size tar2ext4 writes
+	ext4BlockSize = 4096
+	// ext4EntryOverhead covers the inode, directory entry and extent metadata of one file
+	ext4EntryOverhead = 512
+	// ext4MinSize leaves room for the journal-less superblock, group descriptors and bitmaps of tiny images
+	ext4MinSize = 64 << 20
+)
+
+// layerBlob is a layer of an image in an OCI layout
+type layerBlob struct {
+	path string
+	info types.BlobInfo
+}
+
+func (l layerBlob) open(ctx context.Context) (io.ReadCloser, error) {
+	return openLayer(ctx, l.path, l.info)
+}
+
+// layerBlobsFromOCILayout returns the layers of img in the order they are applied, bottom first
+func layerBlobsFromOCILayout(ociLayoutDir string, img types.Image) []layerBlob {
+	blobs := []layerBlob{}
+	for _, info := range img.LayerInfos() {
+		blobs = append(blobs, layerBlob{
+			path: filepath.Join(ociLayoutDir, "blobs", info.Digest.Algorithm().String(), info.Digest.Encoded()),
+			info: info,
+		})
+	}
+	return blobs
+}
+
+type mergedKind int
+
+const (
+	// mergedEntry is a non-directory an upper layer defined; it hides the path and everything below it
+	mergedEntry mergedKind = iota + 1
+	// mergedDir is a directory an upper layer defined; lower layers can still add children
+	mergedDir
+	// mergedImplicitDir is an ancestor of an upper layer entry that the upper layer did not declare. it is
+	// a directory, but a lower layer's header may still supply its metadata.
+	mergedImplicitDir
+)
+
+// layerMerger flattens layers into one tar stream without extracting them. layers are read top first, so an
+// entry is written as soon as it is known not to be hidden by an upper layer; only the paths seen so far
+// are kept in memory, never file contents.
+//
+// a hard link has to follow its target in the stream. links to a file of a lower layer wait in pending until
+// the target is read, and links to a file an upper layer hid are written as copies of the hidden file.
+type layerMerger struct {
+	// paths written by upper layers
+	paths map[string]mergedKind
+	// paths removed by upper layer whiteouts, with everything below them
+	whiteouts map[string]struct{}
+	// directories whose lower layer contents are hidden by an upper layer
+	opaque map[string]struct{}
+	// hard links of upper layers by the path of their target in a lower layer
+	pending map[string][]*tar.Header
+}
+
+func newLayerMerger() *layerMerger {
+	return &layerMerger{
+		paths:     map[string]mergedKind{},
+		whiteouts: map[string]struct{}{},
+		opaque:    map[string]struct{}{},
+		pending:   map[string][]*tar.Header{},
+	}
+}
+
+// layerLinks tracks the hard link targets of the layer being merged
+type layerLinks struct {
+	// hidden records, for every entry of the layer read so far, whether upper layers hide it
+	hidden map[string]bool
+	// targets maps the hard links of the layer to their target
+	targets map[string]string
+	// copies are the links to hidden files of the layer, by target; they are written as copies once the
+	// layer is read again
+	copies map[string][]*tar.Header
+}
+
+// target follows name through the hard links of the layer to the file they all share
+func (l *layerLinks) target(name string) string {
+	for range len(l.targets) {
+		next, ok := l.targets[name]
+		if !ok {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+// hidden reports whether an upper layer hides name, given the type of the lower layer entry
+func (m *layerMerger) hidden(name string, isDir bool) bool {
+	if _, ok := m.whiteouts[name]; ok {
+		return true
+	}
+
+	switch m.paths[name] {
+	case mergedEntry, mergedDir:
+		return true
+	case mergedImplicitDir:
+		if !isDir {
+			return true
+		}
+	}
+
+	for dir := parentLayerPath(name); dir != ""; dir = parentLayerPath(dir) {
+		if _, ok := m.whiteouts[dir]; ok {
+			return true
+		}
+		if _, ok := m.opaque[dir]; ok {
+			return true
+		}
+		// an upper layer replaced the directory with something else
+		if m.paths[dir] == mergedEntry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mergeLayer writes the entries of one layer that upper layers do not hide, and records what it hides
+// from the layers below
+func (m *layerMerger) mergeLayer(ctx context.Context, layer layerBlob, tw *tar.Writer) error {
+	rdr, err := layer.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	skip := layerMetadataEntries(layer.info)
+	links := &layerLinks{hidden: map[string]bool{}, targets: map[string]string{}, copies: map[string][]*tar.Header{}}
+	written := []*tar.Header{}
+	whiteouts := []string{}
+	opaque := []string{}
+
+	tr := tar.NewReader(rdr)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("reading tar header: %w", err)
+		}
+
+		name := cleanLayerPath(header.Name)
+		if name == "" || slices.Contains(skip, name) {
+			continue
+		}
+
+		dir, base := filepath.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			whiteouts = append(whiteouts, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		isDir := header.Typeflag == tar.TypeDir
+		hidden := m.hidden(name, isDir)
+		links.hidden[name] = hidden
+		if header.Typeflag == tar.TypeLink {
+			links.targets[name] = cleanLayerPath(header.Linkname)
+		}
+
+		// links of upper layers to this entry
+		upper := m.pending[name]
+		delete(m.pending, name)
+
+		out := *header
+		out.Name = name
+		if isDir {
+			out.Name += "/"
+		}
+
+		switch {
+		case header.Typeflag == tar.TypeLink:
+			if !hidden {
+				if err := m.writeLink(tw, links, &out, links.target(name)); err != nil {
+					return err
+				}
+				written = append(written, &out)
+			}
+			for _, link := range upper {
+				if err := m.writeLink(tw, links, link, links.target(name)); err != nil {
+					return err
+				}
+			}
+			continue
+		case hidden && len(upper) > 0:
+			if err := writeCopies(tw, tr, header, upper); err != nil {
+				return err
+			}
+			continue
+		case hidden:
+			continue
+		}
+
+		if err := tw.WriteHeader(&out); err != nil {
+			return errors.Errorf("writing header for %s: %w", name, err)
+		}
+		if out.Typeflag == tar.TypeReg || out.Typeflag == tar.TypeRegA {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return errors.Errorf("copying %s: %w", name, err)
+			}
+		}
+		written = append(written, &out)
+
+		for _, link := range upper {
+			if err := writeLinkTo(tw, link, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// links whose target only this layer had, before an upper layer hid it, copy the hidden file
+	for target, copies := range links.copies {
+		written = append(written, copies...)
+		slog.DebugContext(ctx, "copying hard links to a file hidden by an upper layer", "target", target, "links", len(copies))
+	}
+	if len(links.copies) > 0 {
+		if err := m.copyHiddenTargets(ctx, layer, tw, links.copies); err != nil {
+			return err
+		}
+	}
+
+	// what this layer did only applies to the layers below it, so a layer never hides its own entries
+	for _, header := range written {
+		name := strings.TrimSuffix(header.Name, "/")
+		if header.Typeflag == tar.TypeDir {
+			m.paths[name] = mergedDir
+		} else {
+			m.paths[name] = mergedEntry
+		}
+		for dir := parentLayerPath(name); dir != ""; dir = parentLayerPath(dir) {
+			if _, ok := m.paths[dir]; !ok {
+				m.paths[dir] = mergedImplicitDir
+			}
+		}
+	}
+	for _, name := range whiteouts {
+		m.whiteouts[name] = struct{}{}
+	}
+	for _, dir := range opaque {
+		m.opaque[dir] = struct{}{}
+	}
+
+	return nil
+}
+
+// writeLink writes link to target once target is in the stream. a target in this layer was read already;
+// when it is hidden the link becomes a copy of it. a target in no layer read so far is in a lower one.
+func (m *layerMerger) writeLink(tw *tar.Writer, links *layerLinks, link *tar.Header, target string) error {
+	hidden, ok := links.hidden[target]
+	switch {
+	case !ok:
+		m.pending[target] = append(m.pending[target], link)
+		return nil
+	case hidden:
+		links.copies[target] = append(links.copies[target], link)
+		return nil
+	default:
+		return writeLinkTo(tw, link, target)
+	}
+}
+
+func writeLinkTo(tw *tar.Writer, link *tar.Header, target string) error {
+	link.Typeflag = tar.TypeLink
+	link.Linkname = target
+	link.Size = 0
+	if err := tw.WriteHeader(link); err != nil {
+		return errors.Errorf("writing header for %s: %w", link.Name, err)
+	}
+	return nil
+}
+
+// writeCopies writes the first of links as a copy of the hidden entry header, whose contents tr is at, and
+// links the others to it
+func writeCopies(tw *tar.Writer, tr *tar.Reader, header *tar.Header, links []*tar.Header) error {
+	first := *header
+	first.Name = links[0].Name
+	if err := tw.WriteHeader(&first); err != nil {
+		return errors.Errorf("writing header for %s: %w", first.Name, err)
+	}
+	if first.Typeflag == tar.TypeReg || first.Typeflag == tar.TypeRegA {
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Errorf("copying %s to %s: %w", header.Name, first.Name, err)
+		}
+	}
+	*links[0] = first
+
+	for _, link := range links[1:] {
+		if err := writeLinkTo(tw, link, first.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyHiddenTargets reads layer again for the contents of the hidden files that links of the layer share.
+// only layers with such links are read twice.
+func (m *layerMerger) copyHiddenTargets(ctx context.Context, layer layerBlob, tw *tar.Writer, copies map[string][]*tar.Header) error {
+	rdr, err := layer.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	tr := tar.NewReader(rdr)
+	for len(copies) > 0 {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("reading tar header: %w", err)
+		}
+
+		name := cleanLayerPath(header.Name)
+		links, ok := copies[name]
+		if !ok {
+			continue
+		}
+		delete(copies, name)
+
+		if err := writeCopies(tw, tr, header, links); err != nil {
+			return err
+		}
+	}
+
+	for target := range copies {
+		slog.WarnContext(ctx, "skipping hard links to a missing file", "target", target)
+	}
+	return nil
+}
+
+// mergeLayers writes the flattened filesystem of layers (bottom first) to w as a tar stream
+func mergeLayers(ctx context.Context, layers []layerBlob, w io.Writer) error {
+	m := newLayerMerger()
+	tw := tar.NewWriter(w)
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+
+		slog.DebugContext(ctx, "merging layer", "layer", i+1, "total", len(layers), "digest", layer.info.Digest)
+
+		if err := m.mergeLayer(ctx, layer, tw); err != nil {
+			return errors.Errorf("merging layer %d: %w", i+1, err)
+		}
+	}
+
+	for target, links := range m.pending {
+		slog.WarnContext(ctx, "skipping hard links to a file no layer has", "target", target, "links", len(links))
+	}
+
+	return tw.Close()
+}
+
+// estimateExt4Size returns a maximum size for an ext4 image holding layers. every entry of every layer is
+// counted, so files replaced by upper layers make it an overestimate, never an underestimate. the layers
+// are decompressed to read the entry sizes, but nothing is written to disk.
+func estimateExt4Size(ctx context.Context, layers []layerBlob) (int64, error) {
+	total := int64(0)
+
+	for _, layer := range layers {
+		rdr, err := layer.open(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		tr := tar.NewReader(rdr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rdr.Close()
+				return 0, errors.Errorf("reading layer %s: %w", layer.info.Digest, err)
+			}
+
+			blocks := (header.Size + ext4BlockSize - 1) / ext4BlockSize
+			total += blocks*ext4BlockSize + ext4EntryOverhead
+		}
+		rdr.Close()
+	}
+
+	return ext4SizeWithOverhead(total), nil
+}
+
+// estimateDirectoryExt4Size is estimateExt4Size for an extracted rootfs directory
+func estimateDirectoryExt4Size(rootfsPath string) (int64, error) {
+	total := int64(0)
+
+	err := filepath.WalkDir(rootfsPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size := int64(0)
+		if fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		blocks := (size + ext4BlockSize - 1) / ext4BlockSize
+		total += blocks*ext4BlockSize + ext4EntryOverhead
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Errorf("walking rootfs: %w", err)
+	}
+
+	return ext4SizeWithOverhead(total), nil
+}
+
+func ext4SizeWithOverhead(content int64) int64 {
+	// a quarter on top for the inode tables, bitmaps and directory blocks the writer lays out
+	size := content + content/4
+	if size < ext4MinSize {
+		size = ext4MinSize
+	}
+	return size
+}
+
+func parentLayerPath(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
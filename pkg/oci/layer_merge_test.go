@@ -0,0 +1,217 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type mergedTestEntry struct {
+	typ  byte
+	body string
+	link string
+}
+
+// mergeTestLayers writes each layer (bottom first) as a gzip blob, merges them and returns the flattened entries
+func mergeTestLayers(t *testing.T, layers ...[]testLayerEntry) (map[string]mergedTestEntry, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	blobs := []layerBlob{}
+	for _, layer := range layers {
+		blobs = append(blobs, layerBlob{
+			path: writeTestLayer(t, dir, archives.Gz{}, layer...),
+			info: types.BlobInfo{MediaType: v1.MediaTypeImageLayerGzip},
+		})
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, mergeLayers(context.Background(), blobs, &buf))
+
+	entries := map[string]mergedTestEntry{}
+	order := []string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		entries[hdr.Name] = mergedTestEntry{typ: hdr.Typeflag, body: string(body), link: hdr.Linkname}
+		order = append(order, hdr.Name)
+	}
+
+	return entries, order
+}
+
+func TestMergeLayers(t *testing.T) {
+	entries, order := mergeTestLayers(t,
+		[]testLayerEntry{
+			dirEntry("etc"),
+			fileEntry("etc/a", "1"),
+			fileEntry("etc/b", "b"),
+			dirEntry("opt"),
+			fileEntry("opt/x", "x"),
+			fileEntry("keep", "k"),
+			dirEntry("var"),
+			fileEntry("var/f", "f"),
+			fileEntry("lib/libc.so", "libc"),
+			{name: "lib/libc.so.6", typ: tar.TypeLink, link: "lib/libc.so"},
+		},
+		[]testLayerEntry{
+			whiteoutEntry("etc/b"),
+			fileEntry("etc/a", "2"),
+			opaqueEntry("opt"),
+			fileEntry("opt/y", "y"),
+			symlinkEntry("var", "/tmp"),
+			fileEntry("new/file", "n"),
+		},
+	)
+
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeReg, body: "2"}, entries["etc/a"])
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeReg, body: "y"}, entries["opt/y"])
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeReg, body: "k"}, entries["keep"])
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeReg, body: "n"}, entries["new/file"])
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeSymlink, link: "/tmp"}, entries["var"])
+	assert.Equal(t, mergedTestEntry{typ: tar.TypeLink, link: "lib/libc.so"}, entries["lib/libc.so.6"])
+
+	// directories from lower layers still supply metadata
+	assert.Contains(t, entries, "etc/")
+	assert.Contains(t, entries, "opt/")
+
+	for _, hidden := range []string{"etc/b", "opt/x", "var/", "var/f"} {
+		assert.NotContains(t, entries, hidden)
+	}
+
+	// whiteouts never reach the flattened stream
+	for _, name := range order {
+		assert.NotContains(t, name, whiteoutPrefix)
+	}
+}
+
+func TestMergeLayersImplicitDirectory(t *testing.T) {
+	// the upper layer creates usr/bin/tool without declaring usr/bin, which the lower layer has as a file
+	entries, _ := mergeTestLayers(t,
+		[]testLayerEntry{
+			dirEntry("usr"),
+			fileEntry("usr/bin", "not a dir"),
+		},
+		[]testLayerEntry{
+			fileEntry("usr/bin/tool", "tool"),
+		},
+	)
+
+	assert.Contains(t, entries, "usr/")
+	assert.NotContains(t, entries, "usr/bin")
+	assert.Equal(t, "tool", entries["usr/bin/tool"].body)
+}
+
+// extractMergedLayers merges layers and extracts the flattened stream, which fails when a hard link comes
+// before its target
+func extractMergedLayers(t *testing.T, layers ...[]testLayerEntry) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	blobs := []layerBlob{}
+	for _, layer := range layers {
+		blobs = append(blobs, layerBlob{
+			path: writeTestLayer(t, dir, archives.Gz{}, layer...),
+			info: types.BlobInfo{MediaType: v1.MediaTypeImageLayerGzip},
+		})
+	}
+
+	merged := filepath.Join(dir, "merged.tar")
+	f, err := os.Create(merged)
+	require.NoError(t, err)
+	require.NoError(t, mergeLayers(context.Background(), blobs, f))
+	require.NoError(t, f.Close())
+
+	rootfs := t.TempDir()
+	require.NoError(t, NewOCIFilesystemConverter().extractLayer(context.Background(), merged, types.BlobInfo{MediaType: v1.MediaTypeImageLayer}, rootfs, nil))
+	return rootfs
+}
+
+func hardlinkEntry(name, target string) testLayerEntry {
+	return testLayerEntry{name: name, typ: tar.TypeLink, link: target}
+}
+
+func TestMergeLayersMatchesExtraction(t *testing.T) {
+	layers := [][]testLayerEntry{
+		{
+			dirEntry("a"), fileEntry("a/1", "one"), fileEntry("a/2", "two"), dirEntry("b"), fileEntry("b/x", "x"),
+			dirEntry("c"), fileEntry("c/orig", "old"), hardlinkEntry("c/link", "c/orig"), hardlinkEntry("c/link2", "c/link"),
+			dirEntry("d"), fileEntry("d/file", "data"),
+			dirEntry("e"), fileEntry("e/file", "v1"),
+		},
+		{
+			whiteoutEntry("a/1"), opaqueEntry("b"), fileEntry("b/y", "y"),
+			// replaces the target of lower hard links, which keep the old contents
+			fileEntry("c/orig", "new"),
+			// hard links to files of the lower layer
+			hardlinkEntry("d/hard", "d/file"), hardlinkEntry("e/hard", "e/file"),
+		},
+		{fileEntry("a/2", "TWO"), whiteoutEntry("b"), fileEntry("e/file", "v2")},
+	}
+
+	entries, _ := mergeTestLayers(t, layers...)
+	rootfs := applyTestLayers(t, layers...)
+	merged := extractMergedLayers(t, layers...)
+
+	assertContent(t, rootfs, "a/2", "TWO")
+	assert.Equal(t, "TWO", entries["a/2"].body)
+
+	assertMissing(t, rootfs, "a/1")
+	assert.NotContains(t, entries, "a/1")
+
+	assertMissing(t, rootfs, "b")
+	assert.NotContains(t, entries, "b/")
+	assert.NotContains(t, entries, "b/y")
+
+	for name, want := range map[string]string{
+		"a/2":     "TWO",
+		"c/orig":  "new",
+		"c/link":  "old",
+		"c/link2": "old",
+		"d/file":  "data",
+		"d/hard":  "data",
+		"e/file":  "v2",
+		"e/hard":  "v1",
+	} {
+		assertContent(t, rootfs, name, want)
+		assertContent(t, merged, name, want)
+	}
+	assertMissing(t, merged, "a/1")
+	assertMissing(t, merged, "b")
+}
+
+func TestEstimateExt4Size(t *testing.T) {
+	dir := t.TempDir()
+	big := make([]byte, 100<<20)
+
+	small := layerBlob{path: writeTestLayer(t, dir, nil, fileEntry("f", "x")), info: types.BlobInfo{MediaType: v1.MediaTypeImageLayer}}
+	large := layerBlob{path: writeTestLayer(t, dir, archives.Gz{}, fileEntry("big", string(big))), info: types.BlobInfo{MediaType: v1.MediaTypeImageLayerGzip}}
+
+	size, err := estimateExt4Size(context.Background(), []layerBlob{small})
+	require.NoError(t, err)
+	assert.Equal(t, int64(ext4MinSize), size)
+
+	// the compressed blob is tiny, the estimate follows the uncompressed content
+	size, err = estimateExt4Size(context.Background(), []layerBlob{small, large})
+	require.NoError(t, err)
+	assert.Greater(t, size, int64(len(big)))
+}
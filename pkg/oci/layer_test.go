@@ -0,0 +1,406 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testLayerEntry describes one tar entry of an in-process test layer
+type testLayerEntry struct {
+	name string
+	typ  byte
+	body string
+	link string
+	// hdr, when set, is written as is
+	hdr *tar.Header
+}
+
+func dirEntry(name string) testLayerEntry { return testLayerEntry{name: name, typ: tar.TypeDir} }
+
+func fileEntry(name, body string) testLayerEntry {
+	return testLayerEntry{name: name, typ: tar.TypeReg, body: body}
+}
+
+func symlinkEntry(name, target string) testLayerEntry {
+	return testLayerEntry{name: name, typ: tar.TypeSymlink, link: target}
+}
+
+func whiteoutEntry(name string) testLayerEntry {
+	dir, base := filepath.Split(name)
+	return fileEntry(dir+whiteoutPrefix+base, "")
+}
+
+func opaqueEntry(dir string) testLayerEntry {
+	return fileEntry(dir+"/"+whiteoutOpaque, "")
+}
+
+// writeTestLayer writes entries as a layer tarball, compressed with compression unless it is nil, and
+// returns its path
+func writeTestLayer(t *testing.T, dir string, compression archives.Compression, entries ...testLayerEntry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var out io.WriteCloser = nopWriteCloser{&buf}
+	if compression != nil {
+		var err error
+		out, err = compression.OpenWriter(&buf)
+		require.NoError(t, err)
+	}
+	tw := tar.NewWriter(out)
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typ,
+			Linkname: e.link,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0755
+			hdr.Size = 0
+		}
+		if e.hdr != nil {
+			hdr = e.hdr
+			hdr.Size = int64(len(e.body))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(e.body))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, out.Close())
+
+	f, err := os.CreateTemp(dir, "layer-*")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	return f.Name()
+}
+
+// applyTestLayers applies each layer in order to a fresh rootfs and returns it
+func applyTestLayers(t *testing.T, layers ...[]testLayerEntry) string {
+	t.Helper()
+
+	layerDir := t.TempDir()
+	rootfs := t.TempDir()
+	converter := NewOCIFilesystemConverter()
+
+	for _, layer := range layers {
+		path := writeTestLayer(t, layerDir, archives.Gz{}, layer...)
+		require.NoError(t, converter.extractLayer(context.Background(), path, types.BlobInfo{MediaType: v1.MediaTypeImageLayerGzip}, rootfs, nil))
+	}
+
+	return rootfs
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func assertContent(t *testing.T, rootfs, name, want string) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(rootfs, name))
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func assertMissing(t *testing.T, rootfs, name string) {
+	t.Helper()
+	_, err := os.Lstat(filepath.Join(rootfs, name))
+	assert.True(t, os.IsNotExist(err), "%s should not exist", name)
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	rootfs := applyTestLayers(t,
+		[]testLayerEntry{
+			dirEntry("etc"),
+			fileEntry("etc/keep", "keep"),
+			fileEntry("etc/remove", "remove"),
+			dirEntry("root/.cache/pip/wheels"),
+			fileEntry("root/.cache/pip/wheels/big.whl", "wheel"),
+		},
+		// like `rm -rf /root/.cache && rm /etc/remove` in a later build step
+		[]testLayerEntry{
+			whiteoutEntry("etc/remove"),
+			whiteoutEntry("root/.cache"),
+		},
+	)
+
+	assertContent(t, rootfs, "etc/keep", "keep")
+	assertMissing(t, rootfs, "etc/remove")
+	assertMissing(t, rootfs, "etc/.wh.remove")
+	assertMissing(t, rootfs, "root/.cache")
+
+	_, err := os.Stat(filepath.Join(rootfs, "root"))
+	assert.NoError(t, err)
+}
+
+func TestApplyLayerOpaqueDirectory(t *testing.T) {
+	rootfs := applyTestLayers(t,
+		[]testLayerEntry{
+			dirEntry("app"),
+			dirEntry("app/lib"),
+			fileEntry("app/a", "a"),
+			fileEntry("app/lib/old.so", "old"),
+			fileEntry("other", "other"),
+		},
+		[]testLayerEntry{
+			dirEntry("app"),
+			// entries of the same layer survive even when they come before the marker
+			fileEntry("app/before", "before"),
+			dirEntry("app/lib"),
+			fileEntry("app/lib/new.so", "new"),
+			opaqueEntry("app"),
+			fileEntry("app/after", "after"),
+		},
+	)
+
+	assertContent(t, rootfs, "app/before", "before")
+	assertContent(t, rootfs, "app/after", "after")
+	assertContent(t, rootfs, "app/lib/new.so", "new")
+	assertMissing(t, rootfs, "app/a")
+	assertMissing(t, rootfs, "app/lib/old.so")
+	assertMissing(t, rootfs, "app/"+whiteoutOpaque)
+	assertContent(t, rootfs, "other", "other")
+}
+
+func TestApplyLayerTypeChanges(t *testing.T) {
+	rootfs := applyTestLayers(t,
+		[]testLayerEntry{
+			dirEntry("was-dir"),
+			fileEntry("was-dir/child", "child"),
+			fileEntry("was-file", "file"),
+			fileEntry("target", "target"),
+			symlinkEntry("was-link", "target"),
+			fileEntry("becomes-dir", "file"),
+		},
+		[]testLayerEntry{
+			fileEntry("was-dir", "now a file"),
+			symlinkEntry("was-file", "target"),
+			fileEntry("was-link", "now a file"),
+			dirEntry("becomes-dir"),
+			fileEntry("becomes-dir/child", "child"),
+		},
+	)
+
+	assertContent(t, rootfs, "was-dir", "now a file")
+
+	link, err := os.Readlink(filepath.Join(rootfs, "was-file"))
+	require.NoError(t, err)
+	assert.Equal(t, "target", link)
+
+	// the new file replaces the symlink instead of writing through it
+	fi, err := os.Lstat(filepath.Join(rootfs, "was-link"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assertContent(t, rootfs, "was-link", "now a file")
+	assertContent(t, rootfs, "target", "target")
+
+	assertContent(t, rootfs, "becomes-dir/child", "child")
+}
+
+func TestCleanLayerPath(t *testing.T) {
+	assert.Equal(t, "etc/passwd", cleanLayerPath("./etc/passwd"))
+	assert.Equal(t, "etc", cleanLayerPath("/etc/"))
+	assert.Equal(t, "etc/passwd", cleanLayerPath("../../etc/passwd"))
+	assert.Equal(t, "", cleanLayerPath("./"))
+}
+
+func TestExtractLayerCompression(t *testing.T) {
+	entries := []testLayerEntry{
+		dirEntry("etc"),
+		fileEntry("etc/os-release", "ID=test"),
+	}
+
+	tests := []struct {
+		name        string
+		compression archives.Compression
+		layer       types.BlobInfo
+	}{
+		{"gzip", archives.Gz{}, types.BlobInfo{MediaType: v1.MediaTypeImageLayerGzip}},
+		{"zstd", archives.Zstd{}, types.BlobInfo{MediaType: v1.MediaTypeImageLayerZstd}},
+		{"uncompressed", nil, types.BlobInfo{MediaType: v1.MediaTypeImageLayer}},
+		{"docker gzip", archives.Gz{}, types.BlobInfo{MediaType: mediaTypeDockerLayerGzip}},
+		{"sniffed gzip", archives.Gz{}, types.BlobInfo{}},
+		{"sniffed zstd", archives.Zstd{}, types.BlobInfo{}},
+		{"sniffed uncompressed", nil, types.BlobInfo{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestLayer(t, t.TempDir(), tt.compression, entries...)
+			rootfs := t.TempDir()
+
+			require.NoError(t, NewOCIFilesystemConverter().extractLayer(context.Background(), path, tt.layer, rootfs, nil))
+			assertContent(t, rootfs, "etc/os-release", "ID=test")
+		})
+	}
+}
+
+func TestExtractLayerEstargz(t *testing.T) {
+	path := writeTestLayer(t, t.TempDir(), archives.Gz{},
+		fileEntry("app", "app"),
+		fileEntry(estargzPrefetchLandmarkEntry, "0"),
+		fileEntry(estargzTOCEntry, "{}"),
+	)
+	rootfs := t.TempDir()
+
+	layer := types.BlobInfo{
+		MediaType:   v1.MediaTypeImageLayerGzip,
+		Annotations: map[string]string{estargzTOCDigestAnnotation: "sha256:0000"},
+	}
+
+	require.NoError(t, NewOCIFilesystemConverter().extractLayer(context.Background(), path, layer, rootfs, nil))
+	assertContent(t, rootfs, "app", "app")
+	assertMissing(t, rootfs, estargzTOCEntry)
+	assertMissing(t, rootfs, estargzPrefetchLandmarkEntry)
+}
+
+func TestLayerCompressionFromMediaType(t *testing.T) {
+	assert.Equal(t, layerCompressionGzip, layerCompressionFromMediaType(v1.MediaTypeImageLayerGzip))
+	assert.Equal(t, layerCompressionZstd, layerCompressionFromMediaType(v1.MediaTypeImageLayerZstd))
+	assert.Equal(t, layerCompressionNone, layerCompressionFromMediaType(v1.MediaTypeImageLayer))
+	assert.Equal(t, layerCompressionZstd, layerCompressionFromMediaType("application/vnd.example.layer+zstd"))
+	assert.Equal(t, layerCompressionUnknown, layerCompressionFromMediaType(""))
+}
+
+func TestApplyLayerContainsSymlinkEscapes(t *testing.T) {
+	outside := t.TempDir()
+
+	rootfs := applyTestLayers(t,
+		[]testLayerEntry{
+			symlinkEntry("abs", outside),
+			symlinkEntry("rel", "../../../../../.."+outside),
+		},
+		[]testLayerEntry{
+			fileEntry("abs/pwned", "abs"),
+			fileEntry("rel/pwned", "rel"),
+			fileEntry("../../escaped", "dotdot"),
+		},
+	)
+
+	_, err := os.Stat(filepath.Join(outside, "pwned"))
+	assert.True(t, os.IsNotExist(err), "write escaped the rootfs through a symlink")
+
+	// both links resolve inside the rootfs, as they would in the guest
+	assertContent(t, rootfs, filepath.Join(outside, "pwned"), "rel")
+	assertContent(t, rootfs, "escaped", "dotdot")
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	require.NoError(t, os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(root, "loop")))
+
+	got, err := resolveInRoot(root, "lib/libc.so")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "usr/lib/libc.so"), got)
+
+	// the final component is never followed
+	got, err = resolveInRoot(root, "lib")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "lib"), got)
+
+	_, err = resolveInRoot(root, "loop/x")
+	assert.Error(t, err)
+}
+
+func TestApplyLayerPreservesMetadata(t *testing.T) {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	rootfs := t.TempDir()
+	attrs := rootfsAttrs{}
+
+	path := writeTestLayer(t, t.TempDir(), nil,
+		testLayerEntry{hdr: &tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		testLayerEntry{
+			body: "ping",
+			hdr: &tar.Header{
+				Name:       "bin/ping",
+				Typeflag:   tar.TypeReg,
+				Mode:       0o4755,
+				Uid:        0,
+				Gid:        0,
+				ModTime:    mtime,
+				PAXRecords: map[string]string{paxXattrPrefix + "security.capability": "\x01\x00"},
+			},
+		},
+		testLayerEntry{hdr: &tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testLayerEntry{hdr: &tar.Header{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600}},
+		testLayerEntry{hdr: &tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0o640, Gid: 42}, body: "root:*"},
+	)
+
+	require.NoError(t, NewOCIFilesystemConverter().extractLayer(context.Background(), path, types.BlobInfo{MediaType: v1.MediaTypeImageLayer}, rootfs, attrs))
+
+	fi, err := os.Stat(filepath.Join(rootfs, "bin/ping"))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSetuid, "setuid bit lost")
+	assert.True(t, mtime.Equal(fi.ModTime()), "mtime not preserved")
+
+	dfi, err := os.Stat(filepath.Join(rootfs, "bin"))
+	require.NoError(t, err)
+	assert.True(t, mtime.Equal(dfi.ModTime()), "directory mtime not preserved")
+
+	ffi, err := os.Lstat(filepath.Join(rootfs, "run/initctl"))
+	require.NoError(t, err)
+	assert.NotZero(t, ffi.Mode()&os.ModeNamedPipe)
+
+	// what the ext4 writer sees must match the layer regardless of host privileges
+	var buf bytes.Buffer
+	require.NoError(t, writeRootfsTar(context.Background(), rootfs, attrs, &buf))
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+
+	ping := headers["bin/ping"]
+	require.NotNil(t, ping)
+	assert.Equal(t, int64(0o4755), ping.Mode&0o7777)
+	assert.Equal(t, 0, ping.Uid)
+	assert.Equal(t, "\x01\x00", ping.PAXRecords[paxXattrPrefix+"security.capability"])
+
+	null := headers["dev/null"]
+	require.NotNil(t, null)
+	assert.Equal(t, byte(tar.TypeChar), null.Typeflag)
+	assert.Equal(t, int64(1), null.Devmajor)
+	assert.Equal(t, int64(3), null.Devminor)
+
+	shadow := headers["etc/shadow"]
+	require.NotNil(t, shadow)
+	assert.Equal(t, int64(0o640), shadow.Mode&0o7777)
+	assert.Equal(t, 42, shadow.Gid)
+
+	// the recorded attrs survive a save/load round trip
+	require.NoError(t, attrs.save(rootfsAttrsPath(rootfs)))
+	loaded, err := loadRootfsAttrs(rootfs)
+	require.NoError(t, err)
+	assert.Equal(t, len(attrs), len(loaded))
+}
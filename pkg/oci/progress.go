@@ -0,0 +1,115 @@
+package oci
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// PullStage is a step of getting an image ready for a VM
+type PullStage string
+
+const (
+	// PullStageResolving looks up the manifest of the image reference
+	PullStageResolving PullStage = "resolving"
+	// PullStageDownloading copies the blobs of the image into an OCI layout
+	PullStageDownloading PullStage = "downloading"
+	// PullStageExtracting unpacks the layers into the rootfs directory
+	PullStageExtracting PullStage = "extracting"
+	// PullStageConverting writes the block image from the layers
+	PullStageConverting PullStage = "converting"
+)
+
+// ProgressEvent reports the progress of a stage. events with a Layer track the bytes of that blob; the
+// event with Done set ends the stage and carries its Duration.
+type ProgressEvent struct {
+	// Image is the reference of a fetch or the OCI layout path of a conversion
+	Image string
+	Stage PullStage
+	// Layer is the blob the bytes refer to, empty for events about the whole stage
+	Layer digest.Digest
+	// BytesDone and BytesTotal count the bytes of Layer; BytesTotal is -1 when the size is unknown
+	BytesDone  int64
+	BytesTotal int64
+	// Duration is the time since the stage started
+	Duration time.Duration
+	Done     bool
+}
+
+// ProgressFunc receives progress events. it is called synchronously from the pull, so it should not block.
+type ProgressFunc func(ctx context.Context, event ProgressEvent)
+
+// LogProgress is the ProgressFunc used when none is set: layer byte counts at debug level and
+// finished stages at info level
+func LogProgress(ctx context.Context, event ProgressEvent) {
+	switch {
+	case event.Done:
+		slog.InfoContext(ctx, "image pull stage finished",
+			"image", event.Image,
+			"stage", event.Stage,
+			"duration", event.Duration)
+	case event.Layer != "":
+		slog.DebugContext(ctx, "image pull progress",
+			"image", event.Image,
+			"stage", event.Stage,
+			"layer", event.Layer.String(),
+			"bytes_done", event.BytesDone,
+			"bytes_total", event.BytesTotal)
+	}
+}
+
+// progressStage reports the events of one stage to fn, or to LogProgress when fn is nil
+type progressStage struct {
+	fn    ProgressFunc
+	image string
+	stage PullStage
+	start time.Time
+}
+
+func startStage(fn ProgressFunc, image string, stage PullStage) *progressStage {
+	if fn == nil {
+		fn = LogProgress
+	}
+	return &progressStage{fn: fn, image: image, stage: stage, start: time.Now()}
+}
+
+func (s *progressStage) layer(ctx context.Context, layer digest.Digest, done, total int64) {
+	s.fn(ctx, ProgressEvent{
+		Image:      s.image,
+		Stage:      s.stage,
+		Layer:      layer,
+		BytesDone:  done,
+		BytesTotal: total,
+		Duration:   time.Since(s.start),
+	})
+}
+
+func (s *progressStage) done(ctx context.Context) {
+	s.fn(ctx, ProgressEvent{
+		Image:    s.image,
+		Stage:    s.stage,
+		Duration: time.Since(s.start),
+		Done:     true,
+	})
+}
+
+// forwardCopyProgress turns the progress of copy.Image into layer events until ch is closed
+func (s *progressStage) forwardCopyProgress(ctx context.Context, ch <-chan types.ProgressProperties) {
+	for props := range ch {
+		switch props.Event {
+		case types.ProgressEventNewArtifact:
+			s.layer(ctx, props.Artifact.Digest, 0, props.Artifact.Size)
+		case types.ProgressEventRead:
+			s.layer(ctx, props.Artifact.Digest, int64(props.Offset), props.Artifact.Size)
+		case types.ProgressEventDone, types.ProgressEventSkipped:
+			size := props.Artifact.Size
+			if size < 0 {
+				size = int64(props.Offset)
+			}
+			s.layer(ctx, props.Artifact.Digest, size, size)
+		}
+	}
+}
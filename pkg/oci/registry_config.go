@@ -0,0 +1,201 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/pelletier/go-toml/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+// RegistryCredentials authenticate against a single registry. the zero value pulls anonymously.
+type RegistryCredentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token, used instead of Username and Password when set
+	IdentityToken string
+}
+
+// RegistryCredentialsFunc returns the credentials for registry, a host (with optional port) or mirror location
+type RegistryCredentialsFunc func(ctx context.Context, registry string) (RegistryCredentials, error)
+
+// RegistryMirror is a pull-through location tried before the registry it mirrors
+type RegistryMirror struct {
+	// Location is a host with an optional port and namespace, like "mirror.internal:5000/dockerhub"
+	Location string
+	// Insecure allows plain HTTP and unverified TLS for this mirror
+	Insecure bool
+}
+
+// registriesConf is the subset of containers-registries.conf(5) the fetcher generates
+type registriesConf struct {
+	Registries []registriesConfRegistry `toml:"registry"`
+}
+
+type registriesConfRegistry struct {
+	Prefix   string                 `toml:"prefix"`
+	Location string                 `toml:"location"`
+	Insecure bool                   `toml:"insecure"`
+	Mirrors  []registriesConfMirror `toml:"mirror,omitempty"`
+}
+
+type registriesConfMirror struct {
+	Location string `toml:"location"`
+	Insecure bool   `toml:"insecure"`
+}
+
+// dockerAuthFile is the "auths" part of a docker config.json, which containers/image reads as an auth file
+type dockerAuthFile struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// systemContext builds the source context for pulling ref. generated auth and registries.conf files are
+// written to workDir, which must outlive the pull.
+func (f *RemoteImageFetcher) systemContext(ctx context.Context, ref types.ImageReference, workDir string) (*types.SystemContext, error) {
+	sysCtx := &types.SystemContext{}
+
+	if f.SkipTLSVerify {
+		sysCtx.OCIInsecureSkipTLSVerify = true
+		sysCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+		sysCtx.DockerDaemonInsecureSkipTLSVerify = true
+	}
+
+	if f.CertDir != "" {
+		sysCtx.DockerCertPath = f.CertDir
+	}
+
+	if f.RegistriesConfPath != "" && (len(f.Mirrors) > 0 || len(f.InsecureRegistries) > 0) {
+		return nil, errors.Errorf("a registries.conf path cannot be combined with mirrors or insecure registries")
+	}
+
+	host := ""
+	if named := ref.DockerReference(); named != nil {
+		host = reference.Domain(named)
+	}
+
+	if f.RegistriesConfPath != "" {
+		sysCtx.SystemRegistriesConfPath = f.RegistriesConfPath
+	} else if len(f.Mirrors) > 0 || len(f.InsecureRegistries) > 0 {
+		confPath, confDir, err := f.writeRegistriesConf(workDir)
+		if err != nil {
+			return nil, err
+		}
+		sysCtx.SystemRegistriesConfPath = confPath
+		sysCtx.SystemRegistriesConfDirPath = confDir
+	}
+
+	switch {
+	case f.Credentials != nil:
+		// every location the image may come from gets its own entry, so a mirror never sees the
+		// credentials of the registry it mirrors
+		locations := []string{host}
+		for _, mirror := range f.Mirrors[host] {
+			locations = append(locations, mirror.Location)
+		}
+
+		authPath, err := writeAuthFile(ctx, workDir, locations, f.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		sysCtx.AuthFilePath = authPath
+	case f.DockerConfigPath != "":
+		sysCtx.AuthFilePath = f.DockerConfigPath
+	}
+
+	return sysCtx, nil
+}
+
+func (f *RemoteImageFetcher) writeRegistriesConf(workDir string) (string, string, error) {
+	hosts := []string{}
+	for host := range f.Mirrors {
+		hosts = append(hosts, host)
+	}
+	for _, host := range f.InsecureRegistries {
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	conf := registriesConf{}
+	for _, host := range hosts {
+		entry := registriesConfRegistry{
+			Prefix:   host,
+			Location: host,
+			Insecure: slices.Contains(f.InsecureRegistries, host),
+		}
+		for _, mirror := range f.Mirrors[host] {
+			entry.Mirrors = append(entry.Mirrors, registriesConfMirror{
+				Location: mirror.Location,
+				Insecure: mirror.Insecure,
+			})
+		}
+		conf.Registries = append(conf.Registries, entry)
+	}
+
+	data, err := toml.Marshal(conf)
+	if err != nil {
+		return "", "", errors.Errorf("marshalling registries.conf: %w", err)
+	}
+
+	confPath := filepath.Join(workDir, "registries.conf")
+	if err := os.WriteFile(confPath, data, CacheFilePerm); err != nil {
+		return "", "", errors.Errorf("writing registries.conf: %w", err)
+	}
+
+	// an empty drop-in directory keeps the host's registries.conf.d out of the pull
+	confDir := filepath.Join(workDir, "registries.conf.d")
+	if err := os.MkdirAll(confDir, CacheDirPerm); err != nil {
+		return "", "", errors.Errorf("creating registries.conf.d: %w", err)
+	}
+
+	return confPath, confDir, nil
+}
+
+func writeAuthFile(ctx context.Context, workDir string, locations []string, credentials RegistryCredentialsFunc) (string, error) {
+	file := dockerAuthFile{Auths: map[string]dockerAuthEntry{}}
+
+	for _, location := range locations {
+		creds, err := credentials(ctx, location)
+		if err != nil {
+			return "", errors.Errorf("getting credentials for %s: %w", location, err)
+		}
+
+		if creds == (RegistryCredentials{}) {
+			continue
+		}
+
+		// containers/image ignores an entry without a decodable "auth", even when it has an identity token
+		entry := dockerAuthEntry{IdentityToken: creds.IdentityToken}
+		if creds.IdentityToken != "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":"))
+		} else {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+		}
+		file.Auths[location] = entry
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return "", errors.Errorf("marshalling auth file: %w", err)
+	}
+
+	authPath := filepath.Join(workDir, "auth.json")
+	if err := os.WriteFile(authPath, data, 0600); err != nil {
+		return "", errors.Errorf("writing auth file: %w", err)
+	}
+
+	return authPath, nil
+}
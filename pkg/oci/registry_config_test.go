@@ -0,0 +1,178 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestRegistry serves an in-process registry over plain HTTP, requiring basic auth when username is set,
+// and returns its host:port
+func startTestRegistry(t *testing.T, username, password string) string {
+	t.Helper()
+
+	var handler http.Handler = registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	if username != "" {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// pushTestImage pushes a random single layer image and returns its manifest digest
+func pushTestImage(t *testing.T, host, repo string, auth authn.Authenticator) digest.Digest {
+	t.Helper()
+
+	img, err := random.Image(512, 1)
+	require.NoError(t, err)
+
+	ref, err := name.ParseReference(host+"/"+repo, name.Insecure)
+	require.NoError(t, err)
+
+	require.NoError(t, remote.Write(ref, img, remote.WithAuth(auth)))
+
+	dig, err := img.Digest()
+	require.NoError(t, err)
+
+	return digest.Digest(dig.String())
+}
+
+// unreachableRegistry returns a host:port nothing is listening on
+func unreachableRegistry(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	return host
+}
+
+func TestRemoteImageFetcherCredentials(t *testing.T) {
+	ctx := context.Background()
+	host := startTestRegistry(t, "ec1", "hunter2")
+	pushTestImage(t, host, "private/image:latest", &authn.Basic{Username: "ec1", Password: "hunter2"})
+
+	t.Run("anonymous", func(t *testing.T) {
+		fetcher := &RemoteImageFetcher{
+			CacheDir:           t.TempDir(),
+			DockerConfigPath:   filepath.Join(t.TempDir(), "missing.json"),
+			InsecureRegistries: []string{host},
+		}
+		_, err := fetcher.FetchImageToOCILayout(ctx, host+"/private/image:latest")
+		assert.Error(t, err)
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		asked := []string{}
+		fetcher := &RemoteImageFetcher{
+			CacheDir:           t.TempDir(),
+			InsecureRegistries: []string{host},
+			Credentials: func(ctx context.Context, registry string) (RegistryCredentials, error) {
+				asked = append(asked, registry)
+				return RegistryCredentials{Username: "ec1", Password: "hunter2"}, nil
+			},
+		}
+		dir, err := fetcher.FetchImageToOCILayout(ctx, host+"/private/image:latest")
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(dir, "index.json"))
+		assert.Equal(t, []string{host}, asked)
+	})
+
+	t.Run("docker config", func(t *testing.T) {
+		config := filepath.Join(t.TempDir(), "config.json")
+		data, err := json.Marshal(map[string]any{
+			"auths": map[string]any{
+				host: map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte("ec1:hunter2"))},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(config, data, 0600))
+
+		fetcher := &RemoteImageFetcher{
+			CacheDir:           t.TempDir(),
+			DockerConfigPath:   config,
+			InsecureRegistries: []string{host},
+		}
+		dir, err := fetcher.FetchImageToOCILayout(ctx, "docker://"+host+"/private/image:latest")
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(dir, "index.json"))
+	})
+}
+
+func TestRemoteImageFetcherMirrorFallback(t *testing.T) {
+	ctx := context.Background()
+	primary := unreachableRegistry(t)
+	mirror := startTestRegistry(t, "", "")
+	pushTestImage(t, mirror, "library/app:v1", authn.Anonymous)
+
+	fetcher := &RemoteImageFetcher{
+		CacheDir: t.TempDir(),
+		Mirrors: map[string][]RegistryMirror{
+			primary: {
+				{Location: unreachableRegistry(t), Insecure: true},
+				{Location: mirror, Insecure: true},
+			},
+		},
+		InsecureRegistries: []string{primary},
+	}
+
+	dir, err := fetcher.FetchImageToOCILayout(ctx, primary+"/library/app:v1")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "index.json"))
+}
+
+func TestRemoteImageFetcherRegistriesConf(t *testing.T) {
+	fetcher := &RemoteImageFetcher{
+		Mirrors: map[string][]RegistryMirror{
+			"docker.io": {{Location: "mirror.internal:5000/dockerhub"}},
+		},
+		InsecureRegistries: []string{"localhost:5000"},
+	}
+
+	confPath, _, err := fetcher.writeRegistriesConf(t.TempDir())
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(confPath)
+	require.NoError(t, err)
+	conf := string(data)
+
+	assert.Contains(t, conf, "[[registry]]")
+	assert.Contains(t, conf, "[[registry.mirror]]")
+	assert.Contains(t, conf, "mirror.internal:5000/dockerhub")
+	assert.Contains(t, conf, "localhost:5000")
+
+	fetcher.RegistriesConfPath = "/etc/containers/registries.conf"
+	_, err = fetcher.FetchImageToOCILayout(context.Background(), "docker.io/library/alpine:latest")
+	assert.ErrorContains(t, err, "cannot be combined")
+}
@@ -0,0 +1,79 @@
+package oci_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	oci_image_cache "github.com/walteh/ec1/gen/oci-image-cache"
+	"github.com/walteh/ec1/pkg/oci"
+	"github.com/walteh/ec1/pkg/testing/toci"
+)
+
+func TestRemoteImageFetcherFromTestRegistry(t *testing.T) {
+	ctx := context.Background()
+	srv := toci.NewRegistryServer(t, toci.WithTLS(), toci.WithBasicAuth("ec1", "hunter2"))
+	ref := "docker://" + srv.Reference(string(oci_image_cache.ALPINE_LATEST))
+
+	credentials := func(password string) oci.RegistryCredentialsFunc {
+		return func(ctx context.Context, registry string) (oci.RegistryCredentials, error) {
+			return oci.RegistryCredentials{Username: "ec1", Password: password}, nil
+		}
+	}
+
+	t.Run("trusted ca", func(t *testing.T) {
+		var stages []oci.PullStage
+		downloaded := map[string]bool{}
+		fetcher := &oci.RemoteImageFetcher{
+			CacheDir:    t.TempDir(),
+			CertDir:     srv.CertDir(),
+			Credentials: credentials("hunter2"),
+			Progress: func(ctx context.Context, event oci.ProgressEvent) {
+				switch {
+				case event.Done:
+					stages = append(stages, event.Stage)
+				case event.BytesTotal > 0 && event.BytesDone == event.BytesTotal:
+					downloaded[event.Layer.String()] = true
+				}
+			},
+		}
+		dir, err := fetcher.FetchImageToOCILayout(ctx, ref)
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(dir, "index.json"))
+		assert.Equal(t, []oci.PullStage{oci.PullStageResolving, oci.PullStageDownloading}, stages)
+		assert.NotEmpty(t, downloaded)
+	})
+
+	t.Run("unknown ca", func(t *testing.T) {
+		fetcher := &oci.RemoteImageFetcher{
+			CacheDir:    t.TempDir(),
+			Credentials: credentials("hunter2"),
+		}
+		_, err := fetcher.FetchImageToOCILayout(ctx, ref)
+		assert.Error(t, err)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		fetcher := &oci.RemoteImageFetcher{
+			CacheDir:    t.TempDir(),
+			CertDir:     srv.CertDir(),
+			Credentials: credentials("wrong"),
+		}
+		_, err := fetcher.FetchImageToOCILayout(ctx, ref)
+		assert.Error(t, err)
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		plain := toci.NewRegistryServer(t)
+		fetcher := &oci.RemoteImageFetcher{
+			CacheDir:           t.TempDir(),
+			InsecureRegistries: []string{plain.Host()},
+		}
+		dir, err := fetcher.FetchImageToOCILayout(ctx, "docker://"+plain.Reference(string(oci_image_cache.ALPINE_LATEST)))
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(dir, "index.json"))
+	})
+}
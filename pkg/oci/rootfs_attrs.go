@@ -0,0 +1,151 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	rootfsAttrsSuffix = ".attrs.json"
+
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// fileAttrs is the metadata of a rootfs entry that could not be applied on disk, usually because extraction
+// ran unprivileged. CreateExt4FromDirectory applies it so the guest sees what the image intended.
+type fileAttrs struct {
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Mode     int64             `json:"mode"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	Typeflag byte              `json:"typeflag,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+}
+
+// rootfsAttrs maps slash separated rootfs relative paths to their recorded metadata. a nil rootfsAttrs
+// records nothing.
+type rootfsAttrs map[string]*fileAttrs
+
+func rootfsAttrsPath(rootfsPath string) string {
+	return strings.TrimSuffix(rootfsPath, string(filepath.Separator)) + rootfsAttrsSuffix
+}
+
+func (r rootfsAttrs) set(name string, attrs *fileAttrs) {
+	if r == nil {
+		return
+	}
+	r[name] = attrs
+}
+
+// remove forgets name and everything below it
+func (r rootfsAttrs) remove(name string) {
+	if r == nil {
+		return
+	}
+	delete(r, name)
+	prefix := name + "/"
+	for k := range r {
+		if strings.HasPrefix(k, prefix) {
+			delete(r, k)
+		}
+	}
+}
+
+func (r rootfsAttrs) save(path string) error {
+	if len(r) == 0 {
+		os.Remove(path)
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Errorf("marshalling rootfs attrs: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, CacheFilePerm); err != nil {
+		return errors.Errorf("writing rootfs attrs: %w", err)
+	}
+
+	return nil
+}
+
+// loadRootfsAttrs reads the attrs recorded next to rootfsPath; a rootfs without any is not an error
+func loadRootfsAttrs(rootfsPath string) (rootfsAttrs, error) {
+	data, err := os.ReadFile(rootfsAttrsPath(rootfsPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rootfsAttrs{}, nil
+		}
+		return nil, errors.Errorf("reading rootfs attrs: %w", err)
+	}
+
+	attrs := rootfsAttrs{}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, errors.Errorf("unmarshalling rootfs attrs: %w", err)
+	}
+
+	return attrs, nil
+}
+
+func fileAttrsFromHeader(header *tar.Header) *fileAttrs {
+	attrs := &fileAttrs{
+		Uid:    header.Uid,
+		Gid:    header.Gid,
+		Mode:   header.Mode,
+		Xattrs: headerXattrs(header),
+	}
+
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		attrs.Typeflag = header.Typeflag
+		attrs.Devmajor = header.Devmajor
+		attrs.Devminor = header.Devminor
+	}
+
+	return attrs
+}
+
+// applyTo overrides the on-disk metadata in a header generated from the extracted rootfs
+func (a *fileAttrs) applyTo(header *tar.Header) {
+	header.Uid = a.Uid
+	header.Gid = a.Gid
+	header.Uname = ""
+	header.Gname = ""
+	header.Mode = a.Mode
+
+	if a.Typeflag != 0 {
+		// device nodes are extracted as empty placeholder files when mknod is not permitted
+		header.Typeflag = a.Typeflag
+		header.Devmajor = a.Devmajor
+		header.Devminor = a.Devminor
+		header.Size = 0
+	}
+
+	for name, value := range a.Xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+}
+
+func headerXattrs(header *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for k, v := range header.PAXRecords {
+		name, ok := strings.CutPrefix(k, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string][]byte{}
+		}
+		xattrs[name] = []byte(v)
+	}
+	return xattrs
+}
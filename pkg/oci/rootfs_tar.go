@@ -0,0 +1,108 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// writeRootfsTar writes the rootfs directory as a tar stream with paths relative to its root, overriding the
+// on-disk metadata with attrs and emitting hard links for files that share an inode
+func writeRootfsTar(ctx context.Context, rootfsPath string, attrs rootfsAttrs, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	seen := map[inodeKey]string{}
+
+	err := filepath.WalkDir(rootfsPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(rootfsPath, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return errors.Errorf("creating header for %s: %w", name, err)
+		}
+		header.Name = name
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+		header.Uname = ""
+		header.Gname = ""
+
+		if a, ok := attrs[name]; ok {
+			a.applyTo(header)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+				if first, ok := seen[key]; ok {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+				} else {
+					seen[key] = name
+				}
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Errorf("writing header for %s: %w", name, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || header.Size == 0 {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.CopyN(tw, f, header.Size); err != nil {
+			return errors.Errorf("writing %s: %w", name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Errorf("walking rootfs: %w", err)
+	}
+
+	return tw.Close()
+}
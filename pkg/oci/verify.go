@@ -0,0 +1,339 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+)
+
+// VerificationFile is written into a fetched OCI layout and records how the image was verified
+const VerificationFile = "ec1-verification.json"
+
+type VerificationMethod string
+
+const (
+	// VerificationMethodPolicy means the image was admitted by a containers-policy.json(5)
+	VerificationMethodPolicy VerificationMethod = "policy"
+	// VerificationMethodDigestPin means the manifest digest is in ImagePolicy.AllowedDigests
+	VerificationMethodDigestPin VerificationMethod = "digest-pin"
+	// VerificationMethodSigstore means the manifest carries a sigstore signature from ImagePolicy.SigstorePublicKeyPath
+	VerificationMethodSigstore VerificationMethod = "sigstore"
+)
+
+// ImagePolicy decides which images RemoteImageFetcher accepts. every configured check must pass; a zero
+// ImagePolicy accepts anything and marks the image unverified.
+type ImagePolicy struct {
+	// PolicyPath is a containers-policy.json(5) evaluated for every pull
+	PolicyPath string
+	// AllowedDigests pins images to known manifest digests. for multi-platform images either the index or the
+	// platform manifest digest may be pinned.
+	AllowedDigests []digest.Digest
+	// SigstorePublicKeyPath is a PEM public key (as used by cosign) that must have signed the image manifest
+	SigstorePublicKeyPath string
+	// RegistriesDirPath is a containers-registries.d(5) directory for signature lookaside configuration. empty
+	// means sigstore signatures are read from the registry as attachments.
+	RegistriesDirPath string
+}
+
+// ImageVerification is the outcome of ImagePolicy for a fetched image
+type ImageVerification struct {
+	Verified       bool                 `json:"verified"`
+	Methods        []VerificationMethod `json:"methods,omitempty"`
+	ManifestDigest digest.Digest        `json:"manifest_digest"`
+	// IndexDigest is what the reference resolved to, the index of a multi-platform image
+	IndexDigest digest.Digest `json:"index_digest,omitempty"`
+	// PolicyDigest and SigstoreKeyDigest identify the policy file and sigstore key the image was checked with
+	PolicyDigest      digest.Digest `json:"policy_digest,omitempty"`
+	SigstoreKeyDigest digest.Digest `json:"sigstore_key_digest,omitempty"`
+	VerifiedAt        time.Time     `json:"verified_at"`
+}
+
+// signaturePolicy returns the policy containers/image enforces while copying pinned, the digest reference
+// src resolved to, and the methods it covers. a policy file only counts as verification when it requires a
+// signature for the image.
+func (p *ImagePolicy) signaturePolicy(src, pinned types.ImageReference) (*signature.Policy, []VerificationMethod, error) {
+	if p == nil {
+		return insecureAcceptAnythingPolicy(), nil, nil
+	}
+
+	var policy *signature.Policy
+	methods := []VerificationMethod{}
+
+	if p.PolicyPath != "" {
+		var err error
+		policy, err = signature.NewPolicyFromFile(p.PolicyPath)
+		if err != nil {
+			return nil, nil, errors.Errorf("loading signature policy %s: %w", p.PolicyPath, err)
+		}
+
+		// a scope for the tag still applies to the image it resolved to
+		if scopes, ok := policy.Transports[pinned.Transport().Name()]; ok {
+			if reqs, ok := scopes[src.PolicyConfigurationIdentity()]; ok {
+				if _, ok := scopes[pinned.PolicyConfigurationIdentity()]; !ok {
+					scopes[pinned.PolicyConfigurationIdentity()] = reqs
+				}
+			}
+		}
+
+		requireSignature, err := requiresSignature(policyRequirementsFor(policy, pinned))
+		if err != nil {
+			return nil, nil, err
+		}
+		if requireSignature {
+			methods = append(methods, VerificationMethodPolicy)
+		}
+	} else {
+		policy = insecureAcceptAnythingPolicy()
+	}
+
+	if p.SigstorePublicKeyPath != "" {
+		req, err := signature.NewPRSigstoreSignedKeyPath(p.SigstorePublicKeyPath, signature.NewPRMMatchRepoDigestOrExact())
+		if err != nil {
+			return nil, nil, errors.Errorf("creating sigstore requirement: %w", err)
+		}
+
+		// requirements in a list must all be satisfied, so the key is required on top of whatever the
+		// policy file asks for, in every scope
+		policy.Default = append(policy.Default, req)
+		for _, scopes := range policy.Transports {
+			for scope, reqs := range scopes {
+				scopes[scope] = append(reqs, req)
+			}
+		}
+		methods = append(methods, VerificationMethodSigstore)
+	}
+
+	return policy, methods, nil
+}
+
+// policyRequirementsFor returns the requirements policy applies to ref, picked the way containers/image
+// does: the exact scope, then the closest namespace, then the transport default, then the policy default
+func policyRequirementsFor(policy *signature.Policy, ref types.ImageReference) signature.PolicyRequirements {
+	if scopes, ok := policy.Transports[ref.Transport().Name()]; ok {
+		if reqs, ok := scopes[ref.PolicyConfigurationIdentity()]; ok {
+			return reqs
+		}
+		for _, namespace := range ref.PolicyConfigurationNamespaces() {
+			if reqs, ok := scopes[namespace]; ok {
+				return reqs
+			}
+		}
+		if reqs, ok := scopes[""]; ok {
+			return reqs
+		}
+	}
+	return policy.Default
+}
+
+// requiresSignature reports whether reqs only admit signed images. the requirement types are unexported,
+// so they are told apart by their policy.json type
+func requiresSignature(reqs signature.PolicyRequirements) (bool, error) {
+	for _, req := range reqs {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return false, errors.Errorf("marshalling policy requirement: %w", err)
+		}
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &typed); err != nil {
+			return false, errors.Errorf("unmarshalling policy requirement: %w", err)
+		}
+		if typed.Type == "signedBy" || typed.Type == "sigstoreSigned" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// registriesDir returns the registries.d directory for the pull, generating one under workDir that reads
+// sigstore signatures from registry attachments unless the policy names one
+func (p *ImagePolicy) registriesDir(workDir string) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	if p.RegistriesDirPath != "" {
+		return p.RegistriesDirPath, nil
+	}
+	if p.SigstorePublicKeyPath == "" {
+		return "", nil
+	}
+
+	dir := filepath.Join(workDir, "registries.d")
+	if err := os.MkdirAll(dir, CacheDirPerm); err != nil {
+		return "", errors.Errorf("creating registries.d: %w", err)
+	}
+
+	conf := "default-docker:\n  use-sigstore-attachments: true\n"
+	if err := os.WriteFile(filepath.Join(dir, "ec1.yaml"), []byte(conf), CacheFilePerm); err != nil {
+		return "", errors.Errorf("writing registries.d config: %w", err)
+	}
+
+	return dir, nil
+}
+
+// checkDigestPin fails unless one of digests is allowed; with no allowed digests every image passes
+func (p *ImagePolicy) checkDigestPin(digests ...digest.Digest) error {
+	if p == nil || len(p.AllowedDigests) == 0 {
+		return nil
+	}
+
+	for _, d := range digests {
+		if d != "" && slices.Contains(p.AllowedDigests, d) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("image digest %v is not in the allowed digest list", digests)
+}
+
+// admits checks an image fetched earlier against the policy, from the verification recorded with it. the
+// image must have been checked with the same policy file and sigstore key, and be pinned when digests are.
+func (p *ImagePolicy) admits(v *ImageVerification) error {
+	if p == nil || (p.PolicyPath == "" && p.SigstorePublicKeyPath == "" && len(p.AllowedDigests) == 0) {
+		return nil
+	}
+	if v == nil {
+		return errors.New("the image was fetched without verification")
+	}
+
+	if p.PolicyPath != "" {
+		want, err := fileDigest(p.PolicyPath)
+		if err != nil {
+			return errors.Errorf("reading signature policy: %w", err)
+		}
+		if v.PolicyDigest != want {
+			return errors.Errorf("the image was not checked with signature policy %s", p.PolicyPath)
+		}
+	}
+
+	if p.SigstorePublicKeyPath != "" {
+		want, err := fileDigest(p.SigstorePublicKeyPath)
+		if err != nil {
+			return errors.Errorf("reading sigstore public key: %w", err)
+		}
+		if v.SigstoreKeyDigest != want || !slices.Contains(v.Methods, VerificationMethodSigstore) {
+			return errors.Errorf("the image was not signed by %s", p.SigstorePublicKeyPath)
+		}
+	}
+
+	return p.checkDigestPin(v.IndexDigest, v.ManifestDigest)
+}
+
+// digests returns the digests of the policy file and sigstore key, recorded with the images they checked
+func (p *ImagePolicy) digests() (policy digest.Digest, key digest.Digest, err error) {
+	if p == nil {
+		return "", "", nil
+	}
+	if p.PolicyPath != "" {
+		if policy, err = fileDigest(p.PolicyPath); err != nil {
+			return "", "", errors.Errorf("reading signature policy: %w", err)
+		}
+	}
+	if p.SigstorePublicKeyPath != "" {
+		if key, err = fileDigest(p.SigstorePublicKeyPath); err != nil {
+			return "", "", errors.Errorf("reading sigstore public key: %w", err)
+		}
+	}
+	return policy, key, nil
+}
+
+func fileDigest(path string) (digest.Digest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(data), nil
+}
+
+func insecureAcceptAnythingPolicy() *signature.Policy {
+	return &signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	}
+}
+
+// resolveManifestDigest returns the digest of the manifest ref points at, an index for multi-platform images
+func resolveManifestDigest(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext) (digest.Digest, error) {
+	src, err := ref.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return "", errors.Errorf("creating image source: %w", err)
+	}
+	defer src.Close()
+
+	topManifest, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", errors.Errorf("getting manifest: %w", err)
+	}
+
+	return digest.FromBytes(topManifest), nil
+}
+
+// pinnedReference returns ref by digest, name@dig, so reading it again can't return another image
+func pinnedReference(ref types.ImageReference, dig digest.Digest) (types.ImageReference, error) {
+	named := ref.DockerReference()
+	if named == nil {
+		return nil, errors.Errorf("%s has no registry name to pin", transports.ImageName(ref))
+	}
+
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), dig)
+	if err != nil {
+		return nil, errors.Errorf("pinning %s to %s: %w", named, dig, err)
+	}
+
+	pinned, err := docker.NewReference(canonical)
+	if err != nil {
+		return nil, errors.Errorf("creating pinned reference: %w", err)
+	}
+
+	return pinned, nil
+}
+
+func logImageVerification(ctx context.Context, imageRef string, v *ImageVerification) {
+	if !v.Verified {
+		slog.WarnContext(ctx, "image accepted without verification", "image", imageRef, "digest", v.ManifestDigest)
+		return
+	}
+	slog.InfoContext(ctx, "image verified", "image", imageRef, "digest", v.ManifestDigest, "methods", v.Methods)
+}
+
+func saveImageVerification(ociLayoutPath string, v *ImageVerification) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Errorf("marshalling image verification: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(ociLayoutPath, VerificationFile), data, CacheFilePerm); err != nil {
+		return errors.Errorf("writing image verification: %w", err)
+	}
+	return nil
+}
+
+// loadImageVerification reads the verification recorded by the fetcher; layouts from other fetchers have
+// none and load as nil
+func loadImageVerification(ociLayoutPath string) (*ImageVerification, error) {
+	data, err := os.ReadFile(filepath.Join(ociLayoutPath, VerificationFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading image verification: %w", err)
+	}
+
+	var v ImageVerification
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errors.Errorf("unmarshalling image verification: %w", err)
+	}
+
+	return &v, nil
+}
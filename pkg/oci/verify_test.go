@@ -0,0 +1,223 @@
+package oci
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestPolicy(t *testing.T, policy string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0644))
+	return path
+}
+
+func TestRemoteImageFetcherPolicy(t *testing.T) {
+	ctx := context.Background()
+	host := startTestRegistry(t, "", "")
+	dig := pushTestImage(t, host, "verify/image:latest", authn.Anonymous)
+	imageRef := host + "/verify/image:latest"
+
+	fetch := func(t *testing.T, policy *ImagePolicy) (*ImageVerification, error) {
+		fetcher := &RemoteImageFetcher{
+			CacheDir:           t.TempDir(),
+			InsecureRegistries: []string{host},
+			Policy:             policy,
+		}
+		dir, err := fetcher.FetchImageToOCILayout(ctx, imageRef)
+		if err != nil {
+			return nil, err
+		}
+		return loadImageVerification(dir)
+	}
+
+	t.Run("no policy", func(t *testing.T) {
+		v, err := fetch(t, nil)
+		require.NoError(t, err)
+		require.NotNil(t, v)
+		assert.False(t, v.Verified)
+		assert.Equal(t, dig, v.ManifestDigest)
+	})
+
+	t.Run("pinned digest", func(t *testing.T) {
+		v, err := fetch(t, &ImagePolicy{AllowedDigests: []digest.Digest{dig}})
+		require.NoError(t, err)
+		assert.True(t, v.Verified)
+		assert.Equal(t, []VerificationMethod{VerificationMethodDigestPin}, v.Methods)
+	})
+
+	t.Run("digest not pinned", func(t *testing.T) {
+		_, err := fetch(t, &ImagePolicy{AllowedDigests: []digest.Digest{digest.FromString("something else")}})
+		assert.ErrorContains(t, err, "not in the allowed digest list")
+	})
+
+	t.Run("policy file accepts anything", func(t *testing.T) {
+		v, err := fetch(t, &ImagePolicy{PolicyPath: writeTestPolicy(t, `{"default":[{"type":"insecureAcceptAnything"}]}`)})
+		require.NoError(t, err)
+		assert.False(t, v.Verified, "a policy that asks for no signature verifies nothing")
+		assert.Empty(t, v.Methods)
+	})
+
+	t.Run("policy file rejects", func(t *testing.T) {
+		_, err := fetch(t, &ImagePolicy{PolicyPath: writeTestPolicy(t, `{"default":[{"type":"reject"}]}`)})
+		assert.Error(t, err)
+	})
+
+	t.Run("unsigned image with sigstore key", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+
+		keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+		_, err = fetch(t, &ImagePolicy{SigstorePublicKeyPath: keyPath})
+		assert.Error(t, err)
+	})
+}
+
+func TestImagePolicySigstoreAddsToEveryScope(t *testing.T) {
+	policyPath := writeTestPolicy(t, `{
+		"default": [{"type": "reject"}],
+		"transports": {"docker": {
+			"registry.internal": [{"type": "insecureAcceptAnything"}],
+			"registry.signed/app:latest": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "/keys/signer.gpg"}]
+		}}
+	}`)
+
+	refs := func(image string, dig digest.Digest) (types.ImageReference, types.ImageReference) {
+		src, err := docker.ParseReference("//" + image)
+		require.NoError(t, err)
+		pinned, err := pinnedReference(src, dig)
+		require.NoError(t, err)
+		return src, pinned
+	}
+	dig := digest.FromString("manifest")
+
+	policy, methods, err := (&ImagePolicy{PolicyPath: policyPath, SigstorePublicKeyPath: "/keys/cosign.pub"}).signaturePolicy(refs("registry.internal/app:latest", dig))
+	require.NoError(t, err)
+
+	assert.Equal(t, []VerificationMethod{VerificationMethodSigstore}, methods, "the scope of the image accepts anything")
+	assert.Len(t, policy.Default, 2)
+	assert.Len(t, policy.Transports["docker"]["registry.internal"], 2)
+
+	src, pinned := refs("registry.signed/app:latest", dig)
+	assert.Equal(t, "registry.signed/app@"+dig.String(), pinned.PolicyConfigurationIdentity())
+
+	policy, methods, err = (&ImagePolicy{PolicyPath: policyPath}).signaturePolicy(src, pinned)
+	require.NoError(t, err)
+
+	assert.Equal(t, []VerificationMethod{VerificationMethodPolicy}, methods, "the scope of the tag applies to the image it resolved to")
+	assert.Len(t, policy.Transports["docker"][pinned.PolicyConfigurationIdentity()], 1)
+}
+
+func TestRemoteImageFetcherCopiesTheResolvedDigest(t *testing.T) {
+	ctx := context.Background()
+	host := startTestRegistry(t, "", "")
+	imageRef := host + "/pinned/image:latest"
+
+	tag, err := name.ParseReference(imageRef, name.Insecure)
+	require.NoError(t, err)
+
+	// oci images are copied into the layout as they are, so their manifest digests stay the same
+	push := func() digest.Digest {
+		layer, err := random.Layer(512, ggcrtypes.OCILayer)
+		require.NoError(t, err)
+		img, err := mutate.AppendLayers(mutate.ConfigMediaType(mutate.MediaType(empty.Image, ggcrtypes.OCIManifestSchema1), ggcrtypes.OCIConfigJSON), layer)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(tag, img))
+		dig, err := img.Digest()
+		require.NoError(t, err)
+		return digest.Digest(dig.String())
+	}
+
+	dig := push()
+
+	var moved digest.Digest
+	fetcher := &RemoteImageFetcher{
+		CacheDir:           t.TempDir(),
+		InsecureRegistries: []string{host},
+		Policy:             &ImagePolicy{AllowedDigests: []digest.Digest{dig}},
+		Progress: func(ctx context.Context, event ProgressEvent) {
+			// the tag moves after it was checked against the pinned digests
+			if event.Stage == PullStageResolving && event.Done {
+				moved = push()
+			}
+		},
+	}
+
+	dir, err := fetcher.FetchImageToOCILayout(ctx, imageRef)
+	require.NoError(t, err)
+	require.NotEmpty(t, moved)
+
+	v, err := loadImageVerification(dir)
+	require.NoError(t, err)
+	assert.Equal(t, dig, v.ManifestDigest)
+
+	index, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(index), dig.String(), "the checked image was copied")
+	assert.NotContains(t, string(index), moved.String(), "the image the tag moved to was not copied")
+}
+
+func TestCachedFetcherChecksCachedImagesAgainstThePolicy(t *testing.T) {
+	ctx := context.Background()
+	host := startTestRegistry(t, "", "")
+	dig := pushTestImage(t, host, "cached/image:latest", authn.Anonymous)
+	imageRef := host + "/cached/image:latest"
+
+	pulls := 0
+	remoteFetcher := &RemoteImageFetcher{
+		CacheDir:           t.TempDir(),
+		InsecureRegistries: []string{host},
+		Progress: func(ctx context.Context, event ProgressEvent) {
+			if event.Stage == PullStageResolving && event.Done {
+				pulls++
+			}
+		},
+	}
+	fetcher := NewCachedFetcher(t.TempDir(), remoteFetcher)
+
+	_, err := fetcher.FetchImageToOCILayout(ctx, imageRef)
+	require.NoError(t, err)
+	require.Equal(t, 1, pulls)
+
+	remoteFetcher.Policy = &ImagePolicy{AllowedDigests: []digest.Digest{digest.FromString("something else")}}
+	_, err = fetcher.FetchImageToOCILayout(ctx, imageRef)
+	assert.ErrorContains(t, err, "not in the allowed digest list", "an image cached without the policy is not served under it")
+
+	remoteFetcher.Policy = &ImagePolicy{AllowedDigests: []digest.Digest{dig}}
+	dir, err := fetcher.FetchImageToOCILayout(ctx, imageRef)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pulls)
+
+	v, err := loadImageVerification(dir)
+	require.NoError(t, err)
+	assert.True(t, v.Verified)
+
+	_, err = fetcher.FetchImageToOCILayout(ctx, imageRef)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pulls, "an image verified under the policy is served from the cache")
+}
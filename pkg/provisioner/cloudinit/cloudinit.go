@@ -0,0 +1,151 @@
+package cloudinit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/gvnet"
+	"github.com/walteh/ec1/pkg/kernel"
+	"github.com/walteh/ec1/pkg/virtio"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+var _ vmm.BootProvisioner = &NoCloudProvisioner{}
+
+// Config is the subset of cloud-config the built in images need
+type Config struct {
+	InstanceID        string
+	Hostname          string
+	SSHAuthorizedKeys []string
+	Packages          []string
+	RunCmd            []string
+}
+
+// UserData renders the config as a #cloud-config document. json is a subset of yaml, so cloud-init
+// reads it as is.
+func (cfg *Config) UserData() ([]byte, error) {
+	doc := map[string]any{
+		"hostname":            cfg.Hostname,
+		"ssh_authorized_keys": cfg.SSHAuthorizedKeys,
+	}
+	if len(cfg.Packages) > 0 {
+		doc["packages"] = cfg.Packages
+	}
+	if len(cfg.RunCmd) > 0 {
+		doc["runcmd"] = cfg.RunCmd
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, errors.Errorf("marshaling user-data: %w", err)
+	}
+	return append([]byte("#cloud-config\n"), data...), nil
+}
+
+// MetaData renders the NoCloud meta-data document
+func (cfg *Config) MetaData() ([]byte, error) {
+	data, err := json.Marshal(map[string]string{
+		"instance-id":    cfg.InstanceID,
+		"local-hostname": cfg.Hostname,
+	})
+	if err != nil {
+		return nil, errors.Errorf("marshaling meta-data: %w", err)
+	}
+	return data, nil
+}
+
+// NoCloudProvisioner serves a NoCloud seed to cloud-init over http. the guest reaches the host
+// through the gvproxy host address, and finds the seed through KernelParam.
+type NoCloudProvisioner struct {
+	cfg      *Config
+	listener net.Listener
+}
+
+// NewNoCloudProvisioner listens on a local port right away, so the kernel argument is known before
+// the vm boots
+func NewNoCloudProvisioner(cfg *Config) (*NoCloudProvisioner, error) {
+	listener, err := net.Listen("tcp", gvnet.LOCAL_HOST_IP+":0")
+	if err != nil {
+		return nil, errors.Errorf("listening for cloud-init: %w", err)
+	}
+	return &NoCloudProvisioner{cfg: cfg, listener: listener}, nil
+}
+
+// SeedURL is where the guest fetches meta-data and user-data from
+func (me *NoCloudProvisioner) SeedURL() string {
+	port := me.listener.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("http://%s:%d/", gvnet.VIRUTAL_HOST_IP, port)
+}
+
+// KernelParam selects the NoCloud datasource with the seed
+func (me *NoCloudProvisioner) KernelParam() kernel.Param {
+	return kernel.Param{Key: "ds", Value: "nocloud;s=" + me.SeedURL()}
+}
+
+func (me *NoCloudProvisioner) handler(ctx context.Context) (http.Handler, error) {
+	userData, err := me.cfg.UserData()
+	if err != nil {
+		return nil, err
+	}
+	metaData, err := me.cfg.MetaData()
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		"/user-data":   userData,
+		"/meta-data":   metaData,
+		"/vendor-data": {},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		slog.DebugContext(ctx, "cloud-init request", "method", req.Method, "url", req.URL)
+
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			slog.ErrorContext(ctx, "failed to serve cloud-init file", "path", req.URL.Path, "error", err)
+		}
+	}), nil
+}
+
+func (me *NoCloudProvisioner) RunDuringBoot(ctx context.Context, vm vmm.VirtualMachine) error {
+	handler, err := me.handler(ctx)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.WithoutCancel(ctx)); err != nil {
+			slog.WarnContext(ctx, "failed to shutdown cloud-init server", "error", err)
+		}
+	}()
+
+	err = srv.Serve(me.listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Errorf("serving cloud-init: %w", err)
+	}
+	return nil
+}
+
+// VirtioDevices returns nothing, the seed is served over the vm network
+func (me *NoCloudProvisioner) VirtioDevices(ctx context.Context) ([]virtio.VirtioDevice, error) {
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+package cloudinit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoCloudProvisionerServesSeed(t *testing.T) {
+	ctx := context.Background()
+
+	p, err := NewNoCloudProvisioner(&Config{
+		InstanceID:        "test-1",
+		Hostname:          "test",
+		SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA test"},
+		RunCmd:            []string{"echo hello"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { p.listener.Close() })
+
+	assert.Regexp(t, `^ds=nocloud;s=http://192\.168\.127\.254:\d+/$`, p.KernelParam().String())
+
+	handler, err := p.handler(ctx)
+	require.NoError(t, err)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, userData := get("/user-data")
+	require.Equal(t, http.StatusOK, status)
+	header, doc, ok := strings.Cut(userData, "\n")
+	require.True(t, ok)
+	assert.Equal(t, "#cloud-config", header)
+
+	var parsed map[string]any
+	require.NoError(t, json.Unmarshal([]byte(doc), &parsed))
+	assert.Equal(t, []any{"ssh-ed25519 AAAA test"}, parsed["ssh_authorized_keys"])
+	assert.Equal(t, []any{"echo hello"}, parsed["runcmd"])
+	assert.NotContains(t, parsed, "packages")
+
+	status, metaData := get("/meta-data")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"instance-id": "test-1", "local-hostname": "test"}`, metaData)
+
+	status, _ = get("/network-config")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,605 @@
+package rofs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// EROFS layout, as read by the kernel's fs/erofs
+const (
+	erofsMagic          = 0xe0f5e1e2
+	erofsBlockBits      = 12
+	erofsBlockSize      = 1 << erofsBlockBits
+	erofsSuperOffset    = 1024
+	erofsSuperblockSize = 128
+	// inodes are addressed by nid, their offset in 32 byte slots
+	erofsSlotSize = 32
+	// every inode is written in the extended layout, which has 32 bit ids and nanosecond mtimes
+	erofsInodeSize       = 64
+	erofsDirentSize      = 12
+	erofsXattrHeaderSize = 12
+	erofsMaxNameLen      = 255
+
+	erofsLayoutFlatPlain      = 0
+	erofsLayoutCompressedFull = 1
+	erofsLayoutFlatInline     = 2
+
+	// lz4 compressed blocks are padded with zeros in front, which the kernel skips to find their start
+	erofsFeatureIncompatZeroPadding = 0x1
+	// a compressed block holds at most this much of a file, the window of lz4 matches
+	erofsMaxExtent = 1 << 16
+)
+
+// lcluster index types of compressed files. every 4k of a file has an index: the head of the extent
+// starting in it, or the distance to the heads around it.
+const (
+	erofsLclusterPlain   = 0
+	erofsLclusterHead1   = 1
+	erofsLclusterNonhead = 2
+	// the map header is followed by 8 reserved bytes before the lcluster indexes
+	erofsMapHeaderSize     = 16
+	erofsLclusterIndexSize = 8
+)
+
+// the root inode follows the superblock in the first block, its nid has to fit the superblock's 16 bits
+const erofsRootOffset = erofsSuperOffset + erofsSuperblockSize
+
+const (
+	erofsFileTypeRegular = iota + 1
+	erofsFileTypeDir
+	erofsFileTypeCharDev
+	erofsFileTypeBlockDev
+	erofsFileTypeFifo
+	erofsFileTypeSocket
+	erofsFileTypeSymlink
+)
+
+// erofs xattr name prefixes, by index. the posix acl indexes stand for the whole name.
+var erofsXattrPrefixes = map[string]uint8{
+	"user.":                    1,
+	"system.posix_acl_access":  2,
+	"system.posix_acl_default": 3,
+	"trusted.":                 4,
+	"security.":                6,
+}
+
+// ConvertTarToEROFS writes the filesystem in the tar stream r to w as an lz4 compressed EROFS image. file
+// contents are compressed into 4k blocks, each holding as much of the file as fits, and blocks that do not
+// compress are stored as is. files are block aligned and identical files are stored once, so images of
+// related layers share most of their blocks. directories and symlinks are packed inline with their inodes.
+func ConvertTarToEROFS(r io.Reader, w io.WriteSeeker) error {
+	ew := &erofsWriter{w: w, pos: erofsBlockSize}
+	if _, err := w.Seek(ew.pos, io.SeekStart); err != nil {
+		return errors.Errorf("seeking past superblock: %w", err)
+	}
+
+	root, err := buildTree(r, ew)
+	if err != nil {
+		return err
+	}
+
+	return ew.finish(root)
+}
+
+type erofsInode struct {
+	n *node
+	// parent is the directory n was first found in, the root is its own parent
+	parent *node
+	number uint32
+	// offset is where the inode is written; its nid is offset / erofsSlotSize
+	offset int64
+	layout uint16
+	xattrs []byte
+	// dirBlocks groups the entries of a directory by the block they are stored in
+	dirBlocks [][]string
+	// dataSize is the size of the directory or symlink contents, stored inline or in blocks at blockAddr
+	dataSize  int64
+	blockAddr uint32
+}
+
+func (i *erofsInode) nid() uint64 {
+	return uint64(i.offset / erofsSlotSize)
+}
+
+// inlineSize is the part of the contents stored right after the inode
+func (i *erofsInode) inlineSize() int64 {
+	if i.layout == erofsLayoutFlatInline {
+		return i.dataSize
+	}
+	return 0
+}
+
+// indexSize is the size of the lcluster indexes of a compressed file, which follow the inode aligned to 8 bytes
+func (i *erofsInode) indexSize() int64 {
+	if i.layout != erofsLayoutCompressedFull {
+		return 0
+	}
+	end := int64(erofsInodeSize + len(i.xattrs))
+	pad := (8 - end%8) % 8
+	return pad + erofsMapHeaderSize + erofsLclusterIndexSize*i.lclusters()
+}
+
+func (i *erofsInode) lclusters() int64 {
+	return (i.n.size + erofsBlockSize - 1) / erofsBlockSize
+}
+
+// size is the space the inode takes in the metadata area
+func (i *erofsInode) size() int64 {
+	return erofsInodeSize + int64(len(i.xattrs)) + i.inlineSize() + i.indexSize()
+}
+
+type erofsWriter struct {
+	w   io.WriteSeeker
+	pos int64
+
+	lz4    lz4Encoder
+	buf    []byte
+	block  []byte
+	inodes map[*node]*erofsInode
+}
+
+func (e *erofsWriter) write(p []byte) error {
+	n, err := e.w.Write(p)
+	e.pos += int64(n)
+	return err
+}
+
+func (e *erofsWriter) padToBlock() error {
+	if pad := (erofsBlockSize - e.pos%erofsBlockSize) % erofsBlockSize; pad > 0 {
+		return e.write(make([]byte, pad))
+	}
+	return nil
+}
+
+func (e *erofsWriter) writeFile(r io.Reader, size int64) (fileData, error) {
+	data := fileData{start: e.pos}
+	if e.buf == nil {
+		e.buf = make([]byte, 0, erofsMaxExtent)
+		e.block = make([]byte, 0, erofsBlockSize)
+	}
+
+	buf := e.buf[:0]
+	compressed := false
+	for offset, remaining := int64(0), size; remaining > 0 || len(buf) > 0; {
+		if fill := min(int64(cap(buf)-len(buf)), remaining); fill > 0 {
+			n := len(buf)
+			buf = buf[:n+int(fill)]
+			if _, err := io.ReadFull(r, buf[n:]); err != nil {
+				return data, errors.Errorf("reading file data: %w", err)
+			}
+			remaining -= fill
+		}
+
+		// a compressed block is only worth it when it holds more than a block of the file
+		block, consumed := e.lz4.compress(e.block[:0], buf, erofsBlockSize)
+		if consumed > erofsBlockSize {
+			if err := e.write(make([]byte, erofsBlockSize-len(block))); err != nil {
+				return data, errors.Errorf("writing file data: %w", err)
+			}
+			if err := e.write(block); err != nil {
+				return data, errors.Errorf("writing file data: %w", err)
+			}
+			compressed = true
+			data.extents = append(data.extents, extent{offset: offset})
+		} else {
+			consumed = min(len(buf), erofsBlockSize)
+			if err := e.write(buf[:consumed]); err != nil {
+				return data, errors.Errorf("writing file data: %w", err)
+			}
+			if err := e.padToBlock(); err != nil {
+				return data, errors.Errorf("padding file data: %w", err)
+			}
+			data.extents = append(data.extents, extent{offset: offset, raw: true})
+		}
+
+		offset += int64(consumed)
+		buf = buf[:copy(buf, buf[consumed:])]
+	}
+
+	// blocks stored as is from the start of the file are the plain layout
+	if !compressed {
+		data.extents = nil
+	}
+
+	return data, nil
+}
+
+func (e *erofsWriter) rewind(start int64) error {
+	if _, err := e.w.Seek(start, io.SeekStart); err != nil {
+		return errors.Errorf("rewinding over duplicate file: %w", err)
+	}
+	e.pos = start
+	return nil
+}
+
+func (e *erofsWriter) finish(root *node) error {
+	e.inodes = map[*node]*erofsInode{}
+
+	// breadth first, so the root comes first and the entries of a directory sit next to each other
+	order := []*erofsInode{}
+	queue := [][2]*node{{root, root}}
+	for len(queue) > 0 {
+		n, parent := queue[0][0], queue[0][1]
+		queue = queue[1:]
+		if _, ok := e.inodes[n]; ok {
+			continue
+		}
+
+		inode, err := e.planInode(n, uint32(len(order)+1))
+		if err != nil {
+			return err
+		}
+		inode.parent = parent
+		e.inodes[n] = inode
+		order = append(order, inode)
+
+		for _, name := range n.sortedChildren() {
+			queue = append(queue, [2]*node{n.children[name], n})
+		}
+	}
+
+	// the root goes into the first block after the superblock, without inline data if that does not fit
+	rootInode := order[0]
+	rootInode.offset = erofsRootOffset
+	if rootInode.offset+rootInode.size() > erofsBlockSize {
+		rootInode.layout = erofsLayoutFlatPlain
+	}
+	if rootInode.offset+rootInode.size() > erofsBlockSize {
+		return errors.Errorf("root directory xattrs do not fit the first block")
+	}
+
+	// contents that are not inline go into blocks between the file data and the inodes
+	blockAddr := uint32(e.pos / erofsBlockSize)
+	for _, inode := range order {
+		if inode.layout == erofsLayoutFlatPlain && inode.dataSize > 0 {
+			inode.blockAddr = blockAddr
+			blockAddr += uint32((inode.dataSize + erofsBlockSize - 1) / erofsBlockSize)
+		}
+	}
+
+	offset := int64(blockAddr) * erofsBlockSize
+	for _, inode := range order[1:] {
+		offset = (offset + erofsSlotSize - 1) / erofsSlotSize * erofsSlotSize
+		// inline data cannot cross a block boundary, keeping the whole inode in one block guarantees it
+		if offset%erofsBlockSize+inode.size() > erofsBlockSize {
+			offset = (offset + erofsBlockSize - 1) / erofsBlockSize * erofsBlockSize
+		}
+		inode.offset = offset
+		offset += inode.size()
+	}
+
+	for _, inode := range order {
+		if inode.layout != erofsLayoutFlatPlain || inode.dataSize == 0 {
+			continue
+		}
+		if err := e.write(e.contents(inode)); err != nil {
+			return errors.Errorf("writing directory blocks: %w", err)
+		}
+		if err := e.padToBlock(); err != nil {
+			return errors.Errorf("padding directory blocks: %w", err)
+		}
+	}
+
+	bw := bufio.NewWriter(e.w)
+	for _, inode := range order[1:] {
+		if pad := inode.offset - e.pos; pad > 0 {
+			if _, err := bw.Write(make([]byte, pad)); err != nil {
+				return errors.Errorf("writing inodes: %w", err)
+			}
+			e.pos += pad
+		}
+		b := e.encodeInode(inode)
+		if _, err := bw.Write(b); err != nil {
+			return errors.Errorf("writing inodes: %w", err)
+		}
+		e.pos += int64(len(b))
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.Errorf("writing inodes: %w", err)
+	}
+	if err := e.padToBlock(); err != nil {
+		return errors.Errorf("padding inodes: %w", err)
+	}
+	if t, ok := e.w.(interface{ Truncate(int64) error }); ok {
+		// rewinding over a duplicate at the end of the data can leave stale bytes past the end
+		if err := t.Truncate(e.pos); err != nil {
+			return errors.Errorf("truncating image: %w", err)
+		}
+	}
+
+	incompat := uint32(0)
+	for _, inode := range order {
+		if inode.layout == erofsLayoutCompressedFull {
+			incompat |= erofsFeatureIncompatZeroPadding
+		}
+	}
+
+	sb := erofsSuperblock{
+		FeatureIncompat: incompat,
+		Magic:           erofsMagic,
+		BlockSizeBits:   erofsBlockBits,
+		RootNid:         uint16(rootInode.nid()),
+		Inodes:          uint64(len(order)),
+		BuildTime:       uint64(max(0, root.mtime.Unix())),
+		Blocks:          uint32(e.pos / erofsBlockSize),
+	}
+
+	first := make([]byte, erofsSuperOffset, erofsBlockSize)
+	first, err := binary.Append(first, binary.LittleEndian, &sb)
+	if err != nil {
+		return errors.Errorf("encoding superblock: %w", err)
+	}
+	first = append(first, e.encodeInode(rootInode)...)
+	first = append(first, make([]byte, erofsBlockSize-len(first))...)
+
+	if _, err := e.w.Seek(0, io.SeekStart); err != nil {
+		return errors.Errorf("seeking to superblock: %w", err)
+	}
+	if _, err := e.w.Write(first); err != nil {
+		return errors.Errorf("writing superblock: %w", err)
+	}
+
+	return nil
+}
+
+// planInode decides how n is laid out; everything but the nids it refers to is known afterwards
+func (e *erofsWriter) planInode(n *node, number uint32) (*erofsInode, error) {
+	inode := &erofsInode{n: n, number: number, layout: erofsLayoutFlatPlain, xattrs: erofsXattrs(n)}
+
+	switch n.kind {
+	case kindDir:
+		// . and .. sort before names starting with a letter or digit, but not before every name
+		names := append([]string{".", ".."}, n.sortedChildren()...)
+		slices.Sort(names)
+
+		block := []string{}
+		used := 0
+		for _, name := range names {
+			if len(name) > erofsMaxNameLen {
+				return nil, errors.Errorf("name %q is longer than %d bytes", name, erofsMaxNameLen)
+			}
+			if used+erofsDirentSize+len(name) > erofsBlockSize {
+				inode.dirBlocks = append(inode.dirBlocks, block)
+				block, used = []string{}, 0
+			}
+			block = append(block, name)
+			used += erofsDirentSize + len(name)
+		}
+		inode.dirBlocks = append(inode.dirBlocks, block)
+		inode.dataSize = int64(len(inode.dirBlocks)-1)*erofsBlockSize + int64(used)
+	case kindSymlink:
+		inode.dataSize = int64(len(n.target))
+	case kindFile:
+		if n.data.extents != nil {
+			inode.layout = erofsLayoutCompressedFull
+		}
+	}
+
+	if inode.dataSize > 0 && inode.dataSize < erofsBlockSize && erofsInodeSize+int64(len(inode.xattrs))+inode.dataSize <= erofsBlockSize {
+		inode.layout = erofsLayoutFlatInline
+	}
+
+	return inode, nil
+}
+
+// contents returns the directory entries or symlink target of inode
+func (e *erofsWriter) contents(inode *erofsInode) []byte {
+	n := inode.n
+	if n.kind == kindSymlink {
+		return []byte(n.target)
+	}
+
+	out := make([]byte, 0, inode.dataSize)
+	for i, names := range inode.dirBlocks {
+		block := make([]byte, 0, erofsBlockSize)
+		nameOff := len(names) * erofsDirentSize
+		for _, name := range names {
+			target, typ := n, uint8(erofsFileTypeDir)
+			switch name {
+			case ".":
+			case "..":
+				target = inode.parent
+			default:
+				target = n.children[name]
+				typ = erofsFileType(target)
+			}
+			block = binary.LittleEndian.AppendUint64(block, e.inodes[target].nid())
+			block = binary.LittleEndian.AppendUint16(block, uint16(nameOff))
+			block = append(block, typ, 0)
+			nameOff += len(name)
+		}
+		for _, name := range names {
+			block = append(block, name...)
+		}
+		// the last name of a full block ends at the first NUL
+		if i < len(inode.dirBlocks)-1 {
+			block = append(block, make([]byte, erofsBlockSize-len(block))...)
+		}
+		out = append(out, block...)
+	}
+	return out
+}
+
+func erofsFileType(n *node) uint8 {
+	switch n.kind {
+	case kindDir:
+		return erofsFileTypeDir
+	case kindSymlink:
+		return erofsFileTypeSymlink
+	case kindCharDev:
+		return erofsFileTypeCharDev
+	case kindBlockDev:
+		return erofsFileTypeBlockDev
+	case kindFifo:
+		return erofsFileTypeFifo
+	default:
+		return erofsFileTypeRegular
+	}
+}
+
+// erofsXattrs encodes the inline xattr area of n, nil when it has none
+func erofsXattrs(n *node) []byte {
+	entries := []byte{}
+	for _, x := range n.xattrs {
+		index, name := uint8(0), ""
+		for prefix, i := range erofsXattrPrefixes {
+			if rest, ok := strings.CutPrefix(x.name, prefix); ok {
+				index, name = i, rest
+				break
+			}
+		}
+		if index == 0 || len(name) > math.MaxUint8 || len(x.value) > math.MaxUint16 {
+			continue
+		}
+
+		entries = append(entries, uint8(len(name)), index)
+		entries = binary.LittleEndian.AppendUint16(entries, uint16(len(x.value)))
+		entries = append(entries, name...)
+		entries = append(entries, x.value...)
+		for len(entries)%4 != 0 {
+			entries = append(entries, 0)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return append(make([]byte, erofsXattrHeaderSize), entries...)
+}
+
+// encodeInode returns the extended inode of inode followed by its xattrs and inline data
+func (e *erofsWriter) encodeInode(inode *erofsInode) []byte {
+	n := inode.n
+	le := binary.LittleEndian
+
+	size := inode.dataSize
+	nlink := n.nlink
+	addr := inode.blockAddr
+	switch n.kind {
+	case kindFile:
+		size = n.size
+		addr = uint32(n.data.start / erofsBlockSize)
+		if n.size == 0 {
+			addr = 0
+		}
+		// compressed files count their blocks, the indexes address them
+		if inode.layout == erofsLayoutCompressedFull {
+			addr = uint32(len(n.data.extents))
+		}
+	case kindDir:
+		nlink = 2 + n.subdirs()
+	case kindCharDev, kindBlockDev:
+		addr = n.rdev()
+	}
+
+	xattrCount := uint16(0)
+	if len(inode.xattrs) > 0 {
+		xattrCount = uint16((len(inode.xattrs)-erofsXattrHeaderSize)/4 + 1)
+	}
+
+	b := make([]byte, 0, inode.size())
+	b = le.AppendUint16(b, 1|inode.layout<<1)
+	b = le.AppendUint16(b, xattrCount)
+	b = le.AppendUint16(b, n.unixMode())
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint64(b, uint64(size))
+	b = le.AppendUint32(b, addr)
+	b = le.AppendUint32(b, inode.number)
+	b = le.AppendUint32(b, n.uid)
+	b = le.AppendUint32(b, n.gid)
+	b = le.AppendUint64(b, uint64(max(0, n.mtime.Unix())))
+	b = le.AppendUint32(b, uint32(max(0, n.mtime.Nanosecond())))
+	b = le.AppendUint32(b, nlink)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, inode.xattrs...)
+
+	if inode.layout == erofsLayoutFlatInline {
+		b = append(b, e.contents(inode)...)
+	}
+	if inode.layout == erofsLayoutCompressedFull {
+		b = appendLclusterIndexes(b, inode)
+	}
+
+	return b
+}
+
+// appendLclusterIndexes appends the map header and the full lcluster indexes of a compressed file. each
+// extent is one block, starting at the block of the file's data in order.
+func appendLclusterIndexes(b []byte, inode *erofsInode) []byte {
+	le := binary.LittleEndian
+	data := inode.n.data
+
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	// an all zero header: lz4 for both head types, 4k lclusters and no inline or fragment data
+	b = append(b, make([]byte, erofsMapHeaderSize)...)
+
+	lclusters := inode.lclusters()
+	heads := make([]int, lclusters)
+	for i := range heads {
+		heads[i] = -1
+	}
+	for i, ext := range data.extents {
+		heads[ext.offset/erofsBlockSize] = i
+	}
+
+	head := int64(0)
+	for lcn := range lclusters {
+		if i := heads[lcn]; i >= 0 {
+			typ := uint16(erofsLclusterHead1)
+			if data.extents[i].raw {
+				typ = erofsLclusterPlain
+			}
+			b = le.AppendUint16(b, typ)
+			b = le.AppendUint16(b, uint16(data.extents[i].offset%erofsBlockSize))
+			b = le.AppendUint32(b, uint32(data.start/erofsBlockSize)+uint32(i))
+			head = lcn
+			continue
+		}
+
+		next := lcn + 1
+		for next < lclusters && heads[next] < 0 {
+			next++
+		}
+		b = le.AppendUint16(b, erofsLclusterNonhead)
+		b = le.AppendUint16(b, 0)
+		b = le.AppendUint16(b, uint16(lcn-head))
+		b = le.AppendUint16(b, uint16(next-lcn))
+	}
+
+	return b
+}
+
+type erofsSuperblock struct {
+	Magic            uint32
+	Checksum         uint32
+	FeatureCompat    uint32
+	BlockSizeBits    uint8
+	ExtSlots         uint8
+	RootNid          uint16
+	Inodes           uint64
+	BuildTime        uint64
+	BuildTimeNsec    uint32
+	Blocks           uint32
+	MetaBlockAddr    uint32
+	XattrBlockAddr   uint32
+	UUID             [16]byte
+	VolumeName       [16]byte
+	FeatureIncompat  uint32
+	ComprAlgs        uint16
+	ExtraDevices     uint16
+	DevtSlotOff      uint16
+	DirBlockBits     uint8
+	XattrPrefixCount uint8
+	XattrPrefixStart uint32
+	PackedNid        uint64
+	XattrFilter      uint8
+	Reserved         [23]byte
+}
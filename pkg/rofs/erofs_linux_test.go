@@ -0,0 +1,93 @@
+//go:build linux
+
+package rofs
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/erofs"
+	"gvisor.dev/gvisor/pkg/safemem"
+)
+
+// TestEROFSReadByGvisor reads an image back with the EROFS implementation of gvisor. it only reads
+// uncompressed files, so the image holds nothing that compresses.
+func TestEROFSReadByGvisor(t *testing.T) {
+	random := make([]byte, 100000)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	files := []testFile{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{header: tar.Header{Name: "bin/random", Typeflag: tar.TypeReg, Mode: 0o755, Uid: 1000, Gid: 1000}, content: random},
+		{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "random", Mode: 0o777}},
+		{header: tar.Header{Name: "bin/hardlink", Typeflag: tar.TypeLink, Linkname: "bin/random"}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte("vm\n")},
+		{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}},
+	}
+	for i := range 500 {
+		name := fmt.Sprintf("many/%s-%d", strings.Repeat("f", 1+i%40), i)
+		files = append(files, testFile{header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte(name)})
+	}
+
+	path := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, os.WriteFile(path, convert(t, ConvertTarToEROFS, testTar(t, files)), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	img, err := erofs.OpenImage(f)
+	require.NoError(t, err)
+	defer img.Close()
+
+	entries := map[string]erofs.Inode{}
+	var walk func(path string, nid uint64)
+	walk = func(path string, nid uint64) {
+		inode, err := img.Inode(nid)
+		require.NoError(t, err, path)
+		entries[path] = inode
+		if !inode.IsDir() {
+			return
+		}
+		require.NoError(t, inode.IterDirents(func(name string, typ uint8, nid uint64) error {
+			if name != "." && name != ".." {
+				walk(strings.TrimPrefix(path+"/"+name, "/"), nid)
+			}
+			return nil
+		}))
+	}
+	walk("", img.RootNid())
+
+	require.Len(t, entries, len(files)+4, "the files, the root and the implicit etc, dev and many directories")
+
+	for _, f := range files {
+		inode, ok := entries[strings.TrimSuffix(f.header.Name, "/")]
+		require.True(t, ok, f.header.Name)
+
+		switch f.header.Typeflag {
+		case tar.TypeReg:
+			seq, err := inode.Data()
+			require.NoError(t, err, f.header.Name)
+			data := make([]byte, seq.NumBytes())
+			_, err = safemem.CopySeq(safemem.BlockSeqOf(safemem.BlockFromSafeSlice(data)), seq)
+			require.NoError(t, err)
+			assert.Equal(t, f.content, data, f.header.Name)
+			assert.Equal(t, uint32(f.header.Uid), inode.UID(), f.header.Name)
+		case tar.TypeSymlink:
+			target, err := inode.Readlink()
+			require.NoError(t, err)
+			assert.Equal(t, f.header.Linkname, target)
+		case tar.TypeLink:
+			target := entries[f.header.Linkname]
+			assert.Equal(t, target.Nid(), inode.Nid())
+			assert.Equal(t, uint32(2), inode.Nlink())
+		case tar.TypeChar:
+			assert.True(t, inode.IsCharDev())
+		}
+	}
+}
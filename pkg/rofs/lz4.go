@@ -0,0 +1,107 @@
+package rofs
+
+import (
+	"encoding/binary"
+)
+
+// LZ4 block format limits, as enforced by the kernel's LZ4_decompress_safe
+const (
+	lz4MinMatch = 4
+	// a block ends with at least this many literals
+	lz4LastLiterals = 5
+	// the last match starts at least this far from the end of the block
+	lz4MatchFinishLimit = 12
+	lz4MaxDistance      = 65535
+	lz4HashLog          = 12
+)
+
+// lz4Encoder compresses into blocks of a fixed size, the way LZ4_compress_destSize does: it consumes as much
+// of the input as fits the destination
+type lz4Encoder struct {
+	// table maps the hash of 4 bytes to their position in the input, plus one
+	table [1 << lz4HashLog]int32
+}
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4LengthBytes is how many bytes extend a length that does not fit the 4 bits of the token
+func lz4LengthBytes(n int) int {
+	if n < 15 {
+		return 0
+	}
+	return (n-15)/255 + 1
+}
+
+func appendLZ4Length(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// compress appends to dst an LZ4 block of at most limit bytes, and returns it with the number of bytes of src
+// it holds. the block decompresses to exactly src[:consumed] and never starts with a zero byte.
+func (e *lz4Encoder) compress(dst []byte, src []byte, limit int) ([]byte, int) {
+	clear(e.table[:])
+
+	start := len(dst)
+	anchor, ip := 0, 0
+	// matches end early enough to leave the literals a block has to end with
+	matchEnd := len(src) - lz4MatchFinishLimit
+
+	for ip+lz4MinMatch <= matchEnd {
+		v := binary.LittleEndian.Uint32(src[ip:])
+		h := lz4Hash(v)
+		ref := int(e.table[h]) - 1
+		e.table[h] = int32(ip + 1)
+
+		if ref < 0 || ip-ref > lz4MaxDistance || binary.LittleEndian.Uint32(src[ref:]) != v {
+			// skip faster through input that does not compress
+			ip += 1 + (ip-anchor)>>6
+			continue
+		}
+
+		for ip > anchor && ref > 0 && src[ip-1] == src[ref-1] {
+			ip, ref = ip-1, ref-1
+		}
+		length := lz4MinMatch
+		for ip+length < matchEnd && src[ip+length] == src[ref+length] {
+			length++
+		}
+
+		literals := ip - anchor
+		size := 1 + lz4LengthBytes(literals) + literals + 2 + lz4LengthBytes(length-lz4MinMatch)
+		// keep room for the final literals after the match
+		if len(dst)-start+size+1+lz4MatchFinishLimit > limit {
+			break
+		}
+
+		token := byte(min(literals, 15)<<4) | byte(min(length-lz4MinMatch, 15))
+		dst = append(dst, token)
+		dst = appendLZ4Length(dst, literals)
+		dst = append(dst, src[anchor:ip]...)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(ip-ref))
+		dst = appendLZ4Length(dst, length-lz4MinMatch)
+
+		ip += length
+		anchor = ip
+	}
+
+	// as many of the remaining bytes as fit end the block as literals
+	room := limit - (len(dst) - start) - 1
+	literals := min(len(src)-anchor, room)
+	for literals > 0 && lz4LengthBytes(literals)+literals > room {
+		literals--
+	}
+
+	dst = append(dst, byte(min(literals, 15)<<4))
+	dst = appendLZ4Length(dst, literals)
+	dst = append(dst, src[anchor:anchor+literals]...)
+
+	return dst, anchor + literals
+}
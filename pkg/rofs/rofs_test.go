@@ -0,0 +1,577 @@
+package rofs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEntry is what a reader of an image sees of one file
+type testEntry struct {
+	mode    uint16
+	uid     uint32
+	gid     uint32
+	nlink   uint32
+	content string
+	target  string
+	rdev    uint32
+	xattrs  map[string]string
+}
+
+type testFile struct {
+	header  tar.Header
+	content []byte
+}
+
+func testTar(t *testing.T, files []testFile) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		h := f.header
+		h.Size = int64(len(f.content))
+		if h.ModTime.IsZero() {
+			h.ModTime = time.Unix(1700000000, 0)
+		}
+		require.NoError(t, tw.WriteHeader(&h))
+		_, err := tw.Write(f.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func convert(t *testing.T, convert func(io.Reader, io.WriteSeeker) error, data []byte) []byte {
+	t.Helper()
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "image"))
+	require.NoError(t, err)
+	defer out.Close()
+
+	require.NoError(t, convert(bytes.NewReader(data), out))
+
+	img, err := os.ReadFile(out.Name())
+	require.NoError(t, err)
+	require.Zero(t, len(img)%4096, "image is not block aligned")
+
+	return img
+}
+
+var big = bytes.Repeat([]byte("0123456789abcdef"), 40000)
+
+func sampleFiles() []testFile {
+	return []testFile{
+		{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755}},
+		// a child before its parent's header, like the merged layer stream writes upper layers first
+		{header: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte("root:x:0:0:root:/root:/bin/sh\n")},
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 0, Gid: 42}},
+		{header: tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0o4755, PAXRecords: map[string]string{
+			paxXattrPrefix + "security.capability": "\x01\x00\x00\x02",
+			paxXattrPrefix + "user.comment":        "pong",
+		}}, content: []byte("ping binary")},
+		{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox", Mode: 0o777}},
+		{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755, Uid: 1000, Gid: 1000}, content: big},
+		{header: tar.Header{Name: "bin/busybox-copy", Typeflag: tar.TypeReg, Mode: 0o755}, content: big},
+		{header: tar.Header{Name: "bin/hardlink", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		{header: tar.Header{Name: "dev/pipe", Typeflag: tar.TypeFifo, Mode: 0o600}},
+		{header: tar.Header{Name: "empty", Typeflag: tar.TypeReg, Mode: 0o600}},
+		{header: tar.Header{Name: "holes", Typeflag: tar.TypeReg, Mode: 0o644}, content: append(make([]byte, 300000), 'x')},
+		{header: tar.Header{Name: "var/empty/", Typeflag: tar.TypeDir, Mode: 0o700}},
+	}
+}
+
+func checkSample(t *testing.T, entries map[string]testEntry) {
+	t.Helper()
+
+	assert.ElementsMatch(t, []string{
+		"", "etc", "etc/passwd", "bin", "bin/ping", "bin/sh", "bin/busybox", "bin/busybox-copy", "bin/hardlink",
+		"dev", "dev/null", "dev/pipe", "empty", "holes", "var", "var/empty",
+	}, keys(entries))
+
+	assert.Equal(t, uint16(0o40755), entries[""].mode)
+	assert.Equal(t, uint32(6), entries[""].nlink)
+	assert.Equal(t, testEntry{mode: 0o40750, gid: 42, nlink: 2}, entries["etc"])
+	assert.Equal(t, "root:x:0:0:root:/root:/bin/sh\n", entries["etc/passwd"].content)
+
+	ping := entries["bin/ping"]
+	assert.Equal(t, uint16(0o104755), ping.mode)
+	assert.Equal(t, "ping binary", ping.content)
+	assert.Equal(t, map[string]string{"security.capability": "\x01\x00\x00\x02", "user.comment": "pong"}, ping.xattrs)
+
+	assert.Equal(t, uint16(0o120777), entries["bin/sh"].mode)
+	assert.Equal(t, "busybox", entries["bin/sh"].target)
+
+	busybox := entries["bin/busybox"]
+	assert.Equal(t, string(big), busybox.content)
+	assert.Equal(t, uint32(1000), busybox.uid)
+	assert.Equal(t, uint32(2), busybox.nlink)
+	assert.Equal(t, busybox, entries["bin/hardlink"])
+	assert.Equal(t, string(big), entries["bin/busybox-copy"].content)
+
+	assert.Equal(t, uint16(0o20666), entries["dev/null"].mode)
+	assert.Equal(t, uint32(1<<8|3), entries["dev/null"].rdev)
+	assert.Equal(t, uint16(0o10600), entries["dev/pipe"].mode)
+
+	assert.Equal(t, uint16(0o100600), entries["empty"].mode)
+	assert.Empty(t, entries["empty"].content)
+	assert.Equal(t, string(append(make([]byte, 300000), 'x')), entries["holes"].content)
+	assert.Equal(t, uint16(0o40700), entries["var/empty"].mode)
+}
+
+func keys(entries map[string]testEntry) []string {
+	out := []string{}
+	for k := range entries {
+		out = append(out, k)
+	}
+	return out
+}
+
+func TestConvertTarToSquashfs(t *testing.T) {
+	img := convert(t, ConvertTarToSquashfs, testTar(t, sampleFiles()))
+
+	entries := readSquashfs(t, img)
+	checkSample(t, entries)
+
+	// busybox-copy shares the blocks of busybox, which compress to far less than one copy
+	assert.Less(t, len(img), len(big))
+}
+
+func TestConvertTarToEROFS(t *testing.T) {
+	img := convert(t, ConvertTarToEROFS, testTar(t, sampleFiles()))
+
+	entries := readEROFS(t, img)
+	checkSample(t, entries)
+
+	// busybox-copy shares the blocks of busybox, which compress to far less than one copy
+	assert.Less(t, len(img), len(big)/4)
+}
+
+func TestConvertLargeDirectory(t *testing.T) {
+	files := []testFile{}
+	for i := range 3000 {
+		name := strings.Repeat("f", 1+i%40) + "-" + string(rune('a'+i%26)) + "-" + time.Duration(i).String()
+		files = append(files, testFile{header: tar.Header{Name: "many/" + name, Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte(name)})
+	}
+	random := make([]byte, 200000)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	files = append(files, testFile{header: tar.Header{Name: "random", Typeflag: tar.TypeReg, Mode: 0o644}, content: random})
+
+	// runs that compress between runs that do not, so compressed and raw blocks start at any offset
+	mixed := []byte{}
+	for i := range 50 {
+		mixed = append(mixed, random[i*3000:i*3000+2000+i*150]...)
+		mixed = append(mixed, bytes.Repeat([]byte(strings.Repeat("x", i%7+1)+"abc"), 50*i)...)
+	}
+	files = append(files, testFile{header: tar.Header{Name: "mixed", Typeflag: tar.TypeReg, Mode: 0o644}, content: mixed})
+
+	data := testTar(t, files)
+
+	for _, tc := range []struct {
+		format  string
+		convert func(io.Reader, io.WriteSeeker) error
+		read    func(t *testing.T, img []byte) map[string]testEntry
+	}{
+		{"squashfs", ConvertTarToSquashfs, readSquashfs},
+		{"erofs", ConvertTarToEROFS, readEROFS},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			entries := tc.read(t, convert(t, tc.convert, data))
+			require.Len(t, entries, len(files)+2)
+			for _, f := range files {
+				assert.Equal(t, string(f.content), entries[f.header.Name].content, f.header.Name)
+			}
+		})
+	}
+}
+
+// readSquashfs walks a squashfs image the way the kernel reads it
+func readSquashfs(t *testing.T, img []byte) map[string]testEntry {
+	t.Helper()
+
+	var sb squashfsSuperblock
+	require.NoError(t, binary.Read(bytes.NewReader(img), binary.LittleEndian, &sb))
+	require.Equal(t, uint32(squashfsMagic), sb.Magic)
+	require.LessOrEqual(t, sb.BytesUsed, uint64(len(img)))
+
+	// readTable decompresses the metadata blocks in [start, end), returning the data and where each block starts in it
+	readTable := func(start, end uint64) ([]byte, map[uint64]int) {
+		out := []byte{}
+		blocks := map[uint64]int{}
+		for pos := start; pos < end; {
+			header := binary.LittleEndian.Uint16(img[pos:])
+			size := uint64(header &^ squashfsUncompressedMetadata)
+			blocks[pos-start] = len(out)
+			block := img[pos+2 : pos+2+size]
+			if header&squashfsUncompressedMetadata == 0 {
+				zr, err := zlib.NewReader(bytes.NewReader(block))
+				require.NoError(t, err)
+				block, err = io.ReadAll(zr)
+				require.NoError(t, err)
+			}
+			require.LessOrEqual(t, len(block), squashfsMetadataSize)
+			out = append(out, block...)
+			pos += 2 + size
+		}
+		return out, blocks
+	}
+
+	idIndex := binary.LittleEndian.Uint64(img[sb.IDTableStart:])
+	idData, _ := readTable(idIndex, sb.IDTableStart)
+	id := func(idx uint16) uint32 {
+		return binary.LittleEndian.Uint32(idData[4*int(idx):])
+	}
+
+	var xattrTable []byte
+	var xattrBlocks map[uint64]int
+	var xattrIDs []byte
+	if sb.XattrIDTableStart != squashfsInvalidBlock {
+		kvStart := binary.LittleEndian.Uint64(img[sb.XattrIDTableStart:])
+		count := binary.LittleEndian.Uint32(img[sb.XattrIDTableStart+8:])
+		firstIDBlock := binary.LittleEndian.Uint64(img[sb.XattrIDTableStart+16:])
+		xattrTable, xattrBlocks = readTable(kvStart, firstIDBlock)
+		xattrIDs, _ = readTable(firstIDBlock, sb.XattrIDTableStart)
+		require.Len(t, xattrIDs, 16*int(count))
+	}
+	readXattrs := func(idx uint32) map[string]string {
+		if idx == squashfsInvalidXattr {
+			return nil
+		}
+		entry := xattrIDs[16*idx:]
+		ref := binary.LittleEndian.Uint64(entry)
+		count := binary.LittleEndian.Uint32(entry[8:])
+		kv := xattrTable[xattrBlocks[ref>>16]+int(ref&0xffff):]
+		out := map[string]string{}
+		for range count {
+			typ := binary.LittleEndian.Uint16(kv)
+			nameLen := int(binary.LittleEndian.Uint16(kv[2:]))
+			name := squashfsXattrPrefixes[typ] + string(kv[4:4+nameLen])
+			kv = kv[4+nameLen:]
+			valueLen := int(binary.LittleEndian.Uint32(kv))
+			out[name] = string(kv[4 : 4+valueLen])
+			kv = kv[4+valueLen:]
+		}
+		return out
+	}
+
+	inodes, inodeBlocks := readTable(sb.InodeTableStart, sb.DirectoryTableStart)
+	dirs, dirBlocks := readTable(sb.DirectoryTableStart, sb.FragmentTableStart)
+
+	readData := func(start uint64, size uint64, blocks []byte) string {
+		out := []byte{}
+		for i := 0; len(blocks) > 0; i++ {
+			bsize := binary.LittleEndian.Uint32(blocks)
+			blocks = blocks[4:]
+			want := min(size-uint64(len(out)), squashfsBlockSize)
+			if bsize == 0 {
+				out = append(out, make([]byte, want)...)
+				continue
+			}
+			onDisk := uint64(bsize &^ squashfsUncompressedBlock)
+			block := img[start : start+onDisk]
+			start += onDisk
+			if bsize&squashfsUncompressedBlock == 0 {
+				zr, err := zlib.NewReader(bytes.NewReader(block))
+				require.NoError(t, err)
+				var err2 error
+				block, err2 = io.ReadAll(zr)
+				require.NoError(t, err2)
+			}
+			require.Equal(t, want, uint64(len(block)))
+			out = append(out, block...)
+		}
+		require.Equal(t, size, uint64(len(out)))
+		return string(out)
+	}
+
+	entries := map[string]testEntry{}
+	var walk func(path string, ref uint64)
+	walk = func(path string, ref uint64) {
+		ino := inodes[inodeBlocks[ref>>16]+int(ref&0xffff):]
+		le := binary.LittleEndian
+		typ := le.Uint16(ino)
+		e := testEntry{mode: le.Uint16(ino[2:]), uid: id(le.Uint16(ino[4:])), gid: id(le.Uint16(ino[6:]))}
+		body := ino[16:]
+
+		var listing []byte
+		xattr := uint32(squashfsInvalidXattr)
+		switch typ {
+		case squashfsTypeDir:
+			e.mode |= 0o40000
+			e.nlink = le.Uint32(body[4:])
+			start := dirBlocks[uint64(le.Uint32(body))] + int(le.Uint16(body[10:]))
+			listing = dirs[start : start+int(le.Uint16(body[8:]))-3]
+		case squashfsTypeExtDir:
+			e.mode |= 0o40000
+			e.nlink = le.Uint32(body)
+			start := dirBlocks[uint64(le.Uint32(body[8:]))] + int(le.Uint16(body[18:]))
+			listing = dirs[start : start+int(le.Uint32(body[4:]))-3]
+			xattr = le.Uint32(body[20:])
+		case squashfsTypeFile:
+			e.mode |= 0o100000
+			e.nlink = 1
+			size := uint64(le.Uint32(body[12:]))
+			nblocks := (size + squashfsBlockSize - 1) / squashfsBlockSize
+			e.content = readData(uint64(le.Uint32(body)), size, body[16:16+4*nblocks])
+		case squashfsTypeExtFile:
+			e.mode |= 0o100000
+			size := le.Uint64(body[8:])
+			e.nlink = le.Uint32(body[24:])
+			xattr = le.Uint32(body[36:])
+			nblocks := (size + squashfsBlockSize - 1) / squashfsBlockSize
+			e.content = readData(le.Uint64(body), size, body[40:40+4*nblocks])
+		case squashfsTypeSymlink, squashfsTypeExtSymlink:
+			e.mode |= 0o120000
+			e.nlink = le.Uint32(body)
+			size := le.Uint32(body[4:])
+			e.target = string(body[8 : 8+size])
+			if typ == squashfsTypeExtSymlink {
+				xattr = le.Uint32(body[8+size:])
+			}
+		case squashfsTypeCharDev, squashfsTypeBlockDev:
+			e.mode |= map[uint16]uint16{squashfsTypeCharDev: 0o20000, squashfsTypeBlockDev: 0o60000}[typ]
+			e.nlink = le.Uint32(body)
+			e.rdev = le.Uint32(body[4:])
+		case squashfsTypeFifo:
+			e.mode |= 0o10000
+			e.nlink = le.Uint32(body)
+		default:
+			t.Fatalf("unexpected inode type %d at %s", typ, path)
+		}
+		e.xattrs = readXattrs(xattr)
+		entries[path] = e
+
+		for len(listing) > 0 {
+			count := le.Uint32(listing) + 1
+			block := le.Uint32(listing[4:])
+			listing = listing[12:]
+			for range count {
+				offset := le.Uint16(listing)
+				nameLen := int(le.Uint16(listing[6:])) + 1
+				name := string(listing[8 : 8+nameLen])
+				listing = listing[8+nameLen:]
+				walk(strings.TrimPrefix(path+"/"+name, "/"), uint64(block)<<16|uint64(offset))
+			}
+		}
+	}
+	walk("", sb.RootInode)
+
+	return entries
+}
+
+// readEROFS walks an EROFS image the way the kernel reads it
+func readEROFS(t *testing.T, img []byte) map[string]testEntry {
+	t.Helper()
+
+	var sb erofsSuperblock
+	require.NoError(t, binary.Read(bytes.NewReader(img[erofsSuperOffset:]), binary.LittleEndian, &sb))
+	require.Equal(t, uint32(erofsMagic), sb.Magic)
+	require.Equal(t, uint32(len(img)/erofsBlockSize), sb.Blocks)
+
+	entries := map[string]testEntry{}
+	var walk func(path string, nid uint64)
+	walk = func(path string, nid uint64) {
+		le := binary.LittleEndian
+		ino := img[nid*erofsSlotSize:]
+		format := le.Uint16(ino)
+		require.Equal(t, uint16(1), format&1, "compact inode at %s", path)
+		layout := format >> 1
+
+		e := testEntry{
+			mode:  le.Uint16(ino[4:]),
+			uid:   le.Uint32(ino[24:]),
+			gid:   le.Uint32(ino[28:]),
+			nlink: le.Uint32(ino[44:]),
+		}
+		size := le.Uint64(ino[8:])
+		addr := le.Uint32(ino[16:])
+
+		xattrSize := 0
+		if icount := int(le.Uint16(ino[2:])); icount > 0 {
+			xattrSize = erofsXattrHeaderSize + 4*(icount-1)
+			e.xattrs = map[string]string{}
+			kv := ino[erofsInodeSize+erofsXattrHeaderSize : erofsInodeSize+xattrSize]
+			for len(kv) > 0 {
+				nameLen, index, valueLen := int(kv[0]), kv[1], int(le.Uint16(kv[2:]))
+				prefix := ""
+				for p, i := range erofsXattrPrefixes {
+					if i == index {
+						prefix = p
+					}
+				}
+				e.xattrs[prefix+string(kv[4:4+nameLen])] = string(kv[4+nameLen : 4+nameLen+valueLen])
+				kv = kv[(4+nameLen+valueLen+3)/4*4:]
+			}
+		}
+
+		var data []byte
+		switch {
+		case e.mode&0o170000 == 0o20000 || e.mode&0o170000 == 0o60000 || e.mode&0o170000 == 0o10000:
+			// i_u holds the device number, there is no data
+		case layout == erofsLayoutFlatPlain:
+			data = img[uint64(addr)*erofsBlockSize : uint64(addr)*erofsBlockSize+size]
+		case layout == erofsLayoutFlatInline:
+			start := nid*erofsSlotSize + erofsInodeSize + uint64(xattrSize)
+			require.LessOrEqual(t, start%erofsBlockSize+size, uint64(erofsBlockSize), "inline data crosses a block at %s", path)
+			data = img[start : start+size]
+		case layout == erofsLayoutCompressedFull:
+			require.Equal(t, uint32(erofsFeatureIncompatZeroPadding), sb.FeatureIncompat&erofsFeatureIncompatZeroPadding)
+			indexes := (nid*erofsSlotSize+erofsInodeSize+uint64(xattrSize)+7)/8*8 + erofsMapHeaderSize
+			data = readCompressed(t, img, indexes, size)
+		default:
+			t.Fatalf("unexpected layout %d at %s", layout, path)
+		}
+
+		switch e.mode & 0o170000 {
+		case 0o100000:
+			e.content = string(data)
+		case 0o120000:
+			e.target = string(data)
+		case 0o20000, 0o60000:
+			e.rdev = addr
+		}
+		entries[path] = e
+
+		if e.mode&0o170000 != 0o40000 {
+			return
+		}
+		names := []string{}
+		for len(data) > 0 {
+			block := data[:min(len(data), erofsBlockSize)]
+			data = data[len(block):]
+			count := int(le.Uint16(block[8:])) / erofsDirentSize
+			for i := range count {
+				de := block[i*erofsDirentSize:]
+				nameOff := int(le.Uint16(de[8:]))
+				nameEnd := len(block)
+				if i+1 < count {
+					nameEnd = int(le.Uint16(block[(i+1)*erofsDirentSize+8:]))
+				} else if n := bytes.IndexByte(block[nameOff:], 0); n >= 0 {
+					nameEnd = nameOff + n
+				}
+				name := string(block[nameOff:nameEnd])
+				names = append(names, name)
+				if name == "." || name == ".." {
+					continue
+				}
+				walk(strings.TrimPrefix(path+"/"+name, "/"), le.Uint64(de))
+			}
+		}
+		assert.IsIncreasing(t, names, "entries of %q are not sorted", path)
+	}
+	walk("", uint64(sb.RootNid))
+
+	return entries
+}
+
+// readCompressed decompresses a file from its full lcluster indexes the way the kernel maps them: an extent
+// starts at its head lcluster and ends where the next head starts
+func readCompressed(t *testing.T, img []byte, indexes uint64, size uint64) []byte {
+	t.Helper()
+
+	le := binary.LittleEndian
+	type head struct {
+		offset uint64
+		addr   uint32
+		raw    bool
+	}
+
+	heads := []head{}
+	lclusters := (size + erofsBlockSize - 1) / erofsBlockSize
+	for lcn := range lclusters {
+		index := img[indexes+lcn*erofsLclusterIndexSize:]
+		switch typ := le.Uint16(index); typ {
+		case erofsLclusterPlain, erofsLclusterHead1:
+			heads = append(heads, head{offset: lcn*erofsBlockSize + uint64(le.Uint16(index[2:])), addr: le.Uint32(index[4:]), raw: typ == erofsLclusterPlain})
+		case erofsLclusterNonhead:
+			require.NotEmpty(t, heads, "lcluster %d has no head", lcn)
+			last := heads[len(heads)-1].offset / erofsBlockSize
+			require.Equal(t, lcn-last, uint64(le.Uint16(index[4:])), "lookback of lcluster %d", lcn)
+			next := lcn + uint64(le.Uint16(index[6:]))
+			require.True(t, next == lclusters || le.Uint16(img[indexes+next*erofsLclusterIndexSize:]) != erofsLclusterNonhead, "lookahead of lcluster %d", lcn)
+		default:
+			t.Fatalf("unexpected lcluster type %d", typ)
+		}
+	}
+	require.NotEmpty(t, heads)
+	require.Zero(t, heads[0].offset)
+
+	out := []byte{}
+	for i, h := range heads {
+		end := size
+		if i+1 < len(heads) {
+			end = heads[i+1].offset
+		}
+		block := img[uint64(h.addr)*erofsBlockSize : uint64(h.addr+1)*erofsBlockSize]
+		length := int(end - h.offset)
+
+		if h.raw {
+			require.LessOrEqual(t, length, erofsBlockSize)
+			out = append(out, block[:length]...)
+			continue
+		}
+
+		// the zero padding is skipped, the kernel decompresses exactly the extent
+		src := bytes.TrimLeft(block, "\x00")
+		checkLZ4Block(t, src, length)
+		dst := make([]byte, length)
+		n, err := lz4.UncompressBlock(src, dst)
+		require.NoError(t, err)
+		require.Equal(t, length, n)
+		out = append(out, dst...)
+	}
+
+	return out
+}
+
+// checkLZ4Block checks the end of block rules LZ4_decompress_safe enforces and other decoders may not: the last
+// match starts 12 bytes and ends 5 bytes before the end of the output
+func checkLZ4Block(t *testing.T, src []byte, length int) {
+	t.Helper()
+
+	readLength := func(n int) int {
+		if n == 15 {
+			for {
+				b := src[0]
+				src = src[1:]
+				n += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		return n
+	}
+
+	out := 0
+	for {
+		token := src[0]
+		src = src[1:]
+		literals := readLength(int(token >> 4))
+		src = src[literals:]
+		out += literals
+		if len(src) == 0 {
+			break
+		}
+		require.LessOrEqual(t, out, length-lz4MatchFinishLimit, "match starts too close to the end")
+		src = src[2:]
+		out += readLength(int(token&15)) + lz4MinMatch
+		require.LessOrEqual(t, out, length-lz4LastLiterals, "match ends too close to the end")
+	}
+	require.Equal(t, length, out)
+}
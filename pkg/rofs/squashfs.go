@@ -0,0 +1,651 @@
+package rofs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// squashfs 4.0 layout, as read by the kernel's fs/squashfs
+const (
+	squashfsMagic           = 0x73717368
+	squashfsBlockLog        = 17
+	squashfsBlockSize       = 1 << squashfsBlockLog
+	squashfsMetadataSize    = 8192
+	squashfsSuperblockSize  = 96
+	squashfsCompressionZlib = 1
+
+	squashfsFlagNoFragments = 0x0010
+	squashfsFlagDuplicates  = 0x0040
+	squashfsFlagNoXattrs    = 0x0200
+
+	squashfsInvalidBlock    = math.MaxUint64
+	squashfsInvalidFragment = math.MaxUint32
+	squashfsInvalidXattr    = math.MaxUint32
+
+	// a data block stored as is because it did not compress
+	squashfsUncompressedBlock = 1 << 24
+	// a metadata block stored as is
+	squashfsUncompressedMetadata = 0x8000
+
+	squashfsMaxDirEntries = 256
+	squashfsMaxNameLen    = 256
+
+	// the image is padded like mksquashfs does so it can back a block device
+	squashfsPadding = 4096
+)
+
+const (
+	squashfsTypeDir = iota + 1
+	squashfsTypeFile
+	squashfsTypeSymlink
+	squashfsTypeBlockDev
+	squashfsTypeCharDev
+	squashfsTypeFifo
+	squashfsTypeSocket
+	squashfsTypeExtDir
+	squashfsTypeExtFile
+	squashfsTypeExtSymlink
+	squashfsTypeExtBlockDev
+	squashfsTypeExtCharDev
+	squashfsTypeExtFifo
+)
+
+// squashfs xattr name prefixes, by type
+var squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// ConvertTarToSquashfs writes the filesystem in the tar stream r to w as a zlib compressed squashfs image.
+// files are written without fragments, so every file starts on its own (compressed) block and identical
+// files are stored once. xattrs outside the user, trusted and security namespaces are dropped.
+func ConvertTarToSquashfs(r io.Reader, w io.WriteSeeker) error {
+	sw := &squashfsWriter{w: w, pos: squashfsSuperblockSize}
+	if _, err := w.Seek(sw.pos, io.SeekStart); err != nil {
+		return errors.Errorf("seeking past superblock: %w", err)
+	}
+
+	root, err := buildTree(r, sw)
+	if err != nil {
+		return err
+	}
+
+	return sw.finish(root)
+}
+
+type squashfsInode struct {
+	number uint32
+	// ref is the block of the inode table the inode starts in << 16 | its offset in the block
+	ref     uint64
+	written bool
+}
+
+type squashfsWriter struct {
+	w   io.WriteSeeker
+	pos int64
+
+	compressed bytes.Buffer
+	zw         *zlib.Writer
+
+	inodes     map[*node]*squashfsInode
+	inodeTable *metadataWriter
+	dirTable   *metadataWriter
+	ids        []uint32
+	idIndex    map[uint32]uint16
+	xattrTable *metadataWriter
+	xattrIDs   *metadataWriter
+	xattrIndex map[string]uint32
+	xattrCount uint32
+}
+
+func (s *squashfsWriter) write(p []byte) error {
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return err
+}
+
+// compress returns p compressed, or nil when compressing does not make it smaller
+func (s *squashfsWriter) compress(p []byte) ([]byte, error) {
+	s.compressed.Reset()
+	if s.zw == nil {
+		s.zw = zlib.NewWriter(&s.compressed)
+	} else {
+		s.zw.Reset(&s.compressed)
+	}
+	if _, err := s.zw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := s.zw.Close(); err != nil {
+		return nil, err
+	}
+	if s.compressed.Len() >= len(p) {
+		return nil, nil
+	}
+	return s.compressed.Bytes(), nil
+}
+
+func (s *squashfsWriter) writeFile(r io.Reader, size int64) (fileData, error) {
+	data := fileData{start: s.pos}
+	block := make([]byte, squashfsBlockSize)
+
+	for remaining := size; remaining > 0; {
+		chunk := block[:min(remaining, squashfsBlockSize)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return data, errors.Errorf("reading file data: %w", err)
+		}
+		remaining -= int64(len(chunk))
+
+		// all-zero blocks are holes, which the kernel reads back as zeros
+		if isZero(chunk) {
+			data.blocks = append(data.blocks, 0)
+			data.sparse += int64(len(chunk))
+			continue
+		}
+
+		compressed, err := s.compress(chunk)
+		if err != nil {
+			return data, errors.Errorf("compressing file data: %w", err)
+		}
+		if compressed == nil {
+			data.blocks = append(data.blocks, uint32(len(chunk))|squashfsUncompressedBlock)
+			compressed = chunk
+		} else {
+			data.blocks = append(data.blocks, uint32(len(compressed)))
+		}
+		if err := s.write(compressed); err != nil {
+			return data, errors.Errorf("writing file data: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+func (s *squashfsWriter) rewind(start int64) error {
+	if _, err := s.w.Seek(start, io.SeekStart); err != nil {
+		return errors.Errorf("rewinding over duplicate file: %w", err)
+	}
+	s.pos = start
+	return nil
+}
+
+func (s *squashfsWriter) finish(root *node) error {
+	s.inodes = map[*node]*squashfsInode{}
+	s.inodeTable = newMetadataWriter(s)
+	s.dirTable = newMetadataWriter(s)
+	s.idIndex = map[uint32]uint16{}
+	s.xattrTable = newMetadataWriter(s)
+	s.xattrIDs = newMetadataWriter(s)
+	s.xattrIndex = map[string]uint32{}
+
+	// inode numbers follow the order inodes are written in, so the entries of a directory have close numbers
+	count := uint32(0)
+	err := postOrder(root, map[*node]bool{}, func(n *node) error {
+		count++
+		s.inodes[n] = &squashfsInode{number: count}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the root's parent is by convention one past the last inode
+	if err := s.writeInodes(root, count+1); err != nil {
+		return err
+	}
+
+	sb := squashfsSuperblock{
+		Magic:             squashfsMagic,
+		Inodes:            count,
+		ModificationTime:  clampTime32(root.mtime.Unix()),
+		BlockSize:         squashfsBlockSize,
+		Compression:       squashfsCompressionZlib,
+		BlockLog:          squashfsBlockLog,
+		Flags:             squashfsFlagNoFragments | squashfsFlagDuplicates,
+		Major:             4,
+		RootInode:         s.inodes[root].ref,
+		XattrIDTableStart: squashfsInvalidBlock,
+		LookupTableStart:  squashfsInvalidBlock,
+	}
+
+	sb.InodeTableStart = uint64(s.pos)
+	if err := s.inodeTable.writeTo(); err != nil {
+		return errors.Errorf("writing inode table: %w", err)
+	}
+
+	sb.DirectoryTableStart = uint64(s.pos)
+	if err := s.dirTable.writeTo(); err != nil {
+		return errors.Errorf("writing directory table: %w", err)
+	}
+
+	// there are no fragments, the empty fragment table ends where the id table begins
+	sb.FragmentTableStart = uint64(s.pos)
+
+	ids := newMetadataWriter(s)
+	for _, id := range s.ids {
+		ids.writeUint32(id)
+	}
+	idTableStart, err := s.writeIndexedTable(ids)
+	if err != nil {
+		return errors.Errorf("writing id table: %w", err)
+	}
+	sb.IDTableStart = idTableStart
+	sb.IDCount = uint16(len(s.ids))
+
+	if s.xattrCount == 0 {
+		sb.Flags |= squashfsFlagNoXattrs
+	} else {
+		xattrTableStart := uint64(s.pos)
+		if err := s.xattrTable.writeTo(); err != nil {
+			return errors.Errorf("writing xattr table: %w", err)
+		}
+
+		// the xattr id table is last, its index runs up to the end of the image
+		if err := s.xattrIDs.writeTo(); err != nil {
+			return errors.Errorf("writing xattr id table: %w", err)
+		}
+		sb.XattrIDTableStart = uint64(s.pos)
+
+		header := make([]byte, 16, 16+8*len(s.xattrIDs.blockStarts))
+		binary.LittleEndian.PutUint64(header[0:], xattrTableStart)
+		binary.LittleEndian.PutUint32(header[8:], s.xattrCount)
+		for _, start := range s.xattrIDs.blockStarts {
+			header = binary.LittleEndian.AppendUint64(header, start)
+		}
+		if err := s.write(header); err != nil {
+			return errors.Errorf("writing xattr id table index: %w", err)
+		}
+	}
+
+	sb.BytesUsed = uint64(s.pos)
+
+	if pad := (squashfsPadding - s.pos%squashfsPadding) % squashfsPadding; pad > 0 {
+		if err := s.write(make([]byte, pad)); err != nil {
+			return errors.Errorf("padding image: %w", err)
+		}
+	}
+	if t, ok := s.w.(interface{ Truncate(int64) error }); ok {
+		// rewinding over a duplicate at the end of the data can leave stale bytes past the end
+		if err := t.Truncate(s.pos); err != nil {
+			return errors.Errorf("truncating image: %w", err)
+		}
+	}
+
+	if _, err := s.w.Seek(0, io.SeekStart); err != nil {
+		return errors.Errorf("seeking to superblock: %w", err)
+	}
+	if err := binary.Write(s.w, binary.LittleEndian, &sb); err != nil {
+		return errors.Errorf("writing superblock: %w", err)
+	}
+
+	return nil
+}
+
+// writeIndexedTable writes the metadata blocks of table followed by the list of their positions, and returns
+// the position of the list
+func (s *squashfsWriter) writeIndexedTable(table *metadataWriter) (uint64, error) {
+	if err := table.writeTo(); err != nil {
+		return 0, err
+	}
+
+	start := uint64(s.pos)
+	index := []byte{}
+	for _, blockStart := range table.blockStarts {
+		index = binary.LittleEndian.AppendUint64(index, blockStart)
+	}
+
+	return start, s.write(index)
+}
+
+func (s *squashfsWriter) id(id uint32) (uint16, error) {
+	if idx, ok := s.idIndex[id]; ok {
+		return idx, nil
+	}
+	if len(s.ids) == math.MaxUint16 {
+		return 0, errors.Errorf("more than %d distinct uids and gids", math.MaxUint16)
+	}
+	idx := uint16(len(s.ids))
+	s.ids = append(s.ids, id)
+	s.idIndex[id] = idx
+	return idx, nil
+}
+
+// xattrID returns the index of the xattr set of n in the xattr id table, or squashfsInvalidXattr
+func (s *squashfsWriter) xattrID(n *node) uint32 {
+	kv := []byte{}
+	count := uint32(0)
+	for _, x := range n.xattrs {
+		typ := -1
+		name := ""
+		for i, prefix := range squashfsXattrPrefixes {
+			if rest, ok := strings.CutPrefix(x.name, prefix); ok {
+				typ, name = i, rest
+				break
+			}
+		}
+		if typ < 0 {
+			continue
+		}
+
+		kv = binary.LittleEndian.AppendUint16(kv, uint16(typ))
+		kv = binary.LittleEndian.AppendUint16(kv, uint16(len(name)))
+		kv = append(kv, name...)
+		kv = binary.LittleEndian.AppendUint32(kv, uint32(len(x.value)))
+		kv = append(kv, x.value...)
+		count++
+	}
+	if count == 0 {
+		return squashfsInvalidXattr
+	}
+
+	if id, ok := s.xattrIndex[string(kv)]; ok {
+		return id
+	}
+
+	ref := s.xattrTable.ref()
+	s.xattrTable.write(kv)
+
+	entry := binary.LittleEndian.AppendUint64(nil, ref)
+	entry = binary.LittleEndian.AppendUint32(entry, count)
+	entry = binary.LittleEndian.AppendUint32(entry, uint32(len(kv)))
+	s.xattrIDs.write(entry)
+
+	id := s.xattrCount
+	s.xattrCount++
+	s.xattrIndex[string(kv)] = id
+	return id
+}
+
+// writeInodes writes the inodes below dir before dir itself, since a directory listing needs the inode
+// references of its entries
+func (s *squashfsWriter) writeInodes(dir *node, parent uint32) error {
+	names := dir.sortedChildren()
+
+	for _, name := range names {
+		child := dir.children[name]
+		if s.inodes[child].written {
+			continue
+		}
+		var err error
+		if child.isDir() {
+			err = s.writeInodes(child, s.inodes[dir].number)
+		} else {
+			err = s.writeInode(child, 0, 0, 0)
+		}
+		if err != nil {
+			return errors.Errorf("writing %s: %w", name, err)
+		}
+	}
+
+	listingRef := s.dirTable.ref()
+	listingSize, err := s.writeDirListing(dir, names)
+	if err != nil {
+		return err
+	}
+
+	return s.writeInode(dir, listingRef, listingSize, parent)
+}
+
+// writeDirListing writes the entries of dir to the directory table and returns the size of the listing
+func (s *squashfsWriter) writeDirListing(dir *node, names []string) (uint32, error) {
+	listing := []byte{}
+
+	for i := 0; i < len(names); {
+		first := s.inodes[dir.children[names[i]]]
+		block := first.ref >> 16
+
+		// entries under one header share the inode table block and are within an int16 of its inode number
+		j := i
+		for j < len(names) && j-i < squashfsMaxDirEntries {
+			ino := s.inodes[dir.children[names[j]]]
+			delta := int64(ino.number) - int64(first.number)
+			if ino.ref>>16 != block || delta < math.MinInt16 || delta > math.MaxInt16 {
+				break
+			}
+			j++
+		}
+
+		listing = binary.LittleEndian.AppendUint32(listing, uint32(j-i-1))
+		listing = binary.LittleEndian.AppendUint32(listing, uint32(block))
+		listing = binary.LittleEndian.AppendUint32(listing, first.number)
+
+		for _, name := range names[i:j] {
+			if len(name) > squashfsMaxNameLen {
+				return 0, errors.Errorf("name %q is longer than %d bytes", name, squashfsMaxNameLen)
+			}
+			child := dir.children[name]
+			ino := s.inodes[child]
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(ino.ref&0xffff))
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(int16(int64(ino.number)-int64(first.number))))
+			listing = binary.LittleEndian.AppendUint16(listing, squashfsBasicType(child))
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(len(name)-1))
+			listing = append(listing, name...)
+		}
+
+		i = j
+	}
+
+	s.dirTable.write(listing)
+	return uint32(len(listing)), nil
+}
+
+func squashfsBasicType(n *node) uint16 {
+	switch n.kind {
+	case kindDir:
+		return squashfsTypeDir
+	case kindSymlink:
+		return squashfsTypeSymlink
+	case kindBlockDev:
+		return squashfsTypeBlockDev
+	case kindCharDev:
+		return squashfsTypeCharDev
+	case kindFifo:
+		return squashfsTypeFifo
+	default:
+		return squashfsTypeFile
+	}
+}
+
+// writeInode writes the inode of n. directories pass the position and size of their listing and the inode
+// number of their parent.
+func (s *squashfsWriter) writeInode(n *node, listingRef uint64, listingSize uint32, parent uint32) error {
+	ino := s.inodes[n]
+
+	uid, err := s.id(n.uid)
+	if err != nil {
+		return err
+	}
+	gid, err := s.id(n.gid)
+	if err != nil {
+		return err
+	}
+	xattr := s.xattrID(n)
+	extended := xattr != squashfsInvalidXattr
+
+	typ := squashfsBasicType(n)
+	body := []byte{}
+	le := binary.LittleEndian
+
+	switch n.kind {
+	case kindDir:
+		// the listing size includes the implicit . and .. entries
+		size := listingSize + 3
+		block, offset := uint32(listingRef>>16), uint16(listingRef&0xffff)
+		nlink := 2 + n.subdirs()
+		if extended || size > math.MaxUint16 {
+			typ = squashfsTypeExtDir
+			body = le.AppendUint32(body, nlink)
+			body = le.AppendUint32(body, size)
+			body = le.AppendUint32(body, block)
+			body = le.AppendUint32(body, parent)
+			body = le.AppendUint16(body, 0)
+			body = le.AppendUint16(body, offset)
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, block)
+			body = le.AppendUint32(body, nlink)
+			body = le.AppendUint16(body, uint16(size))
+			body = le.AppendUint16(body, offset)
+			body = le.AppendUint32(body, parent)
+		}
+	case kindFile:
+		start := uint64(n.data.start)
+		if n.size == 0 {
+			start = 0
+		}
+		if extended || n.nlink > 1 || start > math.MaxUint32 || n.size > math.MaxUint32 {
+			typ = squashfsTypeExtFile
+			body = le.AppendUint64(body, start)
+			body = le.AppendUint64(body, uint64(n.size))
+			body = le.AppendUint64(body, uint64(n.data.sparse))
+			body = le.AppendUint32(body, n.nlink)
+			body = le.AppendUint32(body, squashfsInvalidFragment)
+			body = le.AppendUint32(body, 0)
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, uint32(start))
+			body = le.AppendUint32(body, squashfsInvalidFragment)
+			body = le.AppendUint32(body, 0)
+			body = le.AppendUint32(body, uint32(n.size))
+		}
+		for _, size := range n.data.blocks {
+			body = le.AppendUint32(body, size)
+		}
+	case kindSymlink:
+		body = le.AppendUint32(body, n.nlink)
+		body = le.AppendUint32(body, uint32(len(n.target)))
+		body = append(body, n.target...)
+		if extended {
+			typ = squashfsTypeExtSymlink
+			body = le.AppendUint32(body, xattr)
+		}
+	case kindCharDev, kindBlockDev:
+		body = le.AppendUint32(body, n.nlink)
+		body = le.AppendUint32(body, n.rdev())
+		if extended {
+			typ = squashfsTypeExtCharDev
+			if n.kind == kindBlockDev {
+				typ = squashfsTypeExtBlockDev
+			}
+			body = le.AppendUint32(body, xattr)
+		}
+	case kindFifo:
+		body = le.AppendUint32(body, n.nlink)
+		if extended {
+			typ = squashfsTypeExtFifo
+			body = le.AppendUint32(body, xattr)
+		}
+	}
+
+	header := make([]byte, 0, 16+len(body))
+	header = le.AppendUint16(header, typ)
+	header = le.AppendUint16(header, n.perm)
+	header = le.AppendUint16(header, uid)
+	header = le.AppendUint16(header, gid)
+	header = le.AppendUint32(header, clampTime32(n.mtime.Unix()))
+	header = le.AppendUint32(header, ino.number)
+
+	ino.ref = s.inodeTable.ref()
+	ino.written = true
+	s.inodeTable.write(append(header, body...))
+
+	return nil
+}
+
+type squashfsSuperblock struct {
+	Magic               uint32
+	Inodes              uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	Major               uint16
+	Minor               uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	LookupTableStart    uint64
+}
+
+// metadataWriter packs a squashfs metadata table into compressed 8KiB blocks, each prefixed by its size.
+// the table is kept in memory until it is written to the image.
+type metadataWriter struct {
+	s       *squashfsWriter
+	blocks  bytes.Buffer
+	pending []byte
+	// blockStarts are the image offsets of the blocks, known once the table is written
+	blockStarts []uint64
+	offsets     []uint64
+}
+
+func newMetadataWriter(s *squashfsWriter) *metadataWriter {
+	return &metadataWriter{s: s}
+}
+
+// ref returns the position the next write lands at: the table offset of its block << 16 | the offset in it
+func (m *metadataWriter) ref() uint64 {
+	return uint64(m.blocks.Len())<<16 | uint64(len(m.pending))
+}
+
+func (m *metadataWriter) write(p []byte) {
+	m.pending = append(m.pending, p...)
+	for len(m.pending) >= squashfsMetadataSize {
+		m.flush(m.pending[:squashfsMetadataSize])
+		m.pending = append(m.pending[:0], m.pending[squashfsMetadataSize:]...)
+	}
+}
+
+func (m *metadataWriter) writeUint32(v uint32) {
+	m.write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (m *metadataWriter) flush(block []byte) {
+	m.offsets = append(m.offsets, uint64(m.blocks.Len()))
+
+	compressed, err := m.s.compress(block)
+	if err != nil || compressed == nil {
+		// zlib into memory does not fail, store the block as is if it ever does
+		m.blocks.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(block))|squashfsUncompressedMetadata))
+		m.blocks.Write(block)
+		return
+	}
+	m.blocks.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(compressed))))
+	m.blocks.Write(compressed)
+}
+
+// writeTo flushes the last partial block and writes the table at the current image position
+func (m *metadataWriter) writeTo() error {
+	if len(m.pending) > 0 {
+		m.flush(m.pending)
+		m.pending = nil
+	}
+
+	start := uint64(m.s.pos)
+	for _, offset := range m.offsets {
+		m.blockStarts = append(m.blockStarts, start+offset)
+	}
+
+	return m.s.write(m.blocks.Bytes())
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func clampTime32(t int64) uint32 {
+	return uint32(max(0, min(t, math.MaxUint32)))
+}
@@ -0,0 +1,64 @@
+package rofs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestImagesPassReferenceTools checks and extracts the images with the tools of the formats, when they are
+// installed. devices and xattrs are left out, which need privileges to extract.
+func TestImagesPassReferenceTools(t *testing.T) {
+	files := []testFile{}
+	for _, f := range sampleFiles() {
+		if f.header.Typeflag == tar.TypeChar {
+			continue
+		}
+		f.header.PAXRecords = nil
+		files = append(files, f)
+	}
+	data := testTar(t, files)
+
+	for _, tc := range []struct {
+		tool    string
+		convert func(io.Reader, io.WriteSeeker) error
+		args    func(img, dir string) []string
+	}{
+		{"fsck.erofs", ConvertTarToEROFS, func(img, dir string) []string { return []string{"--extract=" + dir, img} }},
+		{"unsquashfs", ConvertTarToSquashfs, func(img, dir string) []string { return []string{"-no-xattrs", "-d", dir, img} }},
+	} {
+		t.Run(tc.tool, func(t *testing.T) {
+			tool, err := exec.LookPath(tc.tool)
+			if err != nil {
+				t.Skipf("%s is not installed", tc.tool)
+			}
+
+			img := filepath.Join(t.TempDir(), "image")
+			require.NoError(t, os.WriteFile(img, convert(t, tc.convert, data), 0o644))
+			dir := filepath.Join(t.TempDir(), "extracted")
+
+			out, err := exec.Command(tool, tc.args(img, dir)...).CombinedOutput()
+			require.NoError(t, err, string(out))
+
+			for _, f := range files {
+				path := filepath.Join(dir, f.header.Name)
+				switch f.header.Typeflag {
+				case tar.TypeReg:
+					content, err := os.ReadFile(path)
+					require.NoError(t, err, f.header.Name)
+					assert.Equal(t, string(f.content), string(content), f.header.Name)
+				case tar.TypeSymlink:
+					target, err := os.Readlink(path)
+					require.NoError(t, err, f.header.Name)
+					assert.Equal(t, f.header.Linkname, target)
+				}
+			}
+		})
+	}
+}
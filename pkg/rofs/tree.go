@@ -0,0 +1,325 @@
+// Package rofs writes read-only filesystem images (squashfs and EROFS) from tar streams in pure Go, so no
+// mkfs tools are needed on the host.
+//
+// file contents are written to the image as the tar stream is read; only the directory tree and the location
+// of each file's data are kept in memory. regular files with identical contents share their data.
+package rofs
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+type nodeKind int
+
+const (
+	kindDir nodeKind = iota + 1
+	kindFile
+	kindSymlink
+	kindCharDev
+	kindBlockDev
+	kindFifo
+)
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// fileData is where the contents of a regular file were written
+type fileData struct {
+	// start is the offset of the first data block in the image
+	start int64
+	// blocks are the on-disk sizes of the data blocks, for formats that compress them
+	blocks []uint32
+	// sparse counts the bytes of all-zero blocks that were not written
+	sparse int64
+	// extents start one data block each, for formats that compress into fixed size blocks. nil when every
+	// block is stored as is.
+	extents []extent
+}
+
+// extent is the part of a file's contents that one data block holds
+type extent struct {
+	// offset is where in the contents the extent starts, it ends where the next one starts
+	offset int64
+	// raw extents are stored uncompressed
+	raw bool
+}
+
+// node is a file of the image. hard links are the same node in more than one directory.
+type node struct {
+	kind     nodeKind
+	perm     uint16
+	uid      uint32
+	gid      uint32
+	mtime    time.Time
+	size     int64
+	target   string
+	devMajor uint32
+	devMinor uint32
+	xattrs   []xattr
+	data     fileData
+	children map[string]*node
+	nlink    uint32
+}
+
+func (n *node) isDir() bool {
+	return n.kind == kindDir
+}
+
+// sortedChildren returns the names of a directory's entries in byte order, the order both formats store them in
+func (n *node) sortedChildren() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// subdirs counts the directories below n, which make up its link count
+func (n *node) subdirs() uint32 {
+	count := uint32(0)
+	for _, child := range n.children {
+		if child.isDir() {
+			count++
+		}
+	}
+	return count
+}
+
+// unixMode is the st_mode of n
+func (n *node) unixMode() uint16 {
+	mode := n.perm
+	switch n.kind {
+	case kindDir:
+		mode |= 0o040000
+	case kindFile:
+		mode |= 0o100000
+	case kindSymlink:
+		mode |= 0o120000
+	case kindCharDev:
+		mode |= 0o020000
+	case kindBlockDev:
+		mode |= 0o060000
+	case kindFifo:
+		mode |= 0o010000
+	}
+	return mode
+}
+
+// rdev is the device number of n in the kernel's new_encode_dev format, which both formats store
+func (n *node) rdev() uint32 {
+	return (n.devMinor & 0xff) | (n.devMajor << 8) | ((n.devMinor &^ 0xff) << 12)
+}
+
+// fileWriter writes the contents of a regular file to the image
+type fileWriter interface {
+	writeFile(r io.Reader, size int64) (fileData, error)
+	// rewind discards the data written since start
+	rewind(start int64) error
+}
+
+// dedupKey identifies file contents
+type dedupKey struct {
+	sum  [sha256.Size]byte
+	size int64
+}
+
+// dedupWriter writes file data through w and, when the contents were already written, rewinds over the copy
+// and returns the earlier data instead
+type dedupWriter struct {
+	w    fileWriter
+	seen map[dedupKey]fileData
+}
+
+func (d *dedupWriter) writeFile(r io.Reader, size int64) (fileData, error) {
+	h := sha256.New()
+	data, err := d.w.writeFile(io.TeeReader(r, h), size)
+	if err != nil {
+		return data, err
+	}
+
+	key := dedupKey{size: size}
+	h.Sum(key.sum[:0])
+
+	if prev, ok := d.seen[key]; ok && size > 0 {
+		if err := d.w.rewind(data.start); err != nil {
+			return data, err
+		}
+		return prev, nil
+	}
+	d.seen[key] = data
+
+	return data, nil
+}
+
+// buildTree reads a tar stream into a tree, writing file contents through w as they are read
+func buildTree(r io.Reader, w fileWriter) (*node, error) {
+	dw := &dedupWriter{w: w, seen: map[dedupKey]fileData{}}
+
+	root := &node{kind: kindDir, perm: 0o755, nlink: 1, children: map[string]*node{}}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("reading tar header: %w", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+
+		if name == "" {
+			if header.Typeflag == tar.TypeDir {
+				setMetadata(root, header)
+			}
+			continue
+		}
+
+		parent, err := mkdirAll(root, path.Dir(name), header)
+		if err != nil {
+			return nil, errors.Errorf("creating parent of %s: %w", name, err)
+		}
+		base := path.Base(name)
+
+		var n *node
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// a directory declared again, or after its children, keeps its entries
+			if existing, ok := parent.children[base]; ok && existing.isDir() {
+				setMetadata(existing, header)
+				continue
+			}
+			n = &node{kind: kindDir, children: map[string]*node{}}
+		case tar.TypeReg, tar.TypeRegA:
+			data, err := dw.writeFile(tr, header.Size)
+			if err != nil {
+				return nil, errors.Errorf("writing %s: %w", name, err)
+			}
+			n = &node{kind: kindFile, size: header.Size, data: data}
+		case tar.TypeSymlink:
+			n = &node{kind: kindSymlink, target: header.Linkname, size: int64(len(header.Linkname))}
+		case tar.TypeChar:
+			n = &node{kind: kindCharDev, devMajor: uint32(header.Devmajor), devMinor: uint32(header.Devminor)}
+		case tar.TypeBlock:
+			n = &node{kind: kindBlockDev, devMajor: uint32(header.Devmajor), devMinor: uint32(header.Devminor)}
+		case tar.TypeFifo:
+			n = &node{kind: kindFifo}
+		case tar.TypeLink:
+			target, err := lookup(root, strings.TrimPrefix(path.Clean("/"+header.Linkname), "/"))
+			if err != nil {
+				return nil, errors.Errorf("hard link %s: %w", name, err)
+			}
+			if target.isDir() {
+				return nil, errors.Errorf("hard link %s points to directory %s", name, header.Linkname)
+			}
+			unlink(parent, base)
+			target.nlink++
+			parent.children[base] = target
+			continue
+		default:
+			continue
+		}
+
+		setMetadata(n, header)
+		unlink(parent, base)
+		n.nlink = 1
+		parent.children[base] = n
+	}
+
+	return root, nil
+}
+
+func setMetadata(n *node, header *tar.Header) {
+	n.perm = uint16(header.Mode & 0o7777)
+	n.uid = uint32(header.Uid)
+	n.gid = uint32(header.Gid)
+	n.mtime = header.ModTime
+
+	n.xattrs = nil
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			n.xattrs = append(n.xattrs, xattr{name: name, value: []byte(value)})
+		}
+	}
+	slices.SortFunc(n.xattrs, func(a, b xattr) int {
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// unlink removes name from dir, dropping a link of a hard linked file
+func unlink(dir *node, name string) {
+	if existing, ok := dir.children[name]; ok {
+		existing.nlink--
+		delete(dir.children, name)
+	}
+}
+
+// mkdirAll returns the directory at name, creating missing directories with the ownership and times of header
+func mkdirAll(root *node, name string, header *tar.Header) (*node, error) {
+	dir := root
+	if name == "." {
+		return dir, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		child, ok := dir.children[part]
+		if !ok {
+			child = &node{kind: kindDir, perm: 0o755, mtime: header.ModTime, nlink: 1, children: map[string]*node{}}
+			dir.children[part] = child
+		}
+		if !child.isDir() {
+			return nil, errors.Errorf("%s is not a directory", part)
+		}
+		dir = child
+	}
+
+	return dir, nil
+}
+
+func lookup(root *node, name string) (*node, error) {
+	n := root
+	for _, part := range strings.Split(name, "/") {
+		if !n.isDir() {
+			return nil, errors.Errorf("%s: not a directory", name)
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil, errors.Errorf("%s: not found", name)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// postOrder visits every node once, children in name order before their directory; hard linked nodes are
+// visited at their first link
+func postOrder(n *node, seen map[*node]bool, visit func(n *node) error) error {
+	if seen[n] {
+		return nil
+	}
+	seen[n] = true
+
+	if n.isDir() {
+		for _, name := range n.sortedChildren() {
+			if err := postOrder(n.children[name], seen, visit); err != nil {
+				return err
+			}
+		}
+	}
+
+	return visit(n)
+}
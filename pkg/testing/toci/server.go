@@ -0,0 +1,396 @@
+package toci
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/walteh/ec1/pkg/oci"
+)
+
+// RegistryServer is an in-process OCI distribution server for the images in Registry(). an image registered
+// as "docker.io/library/alpine:latest" is served as <host>/library/alpine:latest, its OCI layout index being
+// the manifest list of the tag. layouts are extracted the first time they are requested.
+type RegistryServer struct {
+	t      testing.TB
+	srv    *httptest.Server
+	images map[string]*servedImage
+
+	username string
+	password string
+
+	certDir string
+}
+
+type RegistryServerOption func(*registryServerConfig)
+
+type registryServerConfig struct {
+	username string
+	password string
+	tls      bool
+}
+
+// WithBasicAuth requires every request to carry the given credentials
+func WithBasicAuth(username, password string) RegistryServerOption {
+	return func(c *registryServerConfig) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithTLS serves HTTPS with a certificate signed by a CA generated for the server, see CertDir
+func WithTLS() RegistryServerOption {
+	return func(c *registryServerConfig) {
+		c.tls = true
+	}
+}
+
+// servedImage is one tag of a repository, backed by an OCI layout
+type servedImage struct {
+	repository string
+	tag        string
+	compressed []byte
+
+	once   sync.Once
+	layout string
+	err    error
+}
+
+// NewRegistryServer starts a registry serving every image in Registry(); it is stopped when the test ends
+func NewRegistryServer(t testing.TB, opts ...RegistryServerOption) *RegistryServer {
+	t.Helper()
+
+	cfg := &registryServerConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	s := &RegistryServer{
+		t:        t,
+		images:   map[string]*servedImage{},
+		username: cfg.username,
+		password: cfg.password,
+	}
+
+	for name, data := range Registry() {
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			t.Fatalf("parsing registered image %s: %v", name, err)
+		}
+		tag := "latest"
+		if tagged, ok := named.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+		repository := reference.Path(named)
+		s.images[repository+":"+tag] = &servedImage{repository: repository, tag: tag, compressed: data}
+	}
+
+	s.srv = httptest.NewUnstartedServer(s)
+	if cfg.tls {
+		s.startTLS()
+	} else {
+		s.srv.Start()
+	}
+	t.Cleanup(s.srv.Close)
+
+	return s
+}
+
+// Host is the host:port of the registry
+func (s *RegistryServer) Host() string {
+	return s.srv.Listener.Addr().String()
+}
+
+// Reference returns the reference of a registered image on this registry, like
+// "127.0.0.1:5000/library/alpine:latest" for "docker.io/library/alpine:latest"
+func (s *RegistryServer) Reference(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		s.t.Fatalf("parsing image %s: %v", image, err)
+	}
+	ref := s.Host() + "/" + reference.Path(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref += ":" + tagged.Tag()
+	}
+	return ref
+}
+
+// CertDir is a directory with the CA certificate of a TLS registry as ca.crt, in the layout
+// /etc/containers/certs.d/<host> uses. it is empty for a plain HTTP registry.
+func (s *RegistryServer) CertDir() string {
+	return s.certDir
+}
+
+func (s *RegistryServer) startTLS() {
+	s.t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatalf("generating CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ec1 test registry CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		s.t.Fatalf("creating CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		s.t.Fatalf("parsing CA certificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatalf("generating server key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		s.t.Fatalf("creating server certificate: %v", err)
+	}
+
+	s.certDir = s.t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	if err := os.WriteFile(filepath.Join(s.certDir, "ca.crt"), caPEM, 0644); err != nil {
+		s.t.Fatalf("writing CA certificate: %v", err)
+	}
+
+	s.srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	s.srv.StartTLS()
+}
+
+var (
+	manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPath     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	tagsPath     = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+func (s *RegistryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.username != "" {
+		if u, p, ok := r.BasicAuth(); !ok || u != s.username || p != s.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ec1 test registry"`)
+			registryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	switch path := r.URL.Path; {
+	case path == "/v2/" || path == "/v2":
+		w.WriteHeader(http.StatusOK)
+	case tagsPath.MatchString(path):
+		s.serveTags(w, tagsPath.FindStringSubmatch(path)[1])
+	case manifestPath.MatchString(path):
+		m := manifestPath.FindStringSubmatch(path)
+		s.serveManifest(w, r, m[1], m[2])
+	case blobPath.MatchString(path):
+		m := blobPath.FindStringSubmatch(path)
+		s.serveBlob(w, r, m[1], m[2])
+	default:
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "unknown endpoint")
+	}
+}
+
+// layouts returns the extracted layouts of repository, keyed by tag
+func (s *RegistryServer) layouts(repository string) (map[string]*servedImage, error) {
+	out := map[string]*servedImage{}
+	for _, img := range s.images {
+		if img.repository != repository {
+			continue
+		}
+		img.once.Do(func() {
+			img.layout = s.t.TempDir()
+			img.err = oci.ExtractCompressedOCI(s.t.Context(), img.compressed, img.layout)
+		})
+		if img.err != nil {
+			return nil, img.err
+		}
+		out[img.tag] = img
+	}
+	return out, nil
+}
+
+func (s *RegistryServer) serveTags(w http.ResponseWriter, repository string) {
+	tags := []string{}
+	for _, img := range s.images {
+		if img.repository == repository {
+			tags = append(tags, img.tag)
+		}
+	}
+	if len(tags) == 0 {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": repository, "tags": tags})
+}
+
+func (s *RegistryServer) serveManifest(w http.ResponseWriter, r *http.Request, repository, ref string) {
+	layouts, err := s.layouts(repository)
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	// a tag is the index of its layout, which lists the manifest of every platform
+	if img, ok := layouts[ref]; ok {
+		index, err := layoutIndex(img.layout)
+		if err != nil {
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		serveContent(w, r, v1.MediaTypeImageIndex, index)
+		return
+	}
+
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	for _, img := range layouts {
+		// the index of a tag is fetched again by the digest it was served with
+		if index, err := layoutIndex(img.layout); err == nil && digest.FromBytes(index) == dgst {
+			serveContent(w, r, v1.MediaTypeImageIndex, index)
+			return
+		}
+
+		data, err := os.ReadFile(blobFile(img.layout, dgst))
+		if err != nil {
+			continue
+		}
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil || manifest.MediaType == "" {
+			manifest.MediaType = v1.MediaTypeImageManifest
+		}
+		serveContent(w, r, manifest.MediaType, data)
+		return
+	}
+
+	registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+}
+
+func (s *RegistryServer) serveBlob(w http.ResponseWriter, r *http.Request, repository, ref string) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	layouts, err := s.layouts(repository)
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	for _, img := range layouts {
+		f, err := os.Open(blobFile(img.layout, dgst))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		http.ServeContent(w, r, "", time.Time{}, f)
+		return
+	}
+
+	registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+}
+
+// layoutIndex returns the index.json of a layout without the duplicate entries some layouts carry
+func layoutIndex(layout string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var index v1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	seen := map[digest.Digest]bool{}
+	manifests := []v1.Descriptor{}
+	for _, m := range index.Manifests {
+		if !seen[m.Digest] {
+			seen[m.Digest] = true
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = manifests
+	index.MediaType = v1.MediaTypeImageIndex
+
+	return json.Marshal(index)
+}
+
+func blobFile(layout string, dgst digest.Digest) string {
+	return filepath.Join(layout, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func serveContent(w http.ResponseWriter, r *http.Request, mediaType string, data []byte) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
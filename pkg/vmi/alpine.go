@@ -0,0 +1,189 @@
+package vmi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/provisioner/cloudinit"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+const (
+	AlpineVersion = "3.21.3"
+	AlpineMirror  = "https://dl-cdn.alpinelinux.org/alpine"
+)
+
+var _ Provider = &Alpine{}
+
+// Alpine boots the nocloud cloud image with the virt kernel and initramfs from the netboot release
+// of the same version
+type Alpine struct {
+	*linux
+	cloudInit *cloudinit.NoCloudProvisioner
+}
+
+func NewAlpine(opts Options) (*Alpine, error) {
+	opts, err := opts.withDefaults("alpine", AlpineVersion, AlpineMirror)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Count(opts.Version, ".") != 2 {
+		return nil, errors.Errorf("alpine version %q is not a release like %s", opts.Version, AlpineVersion)
+	}
+
+	base, err := newLinux("alpine", "alpine", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ci, err := cloudinit.NewNoCloudProvisioner(&cloudinit.Config{
+		InstanceID:        "alpine-" + opts.Version,
+		Hostname:          opts.Hostname,
+		SSHAuthorizedKeys: []string{base.AuthorizedKey()},
+		Packages:          []string{"qemu-guest-agent"},
+		RunCmd:            []string{"rc-update add qemu-guest-agent default", "rc-service qemu-guest-agent start"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Alpine{linux: base, cloudInit: ci}, nil
+}
+
+// releases is the directory of the release branch, like v3.21/releases
+func (me *Alpine) releases() string {
+	branch := me.opts.Version[:strings.LastIndex(me.opts.Version, ".")]
+	return fmt.Sprintf("%s/v%s/releases", me.opts.Mirror, branch)
+}
+
+func (me *Alpine) Downloads() map[string]string {
+	arch := me.linuxArch()
+	return map[string]string{
+		"netboot": fmt.Sprintf("%s/%s/alpine-netboot-%s-%s.tar.gz", me.releases(), arch, me.opts.Version, arch),
+		"disk":    fmt.Sprintf("%s/cloud/nocloud_alpine-%s-%s-uefi-cloudinit-r0.qcow2", me.releases(), me.opts.Version, arch),
+	}
+}
+
+// DownloadDigests reads the checksum alpine publishes next to each download
+func (me *Alpine) DownloadDigests(ctx context.Context, client *http.Client) (map[string]digest.Digest, error) {
+	downloads := me.Downloads()
+	published := map[string]digest.Digest{}
+	for name, suffix := range map[string]string{"netboot": ".sha256", "disk": ".sha512"} {
+		sums, err := checksums(ctx, client, downloads[name]+suffix)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(published, sums)
+	}
+	return digestsFor(downloads, published)
+}
+
+func (me *Alpine) ExtractDownloads(ctx context.Context, files map[string]io.Reader) (map[string]io.Reader, error) {
+	defer closeAll(files)
+
+	netboot, err := download(files, "netboot")
+	if err != nil {
+		return nil, err
+	}
+	boot, err := extractTarGz(netboot, "boot/vmlinuz-virt", "boot/initramfs-virt")
+	if err != nil {
+		return nil, errors.Errorf("extracting netboot: %w", err)
+	}
+
+	kernel, err := me.unpackKernel(bytes.NewReader(boot["boot/vmlinuz-virt"]))
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := download(files, "disk")
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := me.rootfsDisk(ctx, disk)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]io.Reader{
+		KernelKey:    kernel,
+		InitramfsKey: bytes.NewReader(boot["boot/initramfs-virt"]),
+		RootfsKey:    rootfs,
+	}, nil
+}
+
+func (me *Alpine) KernelArgs() string {
+	cmdline := me.cmdline()
+	// the uefi image has the efi system partition first
+	cmdline.Set("root", "/dev/vda2")
+	cmdline.Set("rootfstype", "ext4")
+	cmdline.Set("modules", "virtio_blk,ext4")
+	cmdline.Set("rw", "")
+	ds := me.cloudInit.KernelParam()
+	cmdline.Set(ds.Key, ds.Value)
+	return cmdline.String()
+}
+
+func (me *Alpine) BootProvisioners() []vmm.BootProvisioner {
+	return []vmm.BootProvisioner{me.cloudInit}
+}
+
+func (me *Alpine) RuntimeProvisioners() []vmm.RuntimeProvisioner {
+	return runtimeProvisioners()
+}
+
+func (me *Alpine) ShutdownCommand() string {
+	return "doas poweroff"
+}
+
+// extractTarGz reads the named files of a gzipped tarball into memory
+func extractTarGz(r io.Reader, names ...string) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Errorf("opening gzip: %w", err)
+	}
+	defer gz.Close()
+
+	want := map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+
+	found := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for len(found) < len(want) {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("reading tar: %w", err)
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !want[name] || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Errorf("reading %s: %w", name, err)
+		}
+		found[name] = data
+	}
+
+	for _, name := range names {
+		if _, ok := found[name]; !ok {
+			return nil, errors.Errorf("%s not found in archive", name)
+		}
+	}
+	return found, nil
+}
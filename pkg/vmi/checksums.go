@@ -0,0 +1,122 @@
+package vmi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+)
+
+// maxChecksumsSize bounds the checksum files and build metadata read from mirrors
+const maxChecksumsSize = 4 << 20
+
+func fetch(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Errorf("creating request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxChecksumsSize))
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", url, err)
+	}
+	return data, nil
+}
+
+// parseChecksums reads the output of sha256sum or sha512sum, mapping file names to digests
+func parseChecksums(data []byte) (map[string]digest.Digest, error) {
+	digests := map[string]digest.Digest{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		algorithm := digest.SHA256
+		if len(fields[0]) == digest.SHA512.Size()*2 {
+			algorithm = digest.SHA512
+		}
+		dgst := digest.NewDigestFromEncoded(algorithm, strings.ToLower(fields[0]))
+		if err := dgst.Validate(); err != nil {
+			return nil, errors.Errorf("checksum of %s: %w", fields[1], err)
+		}
+
+		// binary mode marks names with a *
+		digests[path.Base(strings.TrimPrefix(fields[1], "*"))] = dgst
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf("reading checksums: %w", err)
+	}
+	return digests, nil
+}
+
+// checksums fetches a checksum file, like SHA256SUMS or the .sha256 file published next to a download
+func checksums(ctx context.Context, client *http.Client, url string) (map[string]digest.Digest, error) {
+	data, err := fetch(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(data)
+}
+
+// digestsFor maps download names to the digests published for the files their urls point at
+func digestsFor(downloads map[string]string, published map[string]digest.Digest) (map[string]digest.Digest, error) {
+	digests := make(map[string]digest.Digest, len(downloads))
+	for name, url := range downloads {
+		dgst, ok := published[path.Base(url)]
+		if !ok {
+			return nil, errors.Errorf("no published checksum for %s", path.Base(url))
+		}
+		digests[name] = dgst
+	}
+	return digests, nil
+}
+
+// buildMeta is the meta.json of a coreos build, listing the artifacts with their checksums
+type buildMeta struct {
+	Images map[string]buildImage `json:"images"`
+}
+
+type buildImage struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+}
+
+func parseBuildMeta(data []byte) (map[string]digest.Digest, error) {
+	var meta buildMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, errors.Errorf("decoding build metadata: %w", err)
+	}
+
+	digests := map[string]digest.Digest{}
+	for name, image := range meta.Images {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, image.Sha256)
+		if err := dgst.Validate(); err != nil {
+			return nil, errors.Errorf("checksum of %s: %w", name, err)
+		}
+		digests[path.Base(image.Path)] = dgst
+	}
+	return digests, nil
+}
@@ -0,0 +1,139 @@
+package vmi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	types_exp "github.com/coreos/ignition/v2/config/v3_6_experimental/types"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+const (
+	FedoraCoreOSVersion = "42.20250512.3.0"
+	FedoraCoreOSMirror  = "https://builds.coreos.fedoraproject.org/prod/streams/stable/builds"
+)
+
+var _ Provider = &FedoraCoreOS{}
+
+// FedoraCoreOS live boots a stable build from its pxe artifacts, with the rootfs appended to the
+// initramfs. ignition provisions the core user on every boot, since nothing is persisted.
+type FedoraCoreOS struct {
+	*linux
+}
+
+func NewFedoraCoreOS(opts Options) (*FedoraCoreOS, error) {
+	opts, err := opts.withDefaults("fedora-coreos", FedoraCoreOSVersion, FedoraCoreOSMirror)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := newLinux("fedora-coreos", "core", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FedoraCoreOS{linux: base}, nil
+}
+
+func (me *FedoraCoreOS) build() string {
+	return fmt.Sprintf("%s/%s/%s", me.opts.Mirror, me.opts.Version, me.linuxArch())
+}
+
+func (me *FedoraCoreOS) Downloads() map[string]string {
+	prefix := fmt.Sprintf("%s/fedora-coreos-%s-live", me.build(), me.opts.Version)
+	arch := me.linuxArch()
+	return map[string]string{
+		"live-kernel":    fmt.Sprintf("%s-kernel.%s", prefix, arch),
+		"live-initramfs": fmt.Sprintf("%s-initramfs.%s.img", prefix, arch),
+		"live-rootfs":    fmt.Sprintf("%s-rootfs.%s.img", prefix, arch),
+	}
+}
+
+// DownloadDigests reads the checksums from the meta.json of the build
+func (me *FedoraCoreOS) DownloadDigests(ctx context.Context, client *http.Client) (map[string]digest.Digest, error) {
+	data, err := fetch(ctx, client, me.build()+"/meta.json")
+	if err != nil {
+		return nil, err
+	}
+	published, err := parseBuildMeta(data)
+	if err != nil {
+		return nil, err
+	}
+	return digestsFor(me.Downloads(), published)
+}
+
+func (me *FedoraCoreOS) ExtractDownloads(ctx context.Context, files map[string]io.Reader) (map[string]io.Reader, error) {
+	defer closeAll(files)
+
+	liveKernel, err := download(files, "live-kernel")
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := me.unpackKernel(liveKernel)
+	if err != nil {
+		return nil, err
+	}
+
+	// the live initramfs finds the rootfs image when it is appended as another cpio archive. both are
+	// streamed from the downloads, which the initramfs now owns, rather than read into memory.
+	var parts []io.Reader
+	for _, name := range []string{"live-initramfs", "live-rootfs"} {
+		r, err := download(files, name)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, r)
+	}
+	delete(files, "live-initramfs")
+	delete(files, "live-rootfs")
+
+	return map[string]io.Reader{
+		KernelKey:    kernel,
+		InitramfsKey: concat(parts...),
+	}, nil
+}
+
+// Rootfs returns ErrNoRootfs, the live system runs from the initramfs
+func (me *FedoraCoreOS) Rootfs(ctx context.Context, mem map[string]io.Reader) (io.ReadCloser, error) {
+	return nil, ErrNoRootfs
+}
+
+func (me *FedoraCoreOS) KernelArgs() string {
+	cmdline := me.cmdline()
+	cmdline.Set("ignition.firstboot", "")
+	// the applehv platform fetches the config from the ignition provisioner over vsock
+	cmdline.Set("ignition.platform.id", "applehv")
+	return cmdline.String()
+}
+
+// IgnitionConfig authorizes the ssh key for the core user
+func (me *FedoraCoreOS) IgnitionConfig() *types_exp.Config {
+	return &types_exp.Config{
+		Ignition: types_exp.Ignition{Version: types_exp.MaxVersion.String()},
+		Passwd: types_exp.Passwd{
+			Users: []types_exp.PasswdUser{{
+				Name:              me.user,
+				SSHAuthorizedKeys: []types_exp.SSHAuthorizedKey{types_exp.SSHAuthorizedKey(me.AuthorizedKey())},
+			}},
+		},
+	}
+}
+
+// BootProvisioners serves the ignition config, which needs the Virtualization Framework vsock
+func (me *FedoraCoreOS) BootProvisioners() []vmm.BootProvisioner {
+	if p := ignitionProvisioner(me.IgnitionConfig()); p != nil {
+		return []vmm.BootProvisioner{p}
+	}
+	return nil
+}
+
+func (me *FedoraCoreOS) RuntimeProvisioners() []vmm.RuntimeProvisioner {
+	return runtimeProvisioners()
+}
+
+func (me *FedoraCoreOS) ShutdownCommand() string {
+	return "sudo systemctl poweroff"
+}
@@ -0,0 +1,222 @@
+package vmi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/xid"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/guest"
+	"github.com/walteh/ec1/pkg/kernel"
+	"github.com/walteh/ec1/pkg/magic"
+	"github.com/walteh/ec1/pkg/units"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+// linux holds what the providers share: identity, the ssh key provisioned into the guest and access
+// to the extracted files
+type linux struct {
+	name string
+	opts Options
+	user string
+	// owner of the disk copies of this VM in opts.Disks
+	owner string
+
+	signer ssh.Signer
+}
+
+func newLinux(name, user string, opts Options) (*linux, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Errorf("generating ssh key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Errorf("creating ssh signer: %w", err)
+	}
+	return &linux{name: name, opts: opts, user: user, owner: name + "-" + xid.New().String(), signer: signer}, nil
+}
+
+func (me *linux) Name() string {
+	return me.name
+}
+
+func (me *linux) Version() string {
+	return me.opts.Version
+}
+
+func (me *linux) GuestKernelType() guest.GuestKernelType {
+	return guest.GuestKernelTypeLinux
+}
+
+// InitScript is empty, cloud images configure themselves through their boot provisioners
+func (me *linux) InitScript(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// AuthorizedKey is the public key provisioned for the default user, in authorized_keys format
+func (me *linux) AuthorizedKey() string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(me.signer.PublicKey())))
+}
+
+func (me *linux) SSHConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: me.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(me.signer)},
+		// the host key is generated on first boot, and the guest is only reachable through the vm network
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+}
+
+func (me *linux) Kernel(ctx context.Context, mem map[string]io.Reader) (io.ReadCloser, error) {
+	return extracted(mem, KernelKey)
+}
+
+func (me *linux) Initramfs(ctx context.Context, mem map[string]io.Reader) (io.ReadCloser, error) {
+	return extracted(mem, InitramfsKey)
+}
+
+func (me *linux) Rootfs(ctx context.Context, mem map[string]io.Reader) (io.ReadCloser, error) {
+	return extracted(mem, RootfsKey)
+}
+
+// cmdline starts the kernel command line of the image on its console
+func (me *linux) cmdline() *kernel.CmdLine {
+	cmdline := &kernel.CmdLine{}
+	cmdline.SetConsole(me.opts.Arch, kernel.ConsoleVirtio)
+	return cmdline
+}
+
+// linuxArch is the name distributions use for the architecture
+func (me *linux) linuxArch() string {
+	if me.opts.Arch == units.ArchARM64 {
+		return "aarch64"
+	}
+	return "x86_64"
+}
+
+func extracted(mem map[string]io.Reader, key string) (io.ReadCloser, error) {
+	r, ok := mem[key]
+	if !ok {
+		return nil, errors.Errorf("%s was not extracted", key)
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// download returns a downloaded file, ExtractDownloads takes ownership of them
+func download(files map[string]io.Reader, name string) (io.Reader, error) {
+	r, ok := files[name]
+	if !ok {
+		return nil, errors.Errorf("%s was not downloaded", name)
+	}
+	return r, nil
+}
+
+// closeAll closes the downloaded files, what ExtractDownloads returns is opened separately or removed
+// from files
+func closeAll(files map[string]io.Reader) {
+	for _, r := range files {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// runtimeProvisioners syncs the guest clock after the host sleeps, where the platform supports it
+func runtimeProvisioners() []vmm.RuntimeProvisioner {
+	if p := timesyncProvisioner(); p != nil {
+		return []vmm.RuntimeProvisioner{p}
+	}
+	return nil
+}
+
+// unpackKernel reads the kernel into memory, unpacked so backend boots it directly
+func (me *linux) unpackKernel(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Errorf("reading kernel: %w", err)
+	}
+
+	img, unpacked, err := kernel.Unpack(bytes.NewReader(data), me.opts.Backend)
+	if err != nil {
+		return nil, errors.Errorf("unpacking kernel: %w", err)
+	}
+	if err := img.Validate(me.opts.Arch, me.opts.Backend); err != nil {
+		return nil, err
+	}
+	// the reader it was given or one over the decompressed payload
+	return unpacked.(*bytes.Reader), nil
+}
+
+// rootfsDisk copies a downloaded disk image for this VM to boot read-write, leaving the download and the
+// base it is imported to untouched. qcow2 images are imported to a raw base once.
+func (me *linux) rootfsDisk(ctx context.Context, r io.Reader) (io.Reader, error) {
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil, errors.Errorf("disk images are copied from files, not %T", r)
+	}
+
+	head := make([]byte, len(magic.Qcow2Magic))
+	if _, err := f.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, errors.Errorf("reading disk header: %w", err)
+	}
+
+	base := f.Name()
+	if magic.Qcow2Magic.Matches(head, 0) {
+		var err error
+		base, err = me.opts.Disks.ImportQcow2(ctx, base)
+		if err != nil {
+			return nil, errors.Errorf("importing disk: %w", err)
+		}
+	}
+
+	clone, err := me.opts.Disks.Clone(ctx, base, me.owner, RootfsKey)
+	if err != nil {
+		return nil, errors.Errorf("copying disk: %w", err)
+	}
+	return openFile(clone.Path)
+}
+
+// ReleaseDisks removes the copies of the disk image made for this VM, once it has stopped
+func (me *linux) ReleaseDisks(ctx context.Context) error {
+	return me.opts.Disks.Release(ctx, me.owner)
+}
+
+// concatenated reads readers one after the other and closes all of them
+type concatenated struct {
+	io.Reader
+	readers []io.Reader
+}
+
+func concat(readers ...io.Reader) io.ReadCloser {
+	return &concatenated{Reader: io.MultiReader(readers...), readers: readers}
+}
+
+func (c *concatenated) Close() error {
+	for _, r := range c.readers {
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+	}
+	return nil
+}
+
+func openFile(path string) (io.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("opening file: %w", err)
+	}
+	return f, nil
+}
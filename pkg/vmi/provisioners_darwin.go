@@ -0,0 +1,19 @@
+//go:build darwin
+
+package vmi
+
+import (
+	types_exp "github.com/coreos/ignition/v2/config/v3_6_experimental/types"
+
+	"github.com/walteh/ec1/pkg/provisioner/ignition"
+	"github.com/walteh/ec1/pkg/provisioner/qemuguestagent"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+func ignitionProvisioner(cfg *types_exp.Config) vmm.BootProvisioner {
+	return ignition.NewIgnitionBootConfigProvider(cfg)
+}
+
+func timesyncProvisioner() vmm.RuntimeProvisioner {
+	return &qemuguestagent.QemuGuestAgentTimesyncProvisioner{}
+}
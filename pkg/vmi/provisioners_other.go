@@ -0,0 +1,19 @@
+//go:build !darwin
+
+package vmi
+
+import (
+	types_exp "github.com/coreos/ignition/v2/config/v3_6_experimental/types"
+
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+// the ignition and guest agent provisioners talk to the guest over the Virtualization Framework vsock
+
+func ignitionProvisioner(cfg *types_exp.Config) vmm.BootProvisioner {
+	return nil
+}
+
+func timesyncProvisioner() vmm.RuntimeProvisioner {
+	return nil
+}
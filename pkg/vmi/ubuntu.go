@@ -0,0 +1,151 @@
+package vmi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/provisioner/cloudinit"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+const (
+	UbuntuVersion = "24.04"
+	UbuntuMirror  = "https://cloud-images.ubuntu.com/releases"
+)
+
+// ubuntuCodenames are the releases cloud images are published under
+var ubuntuCodenames = map[string]string{
+	"22.04": "jammy",
+	"24.04": "noble",
+	"25.04": "plucky",
+}
+
+var _ Provider = &Ubuntu{}
+
+// Ubuntu boots the server cloud image of a release with the kernel and initrd published unpacked
+// next to it. the latest build of the release is used, verified against its SHA256SUMS.
+type Ubuntu struct {
+	*linux
+	codename  string
+	cloudInit *cloudinit.NoCloudProvisioner
+}
+
+func NewUbuntu(opts Options) (*Ubuntu, error) {
+	opts, err := opts.withDefaults("ubuntu", UbuntuVersion, UbuntuMirror)
+	if err != nil {
+		return nil, err
+	}
+	codename, ok := ubuntuCodenames[opts.Version]
+	if !ok {
+		return nil, errors.Errorf("no ubuntu cloud images for %q", opts.Version)
+	}
+
+	base, err := newLinux("ubuntu", "ubuntu", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ci, err := cloudinit.NewNoCloudProvisioner(&cloudinit.Config{
+		InstanceID:        "ubuntu-" + opts.Version,
+		Hostname:          opts.Hostname,
+		SSHAuthorizedKeys: []string{base.AuthorizedKey()},
+		Packages:          []string{"qemu-guest-agent"},
+		RunCmd:            []string{"systemctl enable --now qemu-guest-agent"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ubuntu{linux: base, codename: codename, cloudInit: ci}, nil
+}
+
+func (me *Ubuntu) release() string {
+	return fmt.Sprintf("%s/%s/release", me.opts.Mirror, me.codename)
+}
+
+func (me *Ubuntu) Downloads() map[string]string {
+	prefix := fmt.Sprintf("ubuntu-%s-server-cloudimg-%s", me.opts.Version, me.opts.Arch)
+	return map[string]string{
+		"vmlinuz": fmt.Sprintf("%s/unpacked/%s-vmlinuz-generic", me.release(), prefix),
+		"initrd":  fmt.Sprintf("%s/unpacked/%s-initrd-generic", me.release(), prefix),
+		"disk":    fmt.Sprintf("%s/%s.img", me.release(), prefix),
+	}
+}
+
+// DownloadDigests reads the SHA256SUMS of the release and of its unpacked directory
+func (me *Ubuntu) DownloadDigests(ctx context.Context, client *http.Client) (map[string]digest.Digest, error) {
+	published := map[string]digest.Digest{}
+	for _, dir := range []string{me.release(), me.release() + "/unpacked"} {
+		sums, err := checksums(ctx, client, dir+"/SHA256SUMS")
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(published, sums)
+	}
+	return digestsFor(me.Downloads(), published)
+}
+
+func (me *Ubuntu) ExtractDownloads(ctx context.Context, files map[string]io.Reader) (map[string]io.Reader, error) {
+	defer closeAll(files)
+
+	vmlinuz, err := download(files, "vmlinuz")
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := me.unpackKernel(vmlinuz)
+	if err != nil {
+		return nil, err
+	}
+
+	initrd, err := download(files, "initrd")
+	if err != nil {
+		return nil, err
+	}
+	initramfs, err := io.ReadAll(initrd)
+	if err != nil {
+		return nil, errors.Errorf("reading initrd: %w", err)
+	}
+
+	disk, err := download(files, "disk")
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := me.rootfsDisk(ctx, disk)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]io.Reader{
+		KernelKey:    kernel,
+		InitramfsKey: bytes.NewReader(initramfs),
+		RootfsKey:    rootfs,
+	}, nil
+}
+
+func (me *Ubuntu) KernelArgs() string {
+	cmdline := me.cmdline()
+	cmdline.Set("root", "LABEL=cloudimg-rootfs")
+	cmdline.Set("ro", "")
+	ds := me.cloudInit.KernelParam()
+	cmdline.Set(ds.Key, ds.Value)
+	return cmdline.String()
+}
+
+func (me *Ubuntu) BootProvisioners() []vmm.BootProvisioner {
+	return []vmm.BootProvisioner{me.cloudInit}
+}
+
+func (me *Ubuntu) RuntimeProvisioners() []vmm.RuntimeProvisioner {
+	return runtimeProvisioners()
+}
+
+func (me *Ubuntu) ShutdownCommand() string {
+	return "sudo poweroff"
+}
@@ -0,0 +1,148 @@
+// Package vmi provides built in VM images for common cloud distributions. each provider downloads a
+// published release, boots its kernel directly and provisions ssh access on first boot.
+package vmi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/disk"
+	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/kernel"
+	"github.com/walteh/ec1/pkg/units"
+	"github.com/walteh/ec1/pkg/vmm"
+)
+
+var (
+	ErrUnknownImage = errors.New("unknown vm image")
+	// ErrNoRootfs is returned by providers that run from memory
+	ErrNoRootfs = errors.New("image has no rootfs")
+)
+
+// the keys ExtractDownloads returns
+const (
+	KernelKey    = "kernel"
+	InitramfsKey = "initramfs"
+	RootfsKey    = "rootfs"
+)
+
+// Provider is a linux image that can be downloaded and verified
+type Provider interface {
+	vmm.VMIProvider
+	vmm.DownloadableVMIProvider
+	vmm.LinuxVMIProvider2
+	DigestProvider
+}
+
+// DigestProvider is a provider whose distribution publishes checksums for its downloads
+type DigestProvider interface {
+	DownloadDigests(ctx context.Context, client *http.Client) (map[string]digest.Digest, error)
+}
+
+// Options configure a provider
+type Options struct {
+	// Version of the release, defaults to a recent one for each distribution
+	Version string
+	// Arch is the GOARCH of the guest, defaults to runtime.GOARCH
+	Arch string
+	// Mirror replaces the base url of the distribution
+	Mirror string
+	// Backend the kernel is unpacked for, defaults to the Virtualization Framework
+	Backend kernel.Backend
+	// Hostname of the guest, defaults to the image name
+	Hostname string
+	// Disks holds the base image and the copy each VM boots, defaults to the ec1 cache directory
+	Disks *disk.Manager
+}
+
+func (opts Options) withDefaults(name, version, mirror string) (Options, error) {
+	if opts.Version == "" {
+		opts.Version = version
+	}
+	if opts.Arch == "" {
+		opts.Arch = runtime.GOARCH
+	}
+	if opts.Arch != units.ArchARM64 && opts.Arch != units.ArchAMD64 {
+		return opts, errors.Errorf("%s images are not built for %s", name, opts.Arch)
+	}
+	if opts.Mirror == "" {
+		opts.Mirror = mirror
+	}
+	opts.Mirror = strings.TrimSuffix(opts.Mirror, "/")
+	if opts.Backend == "" {
+		opts.Backend = kernel.BackendVirtualizationFramework
+	}
+	if opts.Hostname == "" {
+		opts.Hostname = name
+	}
+	if opts.Disks == nil {
+		disks, err := disk.NewDefaultManager()
+		if err != nil {
+			return opts, errors.Errorf("creating disk manager: %w", err)
+		}
+		opts.Disks = disks
+	}
+	return opts, nil
+}
+
+// Lookup returns the provider for an image name like alpine, ubuntu:24.04 or fedora-coreos. a version
+// in the name takes precedence over opts.Version.
+func Lookup(name string, opts Options) (Provider, error) {
+	name, version, ok := strings.Cut(name, ":")
+	if ok {
+		opts.Version = version
+	}
+
+	switch name {
+	case "alpine":
+		return NewAlpine(opts)
+	case "ubuntu":
+		return NewUbuntu(opts)
+	case "fedora-coreos", "fcos":
+		return NewFedoraCoreOS(opts)
+	}
+	return nil, errors.Errorf("%w: %q", ErrUnknownImage, name)
+}
+
+// Download fetches the files of p into the cache of d, verified against the digests the distribution
+// publishes, and extracts them
+func Download(ctx context.Context, d *host.Downloader, p vmm.DownloadableVMIProvider) (map[string]io.Reader, error) {
+	var digests map[string]digest.Digest
+	if dp, ok := p.(DigestProvider); ok {
+		var err error
+		digests, err = dp.DownloadDigests(ctx, d.Client)
+		if err != nil {
+			return nil, errors.Errorf("getting download digests: %w", err)
+		}
+	}
+
+	downloads := make([]host.VMIDownload, 0, len(p.Downloads()))
+	for name, url := range p.Downloads() {
+		dl := host.VMIDownload{Name: name, URL: url}
+		if digests != nil {
+			if dl.Digest = digests[name]; dl.Digest == "" {
+				return nil, errors.Errorf("no published digest for %s", url)
+			}
+		}
+		downloads = append(downloads, dl)
+	}
+	slices.SortFunc(downloads, func(a, b host.VMIDownload) int { return strings.Compare(a.Name, b.Name) })
+
+	files, err := d.Open(ctx, downloads)
+	if err != nil {
+		return nil, errors.Errorf("downloading: %w", err)
+	}
+
+	extracted, err := p.ExtractDownloads(ctx, files)
+	if err != nil {
+		return nil, errors.Errorf("extracting downloads: %w", err)
+	}
+	return extracted, nil
+}
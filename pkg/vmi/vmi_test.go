@@ -0,0 +1,284 @@
+package vmi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/disk"
+	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/kernel"
+	"github.com/walteh/ec1/pkg/magic"
+)
+
+// mirror serves files by path, like a distribution mirror
+type mirror struct {
+	*httptest.Server
+	files map[string][]byte
+}
+
+func newMirror(t *testing.T) *mirror {
+	m := &mirror{files: map[string][]byte{}}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := m.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Unix(0, 0), bytes.NewReader(data))
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// add serves data at the path of a download url
+func (m *mirror) add(t *testing.T, rawURL string, data []byte) {
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	m.files[u.Path] = data
+}
+
+func arm64Image() []byte {
+	image := make([]byte, 4096)
+	copy(image[magic.ARM64MagicOffset:], magic.ARM64Magic)
+	return image
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return gzipped(t, buf.Bytes())
+}
+
+func readAll(t *testing.T, r io.Reader) []byte {
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	if c, ok := r.(io.Closer); ok {
+		require.NoError(t, c.Close())
+	}
+	return data
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		version string
+	}{
+		{"alpine", "alpine", AlpineVersion},
+		{"alpine", "alpine:3.20.6", "3.20.6"},
+		{"ubuntu", "ubuntu:22.04", "22.04"},
+		{"fedora-coreos", "fcos", FedoraCoreOSVersion},
+	}
+
+	for _, tt := range tests {
+		p, err := Lookup(tt.image, Options{Arch: "arm64"})
+		require.NoError(t, err, tt.image)
+		assert.Equal(t, tt.name, p.Name())
+		assert.Equal(t, tt.version, p.Version())
+		assert.NotEmpty(t, p.ShutdownCommand())
+		assert.Len(t, p.SSHConfig().Auth, 1)
+	}
+
+	_, err := Lookup("gentoo", Options{})
+	require.ErrorIs(t, err, ErrUnknownImage)
+
+	_, err = Lookup("ubuntu:23.10", Options{})
+	require.ErrorContains(t, err, `no ubuntu cloud images for "23.10"`)
+
+	_, err = Lookup("alpine", Options{Arch: "riscv64"})
+	require.ErrorContains(t, err, "alpine images are not built for riscv64")
+}
+
+func TestParseChecksums(t *testing.T) {
+	sha256sum := sha256.Sum256([]byte("a"))
+	sha512sum := sha512.Sum512([]byte("b"))
+
+	digests, err := parseChecksums([]byte(fmt.Sprintf("%s *dir/a.img\n%s  b.tar.gz\n\n",
+		hex.EncodeToString(sha256sum[:]), hex.EncodeToString(sha512sum[:]))))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]digest.Digest{
+		"a.img":    digest.FromString("a"),
+		"b.tar.gz": digest.SHA512.FromString("b"),
+	}, digests)
+
+	_, err = parseChecksums([]byte("not-hex a.img\n"))
+	require.Error(t, err)
+}
+
+func TestAlpineDownloadsAreVerifiedAndExtracted(t *testing.T) {
+	ctx := context.Background()
+	m := newMirror(t)
+
+	disks := disk.NewManager(t.TempDir())
+	p, err := NewAlpine(Options{Arch: "arm64", Mirror: m.URL + "/", Disks: disks})
+	require.NoError(t, err)
+
+	downloads := p.Downloads()
+	assert.Equal(t, m.URL+"/v3.21/releases/aarch64/alpine-netboot-3.21.3-aarch64.tar.gz", downloads["netboot"])
+
+	netboot := tarGz(t, map[string][]byte{
+		"boot/vmlinuz-virt":   gzipped(t, arm64Image()),
+		"boot/initramfs-virt": []byte("initramfs"),
+		"boot/modloop-virt":   []byte("modloop"),
+	})
+	disk := []byte("a raw disk image")
+	m.add(t, downloads["netboot"], netboot)
+	m.add(t, downloads["disk"], disk)
+
+	sha256sum := sha256.Sum256(netboot)
+	m.add(t, downloads["netboot"]+".sha256", []byte(hex.EncodeToString(sha256sum[:])+"  alpine-netboot-3.21.3-aarch64.tar.gz\n"))
+	sha512sum := sha512.Sum512([]byte("a different disk"))
+	m.add(t, downloads["disk"]+".sha512", []byte(hex.EncodeToString(sha512sum[:])+"  nocloud_alpine-3.21.3-aarch64-uefi-cloudinit-r0.qcow2\n"))
+
+	d := &host.Downloader{Dir: t.TempDir(), Backoff: time.Millisecond}
+
+	_, err = Download(ctx, d, p)
+	require.ErrorIs(t, err, host.ErrDigestMismatch)
+
+	sha512sum = sha512.Sum512(disk)
+	m.add(t, downloads["disk"]+".sha512", []byte(hex.EncodeToString(sha512sum[:])+"  nocloud_alpine-3.21.3-aarch64-uefi-cloudinit-r0.qcow2\n"))
+
+	mem, err := Download(ctx, d, p)
+	require.NoError(t, err)
+
+	k, err := p.Kernel(ctx, mem)
+	require.NoError(t, err)
+	assert.Equal(t, arm64Image(), readAll(t, k), "the kernel is decompressed for the Virtualization Framework")
+
+	initramfs, err := p.Initramfs(ctx, mem)
+	require.NoError(t, err)
+	assert.Equal(t, "initramfs", string(readAll(t, initramfs)))
+
+	rootfs, err := p.Rootfs(ctx, mem)
+	require.NoError(t, err)
+	rootfsPath := rootfs.(*os.File).Name()
+	assert.Equal(t, disk, readAll(t, rootfs))
+
+	// the vm boots its own copy of the disk read-write, the cached download stays as it was
+	assert.Equal(t, filepath.Join(disks.Root(), "clones", p.owner, "rootfs.raw"), rootfsPath)
+	require.NoError(t, os.WriteFile(rootfsPath, []byte("written by the vm"), 0644))
+
+	mem, err = Download(ctx, d, p)
+	require.NoError(t, err)
+	rootfs, err = p.Rootfs(ctx, mem)
+	require.NoError(t, err)
+	assert.Equal(t, disk, readAll(t, rootfs))
+
+	require.NoError(t, p.ReleaseDisks(ctx))
+	assert.NoFileExists(t, rootfsPath)
+
+	assert.Contains(t, p.KernelArgs(), "ds=nocloud;s=http://192.168.127.254:")
+	assert.Len(t, p.BootProvisioners(), 1)
+}
+
+func TestUbuntuDigestsFromSHA256SUMS(t *testing.T) {
+	ctx := context.Background()
+	m := newMirror(t)
+
+	p, err := NewUbuntu(Options{Arch: "amd64", Mirror: m.URL})
+	require.NoError(t, err)
+
+	downloads := p.Downloads()
+	assert.Equal(t, m.URL+"/noble/release/unpacked/ubuntu-24.04-server-cloudimg-amd64-vmlinuz-generic", downloads["vmlinuz"])
+
+	sums := func(names ...string) []byte {
+		var buf bytes.Buffer
+		for _, name := range names {
+			sum := sha256.Sum256([]byte(name))
+			fmt.Fprintf(&buf, "%s *%s\n", hex.EncodeToString(sum[:]), name)
+		}
+		return buf.Bytes()
+	}
+	m.files["/noble/release/SHA256SUMS"] = sums("ubuntu-24.04-server-cloudimg-amd64.img", "ubuntu-24.04-server-cloudimg-arm64.img")
+	m.files["/noble/release/unpacked/SHA256SUMS"] = sums("ubuntu-24.04-server-cloudimg-amd64-vmlinuz-generic")
+
+	_, err = p.DownloadDigests(ctx, nil)
+	require.ErrorContains(t, err, "no published checksum for ubuntu-24.04-server-cloudimg-amd64-initrd-generic")
+
+	m.files["/noble/release/unpacked/SHA256SUMS"] = sums("ubuntu-24.04-server-cloudimg-amd64-vmlinuz-generic", "ubuntu-24.04-server-cloudimg-amd64-initrd-generic")
+
+	digests, err := p.DownloadDigests(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]digest.Digest{
+		"vmlinuz": digest.FromString("ubuntu-24.04-server-cloudimg-amd64-vmlinuz-generic"),
+		"initrd":  digest.FromString("ubuntu-24.04-server-cloudimg-amd64-initrd-generic"),
+		"disk":    digest.FromString("ubuntu-24.04-server-cloudimg-amd64.img"),
+	}, digests)
+}
+
+func TestFedoraCoreOSLiveBoot(t *testing.T) {
+	ctx := context.Background()
+	m := newMirror(t)
+
+	p, err := NewFedoraCoreOS(Options{Arch: "arm64", Mirror: m.URL, Backend: kernel.BackendLibkrun})
+	require.NoError(t, err)
+
+	files := map[string][]byte{
+		"live-kernel":    gzipped(t, arm64Image()),
+		"live-initramfs": []byte("initramfs"),
+		"live-rootfs":    []byte("rootfs"),
+	}
+	meta := buildMeta{Images: map[string]buildImage{}}
+	for name, url := range p.Downloads() {
+		m.add(t, url, files[name])
+		meta.Images[name] = buildImage{Path: path.Base(url), Sha256: digest.FromBytes(files[name]).Encoded()}
+	}
+	data, err := json.Marshal(meta)
+	require.NoError(t, err)
+	m.add(t, p.build()+"/meta.json", data)
+
+	mem, err := Download(ctx, &host.Downloader{Dir: t.TempDir()}, p)
+	require.NoError(t, err)
+
+	k, err := p.Kernel(ctx, mem)
+	require.NoError(t, err)
+	assert.Equal(t, files["live-kernel"], readAll(t, k), "libkrun boots the compressed kernel as it is")
+
+	initramfs, err := p.Initramfs(ctx, mem)
+	require.NoError(t, err)
+	assert.Equal(t, "initramfsrootfs", string(readAll(t, initramfs)))
+
+	_, err = p.Rootfs(ctx, mem)
+	require.ErrorIs(t, err, ErrNoRootfs)
+
+	cfg := p.IgnitionConfig()
+	require.Len(t, cfg.Passwd.Users, 1)
+	assert.Equal(t, "core", cfg.Passwd.Users[0].Name)
+	assert.EqualValues(t, p.AuthorizedKey(), cfg.Passwd.Users[0].SSHAuthorizedKeys[0])
+	assert.Equal(t, "core", p.SSHConfig().User)
+}
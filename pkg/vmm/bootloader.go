@@ -4,11 +4,13 @@ import (
 	"context"
 	"io"
 	"log/slog"
+	"maps"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
-
-	"golang.org/x/sync/errgroup"
+	"unicode"
 
 	"gitlab.com/tozd/go/errors"
 
@@ -17,17 +19,31 @@ import (
 	"github.com/walteh/ec1/gen/harpoon/harpoon_vmlinux_amd64"
 	"github.com/walteh/ec1/gen/harpoon/harpoon_vmlinux_arm64"
 	"github.com/walteh/ec1/pkg/binembed"
-	"github.com/walteh/ec1/pkg/ext/osx"
+	"github.com/walteh/ec1/pkg/initramfs"
+	"github.com/walteh/ec1/pkg/kernel"
+	"github.com/walteh/ec1/pkg/oci"
 	"github.com/walteh/ec1/pkg/units"
 	"github.com/walteh/ec1/pkg/virtio"
 )
 
+// KernelCmdLineAnnotation holds kernel parameters merged into the command line of a container vm, with
+// init arguments after --
+const KernelCmdLineAnnotation = "ec1.harpoon.kernel.cmdline"
+
+// KernelModulesAnnotation names the kernel modules injected into the initramfs of a container vm and
+// loaded by harpoond at boot, separated by commas or spaces
+const KernelModulesAnnotation = "ec1.harpoon.kernel.modules"
+
+// KernelModulesPathAnnotation is the directory or tarball holding the modules tree of the harpoon kernel
+// that KernelModulesAnnotation is resolved from, relative to the kernel modules directory of the host
+const KernelModulesPathAnnotation = "ec1.harpoon.kernel.modules.path"
+
 // LinuxBootloader determines which kernel/initrd/kernel args to use when starting
 // the virtual machine.
 type LinuxBootloader struct {
-	VmlinuzPath   string `json:"vmlinuzPath"`
-	KernelCmdLine string `json:"kernelCmdLine"`
-	InitrdPath    string `json:"initrdPath"`
+	VmlinuzPath   string          `json:"vmlinuzPath"`
+	KernelCmdLine *kernel.CmdLine `json:"kernelCmdLine"`
+	InitrdPath    string          `json:"initrdPath"`
 }
 
 // EFIBootloader allows to set a few options related to EFI variable storage
@@ -62,91 +78,212 @@ func (bootloader *LinuxBootloader) isBootloader() {}
 func (bootloader *EFIBootloader) isBootloader()   {}
 func (bootloader *MacOSBootloader) isBootloader() {}
 
-func PrepareHarpoonLinuxBootloader(ctx context.Context, wrkdir string, platform units.Platform) (Bootloader, []virtio.VirtioDevice, error) {
-	groupErrs := errgroup.Group{}
-
-	bl, bldevs, err := PrepareHarpoonLinuxBootloaderAsync(ctx, wrkdir, platform, &groupErrs)
+// KernelCmdLineFromAnnotations reads the kernel parameters a container adds to its vm
+func KernelCmdLineFromAnnotations(annotations map[string]string) (*kernel.CmdLine, error) {
+	cmdline, err := kernel.ParseCmdLine(annotations[KernelCmdLineAnnotation])
 	if err != nil {
-		return nil, nil, errors.Errorf("getting boot loader config: %w", err)
+		return nil, errors.Errorf("invalid %s annotation: %w", KernelCmdLineAnnotation, err)
 	}
-
-	err = groupErrs.Wait()
-	if err != nil {
-		return nil, nil, errors.Errorf("error waiting for errgroup: %w", err)
+	if err := cmdline.Validate(); err != nil {
+		return nil, errors.Errorf("invalid %s annotation: %w", KernelCmdLineAnnotation, err)
 	}
-
-	return bl, bldevs, nil
+	return cmdline, nil
 }
 
-func init() {
-	go binembed.GetDecompressed(harpoon_initramfs_arm64.BinaryXZChecksum)
-	go binembed.GetDecompressed(harpoon_vmlinux_arm64.BinaryXZChecksum)
-}
+// HarpoonKernelCmdLine is the command line the harpoon kernel boots with, with extra merged over it
+func HarpoonKernelCmdLine(platform units.Platform, extra *kernel.CmdLine) (*kernel.CmdLine, error) {
+	cmdline := &kernel.CmdLine{}
+	cmdline.SetConsole(platform.Arch(), kernel.ConsoleVirtio)
+	cmdline.Merge(extra)
 
-func PrepareHarpoonLinuxBootloaderAsync(ctx context.Context, wrkdir string, platform units.Platform, wg *errgroup.Group) (Bootloader, []virtio.VirtioDevice, error) {
-	targetVmLinuxPath := filepath.Join(wrkdir, "vmlinux")
-	targetInitramfsPath := filepath.Join(wrkdir, "initramfs.cpio.gz")
+	if err := cmdline.Validate(); err != nil {
+		return nil, errors.Errorf("invalid kernel command line: %w", err)
+	}
+	return cmdline, nil
+}
 
-	extraArgs := ""
-	extraInitArgs := ""
+// harpoondPath is the agent in the harpoon initramfs, which /init links to
+const harpoondPath = "bin/harpoond"
 
-	devices := []virtio.VirtioDevice{}
+// HarpoonInitramfs is what one vm adds to the embedded harpoon initramfs
+type HarpoonInitramfs struct {
+	// Agent replaces harpoond, the init of the guest
+	Agent []byte
+	// Files are added with mode 0644 by their path in the guest, replacing files already there
+	Files map[string][]byte
+	// KernelModules is the modules tree of the harpoon kernel that Modules are resolved from
+	KernelModules *initramfs.KernelModules
+	// Modules are injected with their dependencies and loaded by harpoond at boot
+	Modules []string
+}
 
-	var kernelXz, initramfsGz io.Reader
-	var err error
+// HarpoonInitramfsFromAnnotations adds the kernel modules a container asks for to the initramfs additions
+// of its vm. add is not modified. modulesDir holds the modules trees annotations may name; containers
+// cannot read anything outside it.
+func HarpoonInitramfsFromAnnotations(ctx context.Context, annotations map[string]string, modulesDir string, add *HarpoonInitramfs) (*HarpoonInitramfs, error) {
+	names := strings.FieldsFunc(annotations[KernelModulesAnnotation], func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(names) == 0 {
+		return add, nil
+	}
 
-	startTime := time.Now()
+	merged := &HarpoonInitramfs{}
+	if add != nil {
+		*merged = *add
+	}
+	merged.Modules = append(slices.Clone(merged.Modules), names...)
 
-	if platform.Arch() == "arm64" {
-		kernelXz, err = binembed.GetDecompressed(harpoon_vmlinux_arm64.BinaryXZChecksum)
-		if err != nil {
-			return nil, nil, errors.Errorf("getting kernel: %w", err)
+	if tree := annotations[KernelModulesPathAnnotation]; tree != "" {
+		if modulesDir == "" {
+			return nil, errors.Errorf("invalid %s annotation: no kernel modules directory is configured", KernelModulesPathAnnotation)
 		}
-		initramfsGz, err = binembed.GetDecompressed(harpoon_initramfs_arm64.BinaryXZChecksum)
+		modules, err := initramfs.OpenKernelModulesIn(ctx, modulesDir, tree)
 		if err != nil {
-			return nil, nil, errors.Errorf("getting initramfs: %w", err)
+			return nil, errors.Errorf("invalid %s annotation: %w", KernelModulesPathAnnotation, err)
 		}
-	} else {
-		kernelXz, err = binembed.GetDecompressed(harpoon_vmlinux_amd64.BinaryXZChecksum)
-		if err != nil {
-			return nil, nil, errors.Errorf("getting kernel: %w", err)
+		merged.KernelModules = modules
+	}
+	if merged.KernelModules == nil {
+		return nil, errors.Errorf("%s needs a modules tree from the %s annotation", KernelModulesAnnotation, KernelModulesPathAnnotation)
+	}
+
+	return merged, nil
+}
+
+func (h *HarpoonInitramfs) operations(ctx context.Context) ([]initramfs.Operation, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	ops := []initramfs.Operation{}
+	if h.Agent != nil {
+		ops = append(ops, initramfs.AddFile(harpoondPath, 0o755, h.Agent))
+	}
+	for _, name := range slices.Sorted(maps.Keys(h.Files)) {
+		ops = append(ops, initramfs.AddFile(name, 0o644, h.Files[name]))
+	}
+
+	if len(h.Modules) > 0 {
+		if h.KernelModules == nil {
+			return nil, errors.Errorf("injecting kernel modules %v: no modules tree", h.Modules)
 		}
-		initramfsGz, err = binembed.GetDecompressed(harpoon_initramfs_amd64.BinaryXZChecksum)
+		modules, err := h.KernelModules.Operations(ctx, h.Modules...)
 		if err != nil {
-			return nil, nil, errors.Errorf("getting initramfs: %w", err)
+			return nil, errors.Errorf("resolving kernel modules: %w", err)
 		}
+		ops = append(ops, modules...)
 	}
-	// 	data, err := os.ReadFile(path)
-	// 	if err != nil {
-	// 		return nil, nil, errors.Errorf("reading file: %w", err)
-	// 	}
-	// 	header, err := initramfs.NewStaticFileHeader(path, innerPath)
-	// 	if err != nil {
-	// 		return nil, nil, errors.Errorf("creating static file header: %w", err)
-	// 	}
-	// 	initramfs.StreamInjectHyper(ctx, initramfsGz, header, data)
-	// }
-	// for path, innerPath := range imageConfig.StaticFiles {
-
-	files := map[string]io.Reader{
-		targetVmLinuxPath:   kernelXz,
-		targetInitramfsPath: initramfsGz,
-	}
-
-	for path, reader := range files {
-		err = osx.WriteFileFromReaderAsync(ctx, path, reader, 0644, wg)
-		if err != nil {
-			return nil, nil, errors.Errorf("writing files: %w", err)
-		}
+
+	return ops, nil
+}
+
+// supportsModules reports whether a kernel built with config can load modules
+func supportsModules(config []byte) bool {
+	value, _ := (&kernel.Image{Config: config}).ConfigValue("MODULES")
+	return value == "y"
+}
+
+// supportsFilesystem reports whether a kernel built with config can mount block images of format
+func supportsFilesystem(config []byte, format oci.ImageFormat) bool {
+	option := map[oci.ImageFormat]string{
+		oci.ImageFormatExt4:     "EXT4_FS",
+		oci.ImageFormatEROFS:    "EROFS_FS",
+		oci.ImageFormatSquashfs: "SQUASHFS",
+	}[format]
+	if option == "" {
+		return false
 	}
+	value, _ := (&kernel.Image{Config: config}).ConfigValue(option)
+	return value == "y"
+}
 
-	cmdLine := strings.TrimSpace(" console=hvc0 " + extraArgs + " -- " + extraInitArgs)
+// harpoonKernelConfig is the config the embedded kernel for platform was built with
+func harpoonKernelConfig(platform units.Platform) []byte {
+	if platform.Arch() == "arm64" {
+		return harpoon_vmlinux_arm64.Config
+	}
+	return harpoon_vmlinux_amd64.Config
+}
+
+// editInitramfs streams the initramfs at src through ops into dst, keeping its compression
+func editInitramfs(ctx context.Context, src string, dst string, ops []initramfs.Operation) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Errorf("opening initramfs: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Errorf("creating initramfs: %w", err)
+	}
+	defer out.Close()
+
+	edited := initramfs.StreamEdit(ctx, in, ops...)
+	defer edited.Close()
+
+	if _, err := io.Copy(out, edited); err != nil {
+		return errors.Errorf("editing initramfs: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return errors.Errorf("closing initramfs: %w", err)
+	}
+
+	return nil
+}
+
+// PrepareHarpoonLinuxBootloader points the bootloader at the embedded kernel and initramfs in the
+// binembed disk cache. the cached files are verified and never modified, so every vm boots from the same
+// copy unless add changes the initramfs, which is then edited into the working directory. extra is merged
+// over the default command line.
+func PrepareHarpoonLinuxBootloader(ctx context.Context, wrkdir string, platform units.Platform, extra *kernel.CmdLine, add *HarpoonInitramfs) (Bootloader, []virtio.VirtioDevice, error) {
+	cmdLine, err := HarpoonKernelCmdLine(platform, extra)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	devices := []virtio.VirtioDevice{}
+
+	kernelChecksum, initramfsChecksum := harpoon_vmlinux_amd64.BinaryXZChecksum, harpoon_initramfs_amd64.BinaryXZChecksum
+	if platform.Arch() == "arm64" {
+		kernelChecksum, initramfsChecksum = harpoon_vmlinux_arm64.BinaryXZChecksum, harpoon_initramfs_arm64.BinaryXZChecksum
+	}
+	kernelConfig := harpoonKernelConfig(platform)
+
+	if add != nil && len(add.Modules) > 0 && !supportsModules(kernelConfig) {
+		return nil, nil, errors.Errorf("injecting kernel modules %v: the embedded %s kernel is built without CONFIG_MODULES", add.Modules, platform.Arch())
+	}
+
+	startTime := time.Now()
+
+	vmlinuxPath, err := binembed.GetDecompressedPath(kernelChecksum)
+	if err != nil {
+		return nil, nil, errors.Errorf("getting kernel: %w", err)
+	}
+	initramfsPath, err := binembed.GetDecompressedPath(initramfsChecksum)
+	if err != nil {
+		return nil, nil, errors.Errorf("getting initramfs: %w", err)
+	}
+
+	ops, err := add.operations(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ops) > 0 {
+		edited := filepath.Join(wrkdir, "initramfs.cpio.gz")
+		if err := editInitramfs(ctx, initramfsPath, edited, ops); err != nil {
+			return nil, nil, err
+		}
+		initramfsPath = edited
+	}
 
-	slog.InfoContext(ctx, "linux boot loader ready", "duration", time.Since(startTime))
+	slog.InfoContext(ctx, "linux boot loader ready", "duration", time.Since(startTime), "cmdline", cmdLine.String())
 
 	return &LinuxBootloader{
-		InitrdPath:    targetInitramfsPath,
-		VmlinuzPath:   targetVmLinuxPath,
+		InitrdPath:    initramfsPath,
+		VmlinuzPath:   vmlinuxPath,
 		KernelCmdLine: cmdLine,
 	}, devices, nil
 }
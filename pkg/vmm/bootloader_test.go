@@ -0,0 +1,181 @@
+package vmm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/cpio"
+	"github.com/walteh/ec1/pkg/initramfs"
+	"github.com/walteh/ec1/pkg/oci"
+	"github.com/walteh/ec1/pkg/units"
+)
+
+func TestHarpoonKernelCmdLineFromAnnotations(t *testing.T) {
+	extra, err := KernelCmdLineFromAnnotations(nil)
+	require.NoError(t, err)
+
+	cmdline, err := HarpoonKernelCmdLine(units.PlatformLinuxARM64, extra)
+	require.NoError(t, err)
+	assert.Equal(t, "console=hvc0", cmdline.String())
+
+	extra, err = KernelCmdLineFromAnnotations(map[string]string{
+		KernelCmdLineAnnotation: `quiet loglevel=7 console=ttyAMA0 -- --debug`,
+	})
+	require.NoError(t, err)
+
+	cmdline, err = HarpoonKernelCmdLine(units.PlatformLinuxARM64, extra)
+	require.NoError(t, err)
+	assert.Equal(t, "console=ttyAMA0 quiet loglevel=7 -- --debug", cmdline.String())
+
+	_, err = KernelCmdLineFromAnnotations(map[string]string{KernelCmdLineAnnotation: `init="/bin/sh`})
+	require.ErrorContains(t, err, "invalid ec1.harpoon.kernel.cmdline annotation")
+}
+
+func TestEditHarpoonInitramfs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var archive bytes.Buffer
+	_, err := initramfs.Build(ctx, &archive, []initramfs.Entry{
+		initramfs.Symlink("init", harpoondPath),
+		initramfs.File(harpoondPath, 0755, []byte("embedded harpoond")),
+		initramfs.File("etc/resolv.conf", 0644, []byte("nameserver 1.1.1.1\n")),
+	})
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(archive.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	src := filepath.Join(dir, "cached.cpio.gz")
+	require.NoError(t, os.WriteFile(src, compressed.Bytes(), 0644))
+
+	var none *HarpoonInitramfs
+	ops, err := none.operations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ops, "a vm without additions boots the cached initramfs")
+
+	add := &HarpoonInitramfs{
+		Agent: []byte("development harpoond"),
+		Files: map[string][]byte{
+			"/etc/resolv.conf":      []byte("nameserver 9.9.9.9\n"),
+			"/etc/harpoon/ec1.json": []byte("{}"),
+		},
+	}
+
+	dst := filepath.Join(dir, "initramfs.cpio.gz")
+	ops, err = add.operations(ctx)
+	require.NoError(t, err)
+	require.NoError(t, editInitramfs(ctx, src, dst, ops))
+
+	f, err := os.Open(dst)
+	require.NoError(t, err)
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err, "the edited initramfs keeps its compression")
+	raw, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+
+	fsys := cpio.NewFS(bytes.NewReader(raw))
+	for name, want := range map[string]string{
+		harpoondPath:           "development harpoond",
+		"etc/resolv.conf":      "nameserver 9.9.9.9\n",
+		"etc/harpoon/ec1.json": "{}",
+	} {
+		data, err := fsys.ReadFile(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, string(data), name)
+	}
+
+	target, err := fsys.ReadLink("init")
+	require.NoError(t, err)
+	assert.Equal(t, harpoondPath, target)
+
+	cached, err := os.ReadFile(src)
+	require.NoError(t, err)
+	assert.Equal(t, compressed.Bytes(), cached, "the cached initramfs is not modified")
+}
+
+func TestHarpoonInitramfsFromAnnotations(t *testing.T) {
+	ctx := context.Background()
+
+	writeTree := func(tree string) {
+		dir := filepath.Join(tree, "lib/modules/6.15.0-rc7")
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "kernel/net/netfilter"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "modules.dep"), []byte(
+			"kernel/net/netfilter/nf_conntrack.ko:\n"+
+				"kernel/net/netfilter/xt_conntrack.ko: kernel/net/netfilter/nf_conntrack.ko\n",
+		), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "kernel/net/netfilter/nf_conntrack.ko"), []byte("nf_conntrack"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "kernel/net/netfilter/xt_conntrack.ko"), []byte("xt_conntrack"), 0644))
+	}
+
+	modulesDir := t.TempDir()
+	writeTree(filepath.Join(modulesDir, "netfilter"))
+
+	base := &HarpoonInitramfs{Files: map[string][]byte{"/etc/hostname": []byte("vm")}}
+
+	add, err := HarpoonInitramfsFromAnnotations(ctx, nil, modulesDir, base)
+	require.NoError(t, err)
+	assert.Same(t, base, add, "no modules leaves the additions alone")
+
+	add, err = HarpoonInitramfsFromAnnotations(ctx, map[string]string{
+		KernelModulesAnnotation:     "xt_conntrack, nf_conntrack",
+		KernelModulesPathAnnotation: "netfilter",
+	}, modulesDir, base)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"xt_conntrack", "nf_conntrack"}, add.Modules)
+	assert.Equal(t, base.Files, add.Files)
+	assert.Empty(t, base.Modules, "the additions passed in are not modified")
+
+	ops, err := add.operations(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, op := range ops {
+		names = append(names, op.String())
+	}
+	assert.Contains(t, names, "add lib/modules/6.15.0-rc7/kernel/net/netfilter/xt_conntrack.ko")
+	assert.Contains(t, names, "add etc/harpoon/modules")
+
+	_, err = HarpoonInitramfsFromAnnotations(ctx, map[string]string{KernelModulesAnnotation: "xt_conntrack"}, modulesDir, nil)
+	require.ErrorContains(t, err, "needs a modules tree from the ec1.harpoon.kernel.modules.path annotation")
+
+	// a container names a tree in the modules directory, never a path of its own on the host
+	outside := t.TempDir()
+	writeTree(outside)
+	require.NoError(t, os.Symlink(outside, filepath.Join(modulesDir, "escape")))
+	for _, tree := range []string{outside, filepath.Join(modulesDir, "netfilter"), "../" + filepath.Base(outside), "escape"} {
+		_, err = HarpoonInitramfsFromAnnotations(ctx, map[string]string{
+			KernelModulesAnnotation:     "xt_conntrack",
+			KernelModulesPathAnnotation: tree,
+		}, modulesDir, nil)
+		require.Error(t, err, tree)
+	}
+
+	_, err = HarpoonInitramfsFromAnnotations(ctx, map[string]string{
+		KernelModulesAnnotation:     "xt_conntrack",
+		KernelModulesPathAnnotation: "netfilter",
+	}, "", nil)
+	require.ErrorContains(t, err, "no kernel modules directory is configured")
+
+	assert.True(t, supportsModules([]byte("CONFIG_MODULES_USE_ELF_RELA=y\nCONFIG_MODULES=y\n")))
+	assert.False(t, supportsModules([]byte("CONFIG_MODULES_USE_ELF_RELA=y\n# CONFIG_MODULES is not set\n")))
+}
+
+func TestSupportsFilesystem(t *testing.T) {
+	config := []byte("CONFIG_EXT4_FS=y\nCONFIG_EROFS_FS=y\n# CONFIG_SQUASHFS is not set\n")
+	assert.True(t, supportsFilesystem(config, oci.ImageFormatExt4))
+	assert.True(t, supportsFilesystem(config, oci.ImageFormatEROFS))
+	assert.False(t, supportsFilesystem(config, oci.ImageFormatSquashfs))
+	assert.False(t, supportsFilesystem(config, "btrfs"))
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -28,11 +29,13 @@ import (
 	slogctx "github.com/veqryn/slog-context"
 
 	harpoonv1 "github.com/walteh/ec1/gen/proto/golang/harpoon/v1"
+	"github.com/walteh/ec1/pkg/disk"
 	"github.com/walteh/ec1/pkg/ec1init"
 	"github.com/walteh/ec1/pkg/ext/osx"
 	"github.com/walteh/ec1/pkg/host"
 	"github.com/walteh/ec1/pkg/logging"
 	"github.com/walteh/ec1/pkg/logging/valuelog"
+	ec1oci "github.com/walteh/ec1/pkg/oci"
 	"github.com/walteh/ec1/pkg/units"
 	"github.com/walteh/ec1/pkg/virtio"
 )
@@ -47,6 +50,12 @@ type ContainerizedVMConfig struct {
 	Memory       strongunits.B
 	VCPUs        uint64
 	Platform     units.Platform
+	// Initramfs is added to the harpoon initramfs of this vm only
+	Initramfs *HarpoonInitramfs
+	// KernelModulesDir holds the modules trees the KernelModulesPathAnnotation of a container may name
+	KernelModulesDir string
+	// Disks holds the writable disks of the vm, like the rootfs scratch disk. nil uses the ec1 cache directory
+	Disks *disk.Manager
 }
 
 func appendContext(ctx context.Context, id string) context.Context {
@@ -123,7 +132,12 @@ func NewContainerizedVirtualMachineFromRootfs[VM VirtualMachine](
 		"spec.Root.Readonly", ctrconfig.Spec.Root.Readonly,
 	)
 
-	ec1Devices, err := PrepareContainerVirtioDevicesFromRootfs(ctx, workingDir, ctrconfig.Spec, ctrconfig.RootfsMounts, bindMounts, creationErrGroup)
+	disks, err := diskManager(ctrconfig.Disks)
+	if err != nil {
+		return nil, errors.Errorf("creating disk manager: %w", err)
+	}
+
+	ec1Devices, imageLease, err := PrepareContainerVirtioDevicesFromRootfs(ctx, id, workingDir, disks, ctrconfig.Spec, ctrconfig.RootfsMounts, bindMounts, creationErrGroup)
 	if err != nil {
 		return nil, errors.Errorf("creating ec1 block device from rootfs: %w", err)
 	}
@@ -133,7 +147,15 @@ func NewContainerizedVirtualMachineFromRootfs[VM VirtualMachine](
 
 	switch ctrconfig.Platform.OS() {
 	case "linux":
-		bl, bldevs, err := PrepareHarpoonLinuxBootloaderAsync(ctx, workingDir, ctrconfig.Platform, creationErrGroup)
+		cmdline, err := KernelCmdLineFromAnnotations(ctrconfig.Spec.Annotations)
+		if err != nil {
+			return nil, errors.Errorf("reading kernel command line from annotations: %w", err)
+		}
+		add, err := HarpoonInitramfsFromAnnotations(ctx, ctrconfig.Spec.Annotations, ctrconfig.KernelModulesDir, ctrconfig.Initramfs)
+		if err != nil {
+			return nil, errors.Errorf("reading initramfs additions from annotations: %w", err)
+		}
+		bl, bldevs, err := PrepareHarpoonLinuxBootloader(ctx, workingDir, ctrconfig.Platform, cmdline, add)
 		if err != nil {
 			return nil, errors.Errorf("getting boot loader config: %w", err)
 		}
@@ -188,23 +210,43 @@ func NewContainerizedVirtualMachineFromRootfs[VM VirtualMachine](
 	}
 
 	runner := &RunningVM[VM]{
-		bootloader:             bootloader,
-		start:                  startTime,
-		vm:                     vm,
-		stdin:                  ctrconfig.StdinReader,
-		stdout:                 ctrconfig.StdoutWriter,
-		stderr:                 ctrconfig.StderrWriter,
-		portOnHostIP:           hostIPPort,
-		wait:                   make(chan error, 1),
-		guestServiceConnection: nil,
-		workingDir:             workingDir,
-		netdev:                 netdev,
+		bootloader:      bootloader,
+		start:           startTime,
+		vm:              vm,
+		stdin:           ctrconfig.StdinReader,
+		stdout:          ctrconfig.StdoutWriter,
+		stderr:          ctrconfig.StderrWriter,
+		portOnHostIP:    hostIPPort,
+		wait:            make(chan error, 1),
+		guestConnection: newGuestConnection(vm),
+		workingDir:      workingDir,
+		netdev:          netdev,
+		releaseImage:    imageLease.Release,
+		disks:           disks,
+		diskOwner:       id,
 	}
 
 	return runner, nil
 }
 
 func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
+	return rvm.run(ctx, bootContainerVM[VM])
+}
+
+// StartFromSnapshot resumes the vm from snapshot id of catalog instead of booting it. the vm has to be prepared
+// with the configuration the snapshot was taken with.
+func (rvm *RunningVM[VM]) StartFromSnapshot(ctx context.Context, catalog *SnapshotCatalog, id string) error {
+	return rvm.run(ctx, func(ctx context.Context, vm VM) error {
+		return resumeFromSnapshot(ctx, catalog, vm, id)
+	})
+}
+
+// SaveSnapshot saves the vm into catalog, pausing it while the machine state is written
+func (rvm *RunningVM[VM]) SaveSnapshot(ctx context.Context, catalog *SnapshotCatalog) (*SnapshotInfo, error) {
+	return saveRunningSnapshot(ctx, catalog, rvm.vm)
+}
+
+func (rvm *RunningVM[VM]) run(ctx context.Context, boot func(ctx context.Context, vm VM) error) error {
 
 	errgrp, ctx := errgroup.WithContext(ctx)
 
@@ -217,7 +259,7 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 		return nil
 	})
 
-	err := bootContainerVM(ctx, rvm.VM())
+	err := boot(ctx, rvm.VM())
 	if err != nil {
 		if err := TryAppendingConsoleLog(ctx, rvm.workingDir); err != nil {
 			slog.ErrorContext(ctx, "error appending console log", "error", err)
@@ -274,11 +316,16 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 			select {
 			case state := <-stateNotify:
 				if state.StateType == VirtualMachineStateTypeError {
+					rvm.releaseCachedImage()
+					rvm.releaseDisks(ctx)
 					rvm.wait <- errors.Errorf("VM entered error state")
 					return
 				}
 				if state.StateType == VirtualMachineStateTypeStopped {
 					slog.InfoContext(ctx, "VM stopped")
+					rvm.guestConnection.Close()
+					rvm.releaseCachedImage()
+					rvm.releaseDisks(ctx)
 					rvm.wait <- nil
 					return
 				}
@@ -303,9 +350,28 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 
 	slog.InfoContext(ctx, "time sync", "response", response)
 
+	// keep the guest service connection healthy for the lifetime of the vm
+	go rvm.guestConnection.Run(ctx)
+
 	return nil
 }
 
+func (rvm *RunningVM[VM]) releaseCachedImage() {
+	if rvm.releaseImage != nil {
+		rvm.releaseImage()
+	}
+}
+
+// releaseDisks removes the writable disks created for the vm, like its rootfs scratch disk
+func (rvm *RunningVM[VM]) releaseDisks(ctx context.Context) {
+	if rvm.disks == nil {
+		return
+	}
+	if err := rvm.disks.Release(ctx, rvm.diskOwner); err != nil {
+		slog.ErrorContext(ctx, "error releasing vm disks", "error", err)
+	}
+}
+
 func (rvm *RunningVM[VM]) Wait(ctx context.Context) error {
 	return <-rvm.wait
 }
@@ -371,8 +437,7 @@ func bindMountToVirtioFs(ctx context.Context, mount specs.Mount, containerId str
 	}
 
 	if fi.IsDir() {
-		hash := sha256.Sum256([]byte(mount.Source))
-		tag := "bind-" + hex.EncodeToString(hash[:8])
+		tag := bindShareTag(mount.Source)
 		// create a new fs direcotry share
 		shareDev, err := virtio.VirtioFsNew(mount.Source, tag)
 		if err != nil {
@@ -384,31 +449,64 @@ func bindMountToVirtioFs(ctx context.Context, mount specs.Mount, containerId str
 		mount.Options = []string{}
 
 		return &mount, shareDev, nil
+	}
 
-	} else {
+	if !fi.Mode().IsRegular() {
+		return nil, nil, errors.Errorf("unsupported bind mount file type %s: %s", fi.Mode().Type(), mount.Source)
+	}
 
-		base := filepath.Base(mount.Source)
-		dir := filepath.Base(filepath.Dir(mount.Source))
+	return bindMountFileToVirtioFs(ctx, mount, containerId)
+}
 
-		if base == "resolv.conf" || base == "hosts" {
-			if dir == containerId {
-				slog.WarnContext(ctx, "skipping mount of file", "file", mount.Source)
+// bindShareTag is the virtiofs tag a bind-mounted host directory is shared under
+func bindShareTag(dir string) string {
+	hash := sha256.Sum256([]byte(dir))
+	return "bind-" + hex.EncodeToString(hash[:8])
+}
 
-				// mount.Type = "copy"
-				return nil, nil, nil
-			}
-		}
+// bindMountFileToVirtioFs shares the directory holding a single file (resolv.conf, hosts, a config file...)
+// and asks harpoond to bind-mount just the file inside the guest, like docker does on linux. host edits,
+// including the rename-over that writers of resolv.conf use, show up in the guest. virtiofs has no read-only
+// flag, so "ro" is enforced by harpoond remounting the bind read-only.
+func bindMountFileToVirtioFs(ctx context.Context, mount specs.Mount, containerId string) (*specs.Mount, virtio.VirtioDevice, error) {
+	realSource, err := filepath.EvalSymlinks(mount.Source)
+	if err != nil {
+		return nil, nil, errors.Errorf("resolving bind mount file %s: %w", mount.Source, err)
+	}
 
-		return nil, nil, errors.Errorf("unsupported bind mount file: %s", mount.Source)
+	dir := filepath.Dir(realSource)
+	tag := bindShareTag(dir)
 
-		// this is probably a security issue, but for now d
+	shareDev, err := virtio.VirtioFsNew(dir, tag)
+	if err != nil {
+		return nil, nil, errors.Errorf("creating share device: %w", err)
 	}
 
+	opts := []string{}
+	if slices.Contains(mount.Options, "ro") {
+		opts = append(opts, "ro")
+	}
+
+	slog.DebugContext(ctx, "sharing directory for file bind mount",
+		"container", containerId,
+		"file", realSource,
+		"tag", tag,
+		"destination", mount.Destination,
+		"options", opts)
+
+	mount.Type = ec1init.BindFileMountType
+	mount.Source = path.Join(tag, filepath.Base(realSource))
+	mount.Options = opts
+
+	return &mount, shareDev, nil
 }
 
+// PrepareContainerMounts turns the mounts of the spec into ones harpoond can make, and the shares they need
 func PrepareContainerMounts(ctx context.Context, spec *oci.Spec, containerId string) ([]specs.Mount, []virtio.VirtioDevice, error) {
 	bindMounts := []specs.Mount{}
 	devices := []virtio.VirtioDevice{}
+	// files bind-mounted from the same directory share it once
+	sharedTags := map[string]bool{}
 
 	// log all the mounts
 	slog.InfoContext(ctx, "mounts", "mounts", valuelog.NewPrettyValue(spec.Mounts))
@@ -427,6 +525,12 @@ func PrepareContainerMounts(ctx context.Context, spec *oci.Spec, containerId str
 			if mnt != nil {
 				bindMounts = append(bindMounts, *mnt)
 			}
+			if fsDev, ok := dev.(*virtio.VirtioFs); ok {
+				if sharedTags[fsDev.MountTag] {
+					continue
+				}
+				sharedTags[fsDev.MountTag] = true
+			}
 			if dev != nil {
 				devices = append(devices, dev)
 			}
@@ -451,8 +555,10 @@ func PrepareContainerMounts(ctx context.Context, spec *oci.Spec, containerId str
 	return bindMounts, devices, nil
 }
 
-// PrepareContainerVirtioDevicesFromRootfs creates virtio devices using an existing rootfs directory
-func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string, ctrconfig *oci.Spec, rootfsMounts []*types.Mount, bindMounts []specs.Mount, wg *errgroup.Group) ([]virtio.VirtioDevice, error) {
+// PrepareContainerVirtioDevicesFromRootfs creates virtio devices using an existing rootfs directory. the lease
+// holds the cached block image of the rootfs, nil when the rootfs is shared over virtiofs. writable disks are
+// created in disks for the vm id.
+func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, id string, wrkdir string, disks *disk.Manager, ctrconfig *oci.Spec, rootfsMounts []*types.Mount, bindMounts []specs.Mount, wg *errgroup.Group) ([]virtio.VirtioDevice, *ec1oci.ImageLease, error) {
 	outMounts := []specs.Mount{}
 	ec1DataPath := filepath.Join(wrkdir, "harpoon-runtime-fs-device")
 
@@ -460,39 +566,63 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 
 	err := os.MkdirAll(ec1DataPath, 0755)
 	if err != nil {
-		return nil, errors.Errorf("creating block device directory: %w", err)
+		return nil, nil, errors.Errorf("creating block device directory: %w", err)
 	}
 
 	if len(rootfsMounts) != 1 {
-		return nil, errors.Errorf("expected 1 rootfs mount, got %d", len(rootfsMounts))
+		return nil, nil, errors.Errorf("expected 1 rootfs mount, got %d", len(rootfsMounts))
 	}
 
 	rootfsMount := rootfsMounts[0]
 
-	// i think the prob is that ctrconfig.Root.Path is set to 'rootfs'
-	// Create a VirtioFs device pointing to the existing rootfs directory
-	blkDev, err := virtio.VirtioFsNew(rootfsMount.Source, ec1init.RootfsVirtioTag)
+	rootfsOpts, err := RootfsOptionsFromAnnotations(ctrconfig.Annotations)
 	if err != nil {
-		return nil, errors.Errorf("creating rootfs virtio device: %w", err)
+		return nil, nil, errors.Errorf("reading rootfs options from annotations: %w", err)
 	}
 
-	outMounts = append(outMounts, specs.Mount{
-		Type:        "virtiofs",
-		Source:      ec1init.RootfsVirtioTag,
-		Destination: "", // the root
-		Options: slices.DeleteFunc(rootfsMount.Options, func(opt string) bool {
-			return opt == "rbind" || opt == "bind"
-		}),
-	})
+	var lease *ec1oci.ImageLease
+	leased := false
+	defer func() {
+		if !leased {
+			lease.Release()
+		}
+	}()
 
-	// consoleAttachment := virtio.NewFileHandleDeviceAttachment(os.NewFile(uintptr(ctrconfig.StdinFD), "ptymaster"), virtio.DeviceSerial)
-	// consoleConfig.SetAttachment(consoleAttachment)
+	switch rootfsOpts.Mode {
+	case ec1init.RootfsModeBlock:
+		// harpoond mounts the block rootfs itself, so there is no rootfs entry in the mounts file
+		blkDevs, blkLease, err := prepareBlockRootfsFromDirectory(ctx, disks, id, rootfsMount.Source, rootfsOpts, wg)
+		if err != nil {
+			return nil, nil, errors.Errorf("creating block rootfs devices: %w", err)
+		}
+		lease = blkLease
+		devices = append(devices, blkDevs...)
+	default:
+		// i think the prob is that ctrconfig.Root.Path is set to 'rootfs'
+		// Create a VirtioFs device pointing to the existing rootfs directory
+		blkDev, err := virtio.VirtioFsNew(rootfsMount.Source, ec1init.RootfsVirtioTag)
+		if err != nil {
+			return nil, nil, errors.Errorf("creating rootfs virtio device: %w", err)
+		}
 
-	devices = append(devices, blkDev)
+		outMounts = append(outMounts, specs.Mount{
+			Type:        "virtiofs",
+			Source:      ec1init.RootfsVirtioTag,
+			Destination: "", // the root
+			Options: slices.DeleteFunc(rootfsMount.Options, func(opt string) bool {
+				return opt == "rbind" || opt == "bind"
+			}),
+		})
+
+		// consoleAttachment := virtio.NewFileHandleDeviceAttachment(os.NewFile(uintptr(ctrconfig.StdinFD), "ptymaster"), virtio.DeviceSerial)
+		// consoleConfig.SetAttachment(consoleAttachment)
+
+		devices = append(devices, blkDev)
+	}
 
 	specBytes, err := json.Marshal(ctrconfig)
 	if err != nil {
-		return nil, errors.Errorf("marshalling spec: %w", err)
+		return nil, nil, errors.Errorf("marshalling spec: %w", err)
 	}
 
 	outMounts = append(outMounts, specs.Mount{
@@ -506,19 +636,25 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 
 	mountsBytes, err := json.Marshal(outMounts)
 	if err != nil {
-		return nil, errors.Errorf("marshalling mounts: %w", err)
+		return nil, nil, errors.Errorf("marshalling mounts: %w", err)
+	}
+
+	rootfsBytes, err := json.Marshal(rootfsOpts.config())
+	if err != nil {
+		return nil, nil, errors.Errorf("marshalling rootfs config: %w", err)
 	}
 
 	files := map[string][]byte{
 		ec1init.ContainerSpecFile:   specBytes,
 		ec1init.ContainerMountsFile: mountsBytes,
+		ec1init.ContainerRootfsFile: rootfsBytes,
 	}
 
 	for name, file := range files {
 		filePath := filepath.Join(ec1DataPath, name)
 		err = osx.WriteFileFromReaderAsync(ctx, filePath, bytes.NewReader(file), 0644, wg)
 		if err != nil {
-			return nil, errors.Errorf("writing file to block device: %w", err)
+			return nil, nil, errors.Errorf("writing file to block device: %w", err)
 		}
 	}
 
@@ -564,10 +700,11 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 
 	ec1Dev, err := virtio.VirtioFsNew(ec1DataPath, ec1init.Ec1VirtioTag)
 	if err != nil {
-		return nil, errors.Errorf("creating ec1 virtio device: %w", err)
+		return nil, nil, errors.Errorf("creating ec1 virtio device: %w", err)
 	}
 
 	devices = append(devices, ec1Dev)
 
-	return devices, nil
+	leased = true
+	return devices, lease, nil
 }
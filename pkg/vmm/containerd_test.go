@@ -0,0 +1,105 @@
+package vmm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+func TestPrepareContainerMountsFileBindMounts(t *testing.T) {
+	ctx := context.Background()
+
+	containerDir := filepath.Join(t.TempDir(), "abcdef1234567890")
+	require.NoError(t, os.MkdirAll(containerDir, 0755))
+
+	resolvConf := filepath.Join(containerDir, "resolv.conf")
+	hosts := filepath.Join(containerDir, "hosts")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 1.1.1.1\n"), 0644))
+	require.NoError(t, os.WriteFile(hosts, []byte("127.0.0.1 localhost\n"), 0644))
+
+	configDir := t.TempDir()
+	configFile := filepath.Join(configDir, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("key: value\n"), 0644))
+
+	spec := &oci.Spec{
+		Mounts: []specs.Mount{
+			{Type: "bind", Source: resolvConf, Destination: "/etc/resolv.conf", Options: []string{"rbind", "rprivate"}},
+			{Type: "bind", Source: hosts, Destination: "/etc/hosts", Options: []string{"rbind", "rprivate"}},
+			{Type: "bind", Source: configFile, Destination: "/etc/app/config.yaml", Options: []string{"rbind", "ro"}},
+		},
+	}
+
+	mounts, devices, err := PrepareContainerMounts(ctx, spec, "abcdef1234567890")
+	require.NoError(t, err)
+	require.Len(t, mounts, 3)
+
+	// the directory of each file is shared once
+	shares := virtio.VirtioDevicesOfType[*virtio.VirtioFs](devices)
+	require.Len(t, shares, 2)
+
+	shared := func(mount specs.Mount) string {
+		tag, name, ok := strings.Cut(mount.Source, "/")
+		require.True(t, ok)
+		for _, share := range shares {
+			if share.MountTag == tag {
+				return filepath.Join(share.SharedDir, name)
+			}
+		}
+		t.Fatalf("no share for %s", mount.Source)
+		return ""
+	}
+
+	for _, mount := range mounts {
+		assert.Equal(t, ec1init.BindFileMountType, mount.Type)
+	}
+
+	realResolvConf, err := filepath.EvalSymlinks(resolvConf)
+	require.NoError(t, err)
+	assert.Equal(t, realResolvConf, shared(mounts[0]))
+	assert.Empty(t, mounts[0].Options)
+
+	// a host file replaced by a rename, as resolvers do, is what the guest sees
+	replacement := filepath.Join(containerDir, "resolv.conf.tmp")
+	require.NoError(t, os.WriteFile(replacement, []byte("nameserver 8.8.8.8\n"), 0644))
+	require.NoError(t, os.Rename(replacement, resolvConf))
+	data, err := os.ReadFile(shared(mounts[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 8.8.8.8\n", string(data))
+
+	assert.FileExists(t, shared(mounts[1]))
+
+	// read-only is left to harpoond remounting the bind
+	assert.Equal(t, []string{"ro"}, mounts[2].Options)
+	assert.Equal(t, "/etc/app/config.yaml", mounts[2].Destination)
+	assert.FileExists(t, shared(mounts[2]))
+}
+
+func TestPrepareContainerMountsDirectoryBindMount(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+
+	spec := &oci.Spec{
+		Mounts: []specs.Mount{
+			{Type: "", Source: dir, Destination: "/data", Options: []string{"rbind"}},
+		},
+	}
+
+	mounts, devices, err := PrepareContainerMounts(ctx, spec, "abcdef1234567890")
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	require.Len(t, devices, 1)
+
+	assert.Equal(t, "virtiofs", mounts[0].Type)
+	assert.Equal(t, devices[0].(*virtio.VirtioFs).MountTag, mounts[0].Source)
+}
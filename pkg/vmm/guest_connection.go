@@ -0,0 +1,404 @@
+package vmm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"gitlab.com/tozd/go/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	harpoonv1 "github.com/walteh/ec1/gen/proto/golang/harpoon/v1"
+)
+
+type GuestConnectionState string
+
+const (
+	GuestConnectionStateDisconnected GuestConnectionState = "disconnected"
+	GuestConnectionStateConnecting   GuestConnectionState = "connecting"
+	GuestConnectionStateConnected    GuestConnectionState = "connected"
+	GuestConnectionStateClosed       GuestConnectionState = "closed"
+)
+
+// GuestConnectionOptions tunes how the guest service connection is established and supervised
+type GuestConnectionOptions struct {
+	// DialTimeout bounds how long a caller waits for a connection before giving up
+	DialTimeout time.Duration
+	// InitialBackoff and MaxBackoff bound the exponential delay between dial attempts
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// HealthInterval is how often an established connection is pinged with Readiness
+	HealthInterval time.Duration
+	// HealthTimeout bounds a single Readiness ping
+	HealthTimeout time.Duration
+	// MaxRetries is how many times an idempotent RPC is retried after a connection failure. zero retries
+	// 3 times, a negative value disables retries.
+	MaxRetries int
+}
+
+func (o GuestConnectionOptions) withDefaults() GuestConnectionOptions {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 3 * time.Second
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = 10 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 500 * time.Millisecond
+	}
+	if o.HealthInterval == 0 {
+		o.HealthInterval = 2 * time.Second
+	}
+	if o.HealthTimeout == 0 {
+		o.HealthTimeout = time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	return o
+}
+
+func (o GuestConnectionOptions) retries() int {
+	return max(o.MaxRetries, 0)
+}
+
+// GuestConnectionManager owns the ttrpc client for the guest service. it dials lazily, drops the client
+// when the connection closes or stops answering Readiness pings, and redials with backoff.
+type GuestConnectionManager struct {
+	dial func(ctx context.Context) (net.Conn, error)
+	opts GuestConnectionOptions
+
+	mu      sync.Mutex
+	client  *ttrpc.Client
+	service harpoonv1.TTRPCGuestServiceClient
+	// dialing is closed when the dial in progress finishes, nil when none is
+	dialing   chan struct{}
+	state     GuestConnectionState
+	notifiers []chan GuestConnectionState
+}
+
+func NewGuestConnectionManager(dial func(ctx context.Context) (net.Conn, error), opts GuestConnectionOptions) *GuestConnectionManager {
+	return &GuestConnectionManager{
+		dial:  dial,
+		opts:  opts.withDefaults(),
+		state: GuestConnectionStateDisconnected,
+	}
+}
+
+// NewVSockGuestConnectionManager connects to the guest service on port of vm
+func NewVSockGuestConnectionManager(vm VirtualMachine, port uint32, opts GuestConnectionOptions) *GuestConnectionManager {
+	return NewGuestConnectionManager(func(ctx context.Context) (net.Conn, error) {
+		return vm.VSockConnect(ctx, port)
+	}, opts)
+}
+
+func (m *GuestConnectionManager) State() GuestConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Subscribe returns a channel that receives every state change. slow readers miss intermediate states
+// but always see the latest one.
+func (m *GuestConnectionManager) Subscribe() <-chan GuestConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := make(chan GuestConnectionState, 1)
+	ch <- m.state
+	m.notifiers = append(m.notifiers, ch)
+	return ch
+}
+
+func (m *GuestConnectionManager) setStateLocked(state GuestConnectionState) {
+	if m.state == state {
+		return
+	}
+	m.state = state
+	for _, ch := range m.notifiers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+}
+
+// Client returns the connected guest service client, dialing with backoff if there is none
+func (m *GuestConnectionManager) Client(ctx context.Context) (harpoonv1.TTRPCGuestServiceClient, error) {
+	_, svc, err := m.connect(ctx)
+	return svc, err
+}
+
+// connect returns the current client and its service, dialing if there is none. the dial runs without
+// holding the lock; concurrent callers wait for it instead of dialing again.
+func (m *GuestConnectionManager) connect(ctx context.Context) (*ttrpc.Client, harpoonv1.TTRPCGuestServiceClient, error) {
+	m.mu.Lock()
+	for m.dialing != nil {
+		dialing := m.dialing
+		m.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+
+	switch m.state {
+	case GuestConnectionStateClosed:
+		m.mu.Unlock()
+		return nil, nil, errors.Errorf("guest connection manager is closed")
+	case GuestConnectionStateConnected:
+		defer m.mu.Unlock()
+		return m.client, m.service, nil
+	}
+
+	dialing := make(chan struct{})
+	m.dialing = dialing
+	m.setStateLocked(GuestConnectionStateConnecting)
+	m.mu.Unlock()
+
+	conn, err := dialWithBackoff(ctx, m.dial, m.opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer close(dialing)
+	m.dialing = nil
+
+	if err != nil {
+		if m.state != GuestConnectionStateClosed {
+			m.setStateLocked(GuestConnectionStateDisconnected)
+		}
+		return nil, nil, errors.Errorf("connecting to guest service: %w", err)
+	}
+
+	if m.state == GuestConnectionStateClosed {
+		conn.Close()
+		return nil, nil, errors.Errorf("guest connection manager is closed")
+	}
+
+	client := ttrpc.NewClient(conn, ttrpc.WithOnCloseError(func(err error) {
+		slog.Debug("guest service connection closed", "error", err)
+	}))
+	// the close callback runs on the client's receive loop, which may finish before NewClient returns, so
+	// the client is dropped once it is fully built and its callback has run
+	go func() {
+		client.UserOnCloseWait(context.Background())
+		m.invalidate(client)
+	}()
+
+	m.client = client
+	m.service = harpoonv1.NewTTRPCGuestServiceClient(client)
+	m.setStateLocked(GuestConnectionStateConnected)
+
+	return m.client, m.service, nil
+}
+
+// invalidate drops client if it is still the current one so the next call redials
+func (m *GuestConnectionManager) invalidate(client *ttrpc.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if client == nil || m.client != client {
+		return
+	}
+
+	m.client.Close()
+	m.client = nil
+	m.service = nil
+
+	if m.state != GuestConnectionStateClosed {
+		m.setStateLocked(GuestConnectionStateDisconnected)
+	}
+}
+
+// Run pings the guest with Readiness until ctx is done, reconnecting whenever the connection is lost
+func (m *GuestConnectionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if m.State() == GuestConnectionStateClosed {
+			return
+		}
+
+		if err := m.ping(ctx); err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "guest service health check failed", "error", err)
+		}
+	}
+}
+
+func (m *GuestConnectionManager) ping(ctx context.Context) error {
+	client, svc, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, m.opts.HealthTimeout)
+	defer cancel()
+
+	resp, err := svc.Readiness(pingCtx, harpoonv1.NewReadinessRequest(func(b *harpoonv1.ReadinessRequest_builder) {}))
+	if err == nil && !resp.GetReady() {
+		err = errors.Errorf("guest service reported not ready")
+	}
+	if err != nil {
+		m.invalidate(client)
+		return errors.Errorf("pinging guest service: %w", err)
+	}
+
+	return nil
+}
+
+// Close shuts down the current connection; the manager cannot be used afterwards
+func (m *GuestConnectionManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setStateLocked(GuestConnectionStateClosed)
+
+	if m.client == nil {
+		return nil
+	}
+
+	err := m.client.Close()
+	m.client = nil
+	m.service = nil
+	return err
+}
+
+// Service returns a guest service client that always uses the current connection. idempotent RPCs
+// (Readiness, TimeSync) are retried on a fresh connection when the old one fails; RunSpec, RunCommand
+// and streams are not, since the guest may already have acted on them.
+func (m *GuestConnectionManager) Service() harpoonv1.TTRPCGuestServiceClient {
+	return &managedGuestService{m: m}
+}
+
+type managedGuestService struct {
+	m *GuestConnectionManager
+}
+
+var _ harpoonv1.TTRPCGuestServiceClient = (*managedGuestService)(nil)
+
+func (s *managedGuestService) TimeSync(ctx context.Context, req *harpoonv1.TimeSyncRequest) (*harpoonv1.TimeSyncResponse, error) {
+	return retryIdempotent(ctx, s.m, func(svc harpoonv1.TTRPCGuestServiceClient) (*harpoonv1.TimeSyncResponse, error) {
+		return svc.TimeSync(ctx, req)
+	})
+}
+
+func (s *managedGuestService) Readiness(ctx context.Context, req *harpoonv1.ReadinessRequest) (*harpoonv1.ReadinessResponse, error) {
+	return retryIdempotent(ctx, s.m, func(svc harpoonv1.TTRPCGuestServiceClient) (*harpoonv1.ReadinessResponse, error) {
+		return svc.Readiness(ctx, req)
+	})
+}
+
+func (s *managedGuestService) RunSpec(ctx context.Context, req *harpoonv1.RunSpecRequest) (*harpoonv1.RunSpecResponse, error) {
+	svc, err := s.m.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return svc.RunSpec(ctx, req)
+}
+
+func (s *managedGuestService) RunSpecSignal(ctx context.Context) (harpoonv1.TTRPCGuestService_RunSpecSignalClient, error) {
+	svc, err := s.m.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return svc.RunSpecSignal(ctx)
+}
+
+func (s *managedGuestService) RunCommand(ctx context.Context, req *harpoonv1.RunCommandRequest) (*harpoonv1.RunCommandResponse, error) {
+	svc, err := s.m.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return svc.RunCommand(ctx, req)
+}
+
+func retryIdempotent[T any](ctx context.Context, m *GuestConnectionManager, call func(harpoonv1.TTRPCGuestServiceClient) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+
+	for attempt := 0; attempt <= m.opts.retries(); attempt++ {
+		client, svc, err := m.connect(ctx)
+		if err != nil {
+			return zero, err
+		}
+
+		resp, err := call(svc)
+		if err == nil {
+			return resp, nil
+		}
+
+		if !isGuestConnectionError(err) || ctx.Err() != nil {
+			return zero, err
+		}
+
+		slog.DebugContext(ctx, "guest service call failed on a broken connection, retrying", "attempt", attempt+1, "error", err)
+
+		m.invalidate(client)
+		lastErr = err
+	}
+
+	return zero, errors.Errorf("guest service call failed after %d retries: %w", m.opts.retries(), lastErr)
+}
+
+// isGuestConnectionError reports whether err means the transport failed rather than the RPC itself
+func isGuestConnectionError(err error) bool {
+	switch {
+	case errors.Is(err, ttrpc.ErrClosed),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return status.Code(err) == codes.Unavailable
+}
+
+// dialWithBackoff calls dial until it succeeds, waiting with exponential backoff between attempts, and
+// gives up after opts.DialTimeout
+func dialWithBackoff(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), opts GuestConnectionOptions) (net.Conn, error) {
+	opts = opts.withDefaults()
+
+	timeout := time.NewTimer(opts.DialTimeout)
+	defer timeout.Stop()
+
+	backoff := opts.InitialBackoff
+	lastError := error(errors.Errorf("no dial attempted"))
+
+	for {
+		conn, err := dial(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		lastError = err
+
+		wait := time.NewTimer(backoff)
+		select {
+		case <-wait.C:
+		case <-timeout.C:
+			wait.Stop()
+			return nil, errors.Errorf("timeout waiting for guest connection: %w", lastError)
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, ctx.Err()
+		}
+
+		backoff = min(backoff*2, opts.MaxBackoff)
+	}
+}
@@ -0,0 +1,162 @@
+package vmm
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	harpoonv1 "github.com/walteh/ec1/gen/proto/golang/harpoon/v1"
+)
+
+type countingGuestService struct {
+	harpoonv1.TTRPCGuestServiceService
+	calls atomic.Int32
+}
+
+func (s *countingGuestService) Readiness(ctx context.Context, req *harpoonv1.ReadinessRequest) (*harpoonv1.ReadinessResponse, error) {
+	s.calls.Add(1)
+	return harpoonv1.NewReadinessResponse(func(b *harpoonv1.ReadinessResponse_builder) {
+		b.Ready = ptr(true)
+	}), nil
+}
+
+func (s *countingGuestService) TimeSync(ctx context.Context, req *harpoonv1.TimeSyncRequest) (*harpoonv1.TimeSyncResponse, error) {
+	s.calls.Add(1)
+	return harpoonv1.NewTimeSyncResponse(func(b *harpoonv1.TimeSyncResponse_builder) {}), nil
+}
+
+func serveGuestService(t *testing.T, sock string) (*ttrpc.Server, *countingGuestService) {
+	t.Helper()
+
+	os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	server, err := ttrpc.NewServer()
+	require.NoError(t, err)
+
+	svc := &countingGuestService{}
+	harpoonv1.RegisterTTRPCGuestServiceService(server, svc)
+
+	go server.Serve(context.Background(), l)
+	t.Cleanup(func() { server.Close() })
+
+	return server, svc
+}
+
+func TestGuestConnectionManagerReconnects(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "guestconn")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "guest.sock")
+
+	first, firstSvc := serveGuestService(t, sock)
+
+	mgr := NewGuestConnectionManager(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("unix", sock)
+	}, GuestConnectionOptions{DialTimeout: 2 * time.Second})
+
+	states := mgr.Subscribe()
+	assert.Equal(t, GuestConnectionStateDisconnected, <-states)
+
+	svc := mgr.Service()
+
+	_, err = svc.Readiness(ctx, harpoonv1.NewReadinessRequest(func(b *harpoonv1.ReadinessRequest_builder) {}))
+	require.NoError(t, err)
+	assert.Equal(t, GuestConnectionStateConnected, mgr.State())
+	assert.Equal(t, int32(1), firstSvc.calls.Load())
+
+	// drop the connection from the guest side and bring up a fresh service
+	require.NoError(t, first.Close())
+	_, secondSvc := serveGuestService(t, sock)
+
+	_, err = svc.TimeSync(ctx, harpoonv1.NewTimeSyncRequest(func(b *harpoonv1.TimeSyncRequest_builder) {}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), secondSvc.calls.Load())
+	assert.Equal(t, GuestConnectionStateConnected, mgr.State())
+
+	require.NoError(t, mgr.Close())
+	assert.Equal(t, GuestConnectionStateClosed, mgr.State())
+
+	_, err = mgr.Client(ctx)
+	assert.Error(t, err)
+}
+
+func TestGuestConnectionManagerDialsOnceOutsideTheLock(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "guestconn")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "guest.sock")
+
+	serveGuestService(t, sock)
+
+	release := make(chan struct{})
+	dials := atomic.Int32{}
+	mgr := NewGuestConnectionManager(func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		<-release
+		return net.Dial("unix", sock)
+	}, GuestConnectionOptions{DialTimeout: 2 * time.Second})
+	t.Cleanup(func() { mgr.Close() })
+
+	results := make(chan harpoonv1.TTRPCGuestServiceClient, 3)
+	for range 3 {
+		go func() {
+			svc, err := mgr.Client(ctx)
+			assert.NoError(t, err)
+			results <- svc
+		}()
+	}
+
+	// the state is readable while the dial is blocked
+	require.Eventually(t, func() bool {
+		return mgr.State() == GuestConnectionStateConnecting
+	}, time.Second, time.Millisecond)
+
+	close(release)
+
+	first := <-results
+	assert.Same(t, first, <-results)
+	assert.Same(t, first, <-results)
+	assert.Equal(t, int32(1), dials.Load())
+}
+
+func TestGuestConnectionOptionsRetries(t *testing.T) {
+	assert.Equal(t, 3, GuestConnectionOptions{}.withDefaults().retries())
+	assert.Equal(t, 0, GuestConnectionOptions{MaxRetries: -1}.withDefaults().retries())
+	assert.Equal(t, 0, GuestConnectionOptions{MaxRetries: -1}.withDefaults().withDefaults().retries())
+	assert.Equal(t, 5, GuestConnectionOptions{MaxRetries: 5}.withDefaults().retries())
+}
+
+func TestDialWithBackoffTimeout(t *testing.T) {
+	attempts := 0
+
+	_, err := dialWithBackoff(context.Background(), func(ctx context.Context) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("refused")
+	}, GuestConnectionOptions{DialTimeout: 100 * time.Millisecond, InitialBackoff: 5 * time.Millisecond})
+
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "refused")
+	assert.Greater(t, attempts, 1)
+}
+
+func TestIsGuestConnectionError(t *testing.T) {
+	assert.True(t, isGuestConnectionError(ttrpc.ErrClosed))
+	assert.True(t, isGuestConnectionError(errors.Errorf("calling: %w", net.ErrClosed)))
+	assert.False(t, isGuestConnectionError(errors.New("command failed")))
+}
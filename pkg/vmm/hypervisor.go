@@ -3,16 +3,15 @@ package vmm
 import (
 	"context"
 	"io"
-	"log/slog"
 	"net"
 	"strings"
 	"time"
 
-	"github.com/containerd/ttrpc"
 	"github.com/mholt/archives"
 	"gitlab.com/tozd/go/errors"
 
 	harpoonv1 "github.com/walteh/ec1/gen/proto/golang/harpoon/v1"
+	"github.com/walteh/ec1/pkg/disk"
 	"github.com/walteh/ec1/pkg/ec1init"
 	"github.com/walteh/ec1/pkg/gvnet"
 )
@@ -33,9 +32,8 @@ type Hypervisor[VM VirtualMachine] interface {
 
 type RunningVM[VM VirtualMachine] struct {
 	// streamExecReady bool
-	// manager                *VSockManager
-	guestServiceConnection harpoonv1.TTRPCGuestServiceClient
-	bootloader             Bootloader
+	guestConnection *GuestConnectionManager
+	bootloader      Bootloader
 
 	// streamexec   *streamexec.Client
 	portOnHostIP uint16
@@ -46,8 +44,12 @@ type RunningVM[VM VirtualMachine] struct {
 	stdin        io.Reader
 	stdout       io.Writer
 	stderr       io.Writer
-	// connStatus      <-chan VSockManagerState
-	start time.Time
+	start        time.Time
+	// releaseImage lets the image cache prune the vm's image again, nil when it does not come from the cache
+	releaseImage func()
+	// disks holds the writable disks created for the vm under diskOwner, removed once it stops
+	disks     *disk.Manager
+	diskOwner string
 }
 
 // func (r *RunningVM[VM]) guestService(ctx context.Context) harpoonv1.TTRPCGuestServiceClient {
@@ -67,61 +69,27 @@ type RunningVM[VM VirtualMachine] struct {
 // }
 
 func connectToVsockWithRetry(ctx context.Context, vm VirtualMachine, port uint32) (net.Conn, error) {
+	return dialWithBackoff(ctx, func(ctx context.Context) (net.Conn, error) {
+		return vm.VSockConnect(ctx, port)
+	}, GuestConnectionOptions{})
+}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	timeout := time.NewTimer(3 * time.Second)
-	defer ticker.Stop()
-	defer timeout.Stop()
-
-	lastError := error(errors.Errorf("initial error"))
-
-	for {
-		select {
-		case <-ticker.C:
-			conn, err := vm.VSockConnect(ctx, port)
-			if err != nil {
-				lastError = err
-				continue
-			}
-			return conn, nil
-		case <-timeout.C:
-			return nil, errors.Errorf("timeout waiting for guest service connection: %w", lastError)
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
-	}
+func newGuestConnection(vm VirtualMachine) *GuestConnectionManager {
+	return NewVSockGuestConnectionManager(vm, uint32(ec1init.VsockPort), GuestConnectionOptions{})
 }
 
+// GuestService waits for the guest service to accept a connection and returns a client that follows
+// reconnects
 func (r *RunningVM[VM]) GuestService(ctx context.Context) (harpoonv1.TTRPCGuestServiceClient, error) {
-	if r.guestServiceConnection != nil {
-		return r.guestServiceConnection, nil
+	if _, err := r.guestConnection.Client(ctx); err != nil {
+		return nil, err
 	}
+	return r.guestConnection.Service(), nil
+}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	timeout := time.NewTimer(3 * time.Second)
-	defer ticker.Stop()
-	defer timeout.Stop()
-
-	lastError := error(errors.Errorf("initial error"))
-
-	for {
-		select {
-		case <-ticker.C:
-			conn, err := r.vm.VSockConnect(ctx, uint32(ec1init.VsockPort))
-			if err != nil {
-				lastError = err
-				continue
-			}
-			r.guestServiceConnection = harpoonv1.NewTTRPCGuestServiceClient(ttrpc.NewClient(conn, ttrpc.WithClientDebugging(), ttrpc.WithOnCloseError(func(err error) {
-				slog.Debug("guest service connection closed", "error", err)
-			})))
-			return r.guestServiceConnection, nil
-		case <-timeout.C:
-			return nil, errors.Errorf("timeout waiting for guest service connection: %w", lastError)
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
-	}
+// GuestConnection exposes the guest service connection state
+func (r *RunningVM[VM]) GuestConnection() *GuestConnectionManager {
+	return r.guestConnection
 }
 
 // func NewRunningContainerdVM[VM VirtualMachine](ctx context.Context, vm VM, portOnHostIP uint16, start time.Time, workingDir string, ec1DataDir string, cfg *ContainerizedVMConfig) *RunningVM[VM] {
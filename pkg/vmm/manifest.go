@@ -16,9 +16,11 @@ import (
 	"github.com/rs/xid"
 	"gitlab.com/tozd/go/errors"
 
+	"github.com/walteh/ec1/pkg/disk"
 	"github.com/walteh/ec1/pkg/ec1init"
 	"github.com/walteh/ec1/pkg/ext/osx"
 	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/kernel"
 	"github.com/walteh/ec1/pkg/oci"
 	"github.com/walteh/ec1/pkg/units"
 	"github.com/walteh/ec1/pkg/virtio"
@@ -32,6 +34,13 @@ type ManifestImageConfig struct {
 	StdinReader  io.Reader
 	StdoutWriter io.Writer
 	StderrWriter io.Writer
+	Rootfs       RootfsOptions
+	// KernelCmdLine is merged over the default kernel command line
+	KernelCmdLine *kernel.CmdLine
+	// Initramfs is added to the harpoon initramfs of this vm only
+	Initramfs *HarpoonInitramfs
+	// Disks holds the writable disks of the vm, like the rootfs scratch disk. nil uses the ec1 cache directory
+	Disks *disk.Manager
 }
 
 func NewManifestVirtualMachine[VM VirtualMachine](
@@ -58,7 +67,12 @@ func NewManifestVirtualMachine[VM VirtualMachine](
 		return nil, errors.Errorf("creating working directory: %w", err)
 	}
 
-	ec1Devices, err := PrepareContainerVirtioDevices(ctx, workingDir, imageConfig, cache, errgrp)
+	imageConfig.Disks, err = diskManager(imageConfig.Disks)
+	if err != nil {
+		return nil, errors.Errorf("creating disk manager: %w", err)
+	}
+
+	ec1Devices, imageLease, err := PrepareContainerVirtioDevices(ctx, id, workingDir, imageConfig, cache, errgrp)
 	if err != nil {
 		return nil, errors.Errorf("creating ec1 block device: %w", err)
 	}
@@ -68,7 +82,7 @@ func NewManifestVirtualMachine[VM VirtualMachine](
 
 	switch imageConfig.Platform.OS() {
 	case "linux":
-		bl, bldevs, err := PrepareHarpoonLinuxBootloaderAsync(ctx, workingDir, imageConfig.Platform, errgrp)
+		bl, bldevs, err := PrepareHarpoonLinuxBootloader(ctx, workingDir, imageConfig.Platform, imageConfig.KernelCmdLine, imageConfig.Initramfs)
 		if err != nil {
 			return nil, errors.Errorf("getting boot loader config: %w", err)
 		}
@@ -105,17 +119,20 @@ func NewManifestVirtualMachine[VM VirtualMachine](
 	}
 
 	runner := &RunningVM[VM]{
-		bootloader:             bootloader,
-		start:                  startTime,
-		vm:                     vm,
-		stdin:                  imageConfig.StdinReader,
-		stdout:                 imageConfig.StdoutWriter,
-		stderr:                 imageConfig.StderrWriter,
-		portOnHostIP:           hostIPPort,
-		wait:                   make(chan error, 1),
-		guestServiceConnection: nil,
-		workingDir:             workingDir,
-		netdev:                 netdev,
+		bootloader:      bootloader,
+		start:           startTime,
+		vm:              vm,
+		stdin:           imageConfig.StdinReader,
+		stdout:          imageConfig.StdoutWriter,
+		stderr:          imageConfig.StderrWriter,
+		portOnHostIP:    hostIPPort,
+		wait:            make(chan error, 1),
+		guestConnection: newGuestConnection(vm),
+		workingDir:      workingDir,
+		netdev:          netdev,
+		releaseImage:    imageLease.Release,
+		disks:           imageConfig.Disks,
+		diskOwner:       id,
 	}
 
 	// if ctx.Err() != nil {
@@ -165,7 +182,10 @@ func NewManifestVirtualMachine[VM VirtualMachine](
 	return runner, nil
 }
 
-func PrepareContainerVirtioDevices(ctx context.Context, wrkdir string, imageConfig ManifestImageConfig, cache oci.ImageFetchConverter, wg *errgroup.Group) ([]virtio.VirtioDevice, error) {
+// PrepareContainerVirtioDevices creates the rootfs and runtime devices for the image. the returned lease keeps
+// the image from being pruned from the cache and should be released once the vm stops. writable disks are
+// created in imageConfig.Disks for the vm id.
+func PrepareContainerVirtioDevices(ctx context.Context, id string, wrkdir string, imageConfig ManifestImageConfig, cache oci.ImageFetchConverter, wg *errgroup.Group) ([]virtio.VirtioDevice, *oci.ImageLease, error) {
 
 	ec1DataPath := filepath.Join(wrkdir, "harpoon-runtime-fs-device")
 
@@ -174,35 +194,72 @@ func PrepareContainerVirtioDevices(ctx context.Context, wrkdir string, imageConf
 	for _, path := range []string{ec1DataPath} {
 		err := os.MkdirAll(path, 0755)
 		if err != nil {
-			return nil, errors.Errorf("creating block device directory: %w", err)
+			return nil, nil, errors.Errorf("creating block device directory: %w", err)
 		}
 	}
 
 	diskPath, err := oci.FetchAndConvertImage(ctx, cache, imageConfig.ImageRef, imageConfig.Platform)
 	if err != nil {
-		return nil, errors.Errorf("container to virtio device: %w", err)
+		return nil, nil, errors.Errorf("container to virtio device: %w", err)
 	}
 
-	blkDev, err := virtio.VirtioFsNew(diskPath.RootfsPath, ec1init.RootfsVirtioTag)
+	lease, err := oci.AcquireImage(diskPath)
 	if err != nil {
-		return nil, errors.Errorf("creating block device: %w", err)
+		return nil, nil, errors.Errorf("leasing cached image: %w", err)
 	}
+	leased := false
+	defer func() {
+		if !leased {
+			lease.Release()
+		}
+	}()
+
+	rootfsOpts := imageConfig.Rootfs.withDefaults()
+	rootfsConfig := rootfsOpts.config()
 
-	devices = append(devices, blkDev)
+	switch rootfsOpts.Mode {
+	case ec1init.RootfsModeBlock:
+		imagePath, format := diskPath.BlockImage()
+		if !supportsFilesystem(harpoonKernelConfig(imageConfig.Platform), format) {
+			return nil, nil, errors.Errorf("image %s is a %s block image, which the embedded %s kernel cannot mount", imageConfig.ImageRef, format, imageConfig.Platform.Arch())
+		}
+		rootfsConfig.Filesystem = string(format)
+
+		blkDevs, err := PrepareBlockRootfsDevices(ctx, imageConfig.Disks, id, imagePath, rootfsOpts)
+		if err != nil {
+			return nil, nil, errors.Errorf("creating block rootfs devices: %w", err)
+		}
+		devices = append(devices, blkDevs...)
+	default:
+		if diskPath.RootfsPath == "" {
+			return nil, nil, errors.Errorf("image %s was converted without a rootfs directory, use the block rootfs mode", imageConfig.ImageRef)
+		}
+		blkDev, err := virtio.VirtioFsNew(diskPath.RootfsPath, ec1init.RootfsVirtioTag)
+		if err != nil {
+			return nil, nil, errors.Errorf("creating block device: %w", err)
+		}
+		devices = append(devices, blkDev)
+	}
 
 	// save all the files to a temp file
 	metadataBytes, err := json.Marshal(diskPath.Metadata)
 	if err != nil {
-		return nil, errors.Errorf("marshalling metadata: %w", err)
+		return nil, nil, errors.Errorf("marshalling metadata: %w", err)
+	}
+
+	rootfsBytes, err := json.Marshal(rootfsConfig)
+	if err != nil {
+		return nil, nil, errors.Errorf("marshalling rootfs config: %w", err)
 	}
 
 	// cmdlineBytes, err := json.Marshal(imageConfig.Cmdline)
 	// if err != nil {
-	// 	return nil, errors.Errorf("marshalling cmdline: %w", err)
+	// 	return nil, nil, errors.Errorf("marshalling cmdline: %w", err)
 	// }
 
 	files := map[string][]byte{
 		ec1init.ContainerManifestFile: metadataBytes,
+		ec1init.ContainerRootfsFile:   rootfsBytes,
 		// ec1init.ContainerCmdlineFile:  cmdlineBytes,
 	}
 
@@ -210,18 +267,19 @@ func PrepareContainerVirtioDevices(ctx context.Context, wrkdir string, imageConf
 		filePath := filepath.Join(ec1DataPath, name)
 		err = osx.WriteFileFromReaderAsync(ctx, filePath, bytes.NewReader(file), 0644, wg)
 		if err != nil {
-			return nil, errors.Errorf("writing file to block device: %w", err)
+			return nil, nil, errors.Errorf("writing file to block device: %w", err)
 		}
 	}
 
 	ec1Dev, err := virtio.VirtioFsNew(ec1DataPath, ec1init.Ec1VirtioTag)
 	if err != nil {
-		return nil, errors.Errorf("creating block device: %w", err)
+		return nil, nil, errors.Errorf("creating block device: %w", err)
 	}
 
 	devices = append(devices, ec1Dev)
 
-	return devices, nil
+	leased = true
+	return devices, lease, nil
 }
 
 func bootContainerVM[VM VirtualMachine](ctx context.Context, vm VM) error {
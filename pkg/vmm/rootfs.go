@@ -0,0 +1,245 @@
+package vmm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/rs/xid"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/disk"
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/oci"
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+const (
+	DefaultRootfsScratchSize = strongunits.B(4 << 30) // 4 GiB, sparse on the host
+
+	rootfsExt4File = "rootfs.ext4"
+	// rootfsScratchDisk names the scratch disk among the disks of a vm
+	rootfsScratchDisk = "rootfs-scratch"
+)
+
+// RootfsOptions controls how the container rootfs is attached to the VM
+type RootfsOptions struct {
+	Mode        ec1init.RootfsMode
+	Scratch     ec1init.RootfsScratch
+	ScratchSize strongunits.B
+}
+
+func (o RootfsOptions) withDefaults() RootfsOptions {
+	if o.Mode == "" {
+		o.Mode = ec1init.RootfsModeVirtioFs
+	}
+	if o.Scratch == "" {
+		o.Scratch = ec1init.RootfsScratchTmpfs
+	}
+	if o.ScratchSize == 0 {
+		o.ScratchSize = DefaultRootfsScratchSize
+	}
+	return o
+}
+
+func (o RootfsOptions) config() *ec1init.RootfsConfig {
+	cfg := &ec1init.RootfsConfig{
+		Mode: o.Mode,
+	}
+	if o.Mode == ec1init.RootfsModeBlock {
+		cfg.Scratch = o.Scratch
+	}
+	return cfg
+}
+
+// RootfsOptionsFromAnnotations reads the rootfs mode selection from container annotations
+func RootfsOptionsFromAnnotations(annotations map[string]string) (RootfsOptions, error) {
+	opts := RootfsOptions{}
+
+	switch mode := ec1init.RootfsMode(annotations[ec1init.RootfsModeAnnotation]); mode {
+	case "", ec1init.RootfsModeVirtioFs, ec1init.RootfsModeBlock:
+		opts.Mode = mode
+	default:
+		return opts, errors.Errorf("invalid %s annotation: %q", ec1init.RootfsModeAnnotation, mode)
+	}
+
+	switch scratch := ec1init.RootfsScratch(annotations[ec1init.RootfsScratchAnnotation]); scratch {
+	case "", ec1init.RootfsScratchTmpfs, ec1init.RootfsScratchDisk:
+		opts.Scratch = scratch
+	default:
+		return opts, errors.Errorf("invalid %s annotation: %q", ec1init.RootfsScratchAnnotation, scratch)
+	}
+
+	if size, ok := annotations[ec1init.RootfsScratchSizeAnnotation]; ok {
+		mib, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			return opts, errors.Errorf("invalid %s annotation (expected MiB): %w", ec1init.RootfsScratchSizeAnnotation, err)
+		}
+		opts.ScratchSize = strongunits.MiB(mib).ToBytes()
+	}
+
+	return opts.withDefaults(), nil
+}
+
+// diskManager is disks, or the disk manager in the ec1 cache directory when it is nil
+func diskManager(disks *disk.Manager) (*disk.Manager, error) {
+	if disks != nil {
+		return disks, nil
+	}
+	return disk.NewDefaultManager()
+}
+
+// PrepareBlockRootfsDevices attaches imagePath as a read-only virtio-blk device and, when requested,
+// a sparse scratch disk that harpoond formats and uses as the writable overlay layer. the scratch disk is
+// created in disks for owner, which releases it once the vm stops.
+func PrepareBlockRootfsDevices(ctx context.Context, disks *disk.Manager, owner string, imagePath string, opts RootfsOptions) ([]virtio.VirtioDevice, error) {
+	opts = opts.withDefaults()
+
+	devices := []virtio.VirtioDevice{}
+
+	imageDev, err := virtio.VirtioBlkNew(imagePath)
+	if err != nil {
+		return nil, errors.Errorf("creating rootfs block device: %w", err)
+	}
+	imageDev.ReadOnly = true
+	imageDev.SetDeviceIdentifier(ec1init.RootfsImageBlockSerial)
+
+	devices = append(devices, imageDev)
+
+	if opts.Scratch == ec1init.RootfsScratchDisk {
+		scratchDev, err := disks.NewVirtioBlk(ctx, "", owner, rootfsScratchDisk, opts.ScratchSize)
+		if err != nil {
+			return nil, errors.Errorf("creating rootfs scratch disk: %w", err)
+		}
+		scratchDev.SetDeviceIdentifier(ec1init.RootfsScratchBlockSerial)
+
+		devices = append(devices, scratchDev)
+	}
+
+	slog.InfoContext(ctx, "using block device rootfs",
+		"image", imagePath,
+		"scratch", opts.Scratch,
+		"scratch_size", opts.ScratchSize)
+
+	return devices, nil
+}
+
+// prepareBlockRootfsFromDirectory attaches the ext4 image of a rootfs directory (for example a containerd
+// snapshot). images are cached by the snapshot they are packed from, so a snapshot is only packed the first
+// time a vm uses it; that conversion runs on wg so it overlaps with the rest of the VM setup. the returned
+// lease keeps the image from being pruned while the vm runs.
+func prepareBlockRootfsFromDirectory(ctx context.Context, disks *disk.Manager, owner string, rootfsDir string, opts RootfsOptions, wg *errgroup.Group) ([]virtio.VirtioDevice, *oci.ImageLease, error) {
+	cacheDir, err := blockRootfsCacheDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, lease, err := cachedBlockRootfs(ctx, cacheDir, rootfsDir, wg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	devices, err := PrepareBlockRootfsDevices(ctx, disks, owner, img.Ext4Path, opts)
+	if err != nil {
+		lease.Release()
+		return nil, nil, err
+	}
+
+	return devices, lease, nil
+}
+
+// blockRootfsCacheDir holds the ext4 images packed from rootfs directories, one oci.CacheManager entry per
+// snapshot, so they are leased and pruned like converted images
+func blockRootfsCacheDir() (string, error) {
+	prefix, err := host.CacheDirPrefix()
+	if err != nil {
+		return "", errors.Errorf("getting cache dir prefix: %w", err)
+	}
+	return filepath.Join(prefix, "rootfs-block"), nil
+}
+
+// cachedBlockRootfs leases the cached ext4 image of rootfsDir, packing it on wg when it is not cached yet
+func cachedBlockRootfs(ctx context.Context, cacheDir string, rootfsDir string, wg *errgroup.Group) (*oci.Image, *oci.ImageLease, error) {
+	key, err := blockRootfsKey(rootfsDir)
+	if err != nil {
+		return nil, nil, errors.Errorf("identifying rootfs %s: %w", rootfsDir, err)
+	}
+
+	ext4Path := filepath.Join(cacheDir, key, rootfsExt4File)
+	img := &oci.Image{
+		RootfsPath: rootfsDir,
+		Ext4Path:   ext4Path,
+		Format:     oci.ImageFormatExt4,
+		DiskPath:   ext4Path,
+	}
+
+	// leasing first creates the entry and keeps a concurrent prune from removing the image being packed
+	lease, err := oci.AcquireImage(img)
+	if err != nil {
+		return nil, nil, errors.Errorf("leasing rootfs image: %w", err)
+	}
+
+	if _, err := os.Stat(ext4Path); err == nil {
+		slog.InfoContext(ctx, "reusing ext4 image of rootfs", "rootfs", rootfsDir, "ext4", ext4Path)
+		return img, lease, nil
+	}
+
+	wg.Go(func() error {
+		// vms packing the same snapshot at once each write their own file, the last rename wins
+		tmpPath := ext4Path + "." + xid.New().String() + ".tmp"
+		if err := oci.CreateExt4FromDirectory(ctx, rootfsDir, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return errors.Errorf("creating ext4 image from rootfs %s: %w", rootfsDir, err)
+		}
+		if err := os.Rename(tmpPath, ext4Path); err != nil {
+			os.Remove(tmpPath)
+			return errors.Errorf("caching ext4 image of rootfs %s: %w", rootfsDir, err)
+		}
+		return nil
+	})
+
+	return img, lease, nil
+}
+
+// blockRootfsKey names the cache entry of a rootfs directory after its path, which is the snapshot key, and
+// the name, mode, size and modification time of everything in it, so a snapshot that changed is packed again
+func blockRootfsKey(rootfsDir string) (string, error) {
+	rootfsDir, err := filepath.Abs(rootfsDir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", rootfsDir)
+
+	err = filepath.WalkDir(rootfsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfsDir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o %d %d\n", rel, fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
@@ -0,0 +1,117 @@
+package vmm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/disk"
+	"github.com/walteh/ec1/pkg/ec1init"
+	"github.com/walteh/ec1/pkg/oci"
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+func TestRootfsOptionsFromAnnotations(t *testing.T) {
+	opts, err := RootfsOptionsFromAnnotations(nil)
+	require.NoError(t, err)
+	assert.Equal(t, ec1init.RootfsModeVirtioFs, opts.Mode)
+	assert.Equal(t, ec1init.RootfsScratchTmpfs, opts.Scratch)
+	assert.Equal(t, DefaultRootfsScratchSize, opts.ScratchSize)
+
+	opts, err = RootfsOptionsFromAnnotations(map[string]string{
+		ec1init.RootfsModeAnnotation:        "block",
+		ec1init.RootfsScratchAnnotation:     "disk",
+		ec1init.RootfsScratchSizeAnnotation: "512",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ec1init.RootfsModeBlock, opts.Mode)
+	assert.Equal(t, ec1init.RootfsScratchDisk, opts.Scratch)
+	assert.Equal(t, strongunits.MiB(512).ToBytes(), opts.ScratchSize)
+
+	_, err = RootfsOptionsFromAnnotations(map[string]string{ec1init.RootfsModeAnnotation: "nfs"})
+	assert.Error(t, err)
+
+	_, err = RootfsOptionsFromAnnotations(map[string]string{ec1init.RootfsScratchSizeAnnotation: "big"})
+	assert.Error(t, err)
+}
+
+func TestPrepareBlockRootfsDevices(t *testing.T) {
+	ctx := context.Background()
+	disks := disk.NewManager(t.TempDir())
+
+	devices, err := PrepareBlockRootfsDevices(ctx, disks, "vm-1", "/cache/rootfs.ext4", RootfsOptions{
+		Mode:        ec1init.RootfsModeBlock,
+		Scratch:     ec1init.RootfsScratchDisk,
+		ScratchSize: strongunits.MiB(8).ToBytes(),
+	})
+	require.NoError(t, err)
+
+	blks := virtio.VirtioDevicesOfType[*virtio.VirtioBlk](devices)
+	require.Len(t, blks, 2)
+
+	assert.Equal(t, "/cache/rootfs.ext4", blks[0].ImagePath)
+	assert.True(t, blks[0].ReadOnly)
+	assert.Equal(t, ec1init.RootfsImageBlockSerial, blks[0].DeviceIdentifier)
+
+	assert.False(t, blks[1].ReadOnly)
+	assert.Equal(t, ec1init.RootfsScratchBlockSerial, blks[1].DeviceIdentifier)
+
+	// the scratch disk belongs to the vm in the disk manager, which removes it once the vm stops
+	fi, err := os.Stat(blks[1].ImagePath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), fi.Size())
+	require.NoError(t, disks.Release(ctx, "vm-1"))
+	assert.NoFileExists(t, blks[1].ImagePath)
+
+	// tmpfs scratch only needs the image
+	devices, err = PrepareBlockRootfsDevices(ctx, disks, "vm-2", "/cache/rootfs.ext4", RootfsOptions{Mode: ec1init.RootfsModeBlock})
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+}
+
+func TestCachedBlockRootfsPacksASnapshotOnce(t *testing.T) {
+	ctx := context.Background()
+	cacheDir := t.TempDir()
+	rootfsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootfsDir, "hello"), []byte("hello"), 0o644))
+
+	pack := func() (*oci.ImageLease, string) {
+		var wg errgroup.Group
+		img, lease, err := cachedBlockRootfs(ctx, cacheDir, rootfsDir, &wg)
+		require.NoError(t, err)
+		require.NoError(t, wg.Wait())
+		return lease, img.Ext4Path
+	}
+
+	lease, first := pack()
+	defer lease.Release()
+	fi, err := os.Stat(first)
+	require.NoError(t, err)
+
+	// leased while the vm runs, so pruning keeps it
+	entries, err := oci.NewCacheManager(cacheDir).Entries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].InUse)
+
+	lease, second := pack()
+	defer lease.Release()
+	assert.Equal(t, first, second)
+	again, err := os.Stat(second)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(fi, again), "the cached image should be reused, not packed again")
+
+	// a snapshot that changed is packed again
+	require.NoError(t, os.WriteFile(filepath.Join(rootfsDir, "hello"), []byte("hello, again"), 0o644))
+	lease, third := pack()
+	defer lease.Release()
+	assert.NotEqual(t, first, third)
+	assert.FileExists(t, third)
+}
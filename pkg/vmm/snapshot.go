@@ -0,0 +1,709 @@
+package vmm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+const (
+	snapshotInfoFile     = "snapshot.json"
+	snapshotStateFile    = "machine-state"
+	snapshotManifestFile = "manifest.json"
+
+	snapshotExportVersion = 1
+
+	// legacySnapshotExtension names the machine state files the vf backend saved before the catalog, as
+	// <cache>/vm/<vm id>/snapshots/<sha256 of the requested path>.ec1-vf-snapshot
+	legacySnapshotExtension = ".ec1-vf-snapshot"
+
+	// snapshotStateTimeout bounds the wait for a vm to pause or resume around a snapshot
+	snapshotStateTimeout = 30 * time.Second
+)
+
+// SnapshotInfo describes a saved VM snapshot in the catalog
+type SnapshotInfo struct {
+	ID         string           `json:"id"`
+	SourceVMID string           `json:"source_vm_id"`
+	Vcpus      uint64           `json:"vcpus"`
+	Memory     strongunits.B    `json:"memory"`
+	Devices    []SnapshotDevice `json:"devices"`
+	CreatedAt  time.Time        `json:"created_at"`
+	// Size is the size on disk of the files of the snapshot, refreshed on read
+	Size int64 `json:"size"`
+}
+
+// SnapshotDevice records a device the snapshotted VM was configured with. restoring a snapshot requires
+// an identical device configuration.
+type SnapshotDevice struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// SnapshotPrunePolicy selects snapshots to delete. a zero value field is ignored.
+type SnapshotPrunePolicy struct {
+	// MaxAge deletes snapshots older than this
+	MaxAge time.Duration
+	// MaxCount keeps only the newest MaxCount snapshots of each source VM
+	MaxCount int
+}
+
+// snapshotExportManifest is the first entry of an exported snapshot tarball
+type snapshotExportManifest struct {
+	Version  int                  `json:"version"`
+	Snapshot SnapshotInfo         `json:"snapshot"`
+	Files    []snapshotExportFile `json:"files"`
+}
+
+type snapshotExportFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// SnapshotCatalog tracks VM snapshots on disk, independent of the hypervisor backend
+//
+//	<root>/<id>/snapshot.json  SnapshotInfo
+//	<root>/<id>/machine-state  the backend's saved machine state
+type SnapshotCatalog struct {
+	root string
+}
+
+func NewSnapshotCatalog(root string) *SnapshotCatalog {
+	return &SnapshotCatalog{
+		root: root,
+	}
+}
+
+// NewDefaultSnapshotCatalog creates a catalog rooted in the ec1 host cache directory, removing the snapshots
+// saved there before the catalog existed
+func NewDefaultSnapshotCatalog(ctx context.Context) (*SnapshotCatalog, error) {
+	prefix, err := host.CacheDirPrefix()
+	if err != nil {
+		return nil, errors.Errorf("getting cache dir prefix: %w", err)
+	}
+
+	if _, err := RemoveLegacySnapshots(ctx, prefix); err != nil {
+		slog.WarnContext(ctx, "error removing legacy vm snapshots", "error", err)
+	}
+
+	return NewSnapshotCatalog(filepath.Join(prefix, "snapshots")), nil
+}
+
+// RemoveLegacySnapshots deletes the machine state files the vf backend saved under cacheDir before the catalog.
+// they recorded neither the vm configuration nor the path they were saved for, so they can be neither imported
+// nor restored, and only take up disk space.
+func RemoveLegacySnapshots(ctx context.Context, cacheDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(cacheDir, "vm", "*", "snapshots", "*"+legacySnapshotExtension))
+	if err != nil {
+		return nil, errors.Errorf("finding legacy snapshots: %w", err)
+	}
+
+	removed := []string{}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return removed, errors.Errorf("removing legacy snapshot %s: %w", path, err)
+		}
+		removed = append(removed, path)
+
+		// the snapshots directory only ever held legacy snapshots, drop it once it is empty
+		os.Remove(filepath.Dir(path))
+	}
+
+	if len(removed) > 0 {
+		slog.InfoContext(ctx, "removed legacy vm snapshots", "count", len(removed), "cache_dir", cacheDir)
+	}
+
+	return removed, nil
+}
+
+func (c *SnapshotCatalog) Root() string {
+	return c.root
+}
+
+func (c *SnapshotCatalog) snapshotDir(id string) string {
+	return filepath.Join(c.root, id)
+}
+
+// StatePath is the path of the backend machine state file for snapshot id
+func (c *SnapshotCatalog) StatePath(id string) string {
+	return filepath.Join(c.snapshotDir(id), snapshotStateFile)
+}
+
+// Save snapshots vm into the catalog
+func (c *SnapshotCatalog) Save(ctx context.Context, vm VirtualMachine) (*SnapshotInfo, error) {
+	now := time.Now().UTC()
+
+	info := &SnapshotInfo{
+		ID:         fmt.Sprintf("%s-%s", vm.ID(), now.Format("20060102T150405.000000000Z")),
+		SourceVMID: vm.ID(),
+		CreatedAt:  now,
+	}
+
+	if opts := vm.Opts(); opts != nil {
+		info.Vcpus = opts.Vcpus
+		info.Memory = opts.Memory
+	}
+
+	devices, err := snapshotDevices(vm.Devices())
+	if err != nil {
+		return nil, errors.Errorf("recording devices: %w", err)
+	}
+	info.Devices = devices
+
+	dir := c.snapshotDir(info.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Errorf("creating snapshot directory: %w", err)
+	}
+
+	if err := vm.SaveFullSnapshot(ctx, c.StatePath(info.ID)); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Errorf("saving snapshot: %w", err)
+	}
+
+	if err := c.writeInfo(info); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "saved vm snapshot", "id", info.ID, "vm", info.SourceVMID, "size", info.Size)
+
+	return info, nil
+}
+
+// Restore restores vm from snapshot id. vm has to be configured like the snapshotted vm: the same vcpus,
+// memory and devices, in the same order.
+func (c *SnapshotCatalog) Restore(ctx context.Context, vm VirtualMachine, id string) error {
+	info, err := c.Inspect(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSnapshotConfig(info, vm); err != nil {
+		return errors.Errorf("restoring snapshot %s into vm %s: %w", id, vm.ID(), err)
+	}
+
+	if err := vm.RestoreFromFullSnapshot(ctx, c.StatePath(id)); err != nil {
+		return errors.Errorf("restoring snapshot %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// List returns every snapshot in the catalog, newest first
+func (c *SnapshotCatalog) List(ctx context.Context) ([]*SnapshotInfo, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading snapshot catalog: %w", err)
+	}
+
+	infos := []*SnapshotInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := c.readInfo(entry.Name())
+		if err != nil {
+			slog.WarnContext(ctx, "skipping unreadable snapshot", "id", entry.Name(), "error", err)
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b *SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return infos, nil
+}
+
+// Inspect returns the catalog entry for snapshot id
+func (c *SnapshotCatalog) Inspect(ctx context.Context, id string) (*SnapshotInfo, error) {
+	if err := validateSnapshotID(id); err != nil {
+		return nil, err
+	}
+
+	info, err := c.readInfo(id)
+	if err != nil {
+		return nil, errors.Errorf("inspecting snapshot %s: %w", id, err)
+	}
+
+	return info, nil
+}
+
+// Delete removes snapshot id from the catalog
+func (c *SnapshotCatalog) Delete(ctx context.Context, id string) error {
+	if err := validateSnapshotID(id); err != nil {
+		return err
+	}
+
+	dir := c.snapshotDir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return errors.Errorf("snapshot %s: %w", id, err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Errorf("deleting snapshot %s: %w", id, err)
+	}
+
+	slog.InfoContext(ctx, "deleted vm snapshot", "id", id)
+
+	return nil
+}
+
+// Prune deletes the snapshots selected by policy and returns their ids
+func (c *SnapshotCatalog) Prune(ctx context.Context, policy SnapshotPrunePolicy) ([]string, error) {
+	infos, err := c.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	perVM := map[string]int{}
+	pruned := []string{}
+
+	// infos are newest first, so the count check keeps the newest snapshots of each vm
+	for _, info := range infos {
+		perVM[info.SourceVMID]++
+
+		expired := policy.MaxAge > 0 && now.Sub(info.CreatedAt) > policy.MaxAge
+		overflow := policy.MaxCount > 0 && perVM[info.SourceVMID] > policy.MaxCount
+
+		if !expired && !overflow {
+			continue
+		}
+
+		if err := c.Delete(ctx, info.ID); err != nil {
+			return pruned, err
+		}
+
+		pruned = append(pruned, info.ID)
+	}
+
+	return pruned, nil
+}
+
+// Export writes snapshot id to w as a gzipped tarball whose first entry is a manifest with file digests
+func (c *SnapshotCatalog) Export(ctx context.Context, id string, w io.Writer) error {
+	info, err := c.Inspect(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	dir := c.snapshotDir(id)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Errorf("reading snapshot directory: %w", err)
+	}
+
+	manifest := snapshotExportManifest{
+		Version:  snapshotExportVersion,
+		Snapshot: *info,
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == snapshotInfoFile {
+			continue
+		}
+
+		digest, size, err := digestFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return errors.Errorf("hashing %s: %w", entry.Name(), err)
+		}
+
+		manifest.Files = append(manifest.Files, snapshotExportFile{
+			Name:   entry.Name(),
+			Size:   size,
+			Digest: digest,
+		})
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Errorf("marshalling manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    snapshotManifestFile,
+		Mode:    0644,
+		Size:    int64(len(manifestData)),
+		ModTime: info.CreatedAt,
+	}); err != nil {
+		return errors.Errorf("writing manifest header: %w", err)
+	}
+
+	if _, err := tw.Write(manifestData); err != nil {
+		return errors.Errorf("writing manifest: %w", err)
+	}
+
+	for _, file := range manifest.Files {
+		if err := writeTarFile(tw, filepath.Join(dir, file.Name), file, info.CreatedAt); err != nil {
+			return errors.Errorf("writing %s: %w", file.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Errorf("closing tar writer: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return errors.Errorf("closing gzip writer: %w", err)
+	}
+
+	slog.InfoContext(ctx, "exported vm snapshot", "id", id, "files", len(manifest.Files))
+
+	return nil
+}
+
+// Import reads a tarball written by Export into the catalog. every file is checked against the manifest
+// digests before the snapshot becomes visible.
+func (c *SnapshotCatalog) Import(ctx context.Context, r io.Reader) (*SnapshotInfo, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Errorf("opening gzip reader: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Errorf("reading manifest header: %w", err)
+	}
+
+	if hdr.Name != snapshotManifestFile {
+		return nil, errors.Errorf("expected %s as the first entry, got %s", snapshotManifestFile, hdr.Name)
+	}
+
+	var manifest snapshotExportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, errors.Errorf("decoding manifest: %w", err)
+	}
+
+	if manifest.Version != snapshotExportVersion {
+		return nil, errors.Errorf("unsupported snapshot export version %d", manifest.Version)
+	}
+
+	info := manifest.Snapshot
+	if err := validateSnapshotID(info.ID); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(c.snapshotDir(info.ID)); err == nil {
+		return nil, errors.Errorf("snapshot %s already exists", info.ID)
+	}
+
+	if err := os.MkdirAll(c.root, 0755); err != nil {
+		return nil, errors.Errorf("creating snapshot catalog: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(c.root, ".import-")
+	if err != nil {
+		return nil, errors.Errorf("creating import directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	expected := map[string]snapshotExportFile{}
+	for _, file := range manifest.Files {
+		expected[file.Name] = file
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("reading tarball: %w", err)
+		}
+
+		file, ok := expected[hdr.Name]
+		if !ok {
+			return nil, errors.Errorf("unexpected file %q in snapshot tarball", hdr.Name)
+		}
+		delete(expected, hdr.Name)
+
+		if err := readTarFile(tr, filepath.Join(tmpDir, filepath.Base(file.Name)), file); err != nil {
+			return nil, errors.Errorf("importing %s: %w", file.Name, err)
+		}
+	}
+
+	if len(expected) > 0 {
+		return nil, errors.Errorf("snapshot tarball is missing %d files", len(expected))
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, errors.Errorf("marshalling snapshot info: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, snapshotInfoFile), data, 0644); err != nil {
+		return nil, errors.Errorf("writing snapshot info: %w", err)
+	}
+
+	if err := os.Rename(tmpDir, c.snapshotDir(info.ID)); err != nil {
+		return nil, errors.Errorf("moving snapshot into place: %w", err)
+	}
+
+	slog.InfoContext(ctx, "imported vm snapshot", "id", info.ID, "vm", info.SourceVMID)
+
+	return c.Inspect(ctx, info.ID)
+}
+
+func (c *SnapshotCatalog) writeInfo(info *SnapshotInfo) error {
+	size, err := dirSize(c.snapshotDir(info.ID))
+	if err != nil {
+		return errors.Errorf("sizing snapshot: %w", err)
+	}
+	info.Size = size
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return errors.Errorf("marshalling snapshot info: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(c.snapshotDir(info.ID), snapshotInfoFile), data, 0644); err != nil {
+		return errors.Errorf("writing snapshot info: %w", err)
+	}
+
+	return nil
+}
+
+func (c *SnapshotCatalog) readInfo(id string) (*SnapshotInfo, error) {
+	data, err := os.ReadFile(filepath.Join(c.snapshotDir(id), snapshotInfoFile))
+	if err != nil {
+		return nil, errors.Errorf("reading snapshot info: %w", err)
+	}
+
+	var info SnapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.Errorf("unmarshalling snapshot info: %w", err)
+	}
+
+	size, err := dirSize(c.snapshotDir(id))
+	if err != nil {
+		return nil, errors.Errorf("sizing snapshot: %w", err)
+	}
+	info.Size = size
+
+	return &info, nil
+}
+
+func snapshotDevices(devices []virtio.VirtioDevice) ([]SnapshotDevice, error) {
+	out := make([]SnapshotDevice, 0, len(devices))
+	for _, dev := range devices {
+		cfg, err := json.Marshal(dev)
+		if err != nil {
+			return nil, errors.Errorf("marshalling %T: %w", dev, err)
+		}
+		out = append(out, SnapshotDevice{
+			Type:   strings.TrimPrefix(fmt.Sprintf("%T", dev), "*"),
+			Config: cfg,
+		})
+	}
+	return out, nil
+}
+
+// checkSnapshotConfig compares the configuration recorded in info with the one of vm, naming the first difference
+func checkSnapshotConfig(info *SnapshotInfo, vm VirtualMachine) error {
+	var vcpus uint64
+	var memory strongunits.B
+	if opts := vm.Opts(); opts != nil {
+		vcpus, memory = opts.Vcpus, opts.Memory
+	}
+
+	if vcpus != info.Vcpus {
+		return errors.Errorf("snapshot was taken with %d vcpus, the vm has %d", info.Vcpus, vcpus)
+	}
+	if memory != info.Memory {
+		return errors.Errorf("snapshot was taken with %d bytes of memory, the vm has %d", info.Memory, memory)
+	}
+
+	devices, err := snapshotDevices(vm.Devices())
+	if err != nil {
+		return errors.Errorf("recording devices: %w", err)
+	}
+
+	if len(devices) != len(info.Devices) {
+		return errors.Errorf("snapshot was taken with %d devices, the vm has %d", len(info.Devices), len(devices))
+	}
+
+	for i, want := range info.Devices {
+		got := devices[i]
+		if got.Type != want.Type {
+			return errors.Errorf("device %d is a %s in the snapshot, the vm has a %s", i, want.Type, got.Type)
+		}
+
+		same, err := sameJSON(want.Config, got.Config)
+		if err != nil {
+			return errors.Errorf("comparing device %d: %w", i, err)
+		}
+		if !same {
+			return errors.Errorf("device %d (%s) is configured differently: snapshot has %s, the vm has %s", i, want.Type, want.Config, got.Config)
+		}
+	}
+
+	return nil
+}
+
+// sameJSON compares two json documents ignoring whitespace, which snapshot.json adds to the device configs
+func sameJSON(a, b json.RawMessage) (bool, error) {
+	var ca, cb bytes.Buffer
+	if err := json.Compact(&ca, a); err != nil {
+		return false, err
+	}
+	if err := json.Compact(&cb, b); err != nil {
+		return false, err
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes()), nil
+}
+
+// saveRunningSnapshot saves vm into catalog, pausing it for the save when it is running
+func saveRunningSnapshot(ctx context.Context, catalog *SnapshotCatalog, vm VirtualMachine) (*SnapshotInfo, error) {
+	if vm.CurrentState() == VirtualMachineStateTypeRunning {
+		if err := vm.Pause(ctx); err != nil {
+			return nil, errors.Errorf("pausing vm: %w", err)
+		}
+		if err := WaitForVMState(ctx, vm, VirtualMachineStateTypePaused, time.After(snapshotStateTimeout)); err != nil {
+			return nil, errors.Errorf("waiting for vm to pause: %w", err)
+		}
+		defer func() {
+			if err := vm.Resume(ctx); err != nil {
+				slog.ErrorContext(ctx, "error resuming vm after snapshot", "error", err)
+			}
+		}()
+	}
+
+	return catalog.Save(ctx, vm)
+}
+
+// resumeFromSnapshot restores a stopped vm from snapshot id and resumes it, in place of booting it
+func resumeFromSnapshot(ctx context.Context, catalog *SnapshotCatalog, vm VirtualMachine, id string) error {
+	if err := catalog.Restore(ctx, vm, id); err != nil {
+		return err
+	}
+
+	if err := vm.Resume(ctx); err != nil {
+		return errors.Errorf("resuming vm: %w", err)
+	}
+
+	if err := WaitForVMState(ctx, vm, VirtualMachineStateTypeRunning, time.After(snapshotStateTimeout)); err != nil {
+		return errors.Errorf("waiting for vm to resume: %w", err)
+	}
+
+	return nil
+}
+
+func validateSnapshotID(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return errors.Errorf("invalid snapshot id %q", id)
+	}
+	return nil
+}
+
+// dirSize sums the files of a snapshot directory, without snapshot.json so the size doesn't change once
+// it is written
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && d.Name() != snapshotInfoFile {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func digestFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func writeTarFile(tw *tar.Writer, path string, file snapshotExportFile, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    file.Name,
+		Mode:    0644,
+		Size:    file.Size,
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, file.Size)
+	return err
+}
+
+func readTarFile(r io.Reader, path string, file snapshotExportFile) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return err
+	}
+
+	if n != file.Size {
+		return errors.Errorf("size mismatch: expected %d, got %d", file.Size, n)
+	}
+
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != file.Digest {
+		return errors.Errorf("digest mismatch: expected %s, got %s", file.Digest, digest)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,236 @@
+package vmm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/ec1/pkg/virtio"
+)
+
+// snapshotTestVM implements just enough of VirtualMachine for the catalog
+type snapshotTestVM struct {
+	VirtualMachine
+	id       string
+	restored string
+	// vcpus and share default to 2 and /tmp/share
+	vcpus uint64
+	share string
+	// state is the vm state, savedIn the state it was saved in
+	state   VirtualMachineStateType
+	savedIn VirtualMachineStateType
+}
+
+func (v *snapshotTestVM) ID() string { return v.id }
+
+func (v *snapshotTestVM) Opts() *NewVMOptions {
+	vcpus := v.vcpus
+	if vcpus == 0 {
+		vcpus = 2
+	}
+	return &NewVMOptions{Vcpus: vcpus, Memory: strongunits.MiB(512).ToBytes()}
+}
+
+func (v *snapshotTestVM) Devices() []virtio.VirtioDevice {
+	share := v.share
+	if share == "" {
+		share = "/tmp/share"
+	}
+	fs, _ := virtio.VirtioFsNew(share, "share")
+	return []virtio.VirtioDevice{fs}
+}
+
+func (v *snapshotTestVM) CurrentState() VirtualMachineStateType { return v.state }
+
+func (v *snapshotTestVM) StateChangeNotify(ctx context.Context) <-chan VirtualMachineStateChange {
+	return nil
+}
+
+func (v *snapshotTestVM) Pause(ctx context.Context) error {
+	v.state = VirtualMachineStateTypePaused
+	return nil
+}
+
+func (v *snapshotTestVM) Resume(ctx context.Context) error {
+	v.state = VirtualMachineStateTypeRunning
+	return nil
+}
+
+func (v *snapshotTestVM) SaveFullSnapshot(ctx context.Context, path string) error {
+	v.savedIn = v.state
+	return os.WriteFile(path, []byte("machine state of "+v.id), 0644)
+}
+
+func (v *snapshotTestVM) RestoreFromFullSnapshot(ctx context.Context, path string) error {
+	v.restored = path
+	v.state = VirtualMachineStateTypePaused
+	return nil
+}
+
+func TestSnapshotCatalogSaveListDelete(t *testing.T) {
+	ctx := context.Background()
+	catalog := NewSnapshotCatalog(t.TempDir())
+	vm := &snapshotTestVM{id: "vm-1"}
+
+	info, err := catalog.Save(ctx, vm)
+	require.NoError(t, err)
+	assert.Equal(t, "vm-1", info.SourceVMID)
+	assert.Equal(t, uint64(2), info.Vcpus)
+	assert.Equal(t, strongunits.MiB(512).ToBytes(), info.Memory)
+	require.Len(t, info.Devices, 1)
+	assert.Equal(t, "virtio.VirtioFs", info.Devices[0].Type)
+	assert.Positive(t, info.Size)
+
+	got, err := catalog.Inspect(ctx, info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, info.SourceVMID, got.SourceVMID)
+	assert.Equal(t, info.Size, got.Size)
+
+	require.NoError(t, catalog.Restore(ctx, vm, info.ID))
+	assert.Equal(t, catalog.StatePath(info.ID), vm.restored)
+
+	infos, err := catalog.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	require.NoError(t, catalog.Delete(ctx, info.ID))
+	infos, err = catalog.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, infos)
+
+	_, err = catalog.Inspect(ctx, "../escape")
+	assert.Error(t, err)
+}
+
+func TestSnapshotCatalogPrune(t *testing.T) {
+	ctx := context.Background()
+	catalog := NewSnapshotCatalog(t.TempDir())
+
+	ids := []string{}
+	for range 3 {
+		info, err := catalog.Save(ctx, &snapshotTestVM{id: "vm-1"})
+		require.NoError(t, err)
+		ids = append(ids, info.ID)
+	}
+	other, err := catalog.Save(ctx, &snapshotTestVM{id: "vm-2"})
+	require.NoError(t, err)
+
+	pruned, err := catalog.Prune(ctx, SnapshotPrunePolicy{MaxCount: 1})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, ids[:2], pruned)
+
+	// age the remaining vm-2 snapshot
+	old, err := catalog.Inspect(ctx, other.ID)
+	require.NoError(t, err)
+	old.CreatedAt = time.Now().Add(-48 * time.Hour)
+	require.NoError(t, catalog.writeInfo(old))
+
+	pruned, err = catalog.Prune(ctx, SnapshotPrunePolicy{MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, []string{other.ID}, pruned)
+
+	infos, err := catalog.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, ids[2], infos[0].ID)
+}
+
+func TestSnapshotCatalogExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := NewSnapshotCatalog(t.TempDir())
+	dst := NewSnapshotCatalog(t.TempDir())
+
+	info, err := src.Save(ctx, &snapshotTestVM{id: "vm-1"})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(ctx, info.ID, &buf))
+
+	imported, err := dst.Import(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, info.ID, imported.ID)
+	assert.Equal(t, info.Size, imported.Size)
+
+	state, err := os.ReadFile(dst.StatePath(info.ID))
+	require.NoError(t, err)
+	assert.Equal(t, "machine state of vm-1", string(state))
+
+	// importing the same snapshot twice is refused
+	_, err = dst.Import(ctx, bytes.NewReader(buf.Bytes()))
+	assert.Error(t, err)
+
+	entries, err := os.ReadDir(filepath.Join(dst.Root()))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "failed import left files behind")
+}
+
+func TestSnapshotCatalogRestoreChecksTheVMConfig(t *testing.T) {
+	ctx := context.Background()
+	catalog := NewSnapshotCatalog(t.TempDir())
+
+	info, err := catalog.Save(ctx, &snapshotTestVM{id: "vm-1"})
+	require.NoError(t, err)
+
+	other := &snapshotTestVM{id: "vm-2", share: "/tmp/other"}
+	err = catalog.Restore(ctx, other, info.ID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device 0 (virtio.VirtioFs) is configured differently")
+	assert.Empty(t, other.restored, "restored a snapshot of a different device config")
+
+	bigger := &snapshotTestVM{id: "vm-2", vcpus: 4}
+	err = catalog.Restore(ctx, bigger, info.ID)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "snapshot was taken with 2 vcpus, the vm has 4")
+	assert.Empty(t, bigger.restored)
+
+	same := &snapshotTestVM{id: "vm-2"}
+	require.NoError(t, catalog.Restore(ctx, same, info.ID))
+	assert.Equal(t, catalog.StatePath(info.ID), same.restored)
+}
+
+func TestSnapshotRunningVM(t *testing.T) {
+	ctx := context.Background()
+	catalog := NewSnapshotCatalog(t.TempDir())
+
+	vm := &snapshotTestVM{id: "vm-1", state: VirtualMachineStateTypeRunning}
+	info, err := saveRunningSnapshot(ctx, catalog, vm)
+	require.NoError(t, err)
+	assert.Equal(t, VirtualMachineStateTypePaused, vm.savedIn, "saved a running vm")
+	assert.Equal(t, VirtualMachineStateTypeRunning, vm.state, "vm was not resumed")
+
+	restored := &snapshotTestVM{id: "vm-2", state: VirtualMachineStateTypeStopped}
+	require.NoError(t, resumeFromSnapshot(ctx, catalog, restored, info.ID))
+	assert.Equal(t, catalog.StatePath(info.ID), restored.restored)
+	assert.Equal(t, VirtualMachineStateTypeRunning, restored.state)
+}
+
+func TestRemoveLegacySnapshots(t *testing.T) {
+	ctx := context.Background()
+	cacheDir := t.TempDir()
+
+	legacy := filepath.Join(cacheDir, "vm", "vm-1", "snapshots", "0123abcd"+legacySnapshotExtension)
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacy), 0755))
+	require.NoError(t, os.WriteFile(legacy, []byte("machine state"), 0644))
+
+	kept := filepath.Join(cacheDir, "vm", "vm-1", "console.log")
+	require.NoError(t, os.WriteFile(kept, nil, 0644))
+
+	removed, err := RemoveLegacySnapshots(ctx, cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{legacy}, removed)
+
+	assert.NoFileExists(t, legacy)
+	assert.NoDirExists(t, filepath.Dir(legacy))
+	assert.FileExists(t, kept)
+
+	removed, err = RemoveLegacySnapshots(ctx, cacheDir)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+}
@@ -2,32 +2,30 @@ package vf
 
 import (
 	"fmt"
+	"os"
 	"runtime"
 
 	"github.com/Code-Hex/vz/v3"
 	"gitlab.com/tozd/go/errors"
 
-	"github.com/walteh/ec1/pkg/host"
+	"github.com/walteh/ec1/pkg/kernel"
 	"github.com/walteh/ec1/pkg/vmm"
 )
 
 func toVzLinuxBootloader(bootloader *vmm.LinuxBootloader) (vz.BootLoader, error) {
-	if runtime.GOARCH == "arm64" {
-		uncompressed, err := host.IsKernelUncompressed(bootloader.VmlinuzPath)
-		if err != nil {
-			return nil, err
-		}
-		if !uncompressed {
-			return nil, fmt.Errorf("kernel must be uncompressed, %s is a compressed file", bootloader.VmlinuzPath)
-		}
+	if err := validateKernel(bootloader.VmlinuzPath); err != nil {
+		return nil, err
 	}
 
 	opts := []vz.LinuxBootLoaderOption{}
 	if bootloader.InitrdPath != "" {
 		opts = append(opts, vz.WithInitrd(bootloader.InitrdPath))
 	}
-	if bootloader.KernelCmdLine != "" {
-		opts = append(opts, vz.WithCommandLine(bootloader.KernelCmdLine))
+	if bootloader.KernelCmdLine != nil {
+		if err := bootloader.KernelCmdLine.Validate(); err != nil {
+			return nil, errors.Errorf("kernel command line: %w", err)
+		}
+		opts = append(opts, vz.WithCommandLine(bootloader.KernelCmdLine.String()))
 	}
 
 	return vz.NewLinuxBootLoader(
@@ -36,6 +34,25 @@ func toVzLinuxBootloader(bootloader *vmm.LinuxBootloader) (vz.BootLoader, error)
 	)
 }
 
+// validateKernel checks the kernel before the framework fails to boot it without saying why. only the
+// header is read, so starting a vm does not unpack its kernel.
+func validateKernel(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Errorf("opening kernel: %w", err)
+	}
+	defer file.Close()
+
+	img, err := kernel.Identify(file)
+	if err != nil {
+		return errors.Errorf("identifying kernel %s: %w", path, err)
+	}
+	if err := img.Validate(runtime.GOARCH, kernel.BackendVirtualizationFramework); err != nil {
+		return errors.Errorf("kernel %s: %w", path, err)
+	}
+	return nil
+}
+
 func toVzEFIBootloader(bootloader *vmm.EFIBootloader) (vz.BootLoader, error) {
 	var efiVariableStore *vz.EFIVariableStore
 	var err error